@@ -1,15 +1,29 @@
 package cmd
 
 import (
+	"github.com/elastic/beats/libbeat/beat"
 	cmd "github.com/elastic/beats/libbeat/cmd"
+	"github.com/elastic/beats/libbeat/common"
 	"github.com/elastic/beats/metricbeat/beater"
+	"github.com/shiguredo/sorabeat/module/sora"
 
 	// import modules of sorabeat
 	_ "github.com/shiguredo/sorabeat/include"
+	// register the export, influxdb and spool outputs
+	_ "github.com/shiguredo/sorabeat/export"
+	_ "github.com/shiguredo/sorabeat/influxdb"
+	_ "github.com/shiguredo/sorabeat/spool"
 )
 
 // Name of this beat
 var Name = "sorabeat"
 
 // RootCmd to handle beats cli
-var RootCmd = cmd.GenRootCmd(Name, "", beater.New)
+var RootCmd = cmd.GenRootCmd(Name, "", newBeater)
+
+// newBeater creates the metricbeat beater publishing the sora events through
+// sora.Pipeline.
+func newBeater(b *beat.Beat, rawConfig *common.Config) (beat.Beater, error) {
+	b.Publisher = sora.Pipeline(b.Publisher)
+	return beater.New(b, rawConfig)
+}
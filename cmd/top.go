@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/libbeat/cfgfile"
+	"github.com/elastic/beats/libbeat/cmd/instance"
+	"github.com/elastic/beats/libbeat/common"
+
+	"github.com/shiguredo/sorabeat/top"
+)
+
+func init() {
+	RootCmd.AddCommand(genTopCmd(Name, ""))
+}
+
+// genTopCmd returns the top command showing a live view of the configured
+// Sora hosts in the terminal.
+func genTopCmd(name, beatVersion string) *cobra.Command {
+	options := top.DefaultOptions
+	topCmd := &cobra.Command{
+		Use:   "top",
+		Short: "Show a live view of the Sora hosts",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runTop(name, beatVersion, options); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	topCmd.Flags().DurationVar(&options.Interval, "interval", options.Interval, "Polling interval")
+	topCmd.Flags().StringVar(&options.Sort, "sort", options.Sort, "Order of the channels: bitrate or connections")
+	topCmd.Flags().StringVar(&options.SortConnections, "sort-connections", options.SortConnections, "Order of the connections: nack or pli")
+	topCmd.Flags().StringVar(&options.Filter, "filter", options.Filter, "Only show the channels whose channel_id contains it")
+	topCmd.Flags().IntVar(&options.Rows, "rows", options.Rows, "Rows of the channel and connection tables, 0 for all")
+	return topCmd
+}
+
+func runTop(name, beatVersion string, options top.Options) error {
+	b, err := instance.NewBeat(name, beatVersion)
+	if err != nil {
+		return errors.Wrap(err, "error initializing beat")
+	}
+	if err := b.Init(); err != nil {
+		return errors.Wrap(err, "error initializing beat")
+	}
+
+	configs, err := moduleConfigs(b.Beat.BeatConfig)
+	if err != nil {
+		return err
+	}
+	t, err := top.New(configs, options)
+	if err != nil {
+		return err
+	}
+
+	restore, err := top.Cbreak()
+	if err == nil {
+		defer restore()
+	}
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		close(done)
+	}()
+	err = t.Run(os.Stdin, os.Stdout, done)
+	fmt.Println()
+	return err
+}
+
+// moduleConfigs returns the module configurations of the beat, including the
+// enabled files of config.modules, like the modules Sorabeat runs.
+func moduleConfigs(beatConfig *common.Config) ([]*common.Config, error) {
+	config := struct {
+		Modules       []*common.Config `config:"modules"`
+		ConfigModules *common.Config   `config:"config.modules"`
+	}{}
+	if err := beatConfig.Unpack(&config); err != nil {
+		return nil, errors.Wrap(err, "error reading configuration file")
+	}
+	configs := config.Modules
+	if config.ConfigModules.Enabled() {
+		dynamic := cfgfile.DefaultDynamicConfig
+		if err := config.ConfigModules.Unpack(&dynamic); err != nil {
+			return nil, err
+		}
+		manager, err := cfgfile.NewGlobManager(dynamic.Path, ".yml", ".disabled")
+		if err != nil {
+			return nil, errors.Wrap(err, "initialization error")
+		}
+		for _, file := range manager.ListEnabled() {
+			list, err := cfgfile.LoadList(file.Path)
+			if err != nil {
+				return nil, errors.Wrap(err, "error loading config files")
+			}
+			configs = append(configs, list...)
+		}
+	}
+	return configs, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Formats of the files.
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// Compressions of the files.
+const (
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+type config struct {
+	Path        string `config:"path"`
+	Format      string `config:"format"`
+	Compression string `config:"compression"`
+	// MetricSets are the sora metricsets whose events are written.
+	MetricSets []string `config:"metricsets"`
+	// RotateEvery and RotateBytes close a file once it is that old or large.
+	RotateEvery time.Duration `config:"rotate_every" validate:"positive"`
+	RotateBytes int64         `config:"rotate_bytes" validate:"min=1"`
+	Parquet     parquetConfig `config:"parquet"`
+	BulkMaxSize int           `config:"bulk_max_size"`
+	MaxRetries  int           `config:"max_retries"`
+	// Backoff is the wait after a failed write, doubled while writes fail.
+	Backoff backoff `config:"backoff"`
+}
+
+// parquetConfig decides when the buffered rows of a Parquet file are written
+// as a row group. Batches are ACKed once their rows are written, so
+// FlushInterval and FlushEvents also bound how long and how many events wait
+// for the ACK.
+type parquetConfig struct {
+	RowGroupBytes int64         `config:"row_group_bytes" validate:"min=1"`
+	FlushInterval time.Duration `config:"flush_interval" validate:"positive"`
+	FlushEvents   int           `config:"flush_events" validate:"min=1"`
+}
+
+type backoff struct {
+	Init time.Duration `config:"init" validate:"nonzero"`
+	Max  time.Duration `config:"max" validate:"nonzero"`
+}
+
+var defaultConfig = config{
+	Format:      FormatCSV,
+	Compression: CompressionGzip,
+	MetricSets:  []string{"stats", "connections"},
+	RotateEvery: time.Hour,
+	RotateBytes: 64 * 1024 * 1024,
+	Parquet: parquetConfig{
+		RowGroupBytes: 8 * 1024 * 1024,
+		FlushInterval: 10 * time.Second,
+		// queue.mem.events の既定値。これより多く ACK を待たせるとキューが詰まる
+		FlushEvents: 4096,
+	},
+	BulkMaxSize: 1000,
+	MaxRetries:  3,
+	Backoff: backoff{
+		Init: 1 * time.Second,
+		Max:  60 * time.Second,
+	},
+}
+
+func (c *config) Validate() error {
+	switch c.Format {
+	case FormatCSV, FormatParquet:
+	default:
+		return fmt.Errorf("unknown format '%s', must be %s or %s", c.Format, FormatCSV, FormatParquet)
+	}
+	switch c.Compression {
+	case CompressionGzip, CompressionNone:
+	default:
+		return fmt.Errorf("unknown compression '%s', must be %s or %s", c.Compression, CompressionGzip, CompressionNone)
+	}
+	for _, name := range c.MetricSets {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("no columns declared for metricset '%s'", name)
+		}
+	}
+	if c.Backoff.Max < c.Backoff.Init {
+		return errors.New("backoff.max must not be smaller than backoff.init")
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"io"
+	"os"
+	"time"
+)
+
+// countingWriter counts the bytes written to the file.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// csvWriter writes a header and a line per row. With gzip each flush ends a
+// deflate block so that the rows flushed before a crash can be read.
+type csvWriter struct {
+	file    *os.File
+	counter *countingWriter
+	gzip    *gzip.Writer
+	csv     *csv.Writer
+	record  []string
+}
+
+func newCSVWriter(file *os.File, cols []column, compress bool) (*csvWriter, error) {
+	w := &csvWriter{
+		file:    file,
+		counter: &countingWriter{w: file},
+		record:  make([]string, len(cols)+2),
+	}
+	var out io.Writer = w.counter
+	if compress {
+		w.gzip = gzip.NewWriter(w.counter)
+		out = w.gzip
+	}
+	w.csv = csv.NewWriter(out)
+	if err := w.csv.Write(header(cols)); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *csvWriter) write(r row) error {
+	w.record[0] = r.timestamp.Format(time.RFC3339Nano)
+	w.record[1] = r.host
+	for i, v := range r.values {
+		w.record[i+2] = format(v)
+	}
+	return w.csv.Write(w.record)
+}
+
+func (w *csvWriter) flush() error {
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil {
+		return err
+	}
+	if w.gzip != nil {
+		if err := w.gzip.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.file.Sync()
+}
+
+func (w *csvWriter) size() int64 {
+	return w.counter.n
+}
+
+func (w *csvWriter) close() error {
+	err := w.flush()
+	if w.gzip != nil {
+		if e := w.gzip.Close(); err == nil {
+			err = e
+		}
+	}
+	if e := w.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,606 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package export provides the export output. It writes the events of the
+stats and connections metricsets as rows of CSV or Parquet files partitioned
+by metricset, date and host, for analysis outside of Elasticsearch. The
+columns are the fields declared in scripts/sora_fields.yml, and the files are
+rotated by age and size.
+
+	output.export:
+	  path: "/var/lib/sorabeat/export"
+	  format: parquet
+*/
+package export
+
+//go:generate go run ../scripts/export_columns/main.go -i ../scripts/sora_fields.yml -o columns.go
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/paths"
+	"github.com/elastic/beats/libbeat/publisher"
+)
+
+func init() {
+	outputs.RegisterType("export", makeExport)
+}
+
+func makeExport(
+	beat beat.Info,
+	stats *outputs.Stats,
+	cfg *common.Config,
+) (outputs.Group, error) {
+	config := defaultConfig
+	if err := cfg.Unpack(&config); err != nil {
+		return outputs.Fail(err)
+	}
+	if config.Path == "" {
+		config.Path = paths.Resolve(paths.Data, "export")
+	}
+	c, err := newClient(config, stats)
+	if err != nil {
+		return outputs.Fail(err)
+	}
+	return outputs.Success(config.BulkMaxSize, config.MaxRetries, c)
+}
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindNumber
+)
+
+type column struct {
+	name string
+	kind kind
+}
+
+// row is an event of a metricset. The values are a string, a float64 or nil
+// for each of the columns of the metricset.
+type row struct {
+	timestamp time.Time
+	host      string
+	values    []interface{}
+}
+
+// writer writes the rows of a file.
+type writer interface {
+	write(r row) error
+	// flush makes the rows written so far durable.
+	flush() error
+	// size is the size the file would have if it was closed now.
+	size() int64
+	close() error
+}
+
+// partition is the directory of a file.
+type partition struct {
+	metricset string
+	date      string
+	host      string
+}
+
+type file struct {
+	writer writer
+	opened time.Time
+	// 書いている間は . で始まる名前にして、読む側に途中のファイルを見せない
+	tmp   string
+	final string
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.\-]+`)
+
+// derivedFields mark the documents that the metricsets derive from what they
+// fetched, e.g. the breakdowns of stats, the rollups and the alerts. They are
+// not rows of the metricset and are not written.
+var derivedFields = []string{"breakdown", "rollup", "accounting"}
+
+// derivedModuleFields are the derived documents reported at the module level.
+var derivedModuleFields = []string{"alert", "anomaly", "server.restarted"}
+
+type client struct {
+	config config
+	stats  *outputs.Stats
+	now    func() time.Time
+	// 書けなかったときに次の Publish まで待つ時間。Publish だけが使う
+	wait time.Duration
+	done chan struct{}
+
+	mu    sync.Mutex
+	files map[partition]*file
+	// 行がまだディスクにないバッチを受け取った順に持つ。flush してから ACK する
+	held       []*heldBatch
+	heldEvents int
+	timer      *time.Timer
+}
+
+// heldBatch is a batch whose rows are not all on disk yet.
+type heldBatch struct {
+	batch    publisher.Batch
+	events   []publisher.Event
+	received time.Time
+	// ファイルに書いてまだ flush していないイベント
+	pending map[partition][]int
+	retry   []int
+}
+
+func newClient(config config, stats *outputs.Stats) (*client, error) {
+	if err := os.MkdirAll(config.Path, 0750); err != nil {
+		return nil, err
+	}
+	if err := recoverFiles(config.Path); err != nil {
+		return nil, err
+	}
+	return &client{
+		config: config,
+		stats:  stats,
+		now:    time.Now,
+		wait:   config.Backoff.Init,
+		done:   make(chan struct{}),
+		files:  map[partition]*file{},
+	}, nil
+}
+
+func (c *client) String() string {
+	return "export"
+}
+
+// Close interrupts a pending backoff, closes all open files and ACKs the
+// batches whose rows they hold.
+func (c *client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	var last error
+	for p, f := range c.files {
+		if err := c.closeFile(p, f); err != nil {
+			last = err
+		}
+	}
+	c.release()
+	return last
+}
+
+// Publish writes the rows of the batch. The batch is ACKed once the files
+// holding its rows are flushed: right away for CSV, and for Parquet once the
+// row groups are written after parquet.flush_interval or parquet.flush_events,
+// or when the files are rotated or closed. Events that are not from the
+// configured metricsets and derived documents are not written. When a file
+// fails, the rows that made it to the other files are ACKed and the rest is
+// retried after a backoff. Publish does not return the error, which would
+// stop the output worker.
+func (c *client) Publish(batch publisher.Batch) error {
+	if c.publish(batch) {
+		c.sleep()
+	} else {
+		c.wait = c.config.Backoff.Init
+	}
+	// Connect のない出力はエラーを返すとワーカーが止まるので、エラーは
+	// abort で記録して nil を返す
+	return nil
+}
+
+// publish writes the batch and reports whether events are retried.
+func (c *client) publish(batch publisher.Batch) bool {
+	events := batch.Events()
+	c.stats.NewBatch(len(events))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for p, f := range c.files {
+		if now.Sub(f.opened) >= c.config.RotateEvery {
+			if err := c.closeFile(p, f); err != nil {
+				logp.Err("export: failed to close %s: %v", f.final, err)
+			}
+		}
+	}
+
+	h := &heldBatch{batch: batch, events: events, received: now, pending: map[partition][]int{}}
+	c.held = append(c.held, h)
+	c.heldEvents += len(events)
+
+	i := 0
+	for ; i < len(events); i++ {
+		p, r, ok := c.row(&events[i].Content)
+		if !ok {
+			continue
+		}
+		f, err := c.file(p, now)
+		if err == nil {
+			err = f.writer.write(r)
+		}
+		if err != nil {
+			c.abort(p, err)
+			break
+		}
+		h.pending[p] = append(h.pending[p], i)
+		if f.writer.size() >= c.config.RotateBytes {
+			if err := c.closeFile(p, f); err != nil {
+				c.abort(p, err)
+				i++
+				break
+			}
+		}
+	}
+	// 失敗したイベントから後は書かずに再送する
+	for ; i < len(events); i++ {
+		h.retry = append(h.retry, i)
+	}
+
+	if c.config.Format == FormatCSV ||
+		now.Sub(c.held[0].received) >= c.config.Parquet.FlushInterval ||
+		c.heldEvents >= c.config.Parquet.FlushEvents {
+		c.flush()
+	} else if c.timer == nil {
+		c.timer = time.AfterFunc(c.config.Parquet.FlushInterval-now.Sub(c.held[0].received), c.flushHeld)
+	}
+	return c.release()
+}
+
+// flushHeld flushes the files of the held batches once they waited for
+// parquet.flush_interval without another Publish.
+func (c *client) flushHeld() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	c.flush()
+	c.release()
+}
+
+// flush makes the rows of the held batches durable.
+func (c *client) flush() {
+	partitions := map[partition]bool{}
+	for _, h := range c.held {
+		for p := range h.pending {
+			partitions[p] = true
+		}
+	}
+	for p := range partitions {
+		f, ok := c.files[p]
+		if !ok {
+			continue
+		}
+		if err := f.writer.flush(); err != nil {
+			c.abort(p, err)
+			continue
+		}
+		c.settle(p, nil)
+	}
+}
+
+// settle records that the rows written to the file of the partition are on
+// disk, or lost when err is not nil and their events are retried.
+func (c *client) settle(p partition, err error) {
+	for _, h := range c.held {
+		if err != nil {
+			h.retry = append(h.retry, h.pending[p]...)
+		}
+		delete(h.pending, p)
+	}
+}
+
+// release ACKs the held batches whose rows are all on disk, in the order
+// they were received, and retries their events that were not written. It
+// reports whether events are retried.
+func (c *client) release() bool {
+	retried := false
+	for len(c.held) > 0 && len(c.held[0].pending) == 0 {
+		h := c.held[0]
+		c.held = c.held[1:]
+		c.heldEvents -= len(h.events)
+
+		if len(h.retry) == 0 {
+			c.stats.Acked(len(h.events))
+			h.batch.ACK()
+			continue
+		}
+		sort.Ints(h.retry)
+		failed := make([]publisher.Event, len(h.retry))
+		for j, k := range h.retry {
+			failed[j] = h.events[k]
+		}
+		c.stats.Acked(len(h.events) - len(h.retry))
+		c.stats.Failed(len(h.retry))
+		logp.Warn("export: retrying %d of %d events", len(h.retry), len(h.events))
+		h.batch.RetryEvents(failed)
+		retried = true
+	}
+	if len(c.held) == 0 && c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	return retried
+}
+
+// sleep は書けないディスクへの再送を続けて空回りしないように、失敗が続くほど
+// 長く待つ。c.mu を持たずに待つので、Close すると待つのをやめる
+func (c *client) sleep() {
+	timer := time.NewTimer(c.wait)
+	defer timer.Stop()
+	select {
+	case <-c.done:
+	case <-timer.C:
+	}
+	c.wait *= 2
+	if c.wait > c.config.Backoff.Max {
+		c.wait = c.config.Backoff.Max
+	}
+}
+
+// abort は書けなかったファイルを閉じて、再送で新しいファイルに書く。
+// 閉じられたときは書いた行も読めるので、閉じられなかったときだけ
+// それらのイベントを再送する
+func (c *client) abort(p partition, err error) {
+	logp.Err("export: failed to write %s events of %s: %v", p.metricset, p.host, err)
+	c.stats.WriteError()
+	if f, ok := c.files[p]; ok {
+		c.closeFile(p, f)
+		return
+	}
+	c.settle(p, err)
+}
+
+// row returns the partition and the row of a sora event.
+func (c *client) row(event *beat.Event) (partition, row, bool) {
+	module, _ := event.Fields.GetValue("metricset.module")
+	name, _ := event.Fields.GetValue("metricset.name")
+	metricset, _ := name.(string)
+	if module != "sora" || !c.includes(metricset) {
+		return partition{}, row{}, false
+	}
+	value, err := event.Fields.GetValue("sora." + metricset)
+	if err != nil {
+		return partition{}, row{}, false
+	}
+	fields, ok := toMapStr(value)
+	if !ok || derived(event, fields) {
+		return partition{}, row{}, false
+	}
+
+	r := row{timestamp: event.Timestamp.UTC()}
+	if host, err := event.Fields.GetValue("metricset.host"); err == nil {
+		r.host, _ = host.(string)
+	}
+	for _, col := range columns[metricset] {
+		v, err := fields.GetValue(col.name)
+		if err != nil {
+			r.values = append(r.values, nil)
+			continue
+		}
+		r.values = append(r.values, convert(col.kind, v))
+	}
+
+	host := unsafeFileChars.ReplaceAllString(r.host, "_")
+	if host == "" {
+		host = "unknown"
+	}
+	p := partition{
+		metricset: metricset,
+		date:      r.timestamp.Format("2006-01-02"),
+		host:      host,
+	}
+	return p, r, true
+}
+
+func derived(event *beat.Event, fields common.MapStr) bool {
+	for _, field := range derivedFields {
+		if _, ok := fields[field]; ok {
+			return true
+		}
+	}
+	for _, field := range derivedModuleFields {
+		if _, err := event.Fields.GetValue("sora." + field); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) includes(metricset string) bool {
+	if _, ok := columns[metricset]; !ok {
+		return false
+	}
+	for _, m := range c.config.MetricSets {
+		if m == metricset {
+			return true
+		}
+	}
+	return false
+}
+
+// convert は列の型に合わない値と配列、オブジェクトを nil にする
+func convert(k kind, v interface{}) interface{} {
+	if k == kindNumber {
+		if f, ok := toFloat(v); ok {
+			return f
+		}
+		return nil
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	if f, ok := toFloat(v); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func toMapStr(v interface{}) (common.MapStr, bool) {
+	switch m := v.(type) {
+	case common.MapStr:
+		return m, true
+	case map[string]interface{}:
+		return common.MapStr(m), true
+	}
+	return nil, false
+}
+
+// file returns the open file of the partition or opens a new one.
+func (c *client) file(p partition, now time.Time) (*file, error) {
+	if f, ok := c.files[p]; ok {
+		return f, nil
+	}
+	dir := filepath.Join(c.config.Path, p.metricset, "date="+p.date, "host="+p.host)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	extension := "." + c.config.Format
+	if c.config.Format == FormatCSV && c.config.Compression == CompressionGzip {
+		extension += ".gz"
+	}
+	// 同じ秒に開き直したときは番号を付ける
+	base := p.metricset + "-" + now.UTC().Format("20060102T150405Z")
+	name := base + extension
+	for n := 1; exists(filepath.Join(dir, name)) || exists(filepath.Join(dir, "."+name)); n++ {
+		name = base + "-" + strconv.Itoa(n) + extension
+	}
+
+	f := &file{
+		opened: now,
+		tmp:    filepath.Join(dir, "."+name),
+		final:  filepath.Join(dir, name),
+	}
+	out, err := os.OpenFile(f.tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+	gzip := c.config.Compression == CompressionGzip
+	if c.config.Format == FormatParquet {
+		f.writer = newParquetWriter(out, columns[p.metricset], gzip, c.config.Parquet.RowGroupBytes)
+	} else {
+		f.writer, err = newCSVWriter(out, columns[p.metricset], gzip)
+		if err != nil {
+			out.Close()
+			os.Remove(f.tmp)
+			return nil, err
+		}
+	}
+	c.files[p] = f
+	return f, nil
+}
+
+// closeFile closes the file and settles the rows of the held batches it
+// holds.
+func (c *client) closeFile(p partition, f *file) error {
+	delete(c.files, p)
+	err := f.writer.close()
+	if err == nil {
+		err = os.Rename(f.tmp, f.final)
+	}
+	c.settle(p, err)
+	return err
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// recoverFiles は前回閉じられなかったファイルを片付ける。CSV は flush 済みの行を
+// 読めるので名前を戻し、Parquet は書き終えた行グループの footer を書いて名前を戻す。
+// 行グループがひとつもない Parquet は読めないので消す
+func recoverFiles(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, ".") {
+			return nil
+		}
+		final := filepath.Join(filepath.Dir(path), name[1:])
+		switch {
+		case strings.HasSuffix(name, ".csv"), strings.HasSuffix(name, ".csv.gz"):
+			logp.Warn("export: recovering %s left open", final)
+			return os.Rename(path, final)
+		case strings.HasSuffix(name, ".parquet"):
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			metricset := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+			ok, err := recoverParquet(path, columns[metricset])
+			if err != nil {
+				return err
+			}
+			if ok {
+				logp.Warn("export: recovering %s left open", final)
+				return os.Rename(path, final)
+			}
+			logp.Warn("export: removing incomplete %s", final)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// format formats a value of a row for CSV.
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+func header(cols []column) []string {
+	names := []string{"@timestamp", "host"}
+	for _, col := range cols {
+		names = append(names, col.name)
+	}
+	return names
+}
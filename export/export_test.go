@@ -0,0 +1,515 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// +build !integration
+
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs/outest"
+	"github.com/stretchr/testify/assert"
+)
+
+var timestamp = time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+
+func soraEvent(metricset, host string, ts time.Time, fields common.MapStr) beat.Event {
+	return beat.Event{
+		Timestamp: ts,
+		Fields: common.MapStr{
+			"metricset": common.MapStr{
+				"module": "sora",
+				"name":   metricset,
+				"host":   host,
+			},
+			"sora": common.MapStr{metricset: fields},
+		},
+	}
+}
+
+func newTestClient(t *testing.T, config config) (*client, string) {
+	dir, err := ioutil.TempDir("", "sorabeat-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Path = dir
+	config.Backoff = backoff{Init: time.Millisecond, Max: 4 * time.Millisecond}
+	c, err := newClient(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return timestamp }
+	return c, dir
+}
+
+func signals(batch *outest.Batch) []outest.BatchSignalTag {
+	var tags []outest.BatchSignalTag
+	for _, sig := range batch.Signals {
+		tags = append(tags, sig.Tag)
+	}
+	return tags
+}
+
+func readCSV(t *testing.T, path string) [][]string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(z).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func files(t *testing.T, dir string) []string {
+	var names []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			names = append(names, rel)
+		}
+		return nil
+	})
+	return names
+}
+
+func TestPublishCSV(t *testing.T) {
+	c, dir := newTestClient(t, defaultConfig)
+	defer os.RemoveAll(dir)
+
+	batch := outest.NewBatch(
+		soraEvent("connections", "127.0.0.1:3000", timestamp, common.MapStr{
+			"channel_id":    "sora",
+			"connection_id": "6ZF3DT1Q2D5NHAB1QMFGWP4VAW",
+			"identity":      "6ZF3DT1Q2D5NHAB1QMFGWP4VAW",
+			"rtp":           common.MapStr{"total_sent_byte_size": 1234.},
+		}),
+		soraEvent("stats", "127.0.0.1:3000", timestamp.Add(time.Second), common.MapStr{
+			"total_ongoing_connections": int64(3),
+			"erlang_vm": map[string]interface{}{
+				"statistics": map[string]interface{}{
+					// 配列は書かない
+					"run_queue_lengths":      []interface{}{1., 2.},
+					"run_queue_lengths_mean": 1.5,
+				},
+			},
+		}),
+		soraEvent("stats", "127.0.0.2:3000", timestamp.Add(24*time.Hour), common.MapStr{"total_ongoing_connections": 1.}),
+		soraEvent("client_stats", "127.0.0.1:3000", timestamp, common.MapStr{"rate": common.MapStr{"nack_count": 1.}}),
+	)
+	assert.NoError(t, c.Publish(batch))
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(batch))
+
+	// 書いている間は隠しておく
+	assert.Equal(t, []string{
+		"connections/date=2017-10-10/host=127.0.0.1_3000/.connections-20171010T000000Z.csv.gz",
+		"stats/date=2017-10-10/host=127.0.0.1_3000/.stats-20171010T000000Z.csv.gz",
+		"stats/date=2017-10-11/host=127.0.0.2_3000/.stats-20171010T000000Z.csv.gz",
+	}, files(t, dir))
+	assert.NoError(t, c.Close())
+	assert.Equal(t, []string{
+		"connections/date=2017-10-10/host=127.0.0.1_3000/connections-20171010T000000Z.csv.gz",
+		"stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000000Z.csv.gz",
+		"stats/date=2017-10-11/host=127.0.0.2_3000/stats-20171010T000000Z.csv.gz",
+	}, files(t, dir))
+
+	records := readCSV(t, filepath.Join(dir, "connections/date=2017-10-10/host=127.0.0.1_3000/connections-20171010T000000Z.csv.gz"))
+	if assert.Len(t, records, 2) {
+		header := records[0]
+		assert.Equal(t, []string{"@timestamp", "host", "channel_id"}, header[:3])
+		row := map[string]string{}
+		for i, name := range header {
+			row[name] = records[1][i]
+		}
+		assert.Equal(t, "2017-10-10T00:00:00Z", row["@timestamp"])
+		assert.Equal(t, "127.0.0.1:3000", row["host"])
+		assert.Equal(t, "sora", row["channel_id"])
+		assert.Equal(t, "6ZF3DT1Q2D5NHAB1QMFGWP4VAW", row["connection_id"])
+		assert.Equal(t, "6ZF3DT1Q2D5NHAB1QMFGWP4VAW", row["identity"])
+		assert.Equal(t, "", row["channel_client_id"])
+		assert.Equal(t, "1234", row["rtp.total_sent_byte_size"])
+		assert.Equal(t, "", row["rtp.total_received_byte_size"])
+	}
+
+	records = readCSV(t, filepath.Join(dir, "stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000000Z.csv.gz"))
+	if assert.Len(t, records, 2) {
+		row := map[string]string{}
+		for i, name := range records[0] {
+			row[name] = records[1][i]
+		}
+		assert.Equal(t, "2017-10-10T00:00:01Z", row["@timestamp"])
+		assert.Equal(t, "3", row["total_ongoing_connections"])
+		assert.Equal(t, "", row["erlang_vm.statistics.run_queue_lengths"])
+		assert.Equal(t, "1.5", row["erlang_vm.statistics.run_queue_lengths_mean"])
+	}
+}
+
+func TestPublishSkipsDerived(t *testing.T) {
+	c, dir := newTestClient(t, defaultConfig)
+	defer os.RemoveAll(dir)
+
+	moduleEvent := func(metricset string, fields common.MapStr) beat.Event {
+		event := soraEvent(metricset, "127.0.0.1:3000", timestamp, common.MapStr{})
+		event.Fields.DeepUpdate(common.MapStr{"sora": fields})
+		return event
+	}
+	batch := outest.NewBatch(
+		soraEvent("stats", "127.0.0.1:3000", timestamp, common.MapStr{"total_ongoing_connections": 1.}),
+		soraEvent("stats", "127.0.0.1:3000", timestamp, common.MapStr{
+			"breakdown": common.MapStr{"type": "browser", "name": "Chrome", "count": 1.},
+		}),
+		soraEvent("connections", "127.0.0.1:3000", timestamp, common.MapStr{
+			"channel_id": "sora",
+			"rollup":     common.MapStr{"scope": "channel", "connections": 1.},
+		}),
+		soraEvent("connections", "127.0.0.1:3000", timestamp, common.MapStr{
+			"channel_id": "sora",
+			"accounting": common.MapStr{"hour": "2017-10-10T00:00:00Z", "sent_bytes": 1.},
+		}),
+		moduleEvent("stats", common.MapStr{"alert": common.MapStr{"rule": "memory", "state": "firing"}}),
+		moduleEvent("connections", common.MapStr{"anomaly": common.MapStr{"series": "channel_sent_bytes", "value": 1.}}),
+		moduleEvent("stats", common.MapStr{"server": common.MapStr{"restarted": true, "instance_id": "a"}}),
+	)
+	assert.NoError(t, c.Publish(batch))
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(batch))
+	assert.NoError(t, c.Close())
+
+	// 取得した値の行だけを書く
+	assert.Equal(t, []string{
+		"stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000000Z.csv.gz",
+	}, files(t, dir))
+	assert.Len(t, readCSV(t, filepath.Join(dir, files(t, dir)[0])), 2)
+}
+
+func TestPublishPartialFailure(t *testing.T) {
+	c, dir := newTestClient(t, defaultConfig)
+	defer os.RemoveAll(dir)
+
+	// 2017-10-11 のディレクトリを作れないようにする
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "stats"), 0750))
+	blocked := filepath.Join(dir, "stats", "date=2017-10-11")
+	assert.NoError(t, ioutil.WriteFile(blocked, nil, 0640))
+
+	stats := func(ts time.Time, connections float64) beat.Event {
+		return soraEvent("stats", "127.0.0.1:3000", ts, common.MapStr{"total_ongoing_connections": connections})
+	}
+	batch := outest.NewBatch(
+		stats(timestamp, 1),
+		soraEvent("connections", "127.0.0.1:3000", timestamp, common.MapStr{"channel_id": "sora"}),
+		stats(timestamp.Add(24*time.Hour), 2),
+		stats(timestamp, 3),
+	)
+	assert.NoError(t, c.Publish(batch))
+
+	// 書けたイベントは ACK して、失敗したイベントから後だけを再送する
+	if assert.Len(t, batch.Signals, 1) {
+		assert.Equal(t, outest.BatchRetryEvents, batch.Signals[0].Tag)
+		events := batch.Signals[0].Events
+		if assert.Len(t, events, 2) {
+			assert.Equal(t, timestamp.Add(24*time.Hour), events[0].Content.Timestamp)
+			assert.Equal(t, timestamp, events[1].Content.Timestamp)
+		}
+	}
+
+	assert.NoError(t, os.Remove(blocked))
+	var retried []beat.Event
+	for _, event := range batch.Signals[0].Events {
+		retried = append(retried, event.Content)
+	}
+	batch = outest.NewBatch(retried...)
+	assert.NoError(t, c.Publish(batch))
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(batch))
+	assert.NoError(t, c.Close())
+
+	// 再送しても行は重ならない
+	rows := map[string]int{}
+	for _, name := range files(t, dir) {
+		rows[name] = len(readCSV(t, filepath.Join(dir, name))) - 1
+	}
+	assert.Equal(t, map[string]int{
+		"connections/date=2017-10-10/host=127.0.0.1_3000/connections-20171010T000000Z.csv.gz": 1,
+		"stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000000Z.csv.gz":             2,
+		"stats/date=2017-10-11/host=127.0.0.1_3000/stats-20171010T000000Z.csv.gz":             1,
+	}, rows)
+}
+
+// failingWriter fails to write after the given number of rows.
+type failingWriter struct {
+	writer
+	rows int
+}
+
+func (w *failingWriter) write(r row) error {
+	if w.rows == 0 {
+		return errors.New("disk full")
+	}
+	w.rows--
+	return w.writer.write(r)
+}
+
+func TestPublishWriteFailure(t *testing.T) {
+	c, dir := newTestClient(t, defaultConfig)
+	defer os.RemoveAll(dir)
+
+	stats := func(connections float64) beat.Event {
+		return soraEvent("stats", "127.0.0.1:3000", timestamp, common.MapStr{"total_ongoing_connections": connections})
+	}
+	assert.NoError(t, c.Publish(outest.NewBatch(stats(1))))
+	for _, f := range c.files {
+		f.writer = &failingWriter{writer: f.writer, rows: 1}
+	}
+
+	// 書けなかったファイルは閉じて、それまでに書いた行は ACK する
+	batch := outest.NewBatch(stats(2), stats(3), stats(4))
+	assert.NoError(t, c.Publish(batch))
+	if assert.Len(t, batch.Signals, 1) {
+		assert.Equal(t, outest.BatchRetryEvents, batch.Signals[0].Tag)
+		assert.Len(t, batch.Signals[0].Events, 2)
+	}
+	assert.Empty(t, c.files)
+	records := readCSV(t, filepath.Join(dir, "stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000000Z.csv.gz"))
+	assert.Len(t, records, 3)
+	// 書けない間は再送のたびに待つ時間を延ばし、書けたら戻す
+	assert.Equal(t, 2*time.Millisecond, c.wait)
+	assert.NoError(t, c.Publish(outest.NewBatch(stats(5))))
+	assert.Equal(t, time.Millisecond, c.wait)
+}
+
+func TestRotate(t *testing.T) {
+	config := defaultConfig
+	config.Compression = CompressionNone
+	config.RotateEvery = time.Minute
+	config.RotateBytes = 4096
+	c, dir := newTestClient(t, config)
+	defer os.RemoveAll(dir)
+
+	publish := func() {
+		batch := outest.NewBatch(soraEvent("stats", "127.0.0.1:3000", timestamp, common.MapStr{"total_ongoing_connections": 1.}))
+		assert.NoError(t, c.Publish(batch))
+	}
+	publish()
+	// 古くなったファイルは次の Publish で閉じる
+	c.now = func() time.Time { return timestamp.Add(time.Minute) }
+	publish()
+	assert.Equal(t, []string{
+		"stats/date=2017-10-10/host=127.0.0.1_3000/.stats-20171010T000100Z.csv",
+		"stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000000Z.csv",
+	}, files(t, dir))
+
+	// 大きくなったファイルは書いた直後に閉じて、同じ秒なら番号を付ける
+	for len(c.files) > 0 {
+		publish()
+	}
+	publish()
+	assert.NoError(t, c.Close())
+	assert.Equal(t, []string{
+		"stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000000Z.csv",
+		"stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000100Z-1.csv",
+		"stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000100Z.csv",
+	}, files(t, dir))
+	info, err := os.Stat(filepath.Join(dir, "stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000100Z.csv"))
+	if assert.NoError(t, err) {
+		assert.True(t, info.Size() >= 4096)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	c, dir := newTestClient(t, defaultConfig)
+	defer os.RemoveAll(dir)
+
+	batch := outest.NewBatch(soraEvent("stats", "127.0.0.1:3000", timestamp, common.MapStr{"total_ongoing_connections": 1.}))
+	assert.NoError(t, c.Publish(batch))
+	partial := filepath.Join(dir, "stats/date=2017-10-10/host=127.0.0.1_3000/.stats-20171010T000000Z.parquet")
+	assert.NoError(t, ioutil.WriteFile(partial, []byte("PAR1"), 0640))
+
+	// 閉じずに止まったあとに起動すると flush 済みの CSV を読める名前に戻す
+	config := defaultConfig
+	config.Path = dir
+	_, err := newClient(config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000000Z.csv.gz",
+	}, files(t, dir))
+
+	f, err := os.Open(filepath.Join(dir, files(t, dir)[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gzip の終わりはないが flush した行までは読める
+	data, _ := ioutil.ReadAll(z)
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+}
+
+func TestRecoverParquet(t *testing.T) {
+	config := defaultConfig
+	config.Format = FormatParquet
+	c, dir := newTestClient(t, config)
+	defer os.RemoveAll(dir)
+
+	now := timestamp
+	c.now = func() time.Time { return now }
+	var batches []*outest.Batch
+	for i := 0; i < 2; i++ {
+		batch := outest.NewBatch(soraEvent("stats", "127.0.0.1:3000", now, common.MapStr{"total_ongoing_connections": float64(i + 1)}))
+		assert.NoError(t, c.Publish(batch))
+		batches = append(batches, batch)
+		now = now.Add(time.Minute)
+	}
+	for _, batch := range batches {
+		assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(batch))
+	}
+	// flush_interval が経って行グループを書いたあと、次の行グループの途中で止まった
+	partial := filepath.Join(dir, "stats/date=2017-10-10/host=127.0.0.1_3000/.stats-20171010T000000Z.parquet")
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("\x15\x00PAR1\x15"))
+	f.Close()
+
+	// 起動すると書きかけの行グループを切り詰めて footer を書き、読める名前に戻す
+	config.Path = dir
+	_, err = newClient(config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000000Z.parquet",
+	}, files(t, dir))
+	data, err := ioutil.ReadFile(filepath.Join(dir, files(t, dir)[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []interface{}{1., 2.}, readParquet(t, data)["total_ongoing_connections"])
+}
+
+func TestPublishParquetHoldsACK(t *testing.T) {
+	config := defaultConfig
+	config.Format = FormatParquet
+	config.Parquet.FlushEvents = 3
+	c, dir := newTestClient(t, config)
+	defer os.RemoveAll(dir)
+
+	now := timestamp
+	c.now = func() time.Time { return now }
+	tmp := filepath.Join(dir, "stats/date=2017-10-10/host=127.0.0.1_3000/.stats-20171010T000000Z.parquet")
+	// 止まったときに起動して読める行の数
+	onDisk := func() int {
+		data, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied := filepath.Join(dir, "copied.parquet")
+		defer os.Remove(copied)
+		assert.NoError(t, ioutil.WriteFile(copied, data, 0640))
+		if ok, err := recoverParquet(copied, columns["stats"]); !ok || err != nil {
+			return 0
+		}
+		if data, err = ioutil.ReadFile(copied); err != nil {
+			t.Fatal(err)
+		}
+		return len(readParquet(t, data)["total_ongoing_connections"])
+	}
+	publish := func(connections float64) *outest.Batch {
+		batch := outest.NewBatch(soraEvent("stats", "127.0.0.1:3000", now, common.MapStr{"total_ongoing_connections": connections}))
+		assert.NoError(t, c.Publish(batch))
+		return batch
+	}
+
+	// 行がメモリにある間は ACK しない
+	first := publish(1)
+	assert.Empty(t, first.Signals)
+	assert.Equal(t, 0, onDisk())
+
+	// flush_interval が経つと行グループを書いてから、受け取った順に ACK する
+	now = now.Add(config.Parquet.FlushInterval)
+	second := publish(2)
+	assert.Equal(t, 2, onDisk())
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(first))
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(second))
+
+	// flush_events に届いたときも書く
+	third := publish(3)
+	fourth := publish(4)
+	assert.Empty(t, third.Signals)
+	fifth := publish(5)
+	assert.Equal(t, 5, onDisk())
+	for _, batch := range []*outest.Batch{third, fourth, fifth} {
+		assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(batch))
+	}
+
+	// 次の Publish が来なくても flush_interval が経てば書く
+	c.config.Parquet.FlushInterval = 10 * time.Millisecond
+	sixth := publish(6)
+	assert.Empty(t, sixth.Signals)
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		held := len(c.held)
+		c.mu.Unlock()
+		if held == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 6, onDisk())
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(sixth))
+
+	// Close は残りの行を書いて ACK する
+	c.config.Parquet.FlushInterval = time.Hour
+	seventh := publish(7)
+	assert.Empty(t, seventh.Signals)
+	assert.NoError(t, c.Close())
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(seventh))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "stats/date=2017-10-10/host=127.0.0.1_3000/stats-20171010T000000Z.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []interface{}{1., 2., 3., 4., 5., 6., 7.}, readParquet(t, data)["total_ongoing_connections"])
+}
+
+func TestValidate(t *testing.T) {
+	config := defaultConfig
+	assert.NoError(t, config.Validate())
+	config.Format = "json"
+	assert.Error(t, config.Validate())
+	config = defaultConfig
+	config.Compression = "snappy"
+	assert.Error(t, config.Validate())
+	config = defaultConfig
+	config.MetricSets = []string{"client_stats"}
+	assert.Error(t, config.Validate())
+}
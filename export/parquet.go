@@ -0,0 +1,632 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// parquetWriter keeps the rows of a file in memory and writes them as a row
+// group once they reach the row group size or are flushed. The footer listing the row groups is written once, when the file
+// is closed. A file left open has no footer and is recovered by rebuilding it
+// from the page headers of the row groups, see recoverParquet.
+type parquetWriter struct {
+	file     *os.File
+	cols     []column
+	compress bool
+	// 行グループにする行の値の大きさ
+	groupBytes int64
+	// 行グループにしていない行と、その値の大きさ
+	rows    []row
+	pending int64
+	groups  []parquetGroup
+	// 書き終えた行グループの終わり。次の行グループはここから書く
+	offset int64
+	// 書いた行グループの footer の大きさ
+	footerSize int64
+}
+
+// parquetGroup is a row group written to the file.
+type parquetGroup struct {
+	rows   int64
+	total  int64
+	chunks []parquetChunk
+}
+
+// parquetChunk is the column chunk of a column in a row group.
+type parquetChunk struct {
+	offset       int64
+	uncompressed int64
+	compressed   int64
+}
+
+func newParquetWriter(file *os.File, cols []column, compress bool, groupBytes int64) *parquetWriter {
+	w := &parquetWriter{file: file, cols: cols, compress: compress, groupBytes: groupBytes}
+	w.footerSize = int64(len(w.footer()))
+	return w
+}
+
+// write buffers the row, after writing the rows buffered so far as a row
+// group when they reached the row group size.
+func (w *parquetWriter) write(r row) error {
+	if w.pending >= w.groupBytes {
+		if err := w.writeGroup(); err != nil {
+			return err
+		}
+	}
+	w.rows = append(w.rows, r)
+	w.pending += 8 + int64(len(r.host))
+	for _, v := range r.values {
+		switch v := v.(type) {
+		case string:
+			w.pending += 4 + int64(len(v))
+		case float64:
+			w.pending += 8
+		}
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a row group. Until then they are only in
+// memory.
+func (w *parquetWriter) flush() error {
+	if len(w.rows) == 0 {
+		return nil
+	}
+	return w.writeGroup()
+}
+
+// writeGroup writes the buffered rows as a row group and syncs the file.
+// When it fails, the rows stay buffered and the next try writes over what
+// was written.
+func (w *parquetWriter) writeGroup() error {
+	if len(w.rows) == 0 {
+		return nil
+	}
+	body, group, err := w.encode()
+	if err != nil {
+		return err
+	}
+	if err := w.writeAt(body); err != nil {
+		return err
+	}
+	w.groups = append(w.groups, group)
+	w.offset += int64(len(body))
+	w.footerSize = int64(len(w.footer()))
+	w.rows = nil
+	w.pending = 0
+	return nil
+}
+
+// writeAt writes p at the offset, cuts what a failed write left after it
+// and syncs the file.
+func (w *parquetWriter) writeAt(p []byte) error {
+	if _, err := w.file.WriteAt(p, w.offset); err != nil {
+		return err
+	}
+	if err := w.file.Truncate(w.offset + int64(len(p))); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// size is the size of the row groups written, of the values of the buffered
+// rows before compression and of the footer.
+func (w *parquetWriter) size() int64 {
+	return w.offset + w.pending + w.footerSize
+}
+
+// close writes the buffered rows and the footer.
+func (w *parquetWriter) close() error {
+	err := w.writeGroup()
+	if err == nil {
+		footer := w.footer()
+		if w.offset == 0 {
+			footer = append(append([]byte{}, parquetMagic...), footer...)
+		}
+		err = w.writeAt(footer)
+	}
+	if e := w.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Parquet の定数。parquet-format の parquet.thrift から必要なものだけ
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetOptional = 1
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetUncompressed = 0
+	parquetGzip         = 2
+
+	parquetDataPage = 0
+)
+
+var parquetMagic = []byte("PAR1")
+
+// parquetCreatedBy is the created_by of the footer, also used to tell a file
+// closed before it was renamed from a file left open.
+const parquetCreatedBy = "sorabeat"
+
+// parquetColumn is a column of the file with its values.
+type parquetColumn struct {
+	name      string
+	typ       int32
+	converted int32
+	value     func(r row) interface{}
+}
+
+func (w *parquetWriter) columns() []parquetColumn {
+	cols := []parquetColumn{
+		{"@timestamp", parquetInt64, parquetTimestampMillis, func(r row) interface{} {
+			return r.timestamp.UnixNano() / 1e6
+		}},
+		{"host", parquetByteArray, parquetUTF8, func(r row) interface{} {
+			return r.host
+		}},
+	}
+	for i, col := range w.cols {
+		i := i
+		c := parquetColumn{name: col.name, typ: parquetDouble, converted: -1}
+		if col.kind == kindString {
+			c.typ, c.converted = parquetByteArray, parquetUTF8
+		}
+		c.value = func(r row) interface{} {
+			return r.values[i]
+		}
+		cols = append(cols, c)
+	}
+	return cols
+}
+
+// codec is the compression codec of the column chunks.
+func (w *parquetWriter) codec() int32 {
+	if w.compress {
+		return parquetGzip
+	}
+	return parquetUncompressed
+}
+
+// encode returns the bytes to write at the offset: the magic at the start of
+// the file and the row group of the buffered rows, with a data page per
+// column. All columns are optional and plain encoded.
+func (w *parquetWriter) encode() ([]byte, parquetGroup, error) {
+	var out bytes.Buffer
+	if w.offset == 0 {
+		out.Write(parquetMagic)
+	}
+	group := parquetGroup{rows: int64(len(w.rows))}
+	for _, col := range w.columns() {
+		page := w.page(col)
+		data := page
+		if w.compress {
+			var err error
+			if data, err = gzipBytes(page); err != nil {
+				return nil, group, err
+			}
+		}
+
+		var header thrift
+		header.begin()
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(data)))
+		header.structField(5)
+		header.i32(1, int32(len(w.rows)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.end()
+		header.end()
+
+		chunk := parquetChunk{
+			offset:       w.offset + int64(out.Len()),
+			uncompressed: int64(header.buf.Len() + len(page)),
+			compressed:   int64(header.buf.Len() + len(data)),
+		}
+		out.Write(header.buf.Bytes())
+		out.Write(data)
+		group.total += chunk.uncompressed
+		group.chunks = append(group.chunks, chunk)
+	}
+	return out.Bytes(), group, nil
+}
+
+// footer returns the file metadata of the row groups written, followed by
+// its length and the magic.
+func (w *parquetWriter) footer() []byte {
+	cols := w.columns()
+	codec := w.codec()
+	var rows int64
+	for _, g := range w.groups {
+		rows += g.rows
+	}
+
+	var footer thrift
+	footer.begin()
+	footer.i32(1, 1)
+	footer.listField(2, compactStruct, len(cols)+1)
+	footer.begin()
+	footer.binary(4, "schema")
+	footer.i32(5, int32(len(cols)))
+	footer.end()
+	for _, col := range cols {
+		footer.begin()
+		footer.i32(1, col.typ)
+		footer.i32(3, parquetOptional)
+		footer.binary(4, col.name)
+		if col.converted >= 0 {
+			footer.i32(6, col.converted)
+		}
+		footer.end()
+	}
+	footer.i64(3, rows)
+	footer.listField(4, compactStruct, len(w.groups))
+	for _, g := range w.groups {
+		footer.begin()
+		footer.listField(1, compactStruct, len(g.chunks))
+		for i, chunk := range g.chunks {
+			footer.begin()
+			footer.i64(2, chunk.offset)
+			footer.structField(3)
+			footer.i32(1, cols[i].typ)
+			footer.listField(2, compactI32, 2)
+			footer.varint(parquetPlain)
+			footer.varint(parquetRLE)
+			footer.listField(3, compactBinary, 1)
+			footer.bytes([]byte(cols[i].name))
+			footer.i32(4, codec)
+			footer.i64(5, g.rows)
+			footer.i64(6, chunk.uncompressed)
+			footer.i64(7, chunk.compressed)
+			footer.i64(9, chunk.offset)
+			footer.end()
+			footer.end()
+		}
+		footer.i64(2, g.total)
+		footer.i64(3, g.rows)
+		footer.end()
+	}
+	footer.binary(6, parquetCreatedBy)
+	footer.end()
+
+	out := footer.buf.Bytes()
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(out)))
+	out = append(out, length[:]...)
+	return append(out, parquetMagic...)
+}
+
+// recoverParquet finishes a file of the columns left open: it truncates the
+// row group that was being written and writes the footer of the complete
+// row groups, read back from their page headers. It returns false when the
+// file has no complete row group.
+func recoverParquet(path string, cols []column) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.HasPrefix(data, parquetMagic) {
+		return false, nil
+	}
+	// 閉じたあと名前を戻す前に止まったときは footer まで書けている
+	if end := []byte(parquetCreatedBy + "\x00"); len(data) >= 12+len(end) && bytes.HasSuffix(data, parquetMagic) {
+		length := int64(binary.LittleEndian.Uint32(data[len(data)-8:]))
+		if start := int64(len(data)-8) - length; start >= 4 && bytes.HasSuffix(data[start:len(data)-8], end) {
+			return true, nil
+		}
+	}
+
+	w := &parquetWriter{cols: cols}
+	n := len(w.columns())
+	offset := int64(len(parquetMagic))
+	for {
+		group, ok := readGroup(data, offset, n)
+		if !ok {
+			break
+		}
+		if len(w.groups) == 0 {
+			w.compress = gzipped(data, group.chunks[0])
+		}
+		w.groups = append(w.groups, group)
+		last := group.chunks[n-1]
+		offset = last.offset + last.compressed
+	}
+	if len(w.groups) == 0 {
+		return false, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0640)
+	if err != nil {
+		return false, err
+	}
+	w.file = file
+	w.offset = offset
+	err = w.writeAt(w.footer())
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	return err == nil, err
+}
+
+// readGroup reads back the row group of n columns at the offset from the
+// headers of its data pages. It returns false when the row group is not
+// complete.
+func readGroup(data []byte, offset int64, n int) (parquetGroup, bool) {
+	var group parquetGroup
+	for i := 0; i < n; i++ {
+		if offset >= int64(len(data)) {
+			return group, false
+		}
+		header, ok := readPageHeader(data[offset:])
+		if !ok || (i > 0 && header.rows != group.rows) {
+			return group, false
+		}
+		chunk := parquetChunk{
+			offset:       offset,
+			uncompressed: header.size + header.uncompressed,
+			compressed:   header.size + header.compressed,
+		}
+		if offset+chunk.compressed > int64(len(data)) {
+			return group, false
+		}
+		group.rows = header.rows
+		group.total += chunk.uncompressed
+		group.chunks = append(group.chunks, chunk)
+		offset += chunk.compressed
+	}
+	return group, true
+}
+
+// pageHeader is what recoverParquet needs from the header of a data page.
+type pageHeader struct {
+	size         int64
+	uncompressed int64
+	compressed   int64
+	rows         int64
+}
+
+// readPageHeader decodes the page header written by encode: a struct of i32
+// fields and of the struct of the data page header.
+func readPageHeader(data []byte) (pageHeader, bool) {
+	var h pageHeader
+	pos := 0
+	var read func(depth int) bool
+	read = func(depth int) bool {
+		id := int16(0)
+		for {
+			if pos >= len(data) {
+				return false
+			}
+			b := data[pos]
+			pos++
+			if b == 0 {
+				return true
+			}
+			if delta := int16(b >> 4); delta != 0 {
+				id += delta
+			} else {
+				v, n := binary.Varint(data[pos:])
+				if n <= 0 {
+					return false
+				}
+				pos += n
+				id = int16(v)
+			}
+			switch b & 0x0f {
+			case compactI32, compactI64:
+				v, n := binary.Varint(data[pos:])
+				if n <= 0 {
+					return false
+				}
+				pos += n
+				switch {
+				case depth == 0 && id == 2:
+					h.uncompressed = v
+				case depth == 0 && id == 3:
+					h.compressed = v
+				case depth == 1 && id == 1:
+					h.rows = v
+				}
+			case compactStruct:
+				if depth > 0 || !read(depth+1) {
+					return false
+				}
+			default:
+				return false
+			}
+		}
+	}
+	if !read(0) || h.compressed < 0 || h.uncompressed < 0 {
+		return h, false
+	}
+	h.size = int64(pos)
+	return h, true
+}
+
+// gzipped reports whether the page of the chunk is compressed with gzip.
+func gzipped(data []byte, chunk parquetChunk) bool {
+	header, _ := readPageHeader(data[chunk.offset:])
+	page := data[chunk.offset+header.size : chunk.offset+chunk.compressed]
+	z, err := gzip.NewReader(bytes.NewReader(page))
+	if err != nil {
+		return false
+	}
+	decoded, err := ioutil.ReadAll(z)
+	return err == nil && int64(len(decoded)) == header.uncompressed
+}
+
+// page returns the definition levels, prefixed with their length, and the
+// values of the rows that have one.
+func (w *parquetWriter) page(col parquetColumn) []byte {
+	levels := make([]bool, len(w.rows))
+	var values bytes.Buffer
+	for i, r := range w.rows {
+		switch v := col.value(r).(type) {
+		case int64:
+			binary.Write(&values, binary.LittleEndian, v)
+		case float64:
+			binary.Write(&values, binary.LittleEndian, math.Float64bits(v))
+		case string:
+			binary.Write(&values, binary.LittleEndian, uint32(len(v)))
+			values.WriteString(v)
+		default:
+			continue
+		}
+		levels[i] = true
+	}
+
+	rle := runs(levels)
+	var page bytes.Buffer
+	binary.Write(&page, binary.LittleEndian, uint32(len(rle)))
+	page.Write(rle)
+	page.Write(values.Bytes())
+	return page.Bytes()
+}
+
+// runs は定義レベルをビット幅 1 の RLE の連続で表す
+func runs(levels []bool) []byte {
+	var buf []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		buf = appendUvarint(buf, uint64(j-i)<<1)
+		if levels[i] {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		i = j
+	}
+	return buf
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	if _, err := z.Write(data); err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
+
+// Types of the thrift compact protocol.
+const (
+	compactI32    = 5
+	compactI64    = 6
+	compactBinary = 8
+	compactList   = 9
+	compactStruct = 12
+)
+
+// thrift writes the structs of the Parquet metadata in the thrift compact
+// protocol. The fields of a struct must be written in the order of their
+// ids.
+type thrift struct {
+	buf bytes.Buffer
+	// 構造体ごとの直前のフィールド ID
+	last []int16
+}
+
+func (t *thrift) begin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thrift) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thrift) field(id int16, typ byte) {
+	top := len(t.last) - 1
+	if delta := id - t.last[top]; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.last[top] = id
+}
+
+func (t *thrift) i32(id int16, v int32) {
+	t.field(id, compactI32)
+	t.varint(int64(v))
+}
+
+func (t *thrift) i64(id int16, v int64) {
+	t.field(id, compactI64)
+	t.varint(v)
+}
+
+func (t *thrift) binary(id int16, s string) {
+	t.field(id, compactBinary)
+	t.bytes([]byte(s))
+}
+
+// structField starts a struct field, closed by end.
+func (t *thrift) structField(id int16) {
+	t.field(id, compactStruct)
+	t.begin()
+}
+
+// listField starts a list field of n elements, written without field headers.
+func (t *thrift) listField(id int16, typ byte, n int) {
+	t.field(id, compactList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | typ)
+		return
+	}
+	t.buf.WriteByte(0xf0 | typ)
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], uint64(n))])
+}
+
+// varint writes a zigzag varint.
+func (t *thrift) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (t *thrift) bytes(p []byte) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], uint64(len(p)))])
+	t.buf.Write(p)
+}
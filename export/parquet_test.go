@@ -0,0 +1,388 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// +build !integration
+
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs/outest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuns(t *testing.T) {
+	assert.Equal(t, []byte{6, 1, 2, 0, 2, 1}, runs([]bool{true, true, true, false, true}))
+	assert.Empty(t, runs(nil))
+}
+
+func TestThrift(t *testing.T) {
+	var th thrift
+	th.begin()
+	th.i32(1, 1)
+	th.binary(4, "a")
+	th.i64(20, -1)
+	th.listField(21, compactI32, 2)
+	th.varint(0)
+	th.varint(3)
+	th.end()
+	assert.Equal(t, []byte{
+		0x15, 0x02, // 1: i32 1
+		0x38, 0x01, 'a', // 4: binary "a"
+		0x06, 0x28, 0x01, // 20: i64 -1、差が 15 を超えるので ID を書く
+		0x19, 0x25, 0x00, 0x06, // 21: list<i32> [0, 3]
+		0x00,
+	}, th.buf.Bytes())
+}
+
+func TestPublishParquet(t *testing.T) {
+	config := defaultConfig
+	config.Format = FormatParquet
+	c, dir := newTestClient(t, config)
+	defer os.RemoveAll(dir)
+
+	batch := outest.NewBatch(
+		soraEvent("connections", "127.0.0.1:3000", timestamp, common.MapStr{
+			"channel_id": "sora",
+			"rtp":        common.MapStr{"total_sent_byte_size": 1234.},
+		}),
+		soraEvent("connections", "127.0.0.1:3000", timestamp.Add(time.Second), common.MapStr{
+			"channel_id": "sora",
+		}),
+	)
+	assert.NoError(t, c.Publish(batch))
+	// 行グループを書くまでは ACK しない
+	assert.Empty(t, batch.Signals)
+	assert.NoError(t, c.Close())
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(batch))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "connections/date=2017-10-10/host=127.0.0.1_3000/connections-20171010T000000Z.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, parquetMagic, data[:4])
+	assert.Equal(t, parquetMagic, data[len(data)-4:])
+	length := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	if assert.True(t, length < len(data)-12) {
+		footer := data[len(data)-8-length : len(data)-8]
+		assert.True(t, bytes.Contains(footer, []byte("@timestamp")))
+		assert.True(t, bytes.Contains(footer, []byte("rtp.total_sent_byte_size")))
+	}
+}
+
+// compactReader decodes the thrift compact protocol into maps of field IDs,
+// slices, int64 and []byte, independently of the thrift writer above.
+type compactReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *compactReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *compactReader) zigzag() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *compactReader) value(typ byte) interface{} {
+	switch typ {
+	case compactI32, compactI64:
+		return r.zigzag()
+	case compactBinary:
+		n := int(r.uvarint())
+		r.pos += n
+		return r.data[r.pos-n : r.pos]
+	case compactList:
+		header := r.data[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case compactStruct:
+		fields := map[int16]interface{}{}
+		id := int16(0)
+		for {
+			header := r.data[r.pos]
+			r.pos++
+			if header == 0 {
+				return fields
+			}
+			if delta := int16(header >> 4); delta != 0 {
+				id += delta
+			} else {
+				id = int16(r.zigzag())
+			}
+			fields[id] = r.value(header & 0x0f)
+		}
+	}
+	panic(fmt.Sprintf("unexpected compact type %d", typ))
+}
+
+func decodeStruct(data []byte) (map[int16]interface{}, int) {
+	r := &compactReader{data: data}
+	return r.value(compactStruct).(map[int16]interface{}), r.pos
+}
+
+// readParquet decodes a file of plain encoded, optional columns written as
+// row groups of a data page per column chunk, following parquet.thrift. It
+// returns the values of each column by name, nil for the null values.
+func readParquet(t *testing.T, data []byte) map[string][]interface{} {
+	if !assert.Equal(t, parquetMagic, data[:4]) || !assert.Equal(t, parquetMagic, data[len(data)-4:]) {
+		t.FailNow()
+	}
+	length := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	meta, _ := decodeStruct(data[len(data)-8-length : len(data)-8])
+
+	schema := meta[2].([]interface{})
+	root := schema[0].(map[int16]interface{})
+	assert.Equal(t, int64(len(schema)-1), root[5])
+
+	columns := map[string][]interface{}{}
+	total := int64(0)
+	for _, g := range meta[4].([]interface{}) {
+		group := g.(map[int16]interface{})
+		rows := int(group[3].(int64))
+		total += group[3].(int64)
+		chunks := group[1].([]interface{})
+		if !assert.Len(t, chunks, len(schema)-1) {
+			t.FailNow()
+		}
+		for i, c := range chunks {
+			element := schema[i+1].(map[int16]interface{})
+			name, values := readChunk(t, data, element, c.(map[int16]interface{})[3].(map[int16]interface{}), rows)
+			columns[name] = append(columns[name], values...)
+		}
+	}
+	assert.Equal(t, total, meta[3])
+	return columns
+}
+
+// readChunk decodes the values of a column chunk of a row group.
+func readChunk(t *testing.T, data []byte, element, chunk map[int16]interface{}, rows int) (string, []interface{}) {
+	assert.Equal(t, int64(parquetOptional), element[3])
+	name := string(chunk[3].([]interface{})[0].([]byte))
+	assert.Equal(t, string(element[4].([]byte)), name)
+	assert.Equal(t, element[1], chunk[1])
+	assert.Equal(t, int64(rows), chunk[5])
+
+	offset := int(chunk[9].(int64))
+	header, n := decodeStruct(data[offset:])
+	assert.Equal(t, int64(parquetDataPage), header[1])
+	assert.Equal(t, chunk[7], int64(n)+header[3].(int64))
+	page := data[offset+n : offset+n+int(header[3].(int64))]
+	if chunk[4] == int64(parquetGzip) {
+		z, err := gzip.NewReader(bytes.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page, err = ioutil.ReadAll(z); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, header[2], int64(len(page)))
+	dataPage := header[5].(map[int16]interface{})
+	assert.Equal(t, int64(rows), dataPage[1])
+	assert.Equal(t, int64(parquetPlain), dataPage[2])
+	assert.Equal(t, int64(parquetRLE), dataPage[3])
+
+	// 定義レベルはビット幅 1 の RLE と bit-packed の連続
+	levelsSize := int(binary.LittleEndian.Uint32(page))
+	levels := &compactReader{data: page[4 : 4+levelsSize]}
+	var defined []bool
+	for levels.pos < len(levels.data) {
+		run := levels.uvarint()
+		if run&1 == 0 {
+			value := levels.data[levels.pos] == 1
+			levels.pos++
+			for j := uint64(0); j < run>>1; j++ {
+				defined = append(defined, value)
+			}
+			continue
+		}
+		for j := uint64(0); j < (run>>1)*8; j++ {
+			defined = append(defined, levels.data[levels.pos+int(j/8)]>>(j%8)&1 == 1)
+		}
+		levels.pos += int(run >> 1)
+	}
+	values := page[4+levelsSize:]
+	var column []interface{}
+	for row := 0; row < rows; row++ {
+		if !defined[row] {
+			column = append(column, nil)
+			continue
+		}
+		switch element[1] {
+		case int64(parquetInt64):
+			column = append(column, int64(binary.LittleEndian.Uint64(values)))
+			values = values[8:]
+		case int64(parquetDouble):
+			column = append(column, math.Float64frombits(binary.LittleEndian.Uint64(values)))
+			values = values[8:]
+		case int64(parquetByteArray):
+			n := int(binary.LittleEndian.Uint32(values))
+			column = append(column, string(values[4:4+n]))
+			values = values[4+n:]
+		}
+	}
+	assert.Empty(t, values, name)
+	return name, column
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sorabeat-parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, compress := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("connections-%v.parquet", compress))
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := newParquetWriter(file, []column{
+			{"channel_id", kindString},
+			{"rtp.total_sent_bytes", kindNumber},
+		}, compress, defaultConfig.Parquet.RowGroupBytes)
+		assert.NoError(t, w.write(row{timestamp, "127.0.0.1:3000", []interface{}{"sora", 1234.}}))
+		assert.NoError(t, w.write(row{timestamp.Add(time.Second), "127.0.0.1:3000", []interface{}{"sora", nil}}))
+
+		// flush するまでは行グループにしない
+		assert.Empty(t, w.groups)
+		assert.NoError(t, w.flush())
+		assert.Len(t, w.groups, 1)
+		// 書く行がなければ行グループを増やさない
+		assert.NoError(t, w.flush())
+		assert.Len(t, w.groups, 1)
+
+		assert.NoError(t, w.write(row{timestamp.Add(2 * time.Second), "127.0.0.1:3000", []interface{}{nil, 0.5}}))
+		assert.NoError(t, w.writeGroup())
+		size := w.size()
+		assert.NoError(t, w.close())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// footer はひとつだけで、size は閉じたあとの大きさと同じ
+		assert.Equal(t, int64(len(data)), size)
+		assert.Equal(t, 1, bytes.Count(data, []byte(parquetCreatedBy)))
+		millis := timestamp.UnixNano() / 1e6
+		assert.Equal(t, map[string][]interface{}{
+			"@timestamp":           {millis, millis + 1000, millis + 2000},
+			"host":                 {"127.0.0.1:3000", "127.0.0.1:3000", "127.0.0.1:3000"},
+			"channel_id":           {"sora", "sora", nil},
+			"rtp.total_sent_bytes": {1234., nil, 0.5},
+		}, readParquet(t, data), "compress: %v", compress)
+	}
+}
+
+func TestParquetRowGroupBytes(t *testing.T) {
+	file, err := ioutil.TempFile("", "sorabeat-parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	w := newParquetWriter(file, []column{{"channel_id", kindString}}, false, 100)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, w.write(row{timestamp, "127.0.0.1:3000", []interface{}{"sora"}}))
+	}
+	// 1 行は 30 バイトなので 4 行ごとに行グループにする
+	assert.Len(t, w.groups, 2)
+	assert.Len(t, w.rows, 2)
+	assert.NoError(t, w.close())
+
+	data, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, readParquet(t, data)["channel_id"], 10)
+}
+
+func TestRecoverParquetFile(t *testing.T) {
+	cols := []column{{"channel_id", kindString}}
+	for _, compress := range []bool{false, true} {
+		file, err := ioutil.TempFile("", "sorabeat-parquet")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := file.Name()
+		defer os.Remove(path)
+
+		w := newParquetWriter(file, cols, compress, defaultConfig.Parquet.RowGroupBytes)
+		assert.NoError(t, w.write(row{timestamp, "127.0.0.1:3000", []interface{}{"sora"}}))
+		assert.NoError(t, w.writeGroup())
+		assert.NoError(t, w.write(row{timestamp, "127.0.0.1:3000", []interface{}{"sora-2"}}))
+		assert.NoError(t, w.writeGroup())
+		// 次の行グループの途中で止まった
+		assert.NoError(t, w.write(row{timestamp, "127.0.0.1:3000", []interface{}{"sora-3"}}))
+		body, _, err := w.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteAt(body[:len(body)-1], w.offset)
+		file.Close()
+
+		ok, err := recoverParquet(path, cols)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []interface{}{"sora", "sora-2"}, readParquet(t, data)["channel_id"], "compress: %v", compress)
+
+		// footer まで書けているファイルはそのまま
+		ok, err = recoverParquet(path, cols)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		recovered, _ := ioutil.ReadFile(path)
+		assert.Equal(t, data, recovered)
+	}
+
+	// 行グループがひとつもなければ読めない
+	file, err := ioutil.TempFile("", "sorabeat-parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write([]byte("PAR1\x15"))
+	file.Close()
+	ok, err := recoverParquet(file.Name(), cols)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -9,6 +9,11 @@ package include
 import (
 	// This list is automatically generated by `make imports`
 	_ "github.com/shiguredo/sorabeat/module/sora"
+	_ "github.com/shiguredo/sorabeat/module/sora/client_stats"
+	_ "github.com/shiguredo/sorabeat/module/sora/connection_detail"
 	_ "github.com/shiguredo/sorabeat/module/sora/connections"
+	_ "github.com/shiguredo/sorabeat/module/sora/license"
+	_ "github.com/shiguredo/sorabeat/module/sora/recording"
+	_ "github.com/shiguredo/sorabeat/module/sora/scrape"
 	_ "github.com/shiguredo/sorabeat/module/sora/stats"
 )
@@ -0,0 +1,97 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type config struct {
+	URL       string        `config:"url"`
+	Org       string        `config:"org"`
+	Bucket    string        `config:"bucket"`
+	Token     string        `config:"token"`
+	File      string        `config:"file"`
+	Precision string        `config:"precision"`
+	Timeout   time.Duration `config:"timeout" validate:"positive"`
+	// MetricSets are the sora metricsets whose events are written.
+	MetricSets []string `config:"metricsets"`
+	// Tags are the fields of the metricset written as tags besides host.
+	Tags              []string `config:"tags"`
+	MeasurementPrefix string   `config:"measurement_prefix"`
+	BulkMaxSize       int      `config:"bulk_max_size"`
+	MaxRetries        int      `config:"max_retries"`
+	Backoff           backoff  `config:"backoff"`
+}
+
+type backoff struct {
+	Init time.Duration `config:"init" validate:"nonzero"`
+	Max  time.Duration `config:"max" validate:"nonzero"`
+}
+
+var defaultConfig = config{
+	Precision:  "ns",
+	Timeout:    10 * time.Second,
+	MetricSets: []string{"stats", "connections"},
+	Tags: []string{
+		"channel_id",
+		"client_id",
+		// 同じ client_id の接続が同じ時刻の同じ point になって上書きされないよう、
+		// sora.ConnectionKey と同じくチャネルと connection_id で接続を見分ける。
+		// connection_id のない Sora では channel_id と client_id で見分ける
+		"connection_id",
+		// identity.key で選んだ表示用の識別子。client_id を選ぶと接続を見分けられない
+		"identity",
+		// stats のブラウザ、SDK ごとのドキュメントを見分ける
+		"breakdown.type",
+		"breakdown.result",
+		"breakdown.browser",
+		"breakdown.sdk",
+		"breakdown.os",
+	},
+	MeasurementPrefix: "sora_",
+	BulkMaxSize:       1000,
+	MaxRetries:        3,
+	Backoff: backoff{
+		Init: 1 * time.Second,
+		Max:  60 * time.Second,
+	},
+}
+
+// precisions are the timestamp precisions of the write API.
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+func (c *config) Validate() error {
+	if (c.URL == "") == (c.File == "") {
+		return errors.New("either url or file must be set")
+	}
+	if c.URL != "" && (c.Org == "" || c.Bucket == "") {
+		return errors.New("org and bucket are required to write to url")
+	}
+	if _, ok := precisions[c.Precision]; !ok {
+		return fmt.Errorf("unknown precision '%s', must be ns, us, ms or s", c.Precision)
+	}
+	if c.Backoff.Max < c.Backoff.Init {
+		return errors.New("backoff.max must not be smaller than backoff.init")
+	}
+	return nil
+}
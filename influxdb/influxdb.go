@@ -0,0 +1,261 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package influxdb provides the influxdb output. It serializes the events of
+the sora metricsets into InfluxDB line protocol, with the host and the
+configured fields such as channel_id and client_id as tags and the numeric
+fields as fields, and writes each batch to the InfluxDB v2 HTTP write API or
+appends it to a file.
+
+	output.influxdb:
+	  url: "http://localhost:8086"
+	  org: "shiguredo"
+	  bucket: "sora"
+	  token: "..."
+*/
+package influxdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/publisher"
+)
+
+func init() {
+	outputs.RegisterType("influxdb", makeInfluxDB)
+}
+
+func makeInfluxDB(
+	beat beat.Info,
+	stats *outputs.Stats,
+	cfg *common.Config,
+) (outputs.Group, error) {
+	config := defaultConfig
+	if err := cfg.Unpack(&config); err != nil {
+		return outputs.Fail(err)
+	}
+	c, err := newClient(config, stats)
+	if err != nil {
+		return outputs.Fail(err)
+	}
+	return outputs.Success(config.BulkMaxSize, config.MaxRetries, c)
+}
+
+// writer writes a batch of lines.
+type writer interface {
+	write(body []byte) error
+	close() error
+}
+
+// permanentError is a rejection of the batch that retrying does not fix,
+// i.e. a malformed point or a batch too large.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+type client struct {
+	encoder *encoder
+	writer  writer
+	stats   *outputs.Stats
+	backoff backoff
+
+	mu   sync.Mutex
+	wait time.Duration
+	done chan struct{}
+}
+
+func newClient(config config, stats *outputs.Stats) (*client, error) {
+	var w writer
+	if config.File != "" {
+		f, err := newFileWriter(config.File)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	} else {
+		w = newHTTPWriter(config)
+	}
+	return &client{
+		encoder: newEncoder(config),
+		writer:  w,
+		stats:   stats,
+		backoff: config.Backoff,
+		wait:    config.Backoff.Init,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (c *client) String() string {
+	return "influxdb"
+}
+
+// Close interrupts a pending backoff and closes the writer.
+func (c *client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	close(c.done)
+	return c.writer.close()
+}
+
+// Publish writes the points of the batch in one request. Events that are
+// not from the configured metricsets are ACKed without being written. A
+// failed request is retried after a backoff; Publish does not return the
+// error, which would stop the output worker.
+func (c *client) Publish(batch publisher.Batch) error {
+	events := batch.Events()
+	c.stats.NewBatch(len(events))
+
+	var buf bytes.Buffer
+	for i := range events {
+		c.encoder.encode(&buf, &events[i].Content)
+	}
+	if buf.Len() == 0 {
+		c.stats.Acked(len(events))
+		batch.ACK()
+		return nil
+	}
+
+	err := c.writer.write(buf.Bytes())
+	switch err.(type) {
+	case nil:
+		c.stats.WriteBytes(buf.Len())
+		c.stats.Acked(len(events))
+		batch.ACK()
+		c.wait = c.backoff.Init
+		return nil
+	case permanentError:
+		logp.Err("influxdb: dropping %d events: %v", len(events), err)
+		c.stats.WriteError()
+		c.stats.Dropped(len(events))
+		batch.Drop()
+		return nil
+	default:
+		// Connect のない出力はエラーを返すとワーカーが止まるので、
+		// 再送を頼んでから nil を返す
+		logp.Err("influxdb: failed to write %d events, retrying: %v", len(events), err)
+		c.stats.WriteError()
+		c.stats.Failed(len(events))
+		batch.Retry()
+		c.sleep()
+		return nil
+	}
+}
+
+// sleep は失敗が続くほど次の送信を待つ
+func (c *client) sleep() {
+	timer := time.NewTimer(c.wait)
+	defer timer.Stop()
+	select {
+	case <-c.done:
+	case <-timer.C:
+	}
+	c.wait *= 2
+	if c.wait > c.backoff.Max {
+		c.wait = c.backoff.Max
+	}
+}
+
+type httpWriter struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newHTTPWriter(config config) *httpWriter {
+	query := url.Values{}
+	query.Set("org", config.Org)
+	query.Set("bucket", config.Bucket)
+	query.Set("precision", config.Precision)
+	return &httpWriter{
+		url:    strings.TrimRight(config.URL, "/") + "/api/v2/write?" + query.Encode(),
+		token:  config.Token,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+}
+
+func (w *httpWriter) write(body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("influxdb returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	// 同じバッチを送り直しても受け付けられないのは 400 と 413 だけ。
+	// 401、403、404 はトークンやバケットを直せば書けるので、5xx や 429 と同じく再送する
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return permanentError{err}
+	}
+	return err
+}
+
+func (w *httpWriter) close() error {
+	return nil
+}
+
+type fileWriter struct {
+	file *os.File
+}
+
+func newFileWriter(path string) (*fileWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{file: f}, nil
+}
+
+func (w *fileWriter) write(body []byte) error {
+	_, err := w.file.Write(body)
+	return err
+}
+
+func (w *fileWriter) close() error {
+	return w.file.Close()
+}
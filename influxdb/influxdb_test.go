@@ -0,0 +1,209 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package influxdb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs/outest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeInfluxDB is a write endpoint that answers with the queued status codes
+// and records the accepted requests.
+type fakeInfluxDB struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (f *fakeInfluxDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := http.StatusNoContent
+	if len(f.statuses) > 0 {
+		status, f.statuses = f.statuses[0], f.statuses[1:]
+	}
+	if status == http.StatusNoContent {
+		f.requests = append(f.requests, r)
+		f.bodies = append(f.bodies, string(body))
+	} else {
+		http.Error(w, `{"code":"invalid"}`, status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+func newTestClient(t *testing.T, url string) *client {
+	config := defaultConfig
+	config.URL = url
+	config.Org = "shiguredo"
+	config.Bucket = "sora"
+	config.Token = "secret"
+	config.Precision = "s"
+	config.Backoff = backoff{Init: time.Millisecond, Max: 4 * time.Millisecond}
+	c, err := newClient(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func signals(batch *outest.Batch) []outest.BatchSignalTag {
+	var tags []outest.BatchSignalTag
+	for _, sig := range batch.Signals {
+		tags = append(tags, sig.Tag)
+	}
+	return tags
+}
+
+func TestPublishHTTP(t *testing.T) {
+	fake := &fakeInfluxDB{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL+"/")
+	defer c.Close()
+
+	batch := outest.NewBatch(
+		soraEvent("stats", common.MapStr{"total_ongoing_connections": int64(3)}),
+		soraEvent("connections", common.MapStr{"channel_id": "sora", "rtp": common.MapStr{"total_sent_bytes": int64(10)}}),
+		soraEvent("client_stats", common.MapStr{"rate": common.MapStr{"nack_count": 1.}}),
+	)
+	assert.NoError(t, c.Publish(batch))
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(batch))
+
+	if assert.Len(t, fake.requests, 1) {
+		r := fake.requests[0]
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/api/v2/write", r.URL.Path)
+		assert.Equal(t, "shiguredo", r.URL.Query().Get("org"))
+		assert.Equal(t, "sora", r.URL.Query().Get("bucket"))
+		assert.Equal(t, "s", r.URL.Query().Get("precision"))
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		assert.Equal(t,
+			"sora_stats,host=127.0.0.1:3000 total_ongoing_connections=3i 1507593600\n"+
+				"sora_connections,channel_id=sora,host=127.0.0.1:3000 rtp.total_sent_bytes=10i 1507593600\n",
+			fake.bodies[0])
+	}
+
+	// 書く点がなければ送らない
+	batch = outest.NewBatch(soraEvent("client_stats", common.MapStr{"rate": common.MapStr{"nack_count": 1.}}))
+	assert.NoError(t, c.Publish(batch))
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(batch))
+	assert.Len(t, fake.requests, 1)
+}
+
+func TestPublishRetry(t *testing.T) {
+	fake := &fakeInfluxDB{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL)
+	defer c.Close()
+	event := soraEvent("stats", common.MapStr{"total_ongoing_connections": int64(3)})
+
+	for i := 0; i < 2; i++ {
+		batch := outest.NewBatch(event)
+		// エラーを返すとワーカーが止まる
+		assert.NoError(t, c.Publish(batch))
+		assert.Equal(t, []outest.BatchSignalTag{outest.BatchRetry}, signals(batch))
+	}
+	assert.Equal(t, 4*time.Millisecond, c.wait)
+
+	batch := outest.NewBatch(event)
+	assert.NoError(t, c.Publish(batch))
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchACK}, signals(batch))
+	assert.Len(t, fake.requests, 1)
+	assert.Equal(t, time.Millisecond, c.wait)
+
+	// 接続できないときも再送する
+	server.Close()
+	batch = outest.NewBatch(event)
+	assert.NoError(t, c.Publish(batch))
+	assert.Equal(t, []outest.BatchSignalTag{outest.BatchRetry}, signals(batch))
+}
+
+func TestPublishDrop(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge} {
+		fake := &fakeInfluxDB{statuses: []int{status}}
+		server := httptest.NewServer(fake)
+
+		c := newTestClient(t, server.URL)
+		batch := outest.NewBatch(soraEvent("stats", common.MapStr{"total_ongoing_connections": int64(3)}))
+		assert.NoError(t, c.Publish(batch))
+		assert.Equal(t, []outest.BatchSignalTag{outest.BatchDrop}, signals(batch), "status: %d", status)
+		c.Close()
+		server.Close()
+	}
+}
+
+func TestPublishRetryClientError(t *testing.T) {
+	// トークンやバケットを直すまでの間のイベントは捨てない
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		fake := &fakeInfluxDB{statuses: []int{status}}
+		server := httptest.NewServer(fake)
+
+		c := newTestClient(t, server.URL)
+		batch := outest.NewBatch(soraEvent("stats", common.MapStr{"total_ongoing_connections": int64(3)}))
+		assert.NoError(t, c.Publish(batch))
+		assert.Equal(t, []outest.BatchSignalTag{outest.BatchRetry}, signals(batch), "status: %d", status)
+		assert.Equal(t, 2*time.Millisecond, c.wait)
+		c.Close()
+		server.Close()
+	}
+}
+
+func TestPublishFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sorabeat-influxdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := defaultConfig
+	config.File = filepath.Join(dir, "sora.lp")
+	c, err := newClient(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 2; i++ {
+		batch := outest.NewBatch(soraEvent("stats", common.MapStr{"total_ongoing_connections": i}))
+		assert.NoError(t, c.Publish(batch))
+	}
+	assert.NoError(t, c.Close())
+	assert.NoError(t, c.Close())
+
+	data, err := ioutil.ReadFile(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t,
+		"sora_stats,host=127.0.0.1:3000 total_ongoing_connections=1i 1507593600000000000\n"+
+			"sora_stats,host=127.0.0.1:3000 total_ongoing_connections=2i 1507593600000000000\n",
+		string(data))
+}
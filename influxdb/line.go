@@ -0,0 +1,191 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// encoder serializes sora events into InfluxDB line protocol.
+type encoder struct {
+	prefix     string
+	metricsets []string
+	tags       []string
+	precision  time.Duration
+}
+
+func newEncoder(config config) *encoder {
+	return &encoder{
+		prefix:     config.MeasurementPrefix,
+		metricsets: config.MetricSets,
+		tags:       config.Tags,
+		precision:  precisions[config.Precision],
+	}
+}
+
+// encode appends the point of the event to buf. It returns false when the
+// event is not written, i.e. it is not from one of the metricsets or has no
+// numeric field.
+func (e *encoder) encode(buf *bytes.Buffer, event *beat.Event) bool {
+	module, _ := event.Fields.GetValue("metricset.module")
+	name, _ := event.Fields.GetValue("metricset.name")
+	metricset, _ := name.(string)
+	if module != "sora" || !e.includes(metricset) {
+		return false
+	}
+	value, err := event.Fields.GetValue("sora." + metricset)
+	if err != nil {
+		return false
+	}
+	fields, ok := toMapStr(value)
+	if !ok {
+		return false
+	}
+
+	tags := map[string]string{}
+	if host, err := event.Fields.GetValue("metricset.host"); err == nil {
+		if s, ok := host.(string); ok && s != "" {
+			tags["host"] = s
+		}
+	}
+	for _, key := range e.tags {
+		if v, err := fields.GetValue(key); err == nil {
+			if s, ok := v.(string); ok && s != "" {
+				tags[key] = s
+			}
+		}
+	}
+
+	var values []string
+	flatten("", fields, tags, &values)
+	if len(values) == 0 {
+		return false
+	}
+
+	buf.WriteString(measurementEscaper.Replace(e.prefix + metricset))
+	var keys []string
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteByte(',')
+		buf.WriteString(keyEscaper.Replace(key))
+		buf.WriteByte('=')
+		buf.WriteString(keyEscaper.Replace(tags[key]))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strings.Join(values, ","))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(event.Timestamp.UnixNano()/int64(e.precision), 10))
+	buf.WriteByte('\n')
+	return true
+}
+
+func (e *encoder) includes(metricset string) bool {
+	if len(e.metricsets) == 0 {
+		return metricset != ""
+	}
+	for _, m := range e.metricsets {
+		if m == metricset {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten は数値のフィールドをドットでつないだキーの key=value にする。
+// タグにしたフィールドと文字列、配列は含めない
+func flatten(prefix string, fields common.MapStr, tags map[string]string, values *[]string) {
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		path := prefix + key
+		if m, ok := toMapStr(fields[key]); ok {
+			flatten(path+".", m, tags, values)
+			continue
+		}
+		if _, ok := tags[path]; ok {
+			continue
+		}
+		if v, ok := formatValue(fields[key]); ok {
+			*values = append(*values, keyEscaper.Replace(path)+"="+v)
+		}
+	}
+}
+
+// formatValue は整数を integer、float を float として書く。spool を通ると
+// int64 に収まる符号なし整数は int64 に戻るので、unsigned はそれより大きい値にだけ使う
+func formatValue(value interface{}) (string, bool) {
+	var f float64
+	switch v := value.(type) {
+	case int:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case uint:
+		return formatUint(uint64(v)), true
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10) + "i", true
+	case uint64:
+		return formatUint(v), true
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	default:
+		return "", false
+	}
+	// InfluxDB が受け付けない NaN と無限大は捨てる
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), true
+}
+
+func formatUint(v uint64) string {
+	if v > math.MaxInt64 {
+		return strconv.FormatUint(v, 10) + "u"
+	}
+	return strconv.FormatUint(v, 10) + "i"
+}
+
+func toMapStr(v interface{}) (common.MapStr, bool) {
+	switch m := v.(type) {
+	case common.MapStr:
+		return m, true
+	case map[string]interface{}:
+		return common.MapStr(m), true
+	}
+	return nil, false
+}
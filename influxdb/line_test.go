@@ -0,0 +1,167 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package influxdb
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+var timestamp = time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+
+func soraEvent(metricset string, fields common.MapStr) beat.Event {
+	return beat.Event{
+		Timestamp: timestamp,
+		Fields: common.MapStr{
+			"metricset": common.MapStr{
+				"module": "sora",
+				"name":   metricset,
+				"host":   "127.0.0.1:3000",
+			},
+			"sora": common.MapStr{metricset: fields},
+		},
+	}
+}
+
+func encode(config config, events ...beat.Event) string {
+	var buf bytes.Buffer
+	e := newEncoder(config)
+	for i := range events {
+		e.encode(&buf, &events[i])
+	}
+	return buf.String()
+}
+
+func TestEncodeStats(t *testing.T) {
+	event := soraEvent("stats", common.MapStr{
+		"total_ongoing_connections": int64(3),
+		"average_setup_time_msec":   98.5,
+		"version":                   "19.04.0",
+		"erlang_vm": common.MapStr{
+			"memory": map[string]interface{}{"total": uint64(68380480), "max": uint64(math.MaxUint64)},
+			"statistics": common.MapStr{
+				"active_tasks":          []interface{}{1, 0},
+				"run_queue_lengths_max": math.NaN(),
+			},
+		},
+	})
+	assert.Equal(t,
+		"sora_stats,host=127.0.0.1:3000 average_setup_time_msec=98.5,erlang_vm.memory.max=18446744073709551615u,erlang_vm.memory.total=68380480i,total_ongoing_connections=3i 1507593600000000000\n",
+		encode(defaultConfig, event))
+}
+
+func TestEncodeTags(t *testing.T) {
+	connection := soraEvent("connections", common.MapStr{
+		"channel_id":    "room 1,a=b",
+		"client_id":     "c1",
+		"connection_id": "6ZF3DT1Q2D5NHAB1QMFGWP4VAW",
+		"rtp":           common.MapStr{"total_sent_bytes": int64(1024)},
+	})
+	breakdown := soraEvent("stats", common.MapStr{
+		"breakdown": common.MapStr{
+			"type":    "browser",
+			"browser": "chrome",
+			"result":  "successful",
+			"count":   int64(3),
+		},
+	})
+	config := defaultConfig
+	config.Precision = "s"
+	assert.Equal(t,
+		`sora_connections,channel_id=room\ 1\,a\=b,client_id=c1,connection_id=6ZF3DT1Q2D5NHAB1QMFGWP4VAW,host=127.0.0.1:3000 rtp.total_sent_bytes=1024i 1507593600`+"\n"+
+			"sora_stats,breakdown.browser=chrome,breakdown.result=successful,breakdown.type=browser,host=127.0.0.1:3000 breakdown.count=3i 1507593600\n",
+		encode(config, connection, breakdown))
+}
+
+func TestEncodeSharedClientID(t *testing.T) {
+	// Sora 19.04 からは同じ client_id で複数の接続ができる。identity.key が
+	// client_id でも connection_id で別の point にする
+	first := soraEvent("connections", common.MapStr{
+		"channel_id":    "sora",
+		"client_id":     "c1",
+		"connection_id": "6ZF3DT1Q2D5NHAB1QMFGWP4VAW",
+		"identity":      "c1",
+		"rtp":           common.MapStr{"total_sent_bytes": int64(1024)},
+	})
+	second := soraEvent("connections", common.MapStr{
+		"channel_id":    "sora",
+		"client_id":     "c1",
+		"connection_id": "QCEB3Z5YQ94H57VY8N6M8VJCCG",
+		"identity":      "c1",
+		"rtp":           common.MapStr{"total_sent_bytes": int64(2048)},
+	})
+	config := defaultConfig
+	config.Precision = "s"
+	assert.Equal(t,
+		"sora_connections,channel_id=sora,client_id=c1,connection_id=6ZF3DT1Q2D5NHAB1QMFGWP4VAW,host=127.0.0.1:3000,identity=c1 rtp.total_sent_bytes=1024i 1507593600\n"+
+			"sora_connections,channel_id=sora,client_id=c1,connection_id=QCEB3Z5YQ94H57VY8N6M8VJCCG,host=127.0.0.1:3000,identity=c1 rtp.total_sent_bytes=2048i 1507593600\n",
+		encode(config, first, second))
+}
+
+func TestEncodeSkips(t *testing.T) {
+	alert := soraEvent("stats", nil)
+	delete(alert.Fields, "sora")
+	alert.Fields["sora"] = common.MapStr{"alert": common.MapStr{"value": 1.}}
+
+	assert.Empty(t, encode(defaultConfig,
+		// 対象外のメトリックセット
+		soraEvent("client_stats", common.MapStr{"rate": common.MapStr{"nack_count": 1.}}),
+		// 数値のフィールドがない
+		soraEvent("connections", common.MapStr{"channel_id": "sora"}),
+		alert,
+		beat.Event{Timestamp: timestamp, Fields: common.MapStr{"message": "hello"}},
+	))
+
+	config := defaultConfig
+	config.MetricSets = nil
+	config.MeasurementPrefix = ""
+	assert.Equal(t, "client_stats,host=127.0.0.1:3000 rate.nack_count=1 1507593600000000000\n",
+		encode(config, soraEvent("client_stats", common.MapStr{"rate": common.MapStr{"nack_count": 1.}})))
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := defaultConfig
+	valid.URL = "http://localhost:8086"
+	valid.Org = "shiguredo"
+	valid.Bucket = "sora"
+	assert.NoError(t, valid.Validate())
+
+	file := defaultConfig
+	file.File = "/tmp/sora.lp"
+	assert.NoError(t, file.Validate())
+
+	none := defaultConfig
+	assert.Error(t, none.Validate())
+
+	both := valid
+	both.File = "/tmp/sora.lp"
+	assert.Error(t, both.Validate())
+
+	noBucket := valid
+	noBucket.Bucket = ""
+	assert.Error(t, noBucket.Validate())
+
+	precision := valid
+	precision.Precision = "m"
+	assert.Error(t, precision.Validate())
+}
@@ -0,0 +1,353 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/paths"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+// AccountingConfig configures the usage accounting of the connections. It is
+// read from the accounting section of the module configuration.
+type AccountingConfig struct {
+	Enabled bool `config:"enabled"`
+	// Path is the directory the usage of the open hours is saved to.
+	Path string `config:"path"`
+	// MaxGap is the longest interval between two snapshots that counts as
+	// participant time, e.g. not while Sorabeat was stopped.
+	MaxGap time.Duration `config:"max_gap" validate:"positive"`
+}
+
+var defaultAccountingConfig = AccountingConfig{
+	MaxGap: 5 * time.Minute,
+}
+
+// accountingVersion は保存形式が変わったら上げる
+const accountingVersion = 1
+
+// accountingCounters are the byte counters of a connection, the names of
+// Sora 18.10.04 and later first.
+var accountingCounters = map[string][]string{
+	"sent":     {"rtp.total_sent_byte_size", "rtp.total_sent_bytes"},
+	"received": {"rtp.total_received_byte_size", "rtp.total_received_bytes"},
+}
+
+// usage is the usage of a channel in an hour.
+type usage struct {
+	Channel            string    `json:"channel"`
+	Hour               time.Time `json:"hour"`
+	ParticipantSeconds float64   `json:"participant_seconds"`
+	SentBytes          float64   `json:"sent_bytes"`
+	ReceivedBytes      float64   `json:"received_bytes"`
+	PeakConnections    int       `json:"peak_connections"`
+	Samples            int       `json:"samples"`
+}
+
+// snapshotConn is a connection of the previous snapshot.
+type snapshotConn struct {
+	Channel  string  `json:"channel"`
+	Sent     float64 `json:"sent"`
+	Received float64 `json:"received"`
+}
+
+type savedAccounting struct {
+	Version     int                      `json:"version"`
+	Time        time.Time                `json:"time"`
+	Connections map[string]*snapshotConn `json:"connections"`
+	Hours       []*usage                 `json:"hours"`
+}
+
+// Accounting accumulates the usage of each channel per hour from successive
+// snapshots of the connections, and emits a record per channel and hour once
+// the hour is over. The open hours are saved after every snapshot so that a
+// restart neither loses nor counts twice the usage.
+type Accounting struct {
+	mu     sync.Mutex
+	config AccountingConfig
+	host   string
+	file   string
+	now    func() time.Time
+	// 前回のスナップショット
+	time        time.Time
+	connections map[string]*snapshotConn
+	hours       map[string]*usage
+}
+
+// NewAccounting creates the Accounting of a metricset from the module
+// configuration and loads its saved usage. It returns nil when accounting is
+// disabled.
+func NewAccounting(base mb.BaseMetricSet) (*Accounting, error) {
+	config := struct {
+		Accounting AccountingConfig `config:"accounting"`
+	}{
+		Accounting: defaultAccountingConfig,
+	}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	if !config.Accounting.Enabled {
+		return nil, nil
+	}
+	persist, err := Persists(base)
+	if err != nil {
+		return nil, err
+	}
+	// 保存しないときは path を空にする
+	if !persist {
+		config.Accounting.Path = ""
+	} else if config.Accounting.Path == "" {
+		config.Accounting.Path = paths.Resolve(paths.Data, "accounting")
+	}
+	return newAccounting(config.Accounting, base.Name(), base.Host(), time.Now)
+}
+
+func newAccounting(config AccountingConfig, metricset, host string, now func() time.Time) (*Accounting, error) {
+	a := &Accounting{
+		config:      config,
+		host:        host,
+		now:         now,
+		connections: map[string]*snapshotConn{},
+		hours:       map[string]*usage{},
+	}
+	name := metricset
+	if host != "" {
+		name += "-" + unsafeFileChars.ReplaceAllString(host, "_")
+	}
+	if config.Path != "" {
+		a.file = filepath.Join(config.Path, name+".json")
+		if err := a.load(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Observe accounts the connection events of a snapshot and returns a record
+// for each channel and hour that ended before the snapshot.
+func (a *Accounting) Observe(events []common.MapStr) []common.MapStr {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	current := map[string]*snapshotConn{}
+	counts := map[string]int{}
+	for _, event := range events {
+		channelID, ok := event["channel_id"].(string)
+		if !ok {
+			continue
+		}
+		// identity.key が client_id などのときに別の接続の増分を混ぜないよう、
+		// identity ではなく接続ごとに決まるキーを使う
+		id := ConnectionKey(event)
+		conn := &snapshotConn{Channel: channelID}
+		conn.Sent, _ = firstNumber(event, accountingCounters["sent"])
+		conn.Received, _ = firstNumber(event, accountingCounters["received"])
+		current[id] = conn
+		counts[channelID]++
+	}
+
+	// 最初のスナップショットは基準にするだけ
+	if !a.time.IsZero() && now.After(a.time) {
+		interval := now.Sub(a.time)
+		for id, conn := range current {
+			var sent, received, seconds float64
+			if last, ok := a.connections[id]; ok {
+				sent = increase(last.Sent, conn.Sent)
+				received = increase(last.Received, conn.Received)
+				if interval <= a.config.MaxGap {
+					seconds = interval.Seconds()
+				}
+			} else {
+				// 前回の後に接続したので、それまでのバイト数はすべてこの間のもの
+				sent, received = conn.Sent, conn.Received
+			}
+			spread(a.time, now, func(hour time.Time, share float64) {
+				u := a.usage(conn.Channel, hour)
+				u.ParticipantSeconds += seconds * share
+				u.SentBytes += sent * share
+				u.ReceivedBytes += received * share
+			})
+		}
+	}
+	hour := now.Truncate(time.Hour)
+	for channelID, count := range counts {
+		u := a.usage(channelID, hour)
+		if count > u.PeakConnections {
+			u.PeakConnections = count
+		}
+		u.Samples++
+	}
+	a.time = now
+	a.connections = current
+
+	var ended []*usage
+	for key, u := range a.hours {
+		if u.Hour.Before(hour) {
+			ended = append(ended, u)
+			delete(a.hours, key)
+		}
+	}
+	sort.Slice(ended, func(i, j int) bool {
+		if !ended[i].Hour.Equal(ended[j].Hour) {
+			return ended[i].Hour.Before(ended[j].Hour)
+		}
+		return ended[i].Channel < ended[j].Channel
+	})
+	records := make([]common.MapStr, 0, len(ended))
+	for _, u := range ended {
+		records = append(records, a.record(u))
+	}
+
+	if err := a.save(); err != nil {
+		logp.Err("Failed to save accounting to %s: %v", a.file, err)
+	}
+	return records
+}
+
+func (a *Accounting) usage(channelID string, hour time.Time) *usage {
+	key := channelID + "/" + hour.UTC().Format(time.RFC3339)
+	u, ok := a.hours[key]
+	if !ok {
+		u = &usage{Channel: channelID, Hour: hour.UTC()}
+		a.hours[key] = u
+	}
+	return u
+}
+
+// record はホスト、チャネルと時間から決まる ID を付けて、何度送っても同じ
+// ドキュメントになるようにする
+func (a *Accounting) record(u *usage) common.MapStr {
+	hour := u.Hour.Format(time.RFC3339)
+	sum := sha256.Sum256([]byte(a.host + "\n" + u.Channel + "\n" + hour))
+	return common.MapStr{
+		"channel_id": u.Channel,
+		"accounting": common.MapStr{
+			"id":                  hex.EncodeToString(sum[:16]),
+			"hour":                hour,
+			"participant_seconds": u.ParticipantSeconds,
+			"sent_bytes":          int64(u.SentBytes + 0.5),
+			"received_bytes":      int64(u.ReceivedBytes + 0.5),
+			"peak_connections":    int64(u.PeakConnections),
+			"samples":             int64(u.Samples),
+		},
+	}
+}
+
+// increase はカウンタが戻ったときは接続し直したものとして今の値を増分にする
+func increase(last, value float64) float64 {
+	if value < last {
+		return value
+	}
+	return value - last
+}
+
+// spread calls f with each hour overlapping from and to and the share of the
+// interval in that hour.
+func spread(from, to time.Time, f func(hour time.Time, share float64)) {
+	total := to.Sub(from)
+	for start := from; start.Before(to); {
+		hour := start.Truncate(time.Hour)
+		end := hour.Add(time.Hour)
+		if end.After(to) {
+			end = to
+		}
+		f(hour, float64(end.Sub(start))/float64(total))
+		start = end
+	}
+}
+
+func firstNumber(event common.MapStr, fields []string) (float64, bool) {
+	for _, field := range fields {
+		if value, ok := Number(event, field); ok {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+func (a *Accounting) load() error {
+	body, err := ioutil.ReadFile(a.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved savedAccounting
+	if err := json.Unmarshal(body, &saved); err != nil {
+		// 課金に使うので消さずに別の名前で残す
+		logp.Warn("Ignoring unreadable accounting %s: %v", a.file, err)
+		return os.Rename(a.file, a.file+".bad")
+	}
+	if saved.Version != accountingVersion {
+		logp.Warn("Ignoring accounting %s saved in version %d", a.file, saved.Version)
+		return os.Rename(a.file, a.file+".bad")
+	}
+	a.time = saved.Time
+	for id, conn := range saved.Connections {
+		if conn != nil {
+			a.connections[id] = conn
+		}
+	}
+	for _, u := range saved.Hours {
+		if u != nil {
+			a.hours[u.Channel+"/"+u.Hour.UTC().Format(time.RFC3339)] = u
+		}
+	}
+	return nil
+}
+
+// save writes the snapshot and the open hours atomically.
+func (a *Accounting) save() error {
+	if a.file == "" {
+		return nil
+	}
+	saved := savedAccounting{
+		Version:     accountingVersion,
+		Time:        a.time,
+		Connections: a.connections,
+		Hours:       make([]*usage, 0, len(a.hours)),
+	}
+	for _, u := range a.hours {
+		saved.Hours = append(saved.Hours, u)
+	}
+	body, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.file), 0750); err != nil {
+		return err
+	}
+	tmp := a.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.file)
+}
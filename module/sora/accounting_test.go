@@ -0,0 +1,176 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAccounting(t *testing.T, dir string, c *clock) *Accounting {
+	config := defaultAccountingConfig
+	config.Enabled = true
+	config.Path = dir
+	a, err := newAccounting(config, "connections", "localhost:3000", c.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func accountingConn(channelID, connectionID string, sent, received float64) common.MapStr {
+	return common.MapStr{
+		"channel_id":    channelID,
+		"connection_id": connectionID,
+		"rtp": map[string]interface{}{
+			"total_sent_byte_size":     sent,
+			"total_received_byte_size": received,
+		},
+	}
+}
+
+func accountingFields(t *testing.T, records []common.MapStr, i int) common.MapStr {
+	if len(records) <= i {
+		t.Fatalf("no record %d in %v", i, records)
+	}
+	return records[i]["accounting"].(common.MapStr)
+}
+
+func TestAccounting(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c := &clock{t: time.Date(2017, 10, 10, 0, 59, 0, 0, time.UTC)}
+	a := newTestAccounting(t, dir, c)
+
+	assert.Empty(t, a.Observe([]common.MapStr{
+		accountingConn("a", "1", 100, 10),
+		accountingConn("b", "2", 0, 0),
+	}))
+	c.advance(40 * time.Second)
+	// 3 は前回の後に接続した
+	assert.Empty(t, a.Observe([]common.MapStr{
+		accountingConn("a", "1", 200, 20),
+		accountingConn("b", "2", 50, 5),
+		accountingConn("a", "3", 30, 3),
+	}))
+
+	// 01:00 をまたぐ間は時間で按分する
+	c.advance(40 * time.Second)
+	records := a.Observe([]common.MapStr{
+		accountingConn("a", "1", 300, 30),
+		accountingConn("a", "3", 70, 7),
+	})
+	assert.Len(t, records, 2)
+	assert.Equal(t, "a", records[0]["channel_id"])
+	first := accountingFields(t, records, 0)
+	assert.Equal(t, "2017-10-10T00:00:00Z", first["hour"])
+	assert.Equal(t, 80., first["participant_seconds"])
+	assert.Equal(t, int64(200), first["sent_bytes"])
+	assert.Equal(t, int64(20), first["received_bytes"])
+	assert.Equal(t, int64(2), first["peak_connections"])
+	assert.Equal(t, int64(2), first["samples"])
+	assert.Len(t, first["id"], 32)
+
+	assert.Equal(t, "b", records[1]["channel_id"])
+	second := accountingFields(t, records, 1)
+	assert.Equal(t, 40., second["participant_seconds"])
+	assert.Equal(t, int64(50), second["sent_bytes"])
+	assert.Equal(t, int64(1), second["peak_connections"])
+	assert.NotEqual(t, first["id"], second["id"])
+
+	// 再起動しても続きから数え、ID も同じになる
+	a = newTestAccounting(t, dir, c)
+	assert.Equal(t, first["id"], accountingFields(t, []common.MapStr{a.record(&usage{
+		Channel: "a",
+		Hour:    time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC),
+	})}, 0)["id"])
+	c.advance(20 * time.Second)
+	assert.Empty(t, a.Observe([]common.MapStr{accountingConn("a", "1", 310, 31)}))
+
+	// 止まっていた間は参加時間にしないが、バイト数は按分する
+	c.advance(89*time.Minute + 20*time.Second)
+	records = a.Observe([]common.MapStr{accountingConn("a", "1", 410, 41)})
+	assert.Len(t, records, 1)
+	hour := accountingFields(t, records, 0)
+	assert.Equal(t, "2017-10-10T01:00:00Z", hour["hour"])
+	assert.Equal(t, 60., hour["participant_seconds"])
+	assert.Equal(t, int64(70+10+66), hour["sent_bytes"])
+	assert.Equal(t, int64(2), hour["peak_connections"])
+	assert.Equal(t, int64(2), hour["samples"])
+}
+
+func TestAccountingSharedClientID(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	a := newTestAccounting(t, dir, c)
+	// identity.key: client_id のときは identity が同じになる
+	conn := func(channelID, connectionID string, sent float64) common.MapStr {
+		event := accountingConn(channelID, connectionID, sent, 0)
+		event["client_id"] = "c1"
+		event["identity"] = "c1"
+		return event
+	}
+
+	assert.Empty(t, a.Observe([]common.MapStr{
+		conn("a", "1", 1000),
+		conn("a", "2", 10),
+		conn("b", "3", 500),
+	}))
+	c.advance(time.Minute)
+	assert.Empty(t, a.Observe([]common.MapStr{
+		conn("a", "1", 1100),
+		conn("a", "2", 20),
+		conn("b", "3", 600),
+	}))
+	c.advance(time.Hour)
+	records := a.Observe(nil)
+	if assert.Len(t, records, 2) {
+		first := accountingFields(t, records, 0)
+		assert.Equal(t, "a", records[0]["channel_id"])
+		assert.Equal(t, 120., first["participant_seconds"])
+		assert.Equal(t, int64(110), first["sent_bytes"])
+		second := accountingFields(t, records, 1)
+		assert.Equal(t, 60., second["participant_seconds"])
+		assert.Equal(t, int64(100), second["sent_bytes"])
+	}
+
+	// connection_id のない Sora では client_id をチャネルごとに区別する
+	dir2 := tempDir(t)
+	defer os.RemoveAll(dir2)
+	a = newTestAccounting(t, dir2, c)
+	legacy := func(channelID string, sent float64) common.MapStr {
+		event := conn(channelID, "", sent)
+		delete(event, "connection_id")
+		return event
+	}
+	assert.Empty(t, a.Observe([]common.MapStr{legacy("a", 1000), legacy("b", 10)}))
+	c.advance(time.Minute)
+	assert.Empty(t, a.Observe([]common.MapStr{legacy("a", 1100), legacy("b", 20)}))
+	c.advance(time.Hour)
+	records = a.Observe(nil)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, int64(100), accountingFields(t, records, 0)["sent_bytes"])
+		assert.Equal(t, int64(10), accountingFields(t, records, 1)["sent_bytes"])
+	}
+}
@@ -0,0 +1,478 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+// Alert states reported in sora.alert.state.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertConfig configures the threshold alerts. It is read from the alerts
+// section of the module configuration.
+type AlertConfig struct {
+	Rules   []RuleConfig `config:"rules"`
+	Webhook struct {
+		// URL receives a POST with the alert as JSON on every transition.
+		URL     string        `config:"url"`
+		Timeout time.Duration `config:"timeout" validate:"positive"`
+	} `config:"webhook"`
+	// File is appended a line of JSON on every transition.
+	File string `config:"file"`
+	// StateTTL is how long the state of a key that no longer appears in the
+	// events is kept, e.g. of a connection that closed.
+	StateTTL time.Duration `config:"state_ttl" validate:"positive"`
+}
+
+// RuleConfig is a threshold rule over a field of the metricset events.
+type RuleConfig struct {
+	Name string `config:"name" validate:"required"`
+	// MetricSets limits the rule to the events of these metricsets.
+	MetricSets []string `config:"metricsets"`
+	// Condition fires the alert, e.g. "erlang_vm.memory.total > 1073741824".
+	Condition string `config:"condition" validate:"required"`
+	// Resolve resolves the alert. The negation of Condition is used when
+	// empty; a lower threshold gives hysteresis.
+	Resolve string `config:"resolve"`
+	// For is how long Condition must hold before the alert fires.
+	For time.Duration `config:"for"`
+	// Key is a field evaluating the rule separately for each value, e.g.
+	// channel_client_id.
+	Key string `config:"key"`
+}
+
+// Validate checks that the conditions of the rule parse.
+func (c *RuleConfig) Validate() error {
+	if _, err := parseCondition(c.Condition); err != nil {
+		return fmt.Errorf("alert rule %s: %v", c.Name, err)
+	}
+	if c.Resolve != "" {
+		resolve, err := parseCondition(c.Resolve)
+		if err != nil {
+			return fmt.Errorf("alert rule %s: %v", c.Name, err)
+		}
+		// 解消の条件は同じフィールドで判定する
+		if cond, _ := parseCondition(c.Condition); resolve.field != cond.field {
+			return fmt.Errorf("alert rule %s: resolve must use the field %s of the condition", c.Name, cond.field)
+		}
+	}
+	if c.For < 0 {
+		return fmt.Errorf("alert rule %s: for must not be negative", c.Name)
+	}
+	return nil
+}
+
+var defaultAlertConfig = AlertConfig{StateTTL: 10 * time.Minute}
+
+func init() {
+	defaultAlertConfig.Webhook.Timeout = 5 * time.Second
+}
+
+var conditionPattern = regexp.MustCompile(`^\s*([\w.\-]+)\s*(>=|<=|==|!=|>|<)\s*(\S+)\s*$`)
+
+type condition struct {
+	field string
+	op    string
+	value float64
+	text  string
+}
+
+func parseCondition(s string) (*condition, error) {
+	match := conditionPattern.FindStringSubmatch(s)
+	if match == nil {
+		return nil, fmt.Errorf("invalid condition '%s', want '<field> <op> <number>'", s)
+	}
+	value, err := strconv.ParseFloat(match[3], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number in condition '%s': %v", s, err)
+	}
+	return &condition{field: match[1], op: match[2], value: value, text: s}, nil
+}
+
+func (c *condition) match(v float64) bool {
+	switch c.op {
+	case ">":
+		return v > c.value
+	case ">=":
+		return v >= c.value
+	case "<":
+		return v < c.value
+	case "<=":
+		return v <= c.value
+	case "==":
+		return v == c.value
+	case "!=":
+		return v != c.value
+	}
+	return false
+}
+
+type rule struct {
+	config    RuleConfig
+	condition *condition
+	resolve   *condition
+	states    map[string]*alertState
+}
+
+type alertState struct {
+	pending bool
+	firing  bool
+	since   time.Time // 条件を満たし始めた時刻
+	fired   time.Time
+	seen    time.Time
+}
+
+// Alerter evaluates the alert rules against the events of a metricset and
+// returns an event for every firing and resolved transition.
+type Alerter struct {
+	mu        sync.Mutex
+	metricset string
+	host      string
+	rules     []*rule
+	ttl       time.Duration
+	notifier  *notifier
+	now       func() time.Time
+}
+
+// NewAlerter creates the Alerter of a metricset from the module configuration.
+// It has no rules when the module configures none.
+func NewAlerter(base mb.BaseMetricSet) (*Alerter, error) {
+	config := struct {
+		Alerts AlertConfig `config:"alerts"`
+	}{
+		Alerts: defaultAlertConfig,
+	}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	return newAlerter(config.Alerts, base.Name(), base.Host(), time.Now)
+}
+
+func newAlerter(config AlertConfig, metricset, host string, now func() time.Time) (*Alerter, error) {
+	a := &Alerter{
+		metricset: metricset,
+		host:      host,
+		ttl:       config.StateTTL,
+		now:       now,
+	}
+	for _, c := range config.Rules {
+		if len(c.MetricSets) > 0 && !contains(c.MetricSets, metricset) {
+			continue
+		}
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		r := &rule{config: c, states: map[string]*alertState{}}
+		r.condition, _ = parseCondition(c.Condition)
+		if c.Resolve != "" {
+			r.resolve, _ = parseCondition(c.Resolve)
+		}
+		a.rules = append(a.rules, r)
+	}
+	if len(a.rules) > 0 && (config.Webhook.URL != "" || config.File != "") {
+		a.notifier = newNotifier(config.Webhook.URL, config.Webhook.Timeout, config.File)
+	}
+	return a, nil
+}
+
+// Close stops the webhook notifications. The alerts still queued for the
+// webhook are dropped.
+func (a *Alerter) Close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.notifier.close()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate returns an event for each alert transition the events cause, with
+// the alert fields set under mb.ModuleDataKey. The transitions are also sent
+// to the webhook and the file when configured.
+func (a *Alerter) Evaluate(events []common.MapStr) []common.MapStr {
+	if a == nil || len(a.rules) == 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	var alerts []common.MapStr
+	for _, r := range a.rules {
+		for _, event := range events {
+			value, ok := Number(event, r.condition.field)
+			if !ok {
+				continue
+			}
+			key := ""
+			if r.config.Key != "" {
+				k, err := event.GetValue(r.config.Key)
+				if err != nil {
+					continue
+				}
+				key = fmt.Sprint(k)
+			}
+			if alert := a.update(r, key, value, now); alert != nil {
+				alerts = append(alerts, alert)
+			}
+		}
+		alerts = append(alerts, a.expire(r, now)...)
+	}
+
+	events = make([]common.MapStr, 0, len(alerts))
+	for _, alert := range alerts {
+		a.notifier.notify(alert, a.host, now)
+		events = append(events, common.MapStr{mb.ModuleDataKey: alert})
+	}
+	return events
+}
+
+func (a *Alerter) update(r *rule, key string, value float64, now time.Time) common.MapStr {
+	state, ok := r.states[key]
+	if !ok {
+		state = &alertState{}
+		r.states[key] = state
+	}
+	state.seen = now
+
+	if state.firing {
+		resolved := !r.condition.match(value)
+		if r.resolve != nil {
+			resolved = r.resolve.match(value)
+		}
+		if !resolved {
+			return nil
+		}
+		alert := a.alert(r, key, AlertResolved, value, state, now)
+		*state = alertState{seen: now}
+		return alert
+	}
+
+	if !r.condition.match(value) {
+		state.pending = false
+		return nil
+	}
+	if !state.pending {
+		state.pending = true
+		state.since = now
+	}
+	if now.Sub(state.since) < r.config.For {
+		return nil
+	}
+	state.pending = false
+	state.firing = true
+	state.fired = now
+	return a.alert(r, key, AlertFiring, value, state, now)
+}
+
+// expire drops the states of keys that no longer appear, resolving their
+// firing alerts.
+func (a *Alerter) expire(r *rule, now time.Time) []common.MapStr {
+	var keys []string
+	for key, state := range r.states {
+		if now.Sub(state.seen) > a.ttl {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var alerts []common.MapStr
+	for _, key := range keys {
+		state := r.states[key]
+		if state.firing {
+			alert := a.alert(r, key, AlertResolved, 0, state, now)
+			// 値がなくなって解消したので value は入れない
+			delete(alert["alert"].(common.MapStr), "value")
+			alerts = append(alerts, alert)
+		}
+		delete(r.states, key)
+	}
+	return alerts
+}
+
+func (a *Alerter) alert(r *rule, key, state string, value float64, s *alertState, now time.Time) common.MapStr {
+	condition := r.condition.text
+	if state == AlertResolved && r.resolve != nil {
+		condition = r.resolve.text
+	}
+	fields := common.MapStr{
+		"rule":      r.config.Name,
+		"state":     state,
+		"metricset": a.metricset,
+		"field":     r.condition.field,
+		"condition": condition,
+		"value":     value,
+		"since":     s.since.UTC().Format(time.RFC3339Nano),
+	}
+	if key != "" {
+		fields["key"] = key
+	}
+	if state == AlertResolved {
+		fields["duration"] = int64(now.Sub(s.fired) / time.Millisecond)
+	}
+	return common.MapStr{"alert": fields}
+}
+
+var alertDebugf = logp.MakeDebug("sora.alert")
+
+// notifier posts the alerts to the webhook and appends them to the file.
+type notifier struct {
+	url    string
+	file   string
+	client *http.Client
+	// webhook には発生順に 1 件ずつ送る
+	queue   chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// webhook の応答を待つ間に溜める件数
+const alertQueueSize = 100
+
+func newNotifier(url string, timeout time.Duration, file string) *notifier {
+	n := &notifier{
+		url:    url,
+		file:   file,
+		client: &http.Client{Timeout: timeout},
+	}
+	if url != "" {
+		n.queue = make(chan []byte, alertQueueSize)
+		n.done = make(chan struct{})
+		n.stopped = make(chan struct{})
+		go n.run()
+	}
+	return n
+}
+
+func (n *notifier) run() {
+	defer close(n.stopped)
+	for {
+		select {
+		case body := <-n.queue:
+			n.post(body)
+		case <-n.done:
+			if queued := len(n.queue); queued > 0 {
+				logp.Warn("Dropping %d alerts queued for the webhook", queued)
+			}
+			return
+		}
+	}
+}
+
+// close は送信中の webhook を待って止める
+func (n *notifier) close() {
+	if n == nil || n.queue == nil {
+		return
+	}
+	select {
+	case <-n.done:
+	default:
+		close(n.done)
+	}
+	<-n.stopped
+}
+
+// 複数のメトリックセットが同じファイルに書くので行が混ざらないようにする
+var alertFileMu sync.Mutex
+
+func (n *notifier) notify(alert common.MapStr, host string, now time.Time) {
+	if n == nil {
+		return
+	}
+	payload := alert["alert"].(common.MapStr).Clone()
+	payload["@timestamp"] = now.UTC().Format(time.RFC3339Nano)
+	if host != "" {
+		payload["host"] = host
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logp.Err("Failed to encode alert %v: %v", payload["rule"], err)
+		return
+	}
+
+	if n.file != "" {
+		if err := n.write(body); err != nil {
+			logp.Err("Failed to write alert to %s: %v", n.file, err)
+		}
+	}
+	if n.queue != nil {
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+		// 取得を止めないよう webhook は待たない
+		select {
+		case n.queue <- body:
+		default:
+			logp.Err("Alert webhook queue is full, dropping alert %v", payload["rule"])
+		}
+	}
+}
+
+func (n *notifier) write(body []byte) error {
+	alertFileMu.Lock()
+	defer alertFileMu.Unlock()
+
+	f, err := os.OpenFile(n.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(body, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (n *notifier) post(body []byte) {
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logp.Err("Failed to post alert to webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logp.Err("Alert webhook returned HTTP status %d", resp.StatusCode)
+		return
+	}
+	alertDebugf("posted alert %s", body)
+}
@@ -0,0 +1,254 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAlerter(t *testing.T, config AlertConfig, metricset string) (*Alerter, *clock) {
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	a, err := newAlerter(config, metricset, "localhost:3000", c.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, c
+}
+
+func alertConfig(rules ...RuleConfig) AlertConfig {
+	config := defaultAlertConfig
+	config.Rules = rules
+	return config
+}
+
+func memory(total float64) []common.MapStr {
+	return []common.MapStr{{
+		"erlang_vm": map[string]interface{}{
+			"memory": map[string]interface{}{"total": total},
+		},
+	}}
+}
+
+func alertFields(t *testing.T, events []common.MapStr) []common.MapStr {
+	var fields []common.MapStr
+	for _, event := range events {
+		module, ok := event[mb.ModuleDataKey].(common.MapStr)
+		if !assert.True(t, ok) {
+			continue
+		}
+		fields = append(fields, module["alert"].(common.MapStr))
+	}
+	return fields
+}
+
+func TestAlertForAndHysteresis(t *testing.T) {
+	a, c := newTestAlerter(t, alertConfig(RuleConfig{
+		Name:      "memory",
+		Condition: "erlang_vm.memory.total > 1000",
+		Resolve:   "erlang_vm.memory.total < 800",
+		For:       time.Minute,
+	}), "stats")
+
+	assert.Empty(t, a.Evaluate(memory(1500)))
+	c.advance(30 * time.Second)
+	assert.Empty(t, a.Evaluate(memory(1500)))
+	// 続かなければ発火しない
+	c.advance(30 * time.Second)
+	assert.Empty(t, a.Evaluate(memory(900)))
+	c.advance(30 * time.Second)
+	assert.Empty(t, a.Evaluate(memory(1200)))
+	c.advance(time.Minute)
+	fields := alertFields(t, a.Evaluate(memory(1300)))
+	if assert.Len(t, fields, 1) {
+		assert.Equal(t, "memory", fields[0]["rule"])
+		assert.Equal(t, AlertFiring, fields[0]["state"])
+		assert.Equal(t, "stats", fields[0]["metricset"])
+		assert.Equal(t, 1300., fields[0]["value"])
+		assert.Equal(t, "2017-10-10T00:01:30Z", fields[0]["since"])
+	}
+
+	// 閾値を下回っても解消の条件までは firing のまま
+	c.advance(10 * time.Second)
+	assert.Empty(t, a.Evaluate(memory(1300)))
+	assert.Empty(t, a.Evaluate(memory(900)))
+	c.advance(10 * time.Second)
+	fields = alertFields(t, a.Evaluate(memory(700)))
+	if assert.Len(t, fields, 1) {
+		assert.Equal(t, AlertResolved, fields[0]["state"])
+		assert.Equal(t, "erlang_vm.memory.total < 800", fields[0]["condition"])
+		assert.Equal(t, int64(20000), fields[0]["duration"])
+	}
+	assert.Empty(t, a.Evaluate(memory(700)))
+}
+
+func TestAlertKey(t *testing.T) {
+	config := alertConfig(RuleConfig{
+		Name:      "nack",
+		Condition: "rate.nack_count >= 10",
+		Key:       "channel_client_id",
+	})
+	config.StateTTL = time.Minute
+	a, c := newTestAlerter(t, config, "client_stats")
+
+	event := func(id string, nack float64) common.MapStr {
+		return common.MapStr{"channel_client_id": id, "rate": common.MapStr{"nack_count": nack}}
+	}
+	fields := alertFields(t, a.Evaluate([]common.MapStr{event("sora/a", 20), event("sora/b", 1), {"rate": common.MapStr{"nack_count": 50.}}}))
+	if assert.Len(t, fields, 1) {
+		assert.Equal(t, "sora/a", fields[0]["key"])
+	}
+	fields = alertFields(t, a.Evaluate([]common.MapStr{event("sora/b", 15)}))
+	if assert.Len(t, fields, 1) {
+		assert.Equal(t, "sora/b", fields[0]["key"])
+	}
+
+	// 現れなくなったキーは解消して忘れる
+	c.advance(45 * time.Second)
+	assert.Empty(t, a.Evaluate([]common.MapStr{event("sora/b", 15)}))
+	c.advance(30 * time.Second)
+	fields = alertFields(t, a.Evaluate([]common.MapStr{event("sora/b", 15)}))
+	if assert.Len(t, fields, 1) {
+		assert.Equal(t, "sora/a", fields[0]["key"])
+		assert.Equal(t, AlertResolved, fields[0]["state"])
+		assert.NotContains(t, fields[0], "value")
+	}
+	assert.Len(t, a.rules[0].states, 1)
+}
+
+func TestAlertMetricSets(t *testing.T) {
+	config := alertConfig(RuleConfig{
+		Name:       "memory",
+		MetricSets: []string{"stats"},
+		Condition:  "erlang_vm.memory.total > 1000",
+	})
+	a, _ := newTestAlerter(t, config, "connections")
+	assert.Empty(t, a.rules)
+	assert.Nil(t, a.Evaluate(memory(2000)))
+
+	var none *Alerter
+	assert.Nil(t, none.Evaluate(memory(2000)))
+}
+
+func TestAlertNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sorabeat-alert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	posted := make(chan map[string]interface{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		posted <- body
+	}))
+	defer server.Close()
+
+	config := alertConfig(RuleConfig{Name: "memory", Condition: "erlang_vm.memory.total > 1000"})
+	config.Webhook.URL = server.URL
+	config.File = filepath.Join(dir, "alerts.json")
+	a, _ := newTestAlerter(t, config, "stats")
+
+	a.Evaluate(memory(2000))
+	a.Evaluate(memory(10))
+
+	for _, state := range []string{AlertFiring, AlertResolved} {
+		select {
+		case body := <-posted:
+			assert.Equal(t, state, body["state"])
+			assert.Equal(t, "localhost:3000", body["host"])
+			assert.Equal(t, "2017-10-10T00:00:00Z", body["@timestamp"])
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook was not called")
+		}
+	}
+
+	data, err := ioutil.ReadFile(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 2) {
+		var alert map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &alert))
+		assert.Equal(t, AlertResolved, alert["state"])
+		assert.Equal(t, "memory", alert["rule"])
+	}
+}
+
+func TestRuleConfigValidate(t *testing.T) {
+	valid := RuleConfig{Name: "r", Condition: "a.b > 1", Resolve: "a.b <= 0.5", For: time.Second}
+	assert.NoError(t, valid.Validate())
+
+	for _, c := range []RuleConfig{
+		{Name: "r", Condition: "a.b"},
+		{Name: "r", Condition: "a.b > x"},
+		{Name: "r", Condition: "a.b > 1", Resolve: "a.c < 1"},
+		{Name: "r", Condition: "a.b > 1", For: -time.Second},
+	} {
+		assert.Error(t, c.Validate(), "%v", c)
+	}
+
+	_, err := newAlerter(alertConfig(RuleConfig{Name: "r", Condition: "a.b >> 1"}), "stats", "", time.Now)
+	assert.Error(t, err)
+}
+
+func TestAlertClose(t *testing.T) {
+	posted := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- struct{}{}
+	}))
+	defer server.Close()
+
+	config := alertConfig(RuleConfig{Name: "memory", Condition: "erlang_vm.memory.total > 1000"})
+	config.Webhook.URL = server.URL
+	a, _ := newTestAlerter(t, config, "stats")
+
+	a.Evaluate(memory(2000))
+	select {
+	case <-posted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+
+	// 閉じたあとは webhook に送らない
+	a.Close()
+	a.Close()
+	a.Evaluate(memory(10))
+	select {
+	case <-posted:
+		t.Fatal("webhook was called after Close")
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case <-a.notifier.stopped:
+	default:
+		t.Fatal("notifier is still running")
+	}
+}
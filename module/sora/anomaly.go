@@ -0,0 +1,511 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/paths"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+// AnomalyConfig configures the anomaly detection. It is read from the
+// anomaly section of the module configuration.
+type AnomalyConfig struct {
+	Enabled bool `config:"enabled"`
+	// Path is the directory the models are saved to.
+	Path string `config:"path"`
+	// Series are the series to learn. DefaultAnomalySeries is used when empty.
+	Series []SeriesConfig `config:"series"`
+	// Alpha is the EWMA smoothing factor; larger values forget faster.
+	Alpha float64 `config:"alpha" validate:"positive"`
+	// Season is the period of the seasonal pattern, split into Buckets
+	// buckets that each learn their own baseline.
+	Season  time.Duration `config:"season" validate:"positive"`
+	Buckets int           `config:"buckets" validate:"min=1"`
+	// Warmup is the number of samples a bucket learns before it scores.
+	Warmup int `config:"warmup" validate:"min=0"`
+	// Threshold is the score above which a sample is anomalous.
+	Threshold float64 `config:"threshold" validate:"positive"`
+	// MaxKeys bounds the keys learnt per series.
+	MaxKeys int `config:"max_keys" validate:"min=1"`
+	// SaveInterval is how often the models are written to disk.
+	SaveInterval time.Duration `config:"save_interval" validate:"positive"`
+}
+
+// SeriesConfig is a series learnt from a numeric field of the metricset events.
+type SeriesConfig struct {
+	Name       string   `config:"name" validate:"required"`
+	MetricSets []string `config:"metricsets"`
+	Field      string   `config:"field" validate:"required"`
+	// Fallbacks are read when the event has no Field, e.g. the names of the
+	// field in older Sora releases.
+	Fallbacks []string `config:"fallbacks"`
+	// Key learns a series for each value of the field, e.g. channel_id. The
+	// values of the events with the same key are summed.
+	Key string `config:"key"`
+	// Rate learns the per second rate of a counter instead of its value.
+	// The increases are computed per connection before they are summed, so
+	// that connections joining or leaving are not counted as traffic.
+	Rate bool `config:"rate"`
+}
+
+// value returns the value of the field of the series in the event.
+func (s SeriesConfig) value(event common.MapStr) (float64, bool) {
+	if value, ok := Number(event, s.Field); ok {
+		return value, true
+	}
+	return firstNumber(event, s.Fallbacks)
+}
+
+// Validate checks the anomaly detection configuration.
+func (c *AnomalyConfig) Validate() error {
+	if c.Alpha >= 1 {
+		return errors.New("anomaly.alpha must be smaller than 1")
+	}
+	if c.Season%time.Duration(c.Buckets) != 0 {
+		return errors.New("anomaly.season must be a multiple of anomaly.buckets")
+	}
+	return nil
+}
+
+// DefaultAnomalySeries are the series learnt when none are configured.
+var DefaultAnomalySeries = []SeriesConfig{
+	{Name: "ongoing_connections", MetricSets: []string{"stats"}, Field: "total_ongoing_connections"},
+	{Name: "average_setup_time", MetricSets: []string{"stats"}, Field: "average_setup_time_msec"},
+	{Name: "erlang_vm_memory", MetricSets: []string{"stats"}, Field: "erlang_vm.memory.total"},
+	{
+		Name:       "channel_sent_bytes",
+		MetricSets: []string{"connections"},
+		// Sora 18.10.04 で名前が変わった
+		Field:     "rtp.total_sent_byte_size",
+		Fallbacks: []string{"rtp.total_sent_bytes"},
+		Key:       "channel_id",
+		Rate:      true,
+	},
+}
+
+var defaultAnomalyConfig = AnomalyConfig{
+	Alpha:        0.1,
+	Season:       24 * time.Hour,
+	Buckets:      24,
+	Warmup:       10,
+	Threshold:    3,
+	MaxKeys:      1000,
+	SaveInterval: time.Minute,
+}
+
+// modelVersion は保存形式が変わったら上げる
+const modelVersion = 1
+
+// bucket is the EWMA baseline of a season bucket.
+type bucket struct {
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+	Count    int     `json:"count"`
+}
+
+// model is the seasonal baseline of a series and key.
+type model struct {
+	Buckets []bucket `json:"buckets"`
+}
+
+// counters are the values of the counters of a rate series in the previous
+// snapshot, by key and connection.
+type counters struct {
+	time   time.Time
+	values map[string]float64
+}
+
+type savedModels struct {
+	Version int               `json:"version"`
+	Season  time.Duration     `json:"season"`
+	Buckets int               `json:"buckets"`
+	Models  map[string]*model `json:"models"`
+}
+
+// Detector learns seasonal EWMA baselines of series of a metricset and
+// scores each new sample against the baseline of its bucket.
+type Detector struct {
+	mu     sync.Mutex
+	config AnomalyConfig
+	series []SeriesConfig
+	file   string
+	models map[string]*model
+	keys   map[string]int
+	// rate の系列ごとの前回のカウンタ。保存はしない
+	counters map[string]*counters
+	saved    time.Time
+	now      func() time.Time
+}
+
+// NewDetector creates the Detector of a metricset from the module
+// configuration and loads its saved models. It returns nil when anomaly
+// detection is disabled or no series applies to the metricset.
+func NewDetector(base mb.BaseMetricSet) (*Detector, error) {
+	config := struct {
+		Anomaly AnomalyConfig `config:"anomaly"`
+	}{
+		Anomaly: defaultAnomalyConfig,
+	}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	if !config.Anomaly.Enabled {
+		return nil, nil
+	}
+	persist, err := Persists(base)
+	if err != nil {
+		return nil, err
+	}
+	// 保存しないときは path を空にする
+	if !persist {
+		config.Anomaly.Path = ""
+	} else if config.Anomaly.Path == "" {
+		config.Anomaly.Path = paths.Resolve(paths.Data, "anomaly")
+	}
+	return newDetector(config.Anomaly, base.Name(), base.Host(), time.Now)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.\-]+`)
+
+func newDetector(config AnomalyConfig, metricset, host string, now func() time.Time) (*Detector, error) {
+	series := config.Series
+	if len(series) == 0 {
+		series = DefaultAnomalySeries
+	}
+	d := &Detector{
+		config:   config,
+		models:   map[string]*model{},
+		keys:     map[string]int{},
+		counters: map[string]*counters{},
+		now:      now,
+	}
+	for _, s := range series {
+		if len(s.MetricSets) == 0 || contains(s.MetricSets, metricset) {
+			d.series = append(d.series, s)
+		}
+	}
+	if len(d.series) == 0 {
+		return nil, nil
+	}
+
+	// ホストごとにモデルを分ける
+	name := metricset
+	if host != "" {
+		name += "-" + unsafeFileChars.ReplaceAllString(host, "_")
+	}
+	if config.Path != "" {
+		d.file = filepath.Join(config.Path, name+".json")
+		if err := d.load(); err != nil {
+			return nil, err
+		}
+	}
+	d.saved = now()
+	return d, nil
+}
+
+// Observe learns the samples of the events and returns an event for each
+// scored sample, with the anomaly fields set under mb.ModuleDataKey.
+func (d *Detector) Observe(events []common.MapStr) []common.MapStr {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	var results []common.MapStr
+	for _, s := range d.series {
+		var values map[string]float64
+		var order []string
+		if s.Rate {
+			values, order = d.rates(s, events, now)
+		} else {
+			values, order = sum(s, events)
+		}
+		for _, key := range order {
+			if fields := d.observe(s, key, values[key], now); fields != nil {
+				results = append(results, common.MapStr{
+					mb.ModuleDataKey: common.MapStr{"anomaly": fields},
+				})
+			}
+		}
+	}
+
+	if now.Sub(d.saved) >= d.config.SaveInterval {
+		if err := d.save(); err != nil {
+			logp.Err("Failed to save anomaly models to %s: %v", d.file, err)
+		}
+		d.saved = now
+	}
+	return results
+}
+
+// sum はキーごとに値を合計する
+func sum(s SeriesConfig, events []common.MapStr) (map[string]float64, []string) {
+	values := map[string]float64{}
+	var order []string
+	for _, event := range events {
+		value, ok := s.value(event)
+		if !ok {
+			continue
+		}
+		key, ok := s.key(event)
+		if !ok {
+			continue
+		}
+		if _, ok := values[key]; !ok {
+			order = append(order, key)
+		}
+		values[key] += value
+	}
+	sort.Strings(order)
+	return values, order
+}
+
+func (s SeriesConfig) key(event common.MapStr) (string, bool) {
+	if s.Key == "" {
+		return "", true
+	}
+	k, err := event.GetValue(s.Key)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprint(k), true
+}
+
+// isConnection reports whether the event is about a connection.
+func isConnection(event common.MapStr) bool {
+	for _, field := range []string{"connection_id", "client_id"} {
+		if id, _ := event[field].(string); id != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// rates returns the per second increase of the counters of each key since
+// the previous snapshot. The increases of the connection events are summed
+// per ConnectionKey, skipping the connections seen for the first time and
+// counting the current value of a counter that went back. The other events
+// are summed per key first and the key is skipped when the sum went back,
+// e.g. because a connection left.
+func (d *Detector) rates(s SeriesConfig, events []common.MapStr, now time.Time) (map[string]float64, []string) {
+	current := &counters{time: now, values: map[string]float64{}}
+	identified := map[string]bool{}
+	keys := map[string]string{}
+	for _, event := range events {
+		value, ok := s.value(event)
+		if !ok {
+			continue
+		}
+		key, ok := s.key(event)
+		if !ok {
+			continue
+		}
+		// identity.key が client_id などのときに別の接続のカウンタを混ぜないよう、
+		// identity ではなく接続ごとに決まるキーを使う
+		connection := ""
+		if isConnection(event) {
+			connection = ConnectionKey(event)
+		}
+		id := key + "\n" + connection
+		current.values[id] += value
+		identified[id] = connection != ""
+		keys[id] = key
+	}
+	last := d.counters[s.Name]
+	d.counters[s.Name] = current
+	if last == nil {
+		return nil, nil
+	}
+	seconds := now.Sub(last.time).Seconds()
+	if seconds <= 0 {
+		return nil, nil
+	}
+
+	increases := map[string]float64{}
+	skipped := map[string]bool{}
+	for id, value := range current.values {
+		previous, ok := last.values[id]
+		if !ok {
+			continue
+		}
+		key := keys[id]
+		switch {
+		case identified[id]:
+			increases[key] += increase(previous, value)
+		case value < previous:
+			skipped[key] = true
+		default:
+			increases[key] += value - previous
+		}
+	}
+	values := map[string]float64{}
+	var order []string
+	for key, increase := range increases {
+		if skipped[key] {
+			continue
+		}
+		values[key] = increase / seconds
+		order = append(order, key)
+	}
+	sort.Strings(order)
+	return values, order
+}
+
+func (d *Detector) observe(s SeriesConfig, key string, value float64, now time.Time) common.MapStr {
+	// 有限でない値でモデルを作ると max_keys を使ってしまうので先に捨てる
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return nil
+	}
+
+	id := s.Name + "/" + key
+	m, ok := d.models[id]
+	if !ok {
+		if d.keys[s.Name] >= d.config.MaxKeys {
+			return nil
+		}
+		d.keys[s.Name]++
+		m = &model{Buckets: make([]bucket, d.config.Buckets)}
+		d.models[id] = m
+	}
+
+	i := d.bucketIndex(now)
+	b := &m.Buckets[i]
+	fields := common.MapStr{
+		"series": s.Name,
+		"field":  s.Field,
+		"value":  value,
+		"bucket": i,
+	}
+	if key != "" {
+		fields["key"] = key
+	}
+	// 学習する前の基準で評価する
+	if b.Count >= d.config.Warmup {
+		stddev := math.Sqrt(b.Variance)
+		score := math.Abs(value-b.Mean) / math.Max(stddev, minStddev(b.Mean))
+		fields["baseline"] = b.Mean
+		fields["stddev"] = stddev
+		fields["score"] = score
+		fields["anomalous"] = score >= d.config.Threshold
+	}
+	b.update(value, d.config.Alpha)
+	return fields
+}
+
+// minStddev は変化のない系列で小さな揺れを異常としないための下限
+func minStddev(mean float64) float64 {
+	return math.Max(math.Abs(mean)*0.01, 1e-6)
+}
+
+func (b *bucket) update(value, alpha float64) {
+	if b.Count == 0 {
+		b.Mean = value
+		b.Count = 1
+		return
+	}
+	diff := value - b.Mean
+	incr := alpha * diff
+	b.Mean += incr
+	b.Variance = (1 - alpha) * (b.Variance + diff*incr)
+	b.Count++
+}
+
+func (d *Detector) bucketIndex(now time.Time) int {
+	width := d.config.Season / time.Duration(d.config.Buckets)
+	offset := time.Duration(now.UnixNano()) % d.config.Season
+	return int(offset / width)
+}
+
+func (d *Detector) load() error {
+	body, err := ioutil.ReadFile(d.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved savedModels
+	if err := json.Unmarshal(body, &saved); err != nil {
+		// 壊れたモデルは学習し直す
+		logp.Warn("Discarding unreadable anomaly models %s: %v", d.file, err)
+		return nil
+	}
+	if saved.Version != modelVersion || saved.Season != d.config.Season || saved.Buckets != d.config.Buckets {
+		logp.Info("Discarding anomaly models %s learnt with another season", d.file)
+		return nil
+	}
+	for id, m := range saved.Models {
+		if m == nil || len(m.Buckets) != d.config.Buckets {
+			continue
+		}
+		d.models[id] = m
+		for _, s := range d.series {
+			if len(id) > len(s.Name) && id[:len(s.Name)+1] == s.Name+"/" {
+				d.keys[s.Name]++
+			}
+		}
+	}
+	return nil
+}
+
+// save writes the models atomically.
+func (d *Detector) save() error {
+	if d.file == "" {
+		return nil
+	}
+	body, err := json.Marshal(savedModels{
+		Version: modelVersion,
+		Season:  d.config.Season,
+		Buckets: d.config.Buckets,
+		Models:  d.models,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.file), 0750); err != nil {
+		return err
+	}
+	tmp := d.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.file)
+}
+
+// Save writes the models to disk, e.g. before shutdown.
+func (d *Detector) Save() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.save()
+}
@@ -0,0 +1,326 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/shiguredo/sorabeat/module/sora/soratest"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sorabeat-anomaly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func testAnomalyConfig(dir string) AnomalyConfig {
+	config := defaultAnomalyConfig
+	config.Enabled = true
+	config.Path = dir
+	return config
+}
+
+func newTestDetector(t *testing.T, config AnomalyConfig, metricset string, c *clock) *Detector {
+	d, err := newDetector(config, metricset, "localhost:3000", c.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func anomalyFields(events []common.MapStr) []common.MapStr {
+	var fields []common.MapStr
+	for _, event := range events {
+		fields = append(fields, event[mb.ModuleDataKey].(common.MapStr)["anomaly"].(common.MapStr))
+	}
+	return fields
+}
+
+func connectionsEvent(connections float64) []common.MapStr {
+	return []common.MapStr{{"total_ongoing_connections": connections}}
+}
+
+// daily は 1 日周期で増減する接続数に揺らぎを加えた合成データ
+func daily(t time.Time, r *rand.Rand) float64 {
+	hour := float64(t.Hour()) + float64(t.Minute())/60
+	return 1000 + 500*math.Sin(2*math.Pi*hour/24) + r.NormFloat64()*20
+}
+
+func TestDetectorSeasonalSeries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	d := newTestDetector(t, testAnomalyConfig(dir), "stats", c)
+	r := rand.New(rand.NewSource(1))
+
+	// 1 週間分を 10 分ごとに学習する
+	for i := 0; i < 7*24*6; i++ {
+		d.Observe(connectionsEvent(daily(c.t, r)))
+		c.advance(10 * time.Minute)
+	}
+
+	// 周期的な増減は異常にしない
+	anomalous := 0
+	for i := 0; i < 24*6; i++ {
+		fields := anomalyFields(d.Observe(connectionsEvent(daily(c.t, r))))
+		if assert.Len(t, fields, 1) && fields[0]["anomalous"].(bool) {
+			anomalous++
+		}
+		c.advance(10 * time.Minute)
+	}
+	assert.True(t, anomalous <= 2, "%d anomalous samples", anomalous)
+
+	// 夜中に昼のピークの値が来たら異常
+	c.t = time.Date(2017, 10, 18, 18, 0, 0, 0, time.UTC)
+	fields := anomalyFields(d.Observe(connectionsEvent(1500)))
+	if assert.Len(t, fields, 1) {
+		assert.Equal(t, "ongoing_connections", fields[0]["series"])
+		assert.Equal(t, 18, fields[0]["bucket"])
+		assert.True(t, fields[0]["anomalous"].(bool))
+		assert.True(t, fields[0]["score"].(float64) > 10, "score %v", fields[0]["score"])
+		assert.InDelta(t, 500, fields[0]["baseline"], 50)
+	}
+}
+
+func TestDetectorWarmup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := testAnomalyConfig(dir)
+	config.Warmup = 3
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	d := newTestDetector(t, config, "stats", c)
+
+	for i := 0; i < 3; i++ {
+		fields := anomalyFields(d.Observe(connectionsEvent(10)))
+		assert.NotContains(t, fields[0], "score")
+		c.advance(time.Minute)
+	}
+	// 変化のない系列でも小さな揺れは異常にしない
+	fields := anomalyFields(d.Observe(connectionsEvent(10.05)))
+	assert.Equal(t, false, fields[0]["anomalous"])
+	fields = anomalyFields(d.Observe(connectionsEvent(20)))
+	assert.Equal(t, true, fields[0]["anomalous"])
+}
+
+func TestDetectorKeyedRate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := testAnomalyConfig(dir)
+	config.MaxKeys = 2
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	d := newTestDetector(t, config, "connections", c)
+
+	conn := func(channel string, bytes float64) common.MapStr {
+		return common.MapStr{"channel_id": channel, "rtp": map[string]interface{}{"total_sent_bytes": bytes}}
+	}
+	assert.Empty(t, d.Observe([]common.MapStr{conn("a", 100), conn("a", 100), conn("b", 10)}))
+
+	c.advance(10 * time.Second)
+	fields := anomalyFields(d.Observe([]common.MapStr{conn("a", 600), conn("a", 600), conn("b", 110), conn("c", 5)}))
+	if assert.Len(t, fields, 2) {
+		assert.Equal(t, "a", fields[0]["key"])
+		// 同じチャネルの接続は合計する
+		assert.Equal(t, 100., fields[0]["value"])
+		assert.Equal(t, "b", fields[1]["key"])
+		assert.Equal(t, 10., fields[1]["value"])
+	}
+
+	// 接続が減って合計が戻ったときは評価しない
+	c.advance(10 * time.Second)
+	fields = anomalyFields(d.Observe([]common.MapStr{conn("a", 700), conn("b", 210)}))
+	if assert.Len(t, fields, 1) {
+		assert.Equal(t, "b", fields[0]["key"])
+	}
+}
+
+func TestDetectorRateSharedClientID(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	d := newTestDetector(t, testAnomalyConfig(dir), "connections", c)
+	identity := &Identity{key: IdentityClient}
+	conn := func(connectionID string, bytes float64) common.MapStr {
+		event := common.MapStr{
+			"channel_id":    "sora",
+			"client_id":     "sora-client",
+			"connection_id": connectionID,
+			"rtp":           map[string]interface{}{"total_sent_byte_size": bytes},
+		}
+		identity.Annotate(event)
+		return event
+	}
+	assert.Empty(t, d.Observe([]common.MapStr{conn("a", 1000), conn("b", 100)}))
+
+	// 同じ client_id の接続が入れ替わってもカウンタが戻ったとは見なさない
+	c.advance(10 * time.Second)
+	fields := anomalyFields(d.Observe([]common.MapStr{conn("b", 200), conn("c", 10)}))
+	if assert.Len(t, fields, 1) {
+		assert.Equal(t, 10., fields[0]["value"])
+	}
+}
+
+func TestDetectorChannelSentBytes(t *testing.T) {
+	for _, version := range []string{"18.10.04", "19.04"} {
+		t.Run(version, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+			d := newTestDetector(t, testAnomalyConfig(dir), "connections", c)
+			connections := func() []common.MapStr {
+				body, err := soratest.Fixture(version, soratest.GetStatsAllConnections)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var events []common.MapStr
+				if err := json.Unmarshal(body, &events); err != nil {
+					t.Fatal(err)
+				}
+				identity := &Identity{key: IdentityAuto}
+				for _, event := range events {
+					identity.Annotate(event)
+				}
+				return events
+			}
+
+			// 最後の接続は途中から参加する
+			before := connections()
+			joined := len(before) - 1
+			assert.Empty(t, d.Observe(before[:joined]))
+
+			after := connections()
+			sent := 0.
+			for i, event := range after[:joined] {
+				rtp := event["rtp"].(map[string]interface{})
+				rtp["total_sent_byte_size"] = rtp["total_sent_byte_size"].(float64) + float64(1000*(i+1))
+				sent += float64(1000 * (i + 1))
+			}
+			c.advance(10 * time.Second)
+			fields := anomalyFields(d.Observe(after))
+			if assert.Len(t, fields, 1) {
+				assert.Equal(t, "channel_sent_bytes", fields[0]["series"])
+				assert.Equal(t, "sorabeat", fields[0]["key"])
+				// 参加した接続の送信量は含めない
+				assert.Equal(t, sent/10, fields[0]["value"])
+			}
+
+			// 接続が抜けても送信量は減らない
+			c.advance(10 * time.Second)
+			fields = anomalyFields(d.Observe(after[1:]))
+			if assert.Len(t, fields, 1) {
+				assert.Equal(t, 0., fields[0]["value"])
+			}
+		})
+	}
+}
+
+func TestDetectorNonFinite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	d := newTestDetector(t, testAnomalyConfig(dir), "stats", c)
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		assert.Empty(t, d.Observe(connectionsEvent(value)))
+	}
+	// 有限でない値だけの系列はモデルを作らず max_keys も使わない
+	assert.Empty(t, d.models)
+	assert.Empty(t, d.keys)
+}
+
+func TestDetectorPersistence(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := testAnomalyConfig(dir)
+	config.Warmup = 5
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	d := newTestDetector(t, config, "stats", c)
+	for i := 0; i < 5; i++ {
+		d.Observe(connectionsEvent(100))
+	}
+	c.advance(time.Minute)
+	d.Observe(connectionsEvent(100))
+	_, err := os.Stat(filepath.Join(dir, "stats-localhost_3000.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, d.Save())
+
+	// 再起動しても学習した基準で評価する
+	d = newTestDetector(t, config, "stats", c)
+	fields := anomalyFields(d.Observe(connectionsEvent(100)))
+	assert.Equal(t, 100., fields[0]["baseline"])
+
+	// 周期の設定が変わったら学習し直す
+	config.Buckets = 12
+	d = newTestDetector(t, config, "stats", c)
+	fields = anomalyFields(d.Observe(connectionsEvent(100)))
+	assert.NotContains(t, fields[0], "baseline")
+
+	// 壊れたファイルも学習し直す
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "stats-localhost_3000.json"), []byte("{"), 0600))
+	d = newTestDetector(t, config, "stats", c)
+	assert.NotNil(t, d)
+}
+
+func TestDetectorSeries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	config := testAnomalyConfig(dir)
+	assert.Nil(t, newTestDetector(t, config, "connection_detail", c))
+
+	config.Series = []SeriesConfig{{Name: "rtt", Field: "candidate_pair.current_round_trip_time"}}
+	d := newTestDetector(t, config, "connection_detail", c)
+	if assert.NotNil(t, d) {
+		assert.Len(t, d.series, 1)
+	}
+
+	var none *Detector
+	assert.Nil(t, none.Observe(connectionsEvent(1)))
+	assert.NoError(t, none.Save())
+}
+
+func TestAnomalyConfigValidate(t *testing.T) {
+	config := defaultAnomalyConfig
+	assert.NoError(t, config.Validate())
+
+	config.Alpha = 1
+	assert.Error(t, config.Validate())
+
+	config = defaultAnomalyConfig
+	config.Buckets = 7
+	config.Season = time.Hour + time.Nanosecond
+	assert.Error(t, config.Validate())
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_stats
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/metricbeat/mb"
+
+	"github.com/shiguredo/sorabeat/module/sora"
+)
+
+// init registers the MetricSet with the central registry.
+// The New method will be called after the setup of the module and before starting to fetch data
+func init() {
+	if err := mb.Registry.AddMetricSet("sora", "client_stats", New); err != nil {
+		panic(err)
+	}
+}
+
+var debugf = logp.MakeDebug("sora.client_stats")
+
+type config struct {
+	ClientStats struct {
+		// Listen is the address of the HTTP listener receiving the reports.
+		Listen string `config:"listen"`
+		// Path is the HTTP path Sora posts the reports to.
+		Path string `config:"path"`
+		// MaxBodySize limits the size of a request body in bytes.
+		MaxBodySize int64 `config:"max_body_size" validate:"min=1"`
+		// StateTTL is how long the previous report of a client is kept to
+		// compute rates.
+		StateTTL time.Duration `config:"state_ttl" validate:"positive"`
+	} `config:"client_stats"`
+}
+
+func defaultConfig() config {
+	c := config{}
+	c.ClientStats.Listen = "127.0.0.1:5080"
+	c.ClientStats.Path = "/client_stats"
+	c.ClientStats.MaxBodySize = 1024 * 1024
+	c.ClientStats.StateTTL = 5 * time.Minute
+	return c
+}
+
+// MetricSet receives the RTCStatsReport Sora forwards from the clients and
+// reports an event for each supported report.
+type MetricSet struct {
+	mb.BaseMetricSet
+	webhook  *sora.Webhook
+	rates    *rates
+	features *sora.Features
+
+	// reporter の Event は並行に呼べないのでリクエストをまたいで直列にする
+	mu       sync.Mutex
+	reporter mb.Reporter
+}
+
+// New create a new instance of the MetricSet
+// Part of new is also setting up the configuration by processing additional
+// configuration entries if needed.
+func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
+	config := defaultConfig()
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	// ホストごとに listen すると 2 つめが失敗するので、ホストが 1 つ以下のモジュールに限る
+	if hosts := len(base.Module().Config().Hosts); hosts > 1 {
+		return nil, fmt.Errorf("client_stats requires a module with at most one host, got %d hosts; configure client_stats in its own module without hosts", hosts)
+	}
+
+	features, err := sora.NewFeatures(base)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MetricSet{
+		BaseMetricSet: base,
+		rates:         newRates(config.ClientStats.StateTTL),
+		features:      features,
+	}
+	c := config.ClientStats
+	m.webhook, err = sora.NewWebhook("client_stats", c.Listen, c.Path, c.MaxBodySize, func() interface{} {
+		return &message{}
+	}, m.handle)
+	if err != nil {
+		features.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Run serves the webhook until the reporter is done.
+func (m *MetricSet) Run(r mb.PushReporter) {
+	m.mu.Lock()
+	m.reporter = r
+	m.mu.Unlock()
+
+	if err := m.webhook.Run(r.Done()); err != nil {
+		r.Error(err)
+	}
+}
+
+// Close closes the webhook in case Run was never called, stops the alert
+// notifications and saves the anomaly models.
+func (m *MetricSet) Close() error {
+	err := m.webhook.Close()
+	if ferr := m.features.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// handle reports the messages of a request.
+func (m *MetricSet) handle(messages []interface{}) {
+	now := time.Now()
+	for _, msg := range messages {
+		msg := *msg.(*message)
+		if err := m.report(msg, now); err != nil {
+			debugf("dropping client stats of %v/%v: %v", msg.ChannelID, msg.ClientID, err)
+		}
+	}
+}
+
+var errNoClient = errors.New("channel_id or client_id is missing")
+
+func (m *MetricSet) report(msg message, now time.Time) error {
+	if msg.ChannelID == "" || msg.ClientID == "" {
+		return errNoClient
+	}
+
+	// channel_client_id を作る前に置き換える
+	msg.ClientID = m.features.Pseudonym.Hash("client_id", msg.ClientID)
+	msg.ConnectionID = m.features.Pseudonym.Hash("connection_id", msg.ConnectionID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, stats := range msg.Stats {
+		m.features.Pseudonym.Apply(stats)
+		event := normalize(msg, stats)
+		if event == nil {
+			continue
+		}
+		m.features.Identity.Annotate(event)
+		m.rates.apply(event, stats, now)
+		events := m.features.Process([]common.MapStr{event})
+		for _, event := range events {
+			if m.reporter != nil && !m.reporter.Event(event) {
+				return errors.New("metricset is closing")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package client_stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+type reporter struct {
+	events []common.MapStr
+}
+
+func (r *reporter) Event(event common.MapStr) bool {
+	r.events = append(r.events, event)
+	return true
+}
+func (r *reporter) ErrorWith(err error, meta common.MapStr) bool { return true }
+func (r *reporter) Error(err error) bool                         { return true }
+
+func readMessage(t *testing.T) []byte {
+	body, err := ioutil.ReadFile("testdata/stats.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func newTestMetricSet(t *testing.T) (*MetricSet, *reporter) {
+	ms := mbtest.NewPushMetricSet(t, getConfig()).(*MetricSet)
+	r := &reporter{}
+	ms.reporter = r
+	return ms, r
+}
+
+func post(ms *MetricSet, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ms.webhook.ServeHTTP(w, httptest.NewRequest("POST", "/client_stats", strings.NewReader(body)))
+	return w
+}
+
+func TestNormalize(t *testing.T) {
+	var msg message
+	if err := json.Unmarshal(readMessage(t), &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []common.MapStr
+	for _, stats := range msg.Stats {
+		if event := normalize(msg, stats); event != nil {
+			events = append(events, event)
+		}
+	}
+	// codec, transport と使われていない候補のペアは捨てる
+	if !assert.Len(t, events, 4) {
+		t.FailNow()
+	}
+
+	event := events[0]
+	assert.Equal(t, "sorabeat/f43ca35b-f0a3-460f-81e4-851a4a41ff9b", event["channel_client_id"])
+	assert.Equal(t, "6ZF3DT1Q2D5NHAB1QMFGWP4VAW", event["connection_id"])
+	assert.Equal(t, common.MapStr{
+		"ssrc":                int64(1234),
+		"kind":                "video",
+		"codec_id":            "RTCCodec_0_Inbound_96",
+		"packets_received":    int64(1200),
+		"packets_lost":        int64(3),
+		"bytes_received":      int64(1347136),
+		"jitter":              0.012,
+		"frames_received":     int64(300),
+		"frames_decoded":      int64(298),
+		"frames_dropped":      int64(2),
+		"frames_per_second":   30.,
+		"nack_count":          int64(1),
+		"pli_count":           int64(0),
+		"fir_count":           int64(0),
+		"jitter_buffer_delay": 12.5,
+	}, event["inbound_rtp"])
+
+	rtt, _ := events[2].GetValue("remote_inbound_rtp.round_trip_time")
+	assert.Equal(t, 0.042, rtt)
+	state, _ := events[3].GetValue("candidate_pair.state")
+	assert.Equal(t, "succeeded", state)
+
+	// 型の合わない値は捨てる
+	event = normalize(msg, map[string]interface{}{"type": "inbound-rtp", "id": "x", "jitter": "high", "packetsLost": 1.})
+	assert.Equal(t, common.MapStr{"packets_lost": int64(1)}, event["inbound_rtp"])
+}
+
+func TestRates(t *testing.T) {
+	r := newRates(time.Minute)
+	now := time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+	msg := message{ChannelID: "sora", ClientID: "a"}
+	stats := func(timestamp, bytes float64) map[string]interface{} {
+		return map[string]interface{}{"type": "inbound-rtp", "id": "in", "timestamp": timestamp, "bytesReceived": bytes, "packetsLost": 2.}
+	}
+
+	event := normalize(msg, stats(1000, 100))
+	r.apply(event, stats(1000, 100), now)
+	assert.Nil(t, event["rate"])
+
+	event = normalize(msg, stats(3000, 1100))
+	r.apply(event, stats(3000, 1100), now)
+	assert.Equal(t, common.MapStr{"interval": int64(2000), "bytes_received": 500., "packets_lost": 0.}, event["rate"])
+
+	// 別のクライアントとは混ざらない
+	other := normalize(message{ChannelID: "sora", ClientID: "b"}, stats(4000, 5000))
+	r.apply(other, stats(4000, 5000), now)
+	assert.Nil(t, other["rate"])
+
+	// カウンタが戻ったときはその値を出さない
+	event = normalize(msg, stats(4000, 10))
+	r.apply(event, stats(4000, 10), now)
+	assert.Equal(t, common.MapStr{"interval": int64(1000), "packets_lost": 0.}, event["rate"])
+
+}
+
+func TestRatesSharedClientID(t *testing.T) {
+	r := newRates(time.Minute)
+	now := time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+	stats := func(timestamp, bytes float64) map[string]interface{} {
+		return map[string]interface{}{"type": "inbound-rtp", "id": "in", "timestamp": timestamp, "bytesReceived": bytes}
+	}
+	apply := func(connectionID string, timestamp, bytes float64) common.MapStr {
+		msg := message{ChannelID: "sora", ClientID: "a", ConnectionID: connectionID}
+		event := normalize(msg, stats(timestamp, bytes))
+		// identity.key: client_id のときの identity
+		event["identity"] = "a"
+		r.apply(event, stats(timestamp, bytes), now)
+		return event
+	}
+
+	// identity が同じでも接続ごとに計算する
+	apply("x", 1000, 100)
+	apply("y", 1000, 5000)
+	event := apply("x", 2000, 300)
+	assert.Equal(t, common.MapStr{"interval": int64(1000), "bytes_received": 200.}, event["rate"])
+	event = apply("y", 2000, 5100)
+	assert.Equal(t, common.MapStr{"interval": int64(1000), "bytes_received": 100.}, event["rate"])
+}
+
+func TestRatesSweep(t *testing.T) {
+	r := newRates(time.Minute)
+	now := time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+	stats := map[string]interface{}{"type": "candidate-pair", "id": "pair", "state": "succeeded", "bytesSent": 1.}
+
+	r.apply(normalize(message{ChannelID: "sora", ClientID: "a"}, stats), stats, now)
+	r.apply(normalize(message{ChannelID: "sora", ClientID: "b"}, stats), stats, now.Add(30*time.Second))
+	assert.Len(t, r.previous, 2)
+
+	r.apply(normalize(message{ChannelID: "sora", ClientID: "b"}, stats), stats, now.Add(2*time.Minute))
+	assert.Len(t, r.previous, 1)
+	_, ok := r.previous["sora/b/pair"]
+	assert.True(t, ok)
+}
+
+func TestServeHTTP(t *testing.T) {
+	ms, r := newTestMetricSet(t)
+	defer ms.Close()
+
+	w := post(ms, string(readMessage(t)))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Len(t, r.events, 4)
+
+	// ログから転送するときのように 1 行 1 メッセージでも受け付ける
+	lines := `{"channel_id": "sora", "client_id": "a", "stats": [{"type": "outbound-rtp", "id": "out", "timestamp": 1000, "bytesSent": 100}]}
+{"channel_id": "sora", "client_id": "a", "stats": [{"type": "outbound-rtp", "id": "out", "timestamp": 2000, "bytesSent": 300}]}
+{"channel_id": "", "client_id": "a", "stats": [{"type": "outbound-rtp", "id": "out", "timestamp": 2000, "bytesSent": 300}]}
+`
+	r.events = nil
+	w = post(ms, lines)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	if assert.Len(t, r.events, 2) {
+		rate, _ := r.events[1].GetValue("rate.bytes_sent")
+		assert.Equal(t, 200., rate)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, post(ms, `{"channel_id": `).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(ms, `{"channel_id": "`+strings.Repeat("a", 10000)+`"}`).Code)
+
+	w = httptest.NewRecorder()
+	ms.webhook.ServeHTTP(w, httptest.NewRequest("GET", "/client_stats", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestRun(t *testing.T) {
+	ms := mbtest.NewPushMetricSet(t, getConfig())
+	url := "http://" + ms.(*MetricSet).webhook.Addr().String() + "/client_stats"
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(url, "application/json", bytes.NewReader(readMessage(t)))
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	events, errs := mbtest.RunPushMetricSet(500*time.Millisecond, ms)
+	assert.Empty(t, errs)
+	assert.Equal(t, http.StatusNoContent, <-status)
+	assert.Len(t, events, 4)
+}
+
+func TestData(t *testing.T) {
+	ms, r := newTestMetricSet(t)
+	defer ms.Close()
+
+	post(ms, string(readMessage(t)))
+	if len(r.events) == 0 {
+		t.Fatal("no events")
+	}
+	mbtest.WriteEventToDataJSON(t, mbtest.CreateFullEvent(ms, r.events[0]))
+}
+
+func TestListenSingleHost(t *testing.T) {
+	config := getConfig()
+	config["hosts"] = []string{"127.0.0.1:3000", "127.0.0.2:3000"}
+	c, err := common.NewConfigFrom(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = mb.NewModule(c, mb.Registry)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "client_stats requires a module with at most one host")
+	}
+}
+
+func getConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"module":                     "sora",
+		"metricsets":                 []string{"client_stats"},
+		"client_stats.listen":        "127.0.0.1:0",
+		"client_stats.max_body_size": 8192,
+		"client_stats.state_ttl":     "1m",
+	}
+}
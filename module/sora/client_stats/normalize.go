@@ -0,0 +1,244 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_stats
+
+import (
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+
+	"github.com/shiguredo/sorabeat/module/sora"
+)
+
+// message is a client stats message forwarded by Sora.
+type message struct {
+	Type         string                   `json:"type"`
+	ChannelID    string                   `json:"channel_id"`
+	ClientID     string                   `json:"client_id"`
+	ConnectionID string                   `json:"connection_id"`
+	Stats        []map[string]interface{} `json:"stats"`
+}
+
+type fieldType int
+
+const (
+	typeLong fieldType = iota
+	typeFloat
+	typeKeyword
+)
+
+// reportFields are the fields kept for each report type. Other report types
+// and fields are dropped so that the mapping stays stable whatever the
+// browser reports.
+var reportFields = map[string]map[string]fieldType{
+	"inbound-rtp": {
+		"ssrc":              typeLong,
+		"kind":              typeKeyword,
+		"codecId":           typeKeyword,
+		"packetsReceived":   typeLong,
+		"packetsLost":       typeLong,
+		"bytesReceived":     typeLong,
+		"jitter":            typeFloat,
+		"framesReceived":    typeLong,
+		"framesDecoded":     typeLong,
+		"framesDropped":     typeLong,
+		"framesPerSecond":   typeFloat,
+		"nackCount":         typeLong,
+		"pliCount":          typeLong,
+		"firCount":          typeLong,
+		"jitterBufferDelay": typeFloat,
+	},
+	"outbound-rtp": {
+		"ssrc":                     typeLong,
+		"kind":                     typeKeyword,
+		"codecId":                  typeKeyword,
+		"packetsSent":              typeLong,
+		"bytesSent":                typeLong,
+		"retransmittedPacketsSent": typeLong,
+		"framesEncoded":            typeLong,
+		"framesSent":               typeLong,
+		"framesPerSecond":          typeFloat,
+		"nackCount":                typeLong,
+		"pliCount":                 typeLong,
+		"firCount":                 typeLong,
+		"targetBitrate":            typeFloat,
+		"qualityLimitationReason":  typeKeyword,
+	},
+	"remote-inbound-rtp": {
+		"ssrc":               typeLong,
+		"kind":               typeKeyword,
+		"codecId":            typeKeyword,
+		"packetsLost":        typeLong,
+		"jitter":             typeFloat,
+		"fractionLost":       typeFloat,
+		"roundTripTime":      typeFloat,
+		"totalRoundTripTime": typeFloat,
+	},
+	"candidate-pair": {
+		"state":                    typeKeyword,
+		"bytesSent":                typeLong,
+		"bytesReceived":            typeLong,
+		"currentRoundTripTime":     typeFloat,
+		"totalRoundTripTime":       typeFloat,
+		"availableOutgoingBitrate": typeFloat,
+		"availableIncomingBitrate": typeFloat,
+		"requestsSent":             typeLong,
+		"responsesReceived":        typeLong,
+	},
+}
+
+// rateFields are the counters of each report type turned into per second rates.
+var rateFields = map[string][]string{
+	"inbound-rtp":        {"packetsReceived", "packetsLost", "bytesReceived", "framesDecoded", "framesDropped", "nackCount"},
+	"outbound-rtp":       {"packetsSent", "bytesSent", "framesEncoded", "nackCount"},
+	"remote-inbound-rtp": {"packetsLost"},
+	"candidate-pair":     {"bytesSent", "bytesReceived"},
+}
+
+// normalize converts a RTCStats of the message into an event, or returns nil
+// when the report is not supported.
+func normalize(msg message, stats map[string]interface{}) common.MapStr {
+	if stats == nil {
+		return nil
+	}
+	reportType, _ := stats["type"].(string)
+	fields, ok := reportFields[reportType]
+	if !ok {
+		return nil
+	}
+	// 使われていない候補のペアは数が多いので選ばれたものだけにする
+	if reportType == "candidate-pair" && stats["state"] != "succeeded" {
+		return nil
+	}
+
+	values := common.MapStr{}
+	for key, typ := range fields {
+		if v, ok := convert(stats[key], typ); ok {
+			values[sora.SnakeCase(key)] = v
+		}
+	}
+
+	event := common.MapStr{
+		"channel_id":        msg.ChannelID,
+		"client_id":         msg.ClientID,
+		"channel_client_id": msg.ChannelID + "/" + msg.ClientID,
+		"report": common.MapStr{
+			"type": reportType,
+			"id":   stats["id"],
+		},
+		strings.Replace(reportType, "-", "_", -1): values,
+	}
+	if msg.ConnectionID != "" {
+		event["connection_id"] = msg.ConnectionID
+	}
+	return event
+}
+
+// convert は型が合わない値を捨てる
+func convert(value interface{}, typ fieldType) (interface{}, bool) {
+	switch typ {
+	case typeLong:
+		if v, ok := value.(float64); ok {
+			return int64(v), true
+		}
+	case typeFloat:
+		if v, ok := value.(float64); ok {
+			return v, true
+		}
+	case typeKeyword:
+		if v, ok := value.(string); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// rates keeps the previous counters of each report to compute per second
+// rates, keyed by sora.ConnectionKey and report ID.
+type rates struct {
+	ttl       time.Duration
+	previous  map[string]sample
+	lastSweep time.Time
+}
+
+type sample struct {
+	timestamp float64 // ミリ秒
+	counters  map[string]float64
+	received  time.Time
+}
+
+func newRates(ttl time.Duration) *rates {
+	return &rates{
+		ttl:      ttl,
+		previous: map[string]sample{},
+	}
+}
+
+// apply adds the rates since the previous report to the event. The report
+// timestamp is used when the client sent one, the receive time otherwise.
+func (r *rates) apply(event common.MapStr, stats map[string]interface{}, now time.Time) {
+	reportType, _ := stats["type"].(string)
+	counters := map[string]float64{}
+	for _, key := range rateFields[reportType] {
+		if v, ok := stats[key].(float64); ok {
+			counters[key] = v
+		}
+	}
+	timestamp, ok := stats["timestamp"].(float64)
+	if !ok {
+		timestamp = float64(now.UnixNano()) / float64(time.Millisecond)
+	}
+
+	// identity.key が client_id などのときに別の接続のカウンタを混ぜないよう、
+	// identity ではなく接続ごとに決まるキーを使う
+	id, _ := stats["id"].(string)
+	key := sora.ConnectionKey(event) + "/" + id
+	prev, found := r.previous[key]
+	r.previous[key] = sample{timestamp: timestamp, counters: counters, received: now}
+	r.sweep(now)
+
+	if !found || timestamp <= prev.timestamp {
+		return
+	}
+	seconds := (timestamp - prev.timestamp) / 1000
+	rate := common.MapStr{}
+	for key, v := range counters {
+		last, ok := prev.counters[key]
+		// 再接続などでカウンタが戻ったときは出さない
+		if !ok || v < last {
+			continue
+		}
+		rate[sora.SnakeCase(key)] = (v - last) / seconds
+	}
+	if len(rate) == 0 {
+		return
+	}
+	rate["interval"] = int64(timestamp - prev.timestamp)
+	event["rate"] = rate
+}
+
+// sweep は切断されたクライアントの状態を捨てる
+func (r *rates) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.ttl {
+		return
+	}
+	r.lastSweep = now
+	for key, s := range r.previous {
+		if now.Sub(s.received) > r.ttl {
+			delete(r.previous, key)
+		}
+	}
+}
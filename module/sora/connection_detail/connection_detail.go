@@ -0,0 +1,306 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connection_detail
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/metricbeat/helper"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/elastic/beats/metricbeat/mb/parse"
+
+	"github.com/shiguredo/sorabeat/module/sora"
+)
+
+// init registers the MetricSet with the central registry.
+// The New method will be called after the setup of the module and before starting to fetch data
+func init() {
+	if err := mb.Registry.AddMetricSet("sora", "connection_detail", New, hostParser); err != nil {
+		panic(err)
+	}
+}
+
+const (
+	defaultScheme = "http"
+	httpPath      = "/"
+
+	listTarget   = "Sora_20171101.GetStatsAllConnections"
+	detailTarget = "Sora_20171101.GetStatsConnection"
+)
+
+var (
+	hostParser = parse.URLHostParserBuilder{
+		DefaultScheme: defaultScheme,
+		DefaultPath:   httpPath,
+	}.Build()
+
+	debugf = logp.MakeDebug("sora.connection_detail")
+
+	// イベントにする getStats のレポートの種類
+	reportTypes = map[string]bool{
+		"inbound-rtp":    true,
+		"outbound-rtp":   true,
+		"candidate-pair": true,
+		"codec":          true,
+	}
+
+	// 通信量の比較に使う rtp のフィールド。Sora 18.10.04 で名前が変わった
+	trafficKeys = []string{
+		"total_received_byte_size", "total_sent_byte_size",
+		"total_received_bytes", "total_sent_bytes",
+	}
+)
+
+type config struct {
+	ConnectionDetail struct {
+		// Channels selects connections whose channel_id matches one of the
+		// regular expressions. All channels are selected when empty.
+		Channels []string `config:"channels"`
+		// Top limits the selection to the connections with the most traffic.
+		// Zero selects all of them.
+		Top int `config:"top" validate:"min=0"`
+	} `config:"connection_detail"`
+}
+
+// MetricSet type defines all fields of the MetricSet
+// As a minimum it must inherit the mb.BaseMetricSet fields, but can be extended with
+// additional entries. These variables can be used to persist data or configuration between
+// multiple fetch calls.
+type MetricSet struct {
+	mb.BaseMetricSet
+	list     *sora.Target
+	detail   *helper.HTTP
+	fetcher  *sora.Fetcher
+	channels []*regexp.Regexp
+	top      int
+	features *sora.Features
+}
+
+// New create a new instance of the MetricSet
+// Part of new is also setting up the configuration by processing additional
+// configuration entries if needed.
+func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
+	config := config{}
+	config.ConnectionDetail.Top = 10
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+
+	var channels []*regexp.Regexp
+	for _, pattern := range config.ConnectionDetail.Channels {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connection_detail.channels pattern '%s': %v", pattern, err)
+		}
+		channels = append(channels, re)
+	}
+
+	// 一覧は connections メトリックセットと同じ応答を使う
+	fetcher, err := sora.FetcherOf(base)
+	if err != nil {
+		return nil, err
+	}
+	list, err := fetcher.Target(base, listTarget)
+	if err != nil {
+		fetcher.Close()
+		return nil, err
+	}
+
+	features, err := sora.NewFeatures(base)
+	if err != nil {
+		list.Close()
+		fetcher.Close()
+		return nil, err
+	}
+
+	return &MetricSet{
+		BaseMetricSet: base,
+		list:          list,
+		detail:        sora.NewHTTP(base, detailTarget),
+		fetcher:       fetcher,
+		channels:      channels,
+		top:           config.ConnectionDetail.Top,
+		features:      features,
+	}, nil
+}
+
+// Fetch lists the connections, selects the configured subset and returns an
+// event for each getStats report of the selected connections.
+func (m *MetricSet) Fetch() ([]common.MapStr, error) {
+	return m.features.Fetch(m.fetch, nil)
+}
+
+// Close stops the alert notifications, releases the fetcher and saves the
+// anomaly models.
+func (m *MetricSet) Close() error {
+	m.list.Close()
+	m.fetcher.Close()
+	return m.features.Close()
+}
+
+func (m *MetricSet) fetch(scrape *sora.Scrape) ([]common.MapStr, error) {
+	connections, err := m.list.FetchList(scrape)
+	if err != nil {
+		return nil, err
+	}
+	scrape.Connections = len(connections)
+
+	selected := m.selectConnections(connections)
+	events := []common.MapStr{}
+	failed := 0
+	for _, conn := range selected {
+		reports, err := m.fetchReports(scrape, conn)
+		if err != nil {
+			// 一覧を取ってから切断された接続はエラーになるので飛ばす
+			debugf("skipping connection %v of channel %v: %v", conn["client_id"], conn["channel_id"], err)
+			failed++
+			if failed == len(selected) {
+				return nil, err
+			}
+			continue
+		}
+		// Sora への問い合わせには元の ID が要るので、取得した後で置き換える
+		m.features.Pseudonym.Apply(conn)
+		for _, report := range reports {
+			m.features.Pseudonym.Apply(report)
+			if event := reportEvent(conn, report); event != nil {
+				m.features.Identity.Annotate(event)
+				events = append(events, event)
+			}
+		}
+	}
+	return events, nil
+}
+
+// selectConnections returns the connections matching the channel patterns,
+// limited to the top connections by traffic.
+func (m *MetricSet) selectConnections(connections []common.MapStr) []common.MapStr {
+	var selected []common.MapStr
+	for _, conn := range connections {
+		if conn == nil {
+			continue
+		}
+		channelID, _ := conn["channel_id"].(string)
+		if len(m.channels) > 0 && !matchAny(m.channels, channelID) {
+			continue
+		}
+		selected = append(selected, conn)
+	}
+
+	if m.top > 0 && len(selected) > m.top {
+		// 通信量が同じときは一覧の順を保つ
+		sort.SliceStable(selected, func(i, j int) bool {
+			return traffic(selected[i]) > traffic(selected[j])
+		})
+		selected = selected[:m.top]
+	}
+	return selected
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func traffic(conn common.MapStr) float64 {
+	rtp, _ := conn["rtp"].(map[string]interface{})
+	total := 0.0
+	for _, key := range trafficKeys {
+		if v, ok := rtp[key].(float64); ok {
+			total += v
+		}
+	}
+	return total
+}
+
+func (m *MetricSet) fetchReports(scrape *sora.Scrape, conn common.MapStr) ([]map[string]interface{}, error) {
+	request := map[string]interface{}{
+		"channel_id": conn["channel_id"],
+	}
+	// Sora 19.04 から接続は connection_id で識別する
+	if connectionID, ok := conn["connection_id"]; ok {
+		request["connection_id"] = connectionID
+	} else {
+		request["client_id"] = conn["client_id"]
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	m.detail.SetBody(body)
+
+	content, err := m.fetcher.Fetch(scrape, m.detail)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []map[string]interface{}
+	if err := scrape.Decode(content, &reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// reportEvent flattens a getStats report into an event. The report fields
+// are put under the report type, e.g. inbound_rtp.bytes_received. Reports of
+// other types and non scalar values are dropped.
+func reportEvent(conn common.MapStr, report map[string]interface{}) common.MapStr {
+	if report == nil {
+		return nil
+	}
+	reportType, _ := report["type"].(string)
+	if !reportTypes[reportType] {
+		return nil
+	}
+
+	values := common.MapStr{}
+	for key, value := range report {
+		switch key {
+		case "type", "id", "timestamp":
+			continue
+		}
+		switch value.(type) {
+		case float64, string, bool:
+			values[sora.SnakeCase(key)] = value
+		}
+	}
+
+	channelID, _ := conn["channel_id"].(string)
+	clientID, _ := conn["client_id"].(string)
+	event := common.MapStr{
+		"channel_id":        channelID,
+		"client_id":         clientID,
+		"channel_client_id": channelID + "/" + clientID,
+		"report": common.MapStr{
+			"type": reportType,
+			"id":   report["id"],
+		},
+		strings.Replace(reportType, "-", "_", -1): values,
+	}
+	if connectionID, ok := conn["connection_id"].(string); ok {
+		event["connection_id"] = connectionID
+	}
+	return event
+}
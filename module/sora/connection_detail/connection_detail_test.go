@@ -0,0 +1,261 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package connection_detail
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
+
+	"github.com/shiguredo/sorabeat/module/sora"
+	"github.com/shiguredo/sorabeat/module/sora/soratest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchEventContents(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	server.OnRequest(soratest.RequireTarget(t, soratest.GetStatsAllConnections, soratest.GetStatsConnection))
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// 3 接続それぞれの transport 以外の 5 レポート
+	assert.Equal(t, 15, len(events))
+	assert.Equal(t, 3, server.RequestCount(soratest.GetStatsConnection))
+
+	event := events[2]
+	assert.Equal(t, "sorabeat", event["channel_id"])
+	assert.Equal(t, "f43ca35b-f0a3-460f-81e4-851a4a41ff9b", event["client_id"])
+	assert.Equal(t, "6ZF3DT1Q2D5NHAB1QMFGWP4VAW", event["connection_id"])
+	assert.Equal(t, "sorabeat/f43ca35b-f0a3-460f-81e4-851a4a41ff9b", event["channel_client_id"])
+
+	reportType, _ := event.GetValue("report.type")
+	assert.Equal(t, "inbound-rtp", reportType)
+	bytesReceived, _ := event.GetValue("inbound_rtp.bytes_received")
+	assert.Equal(t, 1347136., bytesReceived)
+	codecID, _ := event.GetValue("inbound_rtp.codec_id")
+	assert.Equal(t, "RTCCodec_0_Inbound_96", codecID)
+	_, err = event.GetValue("inbound_rtp.timestamp")
+	assert.Error(t, err)
+
+	for _, e := range events {
+		reportType, _ := e.GetValue("report.type")
+		assert.NotEqual(t, "transport", reportType)
+	}
+}
+
+func TestSelectByChannel(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	config := getConfig(server.URL)
+	config["connection_detail.channels"] = []string{"^live-"}
+	f := mbtest.NewEventsFetcher(t, config)
+	events, err := f.Fetch()
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	assert.Equal(t, 0, server.RequestCount(soratest.GetStatsConnection))
+
+	config["connection_detail.channels"] = []string{"^live-", "^sora"}
+	f = mbtest.NewEventsFetcher(t, config)
+	events, err = f.Fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, 15, len(events))
+}
+
+func TestSelectTopByTraffic(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	server.SetFixture(soratest.GetStatsAllConnections, []byte(`[
+		{"channel_id": "a", "client_id": "small", "connection_id": "1", "rtp": {"total_sent_byte_size": 10}},
+		{"channel_id": "b", "client_id": "large", "connection_id": "2", "rtp": {"total_sent_byte_size": 10, "total_received_byte_size": 1000}},
+		{"channel_id": "c", "client_id": "legacy", "rtp": {"total_sent_bytes": 100}}
+	]`))
+
+	config := getConfig(server.URL)
+	config["connection_detail.top"] = 2
+	f := mbtest.NewEventsFetcher(t, config)
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, 10, len(events))
+
+	var bodies []map[string]interface{}
+	for _, r := range server.Requests() {
+		if r.Target == soratest.GetStatsConnection {
+			var body map[string]interface{}
+			json.Unmarshal(r.Body, &body)
+			bodies = append(bodies, body)
+		}
+	}
+	assert.Equal(t, []map[string]interface{}{
+		{"channel_id": "b", "connection_id": "2"},
+		{"channel_id": "c", "client_id": "legacy"},
+	}, bodies)
+}
+
+func TestFetchPseudonymize(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	config := getConfig(server.URL)
+	config["pseudonymize.enabled"] = true
+	config["pseudonymize.key"] = "0123456789abcdef0123456789abcdef"
+	f := mbtest.NewEventsFetcher(t, config)
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) || !assert.NotEmpty(t, events) {
+		t.FailNow()
+	}
+	for _, event := range events {
+		assert.NotEqual(t, "f43ca35b-f0a3-460f-81e4-851a4a41ff9b", event["client_id"])
+		assert.Equal(t, "sorabeat/"+event["client_id"].(string), event["channel_client_id"])
+	}
+
+	// Sora には元の ID で問い合わせる
+	for _, r := range server.Requests() {
+		if r.Target == soratest.GetStatsConnection {
+			var body map[string]interface{}
+			json.Unmarshal(r.Body, &body)
+			assert.Len(t, body["connection_id"], 26)
+		}
+	}
+}
+
+func TestFetchSkipsFailedConnections(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	server.Inject(soratest.GetStatsConnection, soratest.Fault{Status: 400, Times: 1})
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	events, err := f.Fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(events))
+
+	// すべて失敗したときはエラーにする
+	server.Inject(soratest.GetStatsConnection, soratest.Fault{Status: 503})
+	_, err = f.Fetch()
+	assert.Error(t, err)
+}
+
+func TestFetchUnsupportedSora(t *testing.T) {
+	server := soratest.NewServer(t, "18.10.04")
+	defer server.Close()
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	_, err := f.Fetch()
+	assert.Error(t, err)
+}
+
+func TestFetchGolden(t *testing.T) {
+	for _, version := range soratest.Versions() {
+		if _, err := soratest.Fixture(version, soratest.GetStatsConnection); err != nil {
+			continue
+		}
+		t.Run(version, func(t *testing.T) {
+			server := soratest.NewServer(t, version)
+			defer server.Close()
+
+			f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+			events, err := f.Fetch()
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			soratest.AssertGolden(t, version, soratest.WithoutServer(events))
+		})
+	}
+}
+
+func TestData(t *testing.T) {
+	versions := soratest.Versions()
+	server := soratest.NewServer(t, versions[len(versions)-1])
+	defer server.Close()
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	events, err := f.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ホストはテストのたびに変わるのでサンプルでは固定する
+	fullEvent := mbtest.CreateFullEvent(f, events[2])
+	fullEvent.Fields.Put("metricset.host", "localhost:3000")
+	mbtest.WriteEventToDataJSON(t, fullEvent)
+}
+
+func getConfig(host string) map[string]interface{} {
+	return map[string]interface{}{
+		"module":     "sora",
+		"metricsets": []string{"connection_detail"},
+		"hosts":      []string{host},
+	}
+}
+
+func TestFetchSharesList(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	host := server.Listener.Addr().String()
+
+	first := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	second := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	_, err := first.Fetch()
+	assert.NoError(t, err)
+	sora.ScrapesOf(host).Collect()
+
+	// 同じ周期の一覧は取得し直さない
+	_, err = second.Fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.RequestCount(soratest.GetStatsAllConnections))
+	assert.Equal(t, 6, server.RequestCount(soratest.GetStatsConnection))
+	scrapes := sora.ScrapesOf(host).Collect()
+	if assert.Len(t, scrapes, 1) {
+		assert.Equal(t, true, scrapes[0]["shared"])
+	}
+
+	// 一度使った応答は使わない
+	_, err = first.Fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.RequestCount(soratest.GetStatsAllConnections))
+}
+
+func TestFetchRateLimit(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	host := server.Listener.Addr().String()
+
+	config := getConfig(server.URL)
+	config["fetch.rate_limit"] = 100
+	config["fetch.burst"] = 1
+	f := mbtest.NewEventsFetcher(t, config)
+	start := time.Now()
+	_, err := f.Fetch()
+	assert.NoError(t, err)
+
+	// 一覧と 3 接続の 4 リクエストのうち 3 つが最大 10ms ずつ待つ
+	scrapes := sora.ScrapesOf(host).Collect()
+	if assert.Len(t, scrapes, 1) {
+		wait, _ := scrapes[0]["wait_msec"].(float64)
+		assert.True(t, wait > 0 && wait <= 30, "wait_msec %v", wait)
+		assert.True(t, time.Since(start) >= time.Duration(wait*float64(time.Millisecond)))
+	}
+}
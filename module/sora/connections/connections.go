@@ -15,13 +15,13 @@
 package connections
 
 import (
-	"encoding/json"
-	"io/ioutil"
+	"time"
 
 	"github.com/elastic/beats/libbeat/common"
-	"github.com/elastic/beats/metricbeat/helper"
 	"github.com/elastic/beats/metricbeat/mb"
 	"github.com/elastic/beats/metricbeat/mb/parse"
+
+	"github.com/shiguredo/sorabeat/module/sora"
 )
 
 // init registers the MetricSet with the central registry.
@@ -33,11 +33,9 @@ func init() {
 }
 
 const (
-	defaultScheme     = "http"
-	httpPath          = "/"
-	httpMethod        = "POST"
-	targetHeaderKey   = "x-sora-target"
-	targetHeaderValue = "Sora_20171101.GetStatsAllConnections"
+	defaultScheme = "http"
+	httpPath      = "/"
+	target        = "Sora_20171101.GetStatsAllConnections"
 )
 
 var (
@@ -53,56 +51,111 @@ var (
 // multiple fetch calls.
 type MetricSet struct {
 	mb.BaseMetricSet
-	http *helper.HTTP
+	target   *sora.Target
+	features *sora.Features
+	accounts *sora.Accounting
+	rollup   *rollup
+	raw      bool
+}
+
+type config struct {
+	Rollup rollupConfig `config:"rollup"`
 }
 
 // New create a new instance of the MetricSet
 // Part of new is also setting up the configuration by processing additional
 // configuration entries if needed.
 func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
-	config := struct{}{}
+	config := config{Rollup: defaultRollupConfig}
 
 	if err := base.Module().UnpackConfig(&config); err != nil {
 		return nil, err
 	}
 
-	http := helper.NewHTTP(base)
-	http.SetMethod(httpMethod)
-	http.SetHeader(targetHeaderKey, targetHeaderValue)
-	return &MetricSet{
+	accounts, err := sora.NewAccounting(base)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := sora.NewTarget(base, target)
+	if err != nil {
+		return nil, err
+	}
+
+	features, err := sora.NewFeatures(base)
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+
+	m := &MetricSet{
 		BaseMetricSet: base,
-		http:          http,
-	}, nil
+		target:        target,
+		features:      features,
+		accounts:      accounts,
+		raw:           true,
+	}
+	if config.Rollup.Enabled {
+		m.rollup = newRollup(config.Rollup)
+		m.raw = config.Rollup.Raw
+	}
+	return m, nil
 }
 
 // Fetch methods implements the data gathering and data conversion to the right format
 // It returns the event which is then forward to the output. In case of an error, a
 // descriptive error must be returned.
 func (m *MetricSet) Fetch() ([]common.MapStr, error) {
-	response, err := m.http.FetchResponse()
-	if err != nil {
-		return nil, err
-	}
-	defer response.Body.Close()
+	return m.features.Fetch(m.fetch, m.derive)
+}
 
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
+// Close stops the alert notifications, releases the target and saves the
+// anomaly models.
+func (m *MetricSet) Close() error {
+	m.target.Close()
+	return m.features.Close()
+}
+
+// derive adds the rollups and the accounting records of the connections, and
+// drops the connections when only the rollups are sent.
+func (m *MetricSet) derive(events []common.MapStr, connections int, start time.Time, polling common.MapStr) []common.MapStr {
+	if m.rollup != nil {
+		events = append(events, m.rollup.observe(events[:connections], start)...)
+	}
+	events = append(events, m.accounts.Observe(events[:connections])...)
+	if !m.raw {
+		// 接続ごとのドキュメントは送らず、まとめたものだけにする。
+		// それに付けた polling の状態はそれだけのイベントにして残す
+		events = events[connections:]
+		if polling != nil {
+			events = append(events, common.MapStr{mb.ModuleDataKey: polling})
+		}
 	}
+	return events
+}
 
-	var connections []common.MapStr
-	err = json.Unmarshal(body, &connections)
+func (m *MetricSet) fetch(scrape *sora.Scrape) ([]common.MapStr, error) {
+	connections, err := m.target.FetchList(scrape)
 	if err != nil {
 		return nil, err
 	}
 
 	// 接続ごとの情報にフィールドを追加する
+	events := connections[:0]
 	for _, conn := range connections {
+		// null の要素は捨てる
+		if conn == nil {
+			continue
+		}
+		m.features.Pseudonym.Apply(conn)
 		// チャネル、クライアントのIDを連結したもの
 		channel_id, _ := conn["channel_id"].(string)
 		client_id, _ := conn["client_id"].(string)
 		conn["channel_client_id"] = channel_id + "/" + client_id
+		m.features.Identity.Annotate(conn)
+		events = append(events, conn)
 	}
+	scrape.Connections = len(events)
 
-	return connections, nil
+	return events, nil
 }
@@ -0,0 +1,66 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18 && !integration
+// +build go1.18,!integration
+
+package connections
+
+import (
+	"encoding/json"
+	"testing"
+
+	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
+
+	"github.com/shiguredo/sorabeat/module/sora/soratest"
+)
+
+// FuzzFetch feeds arbitrary response bodies into Fetch.
+// Run with `go test -fuzz=FuzzFetch ./module/sora/connections/`.
+func FuzzFetch(f *testing.F) {
+	for _, version := range soratest.Versions() {
+		body, err := soratest.Fixture(version, soratest.GetStatsAllConnections)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body)
+	}
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[null]`))
+	f.Add([]byte(`[{"channel_id": 1, "client_id": null}]`))
+	f.Add([]byte(`[{}, {"rtp": []}]`))
+
+	server := soratest.NewServer(f, "18.10.04")
+	defer server.Close()
+	fetcher := mbtest.NewEventsFetcher(f, getConfig(server.URL))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		server.SetFixture(soratest.GetStatsAllConnections, body)
+		events, err := fetcher.Fetch()
+		if err != nil {
+			return
+		}
+		for _, event := range events {
+			if event == nil {
+				t.Fatal("nil event")
+			}
+			if _, ok := event["channel_client_id"].(string); !ok {
+				t.Fatalf("channel_client_id is missing: %v", event)
+			}
+		}
+		if _, err := json.Marshal(events); err != nil {
+			t.Fatalf("events can not be encoded: %v", err)
+		}
+	})
+}
@@ -17,171 +17,25 @@
 package connections
 
 import (
-	"net/http"
-	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
 	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
 
+	"github.com/shiguredo/sorabeat/module/sora/soratest"
 	"github.com/stretchr/testify/assert"
 )
 
-// dummy response body
-const response = `[
-    {
-        "channel_id": "sorabeat",
-        "client_id": "f43ca35b-f0a3-460f-81e4-851a4a41ff9b",
-        "rtp": {
-            "total_received_bytes": 1363876,
-            "total_received_packets": 1975,
-            "total_received_rtcp": 279,
-            "total_received_rtcp_bye": 0,
-            "total_received_rtcp_psfb_afb": 179,
-            "total_received_rtcp_psfb_fir": 0,
-            "total_received_rtcp_psfb_pli": 0,
-            "total_received_rtcp_rr": 83,
-            "total_received_rtcp_rtpfb_generic_nack": 10,
-            "total_received_rtcp_rtpfb_tmmbn": 0,
-            "total_received_rtcp_rtpfb_tmmbr": 0,
-            "total_received_rtcp_rtpfb_transport_wide": 0,
-            "total_received_rtcp_sdes": 186,
-            "total_received_rtcp_sr": 186,
-            "total_received_rtcp_unknown": 0,
-            "total_received_rtcp_xr": 0,
-            "total_received_rtp": 1696,
-            "total_sent_bytes": 1360840,
-            "total_sent_packets": 2129,
-            "total_sent_rtcp": 469,
-            "total_sent_rtcp_bye": 0,
-            "total_sent_rtcp_psfb_afb": 91,
-            "total_sent_rtcp_psfb_fir": 0,
-            "total_sent_rtcp_psfb_pli": 7,
-            "total_sent_rtcp_rr": 91,
-            "total_sent_rtcp_rtpfb_generic_nack": 194,
-            "total_sent_rtcp_rtpfb_tmmbn": 0,
-            "total_sent_rtcp_rtpfb_tmmbr": 0,
-            "total_sent_rtcp_rtpfb_transport_wide": 0,
-            "total_sent_rtcp_sdes": 177,
-            "total_sent_rtcp_sr": 177,
-            "total_sent_rtcp_unknown": 0,
-            "total_sent_rtcp_xr": 0,
-            "total_sent_rtp": 1660
-        },
-        "timestamp": "2017-11-16T05:16:02Z",
-        "turn": {
-            "total_received_allocate_request": 6,
-            "total_received_binding_request": 0,
-            "total_received_channel_bind_request": 1,
-            "total_received_channel_data": 1998,
-            "total_received_create_permission_request": 2,
-            "total_received_refresh_request": 0,
-            "total_received_send_indication": 31,
-            "total_received_turn_binding_error": 0,
-            "total_received_turn_binding_request": 0,
-            "total_received_turn_binding_success": 0,
-            "total_sent_allocate_error": 3,
-            "total_sent_allocate_success": 3,
-            "total_sent_binding_error": 0,
-            "total_sent_binding_success": 0,
-            "total_sent_channel_bind_error": 0,
-            "total_sent_channel_bind_success": 1,
-            "total_sent_channel_data": 2168,
-            "total_sent_create_permission_error": 0,
-            "total_sent_create_permission_success": 2,
-            "total_sent_data_indication": 29,
-            "total_sent_refresh_error": 0,
-            "total_sent_refresh_success": 0,
-            "total_sent_turn_binding_error": 0,
-            "total_sent_turn_binding_request": 0,
-            "total_sent_turn_binding_success": 0
-        }
-    },
-    {
-        "channel_id": "sorabeat",
-        "client_id": "d3850543-34d4-4b39-bf7d-570b4ee3ff43",
-        "rtp": {
-            "total_received_bytes": 1348588,
-            "total_received_packets": 1929,
-            "total_received_rtcp": 269,
-            "total_received_rtcp_bye": 0,
-            "total_received_rtcp_psfb_afb": 173,
-            "total_received_rtcp_psfb_fir": 0,
-            "total_received_rtcp_psfb_pli": 0,
-            "total_received_rtcp_rr": 80,
-            "total_received_rtcp_rtpfb_generic_nack": 10,
-            "total_received_rtcp_rtpfb_tmmbn": 0,
-            "total_received_rtcp_rtpfb_tmmbr": 0,
-            "total_received_rtcp_rtpfb_transport_wide": 0,
-            "total_received_rtcp_sdes": 179,
-            "total_received_rtcp_sr": 179,
-            "total_received_rtcp_unknown": 0,
-            "total_received_rtcp_xr": 0,
-            "total_received_rtp": 1660,
-            "total_sent_bytes": 1322488,
-            "total_sent_packets": 2102,
-            "total_sent_rtcp": 473,
-            "total_sent_rtcp_bye": 0,
-            "total_sent_rtcp_psfb_afb": 89,
-            "total_sent_rtcp_psfb_fir": 0,
-            "total_sent_rtcp_psfb_pli": 3,
-            "total_sent_rtcp_rr": 89,
-            "total_sent_rtcp_rtpfb_generic_nack": 194,
-            "total_sent_rtcp_rtpfb_tmmbn": 0,
-            "total_sent_rtcp_rtpfb_tmmbr": 0,
-            "total_sent_rtcp_rtpfb_transport_wide": 0,
-            "total_sent_rtcp_sdes": 187,
-            "total_sent_rtcp_sr": 187,
-            "total_sent_rtcp_unknown": 0,
-            "total_sent_rtcp_xr": 0,
-            "total_sent_rtp": 1629
-        },
-        "timestamp": "2017-11-16T05:16:02Z",
-        "turn": {
-            "total_received_allocate_request": 6,
-            "total_received_binding_request": 0,
-            "total_received_channel_bind_request": 1,
-            "total_received_channel_data": 1949,
-            "total_received_create_permission_request": 2,
-            "total_received_refresh_request": 0,
-            "total_received_send_indication": 31,
-            "total_received_turn_binding_error": 0,
-            "total_received_turn_binding_request": 0,
-            "total_received_turn_binding_success": 0,
-            "total_sent_allocate_error": 3,
-            "total_sent_allocate_success": 3,
-            "total_sent_binding_error": 0,
-            "total_sent_binding_success": 0,
-            "total_sent_channel_bind_error": 0,
-            "total_sent_channel_bind_success": 1,
-            "total_sent_channel_data": 2187,
-            "total_sent_create_permission_error": 0,
-            "total_sent_create_permission_success": 2,
-            "total_sent_data_indication": 28,
-            "total_sent_refresh_error": 0,
-            "total_sent_refresh_success": 0,
-            "total_sent_turn_binding_error": 0,
-            "total_sent_turn_binding_request": 0,
-            "total_sent_turn_binding_success": 0
-        }
-    }
-]`
-
 const delta = 0.01
 
 func TestFetchEventContents(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte(response))
-	}))
+	server := soratest.NewServer(t, "17.10")
 	defer server.Close()
+	server.OnRequest(soratest.RequireTarget(t, soratest.GetStatsAllConnections))
 
-	config := map[string]interface{}{
-		"module":     "sora",
-		"metricsets": []string{"connections"},
-		"hosts":      []string{server.URL},
-	}
-
-	f := mbtest.NewEventsFetcher(t, config)
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
 	events, err := f.Fetch()
 	if !assert.NoError(t, err) {
 		t.FailNow()
@@ -206,3 +60,210 @@ func TestFetchEventContents(t *testing.T) {
 		assert.InDelta(t, 2187., turn1["total_sent_channel_data"], delta)
 	}
 }
+
+func TestFetchGrowingConnections(t *testing.T) {
+	server := soratest.NewServer(t, "18.10.04")
+	defer server.Close()
+	server.Grow(3)
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	for i := 1; i <= 3; i++ {
+		events, err := f.Fetch()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, 3*i, len(events))
+		assert.Equal(t, "sorabeat/client-0000", events[0]["channel_client_id"])
+	}
+}
+
+func TestFetchSkipsNullConnections(t *testing.T) {
+	server := soratest.NewServer(t, "18.10.04")
+	defer server.Close()
+	server.SetFixture(soratest.GetStatsAllConnections,
+		[]byte(`[null, {"channel_id": "sorabeat", "client_id": "c"}, 1, "x"]`))
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	_, err := f.Fetch()
+	assert.Error(t, err)
+
+	server.SetFixture(soratest.GetStatsAllConnections,
+		[]byte(`[null, {"channel_id": "sorabeat", "client_id": "c"}]`))
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "sorabeat/c", events[0]["channel_client_id"])
+}
+
+func TestFetchIdentity(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	// 19.04 では同じ client_id の接続がある
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 3) {
+		t.FailNow()
+	}
+	assert.Equal(t, events[1]["channel_client_id"], events[2]["channel_client_id"])
+	assert.Equal(t, "0RZ5RMPZ7X2VV8NKYE2MTF4AG0", events[1]["identity"])
+	assert.Equal(t, "3KX1W0GSQH6V5C9Z0MBTRHEQ5M", events[2]["identity"])
+
+	config := getConfig(server.URL)
+	config["identity.key"] = "channel_client_id"
+	f = mbtest.NewEventsFetcher(t, config)
+	events, err = f.Fetch()
+	if assert.NoError(t, err) {
+		assert.Equal(t, events[1]["channel_client_id"], events[1]["identity"])
+	}
+}
+
+func TestFetchPseudonymize(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	config := getConfig(server.URL)
+	config["pseudonymize.enabled"] = true
+	config["pseudonymize.key"] = "0123456789abcdef0123456789abcdef"
+	f := mbtest.NewEventsFetcher(t, config)
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 3) {
+		t.FailNow()
+	}
+
+	event := events[1]
+	clientID := event["client_id"].(string)
+	assert.NotEqual(t, "d3850543-34d4-4b39-bf7d-570b4ee3ff43", clientID)
+	assert.Len(t, clientID, 32)
+	assert.NotEqual(t, "0RZ5RMPZ7X2VV8NKYE2MTF4AG0", event["connection_id"])
+	// 置き換えた値から作るので同じクライアントの接続をまとめられる
+	assert.Equal(t, "sorabeat/"+clientID, event["channel_client_id"])
+	assert.Equal(t, event["connection_id"], event["identity"])
+	assert.Equal(t, event["channel_client_id"], events[2]["channel_client_id"])
+
+	again, err := f.Fetch()
+	if assert.NoError(t, err) {
+		assert.Equal(t, event["identity"], again[1]["identity"])
+	}
+}
+
+func TestFetchRollup(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	config := getConfig(server.URL)
+	config["rollup.enabled"] = true
+	config["rollup.window"] = "10ms"
+	config["rollup.raw"] = false
+	f := mbtest.NewEventsFetcher(t, config)
+	events, err := f.Fetch()
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	time.Sleep(20 * time.Millisecond)
+	events, err = f.Fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 2) {
+		t.FailNow()
+	}
+	scope, _ := events[0].GetValue("rollup.scope")
+	assert.Equal(t, ScopeHost, scope)
+	connections, _ := events[0].GetValue("rollup.gauge.connections.last")
+	assert.Equal(t, 3., connections)
+	assert.Equal(t, "sorabeat", events[1]["channel_id"])
+}
+
+func TestFetchPollingWithoutRaw(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	server.SetLatency(20 * time.Millisecond)
+
+	config := getConfig(server.URL)
+	config["period"] = "1s"
+	config["adaptive.enabled"] = true
+	config["adaptive.slow_response"] = "10ms"
+	config["rollup.enabled"] = true
+	config["rollup.raw"] = false
+	f := mbtest.NewEventsFetcher(t, config)
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 1) {
+		t.FailNow()
+	}
+
+	// 接続ごとのドキュメントを送らなくても polling の状態は残る
+	reason, _ := events[0].GetValue(mb.ModuleDataKey + ".polling.reason")
+	assert.Equal(t, "slow", reason)
+	assert.NotContains(t, events[0], "channel_id")
+}
+
+func TestFetchAdaptivePolling(t *testing.T) {
+	server := soratest.NewServer(t, "18.10.04")
+	defer server.Close()
+	server.SetLatency(20 * time.Millisecond)
+
+	config := getConfig(server.URL)
+	config["period"] = "1s"
+	config["adaptive.enabled"] = true
+	config["adaptive.slow_response"] = "10ms"
+
+	f := mbtest.NewEventsFetcher(t, config)
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	polling, _ := events[0].GetValue(mb.ModuleDataKey + ".polling")
+	assert.Equal(t, common.MapStr{
+		"interval": int64(20000),
+		"jitter":   int64(0),
+		"retries":  0,
+		"reason":   "slow",
+	}, polling)
+
+	// 間隔が空くまでは Sora に問い合わせない
+	events, err = f.Fetch()
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	assert.Equal(t, 1, server.RequestCount(soratest.GetStatsAllConnections))
+}
+
+func TestFetchGolden(t *testing.T) {
+	for _, version := range soratest.Versions() {
+		t.Run(version, func(t *testing.T) {
+			server := soratest.NewServer(t, version)
+			defer server.Close()
+
+			f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+			events, err := f.Fetch()
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			soratest.AssertGolden(t, version, soratest.WithoutServer(events))
+		})
+	}
+}
+
+func TestData(t *testing.T) {
+	versions := soratest.Versions()
+	server := soratest.NewServer(t, versions[len(versions)-1])
+	defer server.Close()
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	events, err := f.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ホストはテストのたびに変わるのでサンプルでは固定する
+	fullEvent := mbtest.CreateFullEvent(f, events[0])
+	fullEvent.Fields.Put("metricset.host", "localhost:3000")
+	mbtest.WriteEventToDataJSON(t, fullEvent)
+}
+
+func getConfig(host string) map[string]interface{} {
+	return map[string]interface{}{
+		"module":     "sora",
+		"metricsets": []string{"connections"},
+		"hosts":      []string{host},
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connections
+
+import (
+	"sort"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+
+	"github.com/shiguredo/sorabeat/module/sora"
+)
+
+// Scopes reported in sora.connections.rollup.scope.
+const (
+	ScopeHost    = "host"
+	ScopeChannel = "channel"
+)
+
+// connectionsGauge is the number of connections, always rolled up.
+const connectionsGauge = "connections"
+
+// rollupConfig configures the rollup documents of the connections.
+type rollupConfig struct {
+	Enabled bool `config:"enabled"`
+	// Window is how often the rollups are emitted, aligned on the clock.
+	Window time.Duration `config:"window" validate:"positive"`
+	// Raw keeps emitting a document per connection.
+	Raw bool `config:"raw"`
+	// Gauges are summed over the connections of a sample, and rolled up as
+	// min, max, avg and last over the samples of the window.
+	Gauges []string `config:"gauges"`
+	// Counters are rolled up as the sum of their increases in the window.
+	Counters []string `config:"counters"`
+}
+
+var defaultRollupConfig = rollupConfig{
+	Window: 5 * time.Minute,
+	Raw:    true,
+	Counters: []string{
+		// Sora 18.10.04 より前の名前も含める
+		"rtp.total_received_bytes", "rtp.total_sent_bytes",
+		"rtp.total_received_byte_size", "rtp.total_sent_byte_size",
+		"rtp.total_received_rtcp_rtpfb_generic_nack", "rtp.total_sent_rtcp_rtpfb_generic_nack",
+	},
+}
+
+type gaugeStats struct {
+	min, max, sum, last float64
+	samples             int
+}
+
+func (g *gaugeStats) add(value float64) {
+	if g.samples == 0 || value < g.min {
+		g.min = value
+	}
+	if g.samples == 0 || value > g.max {
+		g.max = value
+	}
+	g.sum += value
+	g.last = value
+	g.samples++
+}
+
+type aggregate struct {
+	samples  int
+	gauges   map[string]*gaugeStats
+	counters map[string]float64
+}
+
+func newAggregate() *aggregate {
+	return &aggregate{gauges: map[string]*gaugeStats{}, counters: map[string]float64{}}
+}
+
+// rollup keeps the window of the samples of a host in memory.
+type rollup struct {
+	config rollupConfig
+	start  time.Time
+	// 接続ごとの前回のカウンタの値。identity で引く
+	previous map[string]map[string]float64
+	host     *aggregate
+	channels map[string]*aggregate
+}
+
+func newRollup(config rollupConfig) *rollup {
+	return &rollup{
+		config:   config,
+		previous: map[string]map[string]float64{},
+		host:     newAggregate(),
+		channels: map[string]*aggregate{},
+	}
+}
+
+// observe adds the connections fetched at now to the window, and returns the
+// rollups of the previous window when now is past its end.
+func (r *rollup) observe(events []common.MapStr, now time.Time) []common.MapStr {
+	var rollups []common.MapStr
+	if !r.start.IsZero() && !now.Before(r.start.Add(r.config.Window)) {
+		rollups = r.flush()
+	}
+	if r.start.IsZero() {
+		r.start = now.Truncate(r.config.Window)
+	}
+	r.add(events)
+	return rollups
+}
+
+func (r *rollup) add(events []common.MapStr) {
+	gauges := append([]string{connectionsGauge}, r.config.Gauges...)
+	hostSample := map[string]float64{}
+	channelSamples := map[string]map[string]float64{}
+	previous := map[string]map[string]float64{}
+
+	for _, event := range events {
+		channelID, _ := event["channel_id"].(string)
+		sample, ok := channelSamples[channelID]
+		if !ok {
+			sample = map[string]float64{}
+			channelSamples[channelID] = sample
+			if _, ok := r.channels[channelID]; !ok {
+				r.channels[channelID] = newAggregate()
+			}
+		}
+		sample[connectionsGauge]++
+		hostSample[connectionsGauge]++
+		for _, field := range r.config.Gauges {
+			if value, ok := sora.Number(event, field); ok {
+				sample[field] += value
+				hostSample[field] += value
+			}
+		}
+
+		// identity.key によっては別の接続と同じ identity になるので、接続ごとに
+		// 決まるキーで前回の値を探す
+		id := sora.ConnectionKey(event)
+		counters := map[string]float64{}
+		last := r.previous[id]
+		for _, field := range r.config.Counters {
+			value, ok := sora.Number(event, field)
+			if !ok {
+				continue
+			}
+			counters[field] = value
+			before, seen := last[field]
+			if !seen {
+				// 初めて見た接続は前回の値がないので数えない
+				continue
+			}
+			delta := value - before
+			if delta < 0 {
+				// 同じ client_id で接続し直したときはカウンタが 0 から始まる
+				delta = value
+			}
+			r.channels[channelID].counters[field] += delta
+			r.host.counters[field] += delta
+		}
+		previous[id] = counters
+	}
+	// 切断された接続は忘れる
+	r.previous = previous
+
+	addSample(r.host, hostSample, gauges)
+	for channelID, sample := range channelSamples {
+		addSample(r.channels[channelID], sample, gauges)
+	}
+}
+
+func addSample(a *aggregate, sample map[string]float64, gauges []string) {
+	a.samples++
+	for _, field := range gauges {
+		value, ok := sample[field]
+		if !ok && field != connectionsGauge {
+			continue
+		}
+		g, ok := a.gauges[field]
+		if !ok {
+			g = &gaugeStats{}
+			a.gauges[field] = g
+		}
+		g.add(value)
+	}
+}
+
+// flush returns the host rollup followed by a rollup per channel, and starts
+// a new window.
+func (r *rollup) flush() []common.MapStr {
+	end := r.start.Add(r.config.Window)
+	rollups := []common.MapStr{r.document(ScopeHost, "", r.host, end)}
+
+	var channels []string
+	for channelID := range r.channels {
+		channels = append(channels, channelID)
+	}
+	sort.Strings(channels)
+	for _, channelID := range channels {
+		rollups = append(rollups, r.document(ScopeChannel, channelID, r.channels[channelID], end))
+	}
+
+	r.start = time.Time{}
+	r.host = newAggregate()
+	r.channels = map[string]*aggregate{}
+	return rollups
+}
+
+func (r *rollup) document(scope, channelID string, a *aggregate, end time.Time) common.MapStr {
+	fields := common.MapStr{
+		"scope":        scope,
+		"window_start": r.start.UTC().Format(time.RFC3339),
+		"window_end":   end.UTC().Format(time.RFC3339),
+		"samples":      int64(a.samples),
+	}
+	for field, g := range a.gauges {
+		fields.Put("gauge."+field, common.MapStr{
+			"min":  g.min,
+			"max":  g.max,
+			"avg":  g.sum / float64(g.samples),
+			"last": g.last,
+		})
+	}
+	for field, sum := range a.counters {
+		fields.Put("counter."+field, sum)
+	}
+
+	event := common.MapStr{"rollup": fields}
+	if scope == ScopeChannel {
+		// テナントの付与などが効くように接続と同じ場所に置く
+		event["channel_id"] = channelID
+	}
+	return event
+}
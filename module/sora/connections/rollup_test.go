@@ -0,0 +1,129 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package connections
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func conn(channelID, clientID string, sent, bitrate float64) common.MapStr {
+	return common.MapStr{
+		"channel_id": channelID,
+		"client_id":  clientID,
+		"rtp": map[string]interface{}{
+			"total_sent_byte_size": sent,
+			"bitrate":              bitrate,
+		},
+	}
+}
+
+func rollupField(t *testing.T, event common.MapStr, key string) interface{} {
+	value, err := event.GetValue("rollup." + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestRollup(t *testing.T) {
+	config := defaultRollupConfig
+	config.Window = time.Minute
+	config.Gauges = []string{"rtp.bitrate"}
+	r := newRollup(config)
+	now := time.Date(2017, 10, 10, 0, 0, 10, 0, time.UTC)
+
+	assert.Empty(t, r.observe([]common.MapStr{
+		conn("a", "1", 100, 10),
+		conn("a", "2", 100, 20),
+		conn("b", "3", 100, 5),
+	}, now))
+	// 2 は切断し、1 は接続し直してカウンタが戻った
+	assert.Empty(t, r.observe([]common.MapStr{
+		conn("a", "1", 40, 30),
+		conn("b", "3", 150, 5),
+	}, now.Add(20*time.Second)))
+	assert.Empty(t, r.observe([]common.MapStr{
+		conn("a", "1", 90, 10),
+		conn("a", "2", 500, 10),
+		conn("b", "3", 160, 5),
+	}, now.Add(40*time.Second)))
+
+	rollups := r.observe([]common.MapStr{conn("a", "1", 100, 10)}, now.Add(50*time.Second))
+	if !assert.Len(t, rollups, 3) {
+		t.FailNow()
+	}
+
+	host := rollups[0]
+	assert.NotContains(t, host, "channel_id")
+	assert.Equal(t, ScopeHost, rollupField(t, host, "scope"))
+	assert.Equal(t, "2017-10-10T00:00:00Z", rollupField(t, host, "window_start"))
+	assert.Equal(t, "2017-10-10T00:01:00Z", rollupField(t, host, "window_end"))
+	assert.Equal(t, int64(3), rollupField(t, host, "samples"))
+	assert.Equal(t, 2., rollupField(t, host, "gauge.connections.min"))
+	assert.Equal(t, 3., rollupField(t, host, "gauge.connections.max"))
+	assert.Equal(t, 3., rollupField(t, host, "gauge.connections.last"))
+	assert.InDelta(t, 35., rollupField(t, host, "gauge.rtp.bitrate.max"), delta)
+	assert.InDelta(t, 25., rollupField(t, host, "gauge.rtp.bitrate.last"), delta)
+	// 1: 40 + 50, 3: 50 + 10, 2 は接続し直したので数えない
+	assert.InDelta(t, 150., rollupField(t, host, "counter.rtp.total_sent_byte_size"), delta)
+
+	a := rollups[1]
+	assert.Equal(t, "a", a["channel_id"])
+	assert.Equal(t, ScopeChannel, rollupField(t, a, "scope"))
+	assert.Equal(t, 1., rollupField(t, a, "gauge.connections.min"))
+	assert.InDelta(t, 5./3, rollupField(t, a, "gauge.connections.avg"), delta)
+	assert.InDelta(t, 80./3, rollupField(t, a, "gauge.rtp.bitrate.avg"), delta)
+	assert.InDelta(t, 90., rollupField(t, a, "counter.rtp.total_sent_byte_size"), delta)
+
+	b := rollups[2]
+	assert.Equal(t, "b", b["channel_id"])
+	assert.InDelta(t, 60., rollupField(t, b, "counter.rtp.total_sent_byte_size"), delta)
+
+	// 次の窓は観測した時刻から始まる
+	rollups = r.observe(nil, now.Add(2*time.Minute))
+	if assert.Len(t, rollups, 2) {
+		assert.Equal(t, "2017-10-10T00:01:00Z", rollupField(t, rollups[0], "window_start"))
+		assert.InDelta(t, 10., rollupField(t, rollups[0], "counter.rtp.total_sent_byte_size"), delta)
+		assert.Equal(t, "a", rollups[1]["channel_id"])
+	}
+}
+
+func TestRollupSharedClientID(t *testing.T) {
+	config := defaultRollupConfig
+	config.Window = time.Minute
+	r := newRollup(config)
+	now := time.Date(2017, 10, 10, 0, 0, 10, 0, time.UTC)
+	// identity.key: client_id のときは同じ client_id の接続の identity が同じになる
+	shared := func(connectionID string, sent float64) common.MapStr {
+		event := conn("a", "c1", sent, 0)
+		event["connection_id"] = connectionID
+		event["identity"] = "c1"
+		return event
+	}
+
+	r.observe([]common.MapStr{shared("1", 1000), shared("2", 10)}, now)
+	r.observe([]common.MapStr{shared("1", 1100), shared("2", 20)}, now.Add(20*time.Second))
+	rollups := r.observe(nil, now.Add(time.Minute))
+	if assert.Len(t, rollups, 2) {
+		// 別の接続のカウンタを戻ったとみなして足さない
+		assert.InDelta(t, 110., rollupField(t, rollups[0], "counter.rtp.total_sent_byte_size"), delta)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+// Features holds the features of the module shared by the metricsets and runs
+// the steps every fetch goes through around the part specific to the
+// metricset: adaptive polling, the scrape, the anomaly detection, the alerts
+// and the Sora instance and tenant annotations.
+type Features struct {
+	name      string
+	Scheduler *Scheduler
+	Alerts    *Alerter
+	Anomaly   *Detector
+	Server    *Server
+	Scrapes   *Scrapes
+	Identity  *Identity
+	Tenants   *Tenants
+	Pseudonym *Pseudonymizer
+}
+
+// NewFeatures creates the features of a metricset from the module
+// configuration. The metricset must call Close when it is closed, and when
+// its New fails after NewFeatures.
+func NewFeatures(base mb.BaseMetricSet) (*Features, error) {
+	scheduler, err := NewScheduler(base)
+	if err != nil {
+		return nil, err
+	}
+
+	alerts, err := NewAlerter(base)
+	if err != nil {
+		return nil, err
+	}
+	// Close は呼ばれないので、失敗したときはここで通知を止める
+	created := false
+	defer func() {
+		if !created {
+			alerts.Close()
+		}
+	}()
+
+	anomaly, err := NewDetector(base)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := NewIdentity(base)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := NewTenants(base)
+	if err != nil {
+		return nil, err
+	}
+
+	pseudonym, err := NewPseudonymizer(base)
+	if err != nil {
+		return nil, err
+	}
+
+	created = true
+	return &Features{
+		name:      base.Name(),
+		Scheduler: scheduler,
+		Alerts:    alerts,
+		Anomaly:   anomaly,
+		Server:    ServerOf(base.Host()),
+		Scrapes:   ScrapesOf(base.Host()),
+		Identity:  identity,
+		Tenants:   tenants,
+		Pseudonym: pseudonym,
+	}, nil
+}
+
+// Fetch runs fetch, the part of a fetch specific to the metricset, and
+// returns its events with the adaptive polling state and the anomaly and
+// alert events, annotated with the Sora instance and the tenant. It returns
+// no events while adaptive polling waits.
+//
+// derive, when not nil, is called once the anomaly detection and the alerts
+// have seen the events of a successful fetch, e.g. to add the rollups. It is
+// given the events, of which the first fetched are the ones the fetch
+// returned, and returns the events to send. polling is nil when adaptive polling is
+// disabled.
+func (f *Features) Fetch(fetch func(scrape *Scrape) ([]common.MapStr, error), derive func(events []common.MapStr, fetched int, start time.Time, polling common.MapStr) []common.MapStr) ([]common.MapStr, error) {
+	// adaptive polling で間隔を空けている間は取得しない
+	if !f.Scheduler.Due() {
+		return nil, nil
+	}
+
+	start := time.Now()
+	scrape := NewScrape(f.name, start)
+	events, err := fetch(scrape)
+
+	f.Scrapes.Record(scrape, err)
+	polling := f.Scheduler.Observe(Observation{
+		Duration:    time.Since(start) - scrape.Wait,
+		Size:        scrape.Bytes,
+		Err:         err,
+		Connections: scrape.Connections,
+	})
+	fetched := len(events)
+	if polling != nil {
+		// エラーのときも polling の状態はイベントにする
+		if fetched == 0 && err != nil {
+			events = []common.MapStr{{}}
+		}
+		for _, event := range events {
+			stamp(event, polling.Clone())
+		}
+	}
+	// 取得に失敗したときは、取得できた分だけを評価する
+	if err == nil || fetched > 0 {
+		events = f.evaluate(events)
+	}
+	if err == nil && derive != nil {
+		events = derive(events, fetched, start, polling)
+	}
+	f.annotate(events)
+	return events, err
+}
+
+// Process returns the events of a metricset that does not fetch from Sora,
+// e.g. received from the clients, with the anomaly and alert events,
+// annotated with the Sora instance and the tenant.
+func (f *Features) Process(events []common.MapStr) []common.MapStr {
+	events = f.evaluate(events)
+	f.annotate(events)
+	return events
+}
+
+// Close stops the alert notifications and saves the anomaly models.
+func (f *Features) Close() error {
+	f.Alerts.Close()
+	return f.Anomaly.Save()
+}
+
+func (f *Features) evaluate(events []common.MapStr) []common.MapStr {
+	events = append(events, f.Anomaly.Observe(events)...)
+	return append(events, f.Alerts.Evaluate(events)...)
+}
+
+func (f *Features) annotate(events []common.MapStr) {
+	f.Server.Annotate(events)
+	f.Tenants.Annotate(events)
+}
+
+// stamp はサーバーの再起動のように既にモジュールのフィールドがあるイベントでは
+// それに加える
+func stamp(event common.MapStr, fields common.MapStr) {
+	module, ok := event[mb.ModuleDataKey].(common.MapStr)
+	if !ok {
+		event[mb.ModuleDataKey] = fields
+		return
+	}
+	module.Update(fields)
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFeatures(t *testing.T) (*Features, *clock) {
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	alerts, err := newAlerter(alertConfig(RuleConfig{
+		Name:      "memory",
+		Condition: "erlang_vm.memory.total > 1000",
+	}), "stats", "localhost:3000", c.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants, err := newTenants(TenantConfig{}, c.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Features{
+		name:      "stats",
+		Scheduler: newScheduler(testPollingConfig(), time.Second, c.now),
+		Alerts:    alerts,
+		Server:    ServerOf("features.test"),
+		Scrapes:   ScrapesOf("features.test"),
+		Tenants:   tenants,
+	}, c
+}
+
+func TestFeaturesFetch(t *testing.T) {
+	f, c := newTestFeatures(t)
+	calls := 0
+	fetch := func(scrape *Scrape) ([]common.MapStr, error) {
+		calls++
+		return memory(1500), nil
+	}
+
+	events, err := f.Fetch(fetch, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, ReasonSteady, polling(events[0][mb.ModuleDataKey].(common.MapStr))["reason"])
+		assert.Equal(t, AlertFiring, alertFields(t, events[1:])[0]["state"])
+	}
+	scrapes := f.Scrapes.Collect()
+	if assert.Len(t, scrapes, 1) {
+		assert.Equal(t, true, scrapes[0]["success"])
+	}
+
+	// 次の間隔までは取得しない
+	c.advance(time.Second)
+	events, err = f.Fetch(fetch, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, events)
+	assert.Equal(t, 1, calls)
+}
+
+func TestFeaturesFetchError(t *testing.T) {
+	f, _ := newTestFeatures(t)
+	derived := false
+	events, err := f.Fetch(func(scrape *Scrape) ([]common.MapStr, error) {
+		return nil, errors.New("down")
+	}, func(events []common.MapStr, fetched int, start time.Time, polling common.MapStr) []common.MapStr {
+		derived = true
+		return events
+	})
+	assert.Error(t, err)
+	assert.False(t, derived)
+	// polling の状態だけのイベントにする
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, ReasonError, polling(events[0][mb.ModuleDataKey].(common.MapStr))["reason"])
+	}
+}
+
+func TestFeaturesFetchDerive(t *testing.T) {
+	f, _ := newTestFeatures(t)
+	events, err := f.Fetch(func(scrape *Scrape) ([]common.MapStr, error) {
+		// 再起動のイベントのように既にあるモジュールのフィールドは残す
+		restart := common.MapStr{mb.ModuleDataKey: common.MapStr{"server": common.MapStr{"restarted": true}}}
+		return append(memory(1500), restart), nil
+	}, func(events []common.MapStr, fetched int, start time.Time, polling common.MapStr) []common.MapStr {
+		assert.Len(t, events, 3)
+		assert.Equal(t, 2, fetched)
+		assert.NotNil(t, polling)
+		return append(events[fetched:], common.MapStr{"rollup": true})
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, AlertFiring, alertFields(t, events[:1])[0]["state"])
+		assert.Equal(t, true, events[1]["rollup"])
+	}
+
+	f, _ = newTestFeatures(t)
+	events, _ = f.Fetch(func(scrape *Scrape) ([]common.MapStr, error) {
+		return []common.MapStr{{mb.ModuleDataKey: common.MapStr{"server": common.MapStr{"restarted": true}}}}, nil
+	}, nil)
+	if assert.Len(t, events, 1) {
+		module := events[0][mb.ModuleDataKey].(common.MapStr)
+		assert.Contains(t, module, "server")
+		assert.Contains(t, module, "polling")
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/helper"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+const (
+	httpMethod      = "POST"
+	targetHeaderKey = "x-sora-target"
+)
+
+// FetchConfig configures the requests to a Sora host. It is read from the
+// fetch section of the module configuration.
+type FetchConfig struct {
+	// RateLimit is the number of requests per second to the host by all
+	// metricsets, 0 for no limit. The modules polling the same host share
+	// the lowest limit.
+	RateLimit float64 `config:"rate_limit" validate:"min=0"`
+	// Burst is the number of requests that can be made at once.
+	Burst int `config:"burst" validate:"min=1"`
+}
+
+// DefaultFetchConfig is the configuration used for unset options.
+var DefaultFetchConfig = FetchConfig{
+	RateLimit: 10,
+	Burst:     20,
+}
+
+// Fetcher coordinates the requests of the metricsets polling a Sora host.
+// The metricsets requesting the same API with the same HTTP settings and
+// period share one decoded response per period and all requests to the host
+// are rate limited.
+type Fetcher struct {
+	host    string
+	limiter *limiter
+	// FetcherOf と Target の数。fetchers のロックで守る
+	refs int
+
+	mu      sync.Mutex
+	targets map[string]*sharedTarget
+}
+
+// sharedTarget is an API of the host requested by one or more metricsets.
+// It is requested at most once per period, counted from its first request.
+type sharedTarget struct {
+	key    string
+	period time.Duration
+	// Target の数。Fetcher のロックで守る
+	refs int
+
+	// 取得は一度に一つにして、待っていた側は終わった取得の応答を使う
+	mu     sync.Mutex
+	http   *helper.HTTP
+	origin time.Time
+	last   *response
+}
+
+// response is the outcome of the request of a target in a period. The value
+// is decoded once and copied for each metricset.
+type response struct {
+	period int64
+	value  interface{}
+	bytes  int
+	status int
+	err    error
+	class  string
+}
+
+var fetchers = struct {
+	sync.Mutex
+	hosts map[string]*Fetcher
+}{hosts: map[string]*Fetcher{}}
+
+// FetcherOf returns the Fetcher of the host of the metricset, shared by all
+// metricsets and modules polling the host. The metricset must Close it.
+func FetcherOf(base mb.BaseMetricSet) (*Fetcher, error) {
+	config := struct {
+		Fetch FetchConfig `config:"fetch"`
+	}{
+		Fetch: DefaultFetchConfig,
+	}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+
+	fetchers.Lock()
+	defer fetchers.Unlock()
+	f, ok := fetchers.hosts[base.Host()]
+	if !ok {
+		f = &Fetcher{
+			host:    base.Host(),
+			limiter: newLimiter(config.Fetch, time.Now, time.Sleep),
+			targets: map[string]*sharedTarget{},
+		}
+		fetchers.hosts[base.Host()] = f
+	} else {
+		f.limiter.tighten(config.Fetch)
+	}
+	f.refs++
+	return f, nil
+}
+
+// Close releases the Fetcher. The host is forgotten, with its rate limit,
+// when the last metricset polling it closes.
+func (f *Fetcher) Close() {
+	fetchers.Lock()
+	defer fetchers.Unlock()
+	f.refs--
+	if f.refs == 0 && fetchers.hosts[f.host] == f {
+		delete(fetchers.hosts, f.host)
+	}
+}
+
+// NewTarget returns the Target of the metricset for the Sora API, e.g.
+// Sora_20171010.GetStatsReport.
+func NewTarget(base mb.BaseMetricSet, target string) (*Target, error) {
+	f, err := FetcherOf(base)
+	if err != nil {
+		return nil, err
+	}
+	// Target が Fetcher を持つ
+	defer f.Close()
+	return f.Target(base, target)
+}
+
+// Target returns the Target of the metricset for the Sora API. Only the
+// metricsets with the same HTTP settings, e.g. the URL, the credentials,
+// the headers and the timeout, and the same period share the responses. The metricset must
+// Close the Target.
+func (f *Fetcher) Target(base mb.BaseMetricSet, target string) (*Target, error) {
+	settings, err := httpSettings(base)
+	if err != nil {
+		return nil, err
+	}
+	period := base.Module().Config().Period
+	key := target + "\n" + settings + "\n" + period.String()
+
+	fetchers.Lock()
+	f.refs++
+	fetchers.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shared, ok := f.targets[key]
+	if !ok {
+		shared = &sharedTarget{key: key, period: period, http: NewHTTP(base, target)}
+		f.targets[key] = shared
+	}
+	shared.refs++
+	return &Target{fetcher: f, shared: shared, used: -1}, nil
+}
+
+// NewHTTP returns the request of the metricset for the Sora API, for the
+// requests that cannot share the response, e.g. with a body.
+func NewHTTP(base mb.BaseMetricSet, target string) *helper.HTTP {
+	http := helper.NewHTTP(base)
+	http.SetMethod(httpMethod)
+	http.SetHeader(targetHeaderKey, target)
+	return http
+}
+
+// httpSettings returns the settings helper.NewHTTP reads from the metricset
+// as a comparable string.
+func httpSettings(base mb.BaseMetricSet) (string, error) {
+	config := struct {
+		SSL     map[string]interface{} `config:"ssl"`
+		Timeout time.Duration          `config:"timeout"`
+		Headers map[string]string      `config:"headers"`
+	}{}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return "", err
+	}
+	host := base.HostData()
+	settings, err := json.Marshal([]interface{}{
+		host.SanitizedURI, host.User, host.Password,
+		config.SSL, config.Timeout, config.Headers,
+	})
+	return string(settings), err
+}
+
+// Fetch makes the request of h, e.g. with a body, within the rate limit of
+// the host without sharing the response.
+func (f *Fetcher) Fetch(scrape *Scrape, h *helper.HTTP) ([]byte, error) {
+	scrape.Wait += f.limiter.wait()
+	return scrape.Fetch(h)
+}
+
+// Target is an API of the host requested by a metricset.
+type Target struct {
+	fetcher *Fetcher
+	shared  *sharedTarget
+	// このメトリックセットが最後に使った応答の周期。同じ応答は二度使わない
+	used int64
+}
+
+// FetchMap returns the JSON object of the API in the current period. The
+// first metricset fetching it in the period makes the request within the
+// rate limit of the host and decodes the response; the others get a copy of
+// the decoded object, or the same error, without a request.
+func (t *Target) FetchMap(scrape *Scrape) (common.MapStr, error) {
+	value, err := t.fetch(scrape, time.Now(), t.request)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		scrape.class = ScrapeDecode
+		return nil, fmt.Errorf("expected a JSON object in %s, got %T", scrape.metricset, value)
+	}
+	return common.MapStr(object), nil
+}
+
+// FetchList returns the JSON array of objects of the API in the current
+// period, like FetchMap. The null elements are nil.
+func (t *Target) FetchList(scrape *Scrape) ([]common.MapStr, error) {
+	value, err := t.fetch(scrape, time.Now(), t.request)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	array, ok := value.([]interface{})
+	if !ok {
+		scrape.class = ScrapeDecode
+		return nil, fmt.Errorf("expected a JSON array in %s, got %T", scrape.metricset, value)
+	}
+	list := make([]common.MapStr, len(array))
+	for i, element := range array {
+		if element == nil {
+			continue
+		}
+		object, ok := element.(map[string]interface{})
+		if !ok {
+			scrape.class = ScrapeDecode
+			return nil, fmt.Errorf("expected JSON objects in %s, got %T", scrape.metricset, element)
+		}
+		list[i] = common.MapStr(object)
+	}
+	return list, nil
+}
+
+// request makes the request of the target within the rate limit of the host.
+func (t *Target) request(scrape *Scrape) ([]byte, error) {
+	scrape.Wait += t.fetcher.limiter.wait()
+	return scrape.Fetch(t.shared.http)
+}
+
+// fetch returns a copy of the decoded response of the period of now,
+// requesting it with request if no metricset did in the period yet.
+func (t *Target) fetch(scrape *Scrape, now time.Time, request func(*Scrape) ([]byte, error)) (interface{}, error) {
+	shared := t.shared
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	if shared.origin.IsZero() {
+		shared.origin = now
+	}
+	// 周期のタイマーは多少ずれるので、境目を半周期ずらして数える
+	period := int64(math.Floor(float64(now.Sub(shared.origin))/float64(shared.period) + 0.5))
+	// 使った周期でもう一度呼ばれたときは次の周期の分を先に取得する
+	if period <= t.used {
+		period = t.used + 1
+	}
+
+	r := shared.last
+	if r != nil && r.period >= period {
+		scrape.Shared = true
+		scrape.Status = r.status
+		scrape.Bytes += r.bytes
+		scrape.class = r.class
+	} else {
+		// 応答の大きさは取得したメトリックセットの Bytes に足される
+		bytes := scrape.Bytes
+		body, err := request(scrape)
+		var value interface{}
+		if err == nil {
+			err = scrape.Decode(body, &value)
+		}
+		r = &response{
+			period: period,
+			value:  value,
+			bytes:  scrape.Bytes - bytes,
+			status: scrape.Status,
+			err:    err,
+			class:  scrape.class,
+		}
+		shared.last = r
+	}
+	t.used = r.period
+	if r.err != nil {
+		return nil, r.err
+	}
+	// メトリックセットはイベントを書き換えるので、それぞれに複製を渡す
+	return copyJSON(r.value), nil
+}
+
+// copyJSON returns a deep copy of a decoded JSON value.
+func copyJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			c[key] = copyJSON(value)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, value := range v {
+			c[i] = copyJSON(value)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// Close releases the Target. The response of the API is forgotten when the
+// last metricset requesting it closes.
+func (t *Target) Close() {
+	if t == nil || t.shared == nil {
+		return
+	}
+	f := t.fetcher
+	f.mu.Lock()
+	t.shared.refs--
+	if t.shared.refs == 0 {
+		delete(f.targets, t.shared.key)
+	}
+	f.mu.Unlock()
+	t.shared = nil
+	f.Close()
+}
+
+// limiter is a token bucket of the requests to a host.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newLimiter(config FetchConfig, now func() time.Time, sleep func(time.Duration)) *limiter {
+	return &limiter{
+		rate:   config.RateLimit,
+		burst:  float64(config.Burst),
+		tokens: float64(config.Burst),
+		last:   now(),
+		now:    now,
+		sleep:  sleep,
+	}
+}
+
+// tighten applies the limit of another module polling the host if it is
+// lower.
+func (l *limiter) tighten(config FetchConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if config.RateLimit > 0 && (l.rate == 0 || config.RateLimit < l.rate) {
+		l.rate = config.RateLimit
+	}
+	if burst := float64(config.Burst); burst < l.burst {
+		l.burst = burst
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+}
+
+// wait takes a token, sleeping until there is one, and returns how long it
+// slept.
+func (l *limiter) wait() time.Duration {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return 0
+	}
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// 足りない分は先に借りて、その分だけ待つ
+	l.tokens--
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if d > 0 {
+		l.sleep(d)
+	}
+	return d
+}
@@ -0,0 +1,207 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// +build !integration
+
+package sora
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	var slept []time.Duration
+	sleep := func(d time.Duration) {
+		slept = append(slept, d)
+		c.advance(d)
+	}
+	l := newLimiter(FetchConfig{RateLimit: 2, Burst: 2}, c.now, sleep)
+
+	// burst までは待たない
+	assert.Equal(t, time.Duration(0), l.wait())
+	assert.Equal(t, time.Duration(0), l.wait())
+	assert.Equal(t, 500*time.Millisecond, l.wait())
+	assert.Equal(t, 500*time.Millisecond, l.wait())
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, 500 * time.Millisecond}, slept)
+
+	// 空いている間に burst まで溜まる
+	c.advance(time.Minute)
+	assert.Equal(t, time.Duration(0), l.wait())
+	assert.Equal(t, time.Duration(0), l.wait())
+	assert.Equal(t, 500*time.Millisecond, l.wait())
+}
+
+func TestLimiterTighten(t *testing.T) {
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	sleep := func(d time.Duration) { c.advance(d) }
+
+	l := newLimiter(FetchConfig{RateLimit: 0, Burst: 20}, c.now, sleep)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, time.Duration(0), l.wait())
+	}
+
+	// 同じホストの別のモジュールの低いほうの制限を使う
+	l.tighten(FetchConfig{RateLimit: 4, Burst: 1})
+	l.tighten(FetchConfig{RateLimit: 0, Burst: 20})
+	l.tighten(FetchConfig{RateLimit: 10, Burst: 5})
+	assert.Equal(t, time.Duration(0), l.wait())
+	assert.Equal(t, 250*time.Millisecond, l.wait())
+}
+
+type baseMetricSet struct {
+	mb.BaseMetricSet
+}
+
+func (baseMetricSet) Fetch() (common.MapStr, error) { return nil, nil }
+
+// testBase returns the BaseMetricSet of a stats metricset of the module
+// configuration.
+func testBase(t *testing.T, config map[string]interface{}) mb.BaseMetricSet {
+	r := mb.NewRegister()
+	err := r.AddMetricSet("sora", "stats", func(base mb.BaseMetricSet) (mb.MetricSet, error) {
+		return &baseMetricSet{base}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config["module"] = "sora"
+	config["metricsets"] = []string{"stats"}
+	c, err := common.NewConfigFrom(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, metricsets, err := mb.NewModule(c, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metricsets[0].(*baseMetricSet).BaseMetricSet
+}
+
+func TestFetcherTargets(t *testing.T) {
+	host := testHost("fetcher")
+	config := func(headers map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"hosts": []string{host}, "headers": headers}
+	}
+	first, err := NewTarget(testBase(t, config(nil)), "Sora_20171010.GetStatsReport")
+	assert.NoError(t, err)
+	same, err := NewTarget(testBase(t, config(nil)), "Sora_20171010.GetStatsReport")
+	assert.NoError(t, err)
+	other, err := NewTarget(testBase(t, config(map[string]interface{}{"authorization": "Bearer x"})), "Sora_20171010.GetStatsReport")
+	assert.NoError(t, err)
+
+	// 同じ設定のメトリックセットだけが応答を共有する
+	assert.True(t, first.shared == same.shared)
+	assert.False(t, first.shared == other.shared)
+	assert.True(t, first.fetcher == other.fetcher)
+	assert.Len(t, first.fetcher.targets, 2)
+
+	// 最後のメトリックセットが閉じたらホストを忘れる
+	f := first.fetcher
+	first.Close()
+	other.Close()
+	assert.Len(t, f.targets, 1)
+	fetchers.Lock()
+	assert.Equal(t, f, fetchers.hosts[host])
+	fetchers.Unlock()
+	same.Close()
+	same.Close()
+	assert.Empty(t, f.targets)
+	fetchers.Lock()
+	assert.NotContains(t, fetchers.hosts, host)
+	fetchers.Unlock()
+}
+
+func TestTargetPeriod(t *testing.T) {
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	shared := &sharedTarget{period: 10 * time.Second}
+	stats := &Target{shared: shared, used: -1}
+	license := &Target{shared: shared, used: -1}
+	requests := 0
+	request := func(scrape *Scrape) ([]byte, error) {
+		requests++
+		scrape.Status = 200
+		body := []byte(fmt.Sprintf(`{"total_ongoing_connections": %d, "erlang_vm": {}}`, requests))
+		scrape.Bytes += len(body)
+		return body, nil
+	}
+	fetch := func(target *Target) (common.MapStr, *Scrape) {
+		scrape := NewScrape("stats", c.now())
+		value, err := target.fetch(scrape, c.now(), request)
+		assert.NoError(t, err)
+		return common.MapStr(value.(map[string]interface{})), scrape
+	}
+
+	first, scrape := fetch(stats)
+	assert.False(t, scrape.Shared)
+	assert.True(t, scrape.Bytes > 0)
+
+	// 同じ周期のメトリックセットはデコードした応答の複製を使う
+	c.advance(4 * time.Second)
+	second, scrape := fetch(license)
+	assert.True(t, scrape.Shared)
+	assert.Equal(t, 200, scrape.Status)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, first, second)
+	second["erlang_vm"].(map[string]interface{})["changed"] = true
+	assert.Empty(t, first["erlang_vm"])
+
+	// タイマーが少し早く来ても次の周期として取得する
+	c.advance(5 * time.Second)
+	next, _ := fetch(stats)
+	assert.Equal(t, 2., next["total_ongoing_connections"])
+	c.advance(11 * time.Second)
+	fetch(license)
+	fetch(stats)
+	assert.Equal(t, 3, requests)
+
+	// 一度使った周期の応答は使わず、次の周期の分を取得する
+	again, _ := fetch(stats)
+	assert.Equal(t, 4., again["total_ongoing_connections"])
+	c.advance(10 * time.Second)
+	later, scrape := fetch(license)
+	assert.True(t, scrape.Shared)
+	assert.Equal(t, 4., later["total_ongoing_connections"])
+	assert.Equal(t, 4, requests)
+}
+
+func TestTargetPeriodError(t *testing.T) {
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	shared := &sharedTarget{period: 10 * time.Second}
+	connections := &Target{shared: shared, used: -1}
+	detail := &Target{shared: shared, used: -1}
+	requests := 0
+	request := func(scrape *Scrape) ([]byte, error) {
+		requests++
+		scrape.Status = 200
+		return []byte(`[{"channel_id": "sora"}, null`), nil
+	}
+
+	// 失敗した周期は他のメトリックセットも取得し直さない
+	_, err := connections.fetch(NewScrape("connections", c.now()), c.now(), request)
+	assert.Error(t, err)
+	scrape := NewScrape("connection_detail", c.now())
+	_, err = detail.fetch(scrape, c.now(), request)
+	assert.Error(t, err)
+	assert.Equal(t, ScrapeDecode, scrape.class)
+	assert.True(t, scrape.Shared)
+	assert.Equal(t, 1, requests)
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"unicode"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Number returns the value of a numeric field of the event, false when the
+// field is missing or not a number.
+func Number(event common.MapStr, field string) (float64, bool) {
+	v, err := event.GetValue(field)
+	if err != nil {
+		return 0, false
+	}
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// SnakeCase converts a camelCase key of getStats to snake_case like the
+// fields of Sora.
+func SnakeCase(s string) string {
+	var b []rune
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b = append(b, '_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b = append(b, r)
+	}
+	return string(b)
+}
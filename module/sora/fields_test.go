@@ -0,0 +1,48 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNumber(t *testing.T) {
+	event := common.MapStr{
+		"float": 1.5,
+		"int":   int64(2),
+		"text":  "3",
+		"rtp":   map[string]interface{}{"total_sent_bytes": 1024.},
+	}
+	for field, expected := range map[string]float64{"float": 1.5, "int": 2, "rtp.total_sent_bytes": 1024} {
+		value, ok := Number(event, field)
+		assert.True(t, ok, field)
+		assert.Equal(t, expected, value, field)
+	}
+	for _, field := range []string{"text", "missing"} {
+		_, ok := Number(event, field)
+		assert.False(t, ok, field)
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	assert.Equal(t, "bytes_received", SnakeCase("bytesReceived"))
+	assert.Equal(t, "current_round_trip_time", SnakeCase("currentRoundTripTime"))
+	assert.Equal(t, "ssrc", SnakeCase("ssrc"))
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"fmt"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+// Identity keys selectable with identity.key.
+const (
+	// IdentityAuto uses connection_id when Sora reports it, i.e. from Sora
+	// 19.04, and channel_client_id before.
+	IdentityAuto              = "auto"
+	IdentityChannelClient     = "channel_client_id"
+	IdentityChannelConnection = "channel_connection_id"
+	IdentityConnection        = "connection_id"
+	IdentityClient            = "client_id"
+)
+
+// IdentityConfig selects the key identifying a connection.
+type IdentityConfig struct {
+	Key string `config:"key"`
+}
+
+var defaultIdentityConfig = IdentityConfig{Key: IdentityAuto}
+
+// Validate checks the key.
+func (c *IdentityConfig) Validate() error {
+	switch c.Key {
+	case IdentityAuto, IdentityChannelClient, IdentityChannelConnection, IdentityConnection, IdentityClient:
+		return nil
+	}
+	return fmt.Errorf("invalid identity.key '%s'", c.Key)
+}
+
+// Identity sets the identity field of the connection documents. It is only
+// a label to display and group the connections by, e.g. in the dashboards:
+// the state kept per connection across fetches is keyed by ConnectionKey.
+type Identity struct {
+	key string
+}
+
+// NewIdentity creates the Identity from the module configuration.
+func NewIdentity(base mb.BaseMetricSet) (*Identity, error) {
+	config := struct {
+		Identity IdentityConfig `config:"identity"`
+	}{
+		Identity: defaultIdentityConfig,
+	}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	return &Identity{key: config.Identity.Key}, nil
+}
+
+// Of returns the identity of a connection. The keys with connection_id fall
+// back to channel_client_id for the Sora releases without connection_id.
+func (i *Identity) Of(channelID, clientID, connectionID string) string {
+	switch {
+	case i.key == IdentityClient:
+		return clientID
+	case connectionID == "" || i.key == IdentityChannelClient:
+		return channelID + "/" + clientID
+	case i.key == IdentityChannelConnection:
+		return channelID + "/" + connectionID
+	}
+	return connectionID
+}
+
+// Annotate sets the identity field of the event from its channel_id,
+// client_id and connection_id fields, and returns it.
+func (i *Identity) Annotate(event common.MapStr) string {
+	channelID, _ := event["channel_id"].(string)
+	clientID, _ := event["client_id"].(string)
+	connectionID, _ := event["connection_id"].(string)
+	id := i.Of(channelID, clientID, connectionID)
+	event["identity"] = id
+	return id
+}
+
+// ConnectionKey returns the key of the state kept per connection across
+// fetches, such as counters: the channel_id with the connection_id, or with
+// the client_id for the Sora releases without connection_id. Unlike the
+// identity, it does not depend on identity.key, so that two connections of
+// a client are never mixed up.
+func ConnectionKey(event common.MapStr) string {
+	channelID, _ := event["channel_id"].(string)
+	id, _ := event["connection_id"].(string)
+	if id == "" {
+		id, _ = event["client_id"].(string)
+	}
+	return channelID + "/" + id
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentity(t *testing.T) {
+	for _, c := range []struct {
+		key        string
+		connection string
+		legacy     string
+	}{
+		{IdentityAuto, "CONN", "sora/client"},
+		{IdentityConnection, "CONN", "sora/client"},
+		{IdentityChannelConnection, "sora/CONN", "sora/client"},
+		{IdentityChannelClient, "sora/client", "sora/client"},
+		{IdentityClient, "client", "client"},
+	} {
+		i := &Identity{key: c.key}
+		// connection_id のない Sora 18.10.04 以前
+		assert.Equal(t, c.legacy, i.Of("sora", "client", ""), c.key)
+		assert.Equal(t, c.connection, i.Of("sora", "client", "CONN"), c.key)
+	}
+
+	event := common.MapStr{"channel_id": "sora", "client_id": "client", "connection_id": "CONN"}
+	assert.Equal(t, "CONN", (&Identity{key: IdentityAuto}).Annotate(event))
+	assert.Equal(t, "CONN", event["identity"])
+}
+
+func TestIdentityConfigValidate(t *testing.T) {
+	c := defaultIdentityConfig
+	assert.NoError(t, c.Validate())
+	c.Key = "session_id"
+	assert.Error(t, c.Validate())
+}
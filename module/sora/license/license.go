@@ -0,0 +1,226 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package license
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/elastic/beats/metricbeat/mb/parse"
+
+	"github.com/shiguredo/sorabeat/module/sora"
+)
+
+// init registers the MetricSet with the central registry.
+// The New method will be called after the setup of the module and before starting to fetch data
+func init() {
+	if err := mb.Registry.AddMetricSet("sora", "license", New, hostParser); err != nil {
+		panic(err)
+	}
+}
+
+const (
+	defaultScheme = "http"
+	httpPath      = "/"
+
+	licenseTarget = "Sora_20171218.GetLicense"
+	statsTarget   = "Sora_20171010.GetStatsReport"
+)
+
+// Reasons reported in sora.license.warning.reason.
+const (
+	WarningExpiring = "expiring"
+	WarningExpired  = "expired"
+)
+
+var hostParser = parse.URLHostParserBuilder{
+	DefaultScheme: defaultScheme,
+	DefaultPath:   httpPath,
+}.Build()
+
+// licenseFields are the fields of the license information copied as is.
+var licenseFields = []string{"product_name", "license_type", "serial_code", "subscriber"}
+
+type config struct {
+	License struct {
+		// WarningDays is how many days before the expiry a warning event is
+		// emitted, once a day.
+		WarningDays int `config:"warning_days" validate:"min=0"`
+	} `config:"license"`
+}
+
+// MetricSet reports the license of Sora and its utilization by the ongoing
+// connections.
+type MetricSet struct {
+	mb.BaseMetricSet
+	license     *sora.Target
+	stats       *sora.Target
+	warningDays int
+	features    *sora.Features
+	now         func() time.Time
+	// 最後に警告した残り日数。警告は 1 日 1 回にする
+	warned *int64
+}
+
+// New create a new instance of the MetricSet
+// Part of new is also setting up the configuration by processing additional
+// configuration entries if needed.
+func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
+	config := config{}
+	config.License.WarningDays = 30
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+
+	license, err := sora.NewTarget(base, licenseTarget)
+	if err != nil {
+		return nil, err
+	}
+	// 接続数は stats メトリックセットと同じ応答を使う
+	stats, err := sora.NewTarget(base, statsTarget)
+	if err != nil {
+		license.Close()
+		return nil, err
+	}
+
+	features, err := sora.NewFeatures(base)
+	if err != nil {
+		license.Close()
+		stats.Close()
+		return nil, err
+	}
+
+	return &MetricSet{
+		BaseMetricSet: base,
+		license:       license,
+		stats:         stats,
+		warningDays:   config.License.WarningDays,
+		features:      features,
+		now:           time.Now,
+	}, nil
+}
+
+// Fetch returns the license event, followed by a warning event when the
+// license expires within the warning window or has expired.
+func (m *MetricSet) Fetch() ([]common.MapStr, error) {
+	return m.features.Fetch(m.events, nil)
+}
+
+// Close stops the alert notifications and releases the targets.
+func (m *MetricSet) Close() error {
+	m.license.Close()
+	m.stats.Close()
+	return m.features.Close()
+}
+
+// events returns the license event and the warning event of a fetch.
+func (m *MetricSet) events(scrape *sora.Scrape) ([]common.MapStr, error) {
+	event, err := m.fetch(scrape, m.now())
+	if event == nil {
+		return nil, err
+	}
+
+	events := []common.MapStr{event}
+	if warning := m.warn(event); warning != nil {
+		events = append(events, warning)
+	}
+	return events, err
+}
+
+// fetch returns the license event. When the connection count cannot be
+// fetched, it returns the event without the utilization with the error.
+func (m *MetricSet) fetch(scrape *sora.Scrape, now time.Time) (common.MapStr, error) {
+	license, err := m.license.FetchMap(scrape)
+	if err != nil {
+		return nil, err
+	}
+
+	event := common.MapStr{}
+	for _, key := range licenseFields {
+		if value, ok := license[key].(string); ok {
+			event[key] = value
+		}
+	}
+	max, hasMax := license["max_connections"].(float64)
+	if hasMax {
+		event["max_connections"] = int64(max)
+	}
+	if value, ok := license["expired_at"].(string); ok {
+		expiry, err := parseExpiry(value)
+		if err != nil {
+			return nil, err
+		}
+		event["expired_at"] = expiry.UTC().Format(time.RFC3339)
+		// 期限を過ぎると負になる
+		event["days_remaining"] = int64(math.Floor(expiry.Sub(now).Hours() / 24))
+		event["expired"] = !now.Before(expiry)
+	}
+
+	stats, err := m.stats.FetchMap(scrape)
+	if err == nil {
+		if connections, ok := stats["total_ongoing_connections"].(float64); ok {
+			scrape.Connections = int(connections)
+			event["connections"] = int64(connections)
+			if hasMax && max > 0 {
+				event["utilization"] = connections / max
+			}
+		}
+	}
+	return event, err
+}
+
+// parseExpiry は日付だけのときはその日の終わり (UTC) を期限とする
+func parseExpiry(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid license expired_at '%s': %v", value, err)
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+// warn returns the warning event once a day while the license expires within
+// the warning window, or has expired.
+func (m *MetricSet) warn(event common.MapStr) common.MapStr {
+	days, ok := event["days_remaining"].(int64)
+	if !ok || days >= int64(m.warningDays) {
+		m.warned = nil
+		return nil
+	}
+	if m.warned != nil && *m.warned == days {
+		return nil
+	}
+	m.warned = &days
+
+	reason, message := WarningExpiring, fmt.Sprintf("Sora license expires in %d days", days)
+	if event["expired"] == true {
+		reason, message = WarningExpired, "Sora license has expired"
+	}
+	logp.Warn("%s (%s, expired_at %v)", message, m.Host(), event["expired_at"])
+	return common.MapStr{
+		"warning": common.MapStr{
+			"reason":         reason,
+			"message":        message,
+			"days_remaining": days,
+			"expired_at":     event["expired_at"],
+		},
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package license
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
+
+	"github.com/shiguredo/sorabeat/module/sora/soratest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFetcher(t *testing.T, config map[string]interface{}, now *time.Time) *MetricSet {
+	f := mbtest.NewEventsFetcher(t, config)
+	m := f.(*MetricSet)
+	m.now = func() time.Time { return *now }
+	return m
+}
+
+func TestFetchEventContents(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	server.OnRequest(soratest.RequireTarget(t, soratest.GetLicense, soratest.GetStatsReport))
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := newFetcher(t, getConfig(server.URL), &now)
+	events, err := m.Fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 1) {
+		t.FailNow()
+	}
+
+	event := events[0]
+	assert.Equal(t, "Sora Enterprise", event["license_type"])
+	assert.Equal(t, "SRA-E-0123-4567-89AB", event["serial_code"])
+	assert.Equal(t, int64(500), event["max_connections"])
+	assert.Equal(t, "2020-05-01T00:00:00Z", event["expired_at"])
+	assert.Equal(t, int64(120), event["days_remaining"])
+	assert.Equal(t, false, event["expired"])
+	assert.Equal(t, int64(3), event["connections"])
+	assert.InDelta(t, 0.006, event["utilization"], 1e-9)
+}
+
+func TestFetchWarning(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	now := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	config := getConfig(server.URL)
+	config["license.warning_days"] = 14
+	m := newFetcher(t, config, &now)
+
+	events, err := m.Fetch()
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+
+	now = time.Date(2020, 4, 20, 9, 0, 0, 0, time.UTC)
+	events, err = m.Fetch()
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		warning := events[1]["warning"].(common.MapStr)
+		assert.Equal(t, WarningExpiring, warning["reason"])
+		assert.Equal(t, int64(10), warning["days_remaining"])
+		assert.Equal(t, "2020-05-01T00:00:00Z", warning["expired_at"])
+	}
+
+	// 同じ日のうちは繰り返さない
+	now = now.Add(time.Hour)
+	events, _ = m.Fetch()
+	assert.Len(t, events, 1)
+	now = now.Add(24 * time.Hour)
+	events, _ = m.Fetch()
+	assert.Len(t, events, 2)
+
+	now = time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	events, _ = m.Fetch()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, true, events[0]["expired"])
+		assert.Equal(t, int64(0), events[0]["days_remaining"])
+		assert.Equal(t, WarningExpired, events[1]["warning"].(common.MapStr)["reason"])
+	}
+}
+
+func TestFetchStatsError(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	server.Inject(soratest.GetStatsReport, soratest.Fault{Status: 503})
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := newFetcher(t, getConfig(server.URL), &now)
+	events, err := m.Fetch()
+	assert.Error(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, int64(500), events[0]["max_connections"])
+		assert.NotContains(t, events[0], "utilization")
+	}
+}
+
+func TestFetchUnsupported(t *testing.T) {
+	// GetLicense のない Sora
+	server := soratest.NewServer(t, "18.10.04")
+	defer server.Close()
+
+	now := time.Now()
+	m := newFetcher(t, getConfig(server.URL), &now)
+	events, err := m.Fetch()
+	assert.Error(t, err)
+	assert.Nil(t, events)
+}
+
+func TestParseExpiry(t *testing.T) {
+	expiry, err := parseExpiry("2020-04-30T15:00:00+09:00")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2020, 4, 30, 6, 0, 0, 0, time.UTC), expiry.UTC())
+
+	_, err = parseExpiry("April 30")
+	assert.Error(t, err)
+}
+
+func TestData(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := newFetcher(t, getConfig(server.URL), &now)
+	events, err := m.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ホストはテストのたびに変わるのでサンプルでは固定する
+	fullEvent := mbtest.CreateFullEvent(m, events[0])
+	fullEvent.Fields.Put("metricset.host", "localhost:3000")
+	mbtest.WriteEventToDataJSON(t, fullEvent)
+}
+
+func getConfig(host string) map[string]interface{} {
+	return map[string]interface{}{
+		"module":     "sora",
+		"metricsets": []string{"license"},
+		"hosts":      []string{host},
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+// Persists reports whether the metricsets of the module save their state,
+// i.e. the Sora instances, the anomaly models and the accounting, under the
+// data path. It is the persist option of the module, true by default.
+// sorabeat top disables it so that it does not write over the state of the
+// running Sorabeat.
+func Persists(base mb.BaseMetricSet) (bool, error) {
+	config := struct {
+		Persist bool `config:"persist"`
+	}{
+		Persist: true,
+	}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return false, err
+	}
+	return config.Persist, nil
+}
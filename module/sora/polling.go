@@ -0,0 +1,308 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+// Reasons reported in metricset.polling.reason for the current interval.
+const (
+	ReasonSteady = "steady"
+	ReasonError  = "error"
+	ReasonSlow   = "slow"
+	ReasonLarge  = "large"
+	ReasonChurn  = "churn"
+)
+
+// PollingConfig configures adaptive polling. It is read from the adaptive
+// section of the module configuration.
+type PollingConfig struct {
+	Enabled bool `config:"enabled"`
+	// Interval is the interval used while Sora is healthy and steady.
+	Interval time.Duration `config:"interval" validate:"positive"`
+	// MaxInterval bounds the back off.
+	MaxInterval time.Duration `config:"max_interval" validate:"positive"`
+	// SlowResponse is the response time above which polling backs off.
+	SlowResponse time.Duration `config:"slow_response" validate:"positive"`
+	// LargeResponse is the response size in bytes above which polling backs off.
+	LargeResponse int `config:"large_response" validate:"min=1"`
+	// Churn is the relative change of the connection count above which the
+	// interval is tightened.
+	Churn float64 `config:"churn" validate:"positive"`
+	// Jitter is the fraction of the interval randomly added to or removed
+	// from the retry interval after an error.
+	Jitter float64 `config:"jitter" validate:"min=0"`
+}
+
+// DefaultPollingConfig is the adaptive polling configuration used for unset
+// options.
+var DefaultPollingConfig = PollingConfig{
+	Interval:      10 * time.Second,
+	MaxInterval:   5 * time.Minute,
+	SlowResponse:  2 * time.Second,
+	LargeResponse: 10 * 1024 * 1024,
+	Churn:         0.2,
+	Jitter:        0.2,
+}
+
+// Validate checks the adaptive polling configuration.
+func (c *PollingConfig) Validate() error {
+	if c.MaxInterval < c.Interval {
+		return errors.New("adaptive.max_interval must not be smaller than adaptive.interval")
+	}
+	if c.Jitter >= 1 {
+		return errors.New("adaptive.jitter must be smaller than 1")
+	}
+	return nil
+}
+
+// Observation is the outcome of a fetch reported to the Scheduler.
+type Observation struct {
+	Duration time.Duration
+	Size     int
+	Err      error
+	// Connections is the number of connections Sora reported, -1 if unknown.
+	Connections int
+}
+
+// Scheduler decides when a metricset fetches from Sora. The module period
+// is the shortest interval; fetches are skipped until the adaptive interval
+// has passed. The interval doubles up to MaxInterval when Sora answers slowly,
+// with large responses or errors, halves down to the period while the number
+// of connections changes fast and goes back to Interval otherwise.
+type Scheduler struct {
+	mu          sync.Mutex
+	config      PollingConfig
+	period      time.Duration
+	interval    time.Duration
+	jitter      time.Duration
+	reason      string
+	retries     int
+	connections int
+	next        time.Time
+
+	now  func() time.Time
+	rand *rand.Rand
+}
+
+// NewScheduler creates a Scheduler for a metricset of the module.
+func NewScheduler(base mb.BaseMetricSet) (*Scheduler, error) {
+	config := struct {
+		Adaptive PollingConfig `config:"adaptive"`
+	}{
+		Adaptive: DefaultPollingConfig,
+	}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	return newScheduler(config.Adaptive, base.Module().Config().Period, time.Now), nil
+}
+
+func newScheduler(config PollingConfig, period time.Duration, now func() time.Time) *Scheduler {
+	interval := config.Interval
+	if interval < period {
+		interval = period
+	}
+	return &Scheduler{
+		config:      config,
+		period:      period,
+		interval:    interval,
+		reason:      ReasonSteady,
+		connections: -1,
+		now:         now,
+		rand:        rand.New(rand.NewSource(now().UnixNano())),
+	}
+}
+
+// Due reports whether the metricset should fetch now. It is always true when
+// adaptive polling is disabled.
+func (s *Scheduler) Due() bool {
+	if !s.config.Enabled {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 周期のタイマーは多少ずれるので半周期の余裕を持たせる
+	return !s.now().Add(s.period / 2).Before(s.next)
+}
+
+// Observe adapts the interval to the outcome of a fetch and returns the
+// module fields describing it, to be set under mb.ModuleDataKey. The pipeline
+// returned by Pipeline publishes them as metricset.polling. It returns nil
+// when adaptive polling is disabled.
+func (s *Scheduler) Observe(o Observation) common.MapStr {
+	if !s.config.Enabled {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jitter = 0
+	switch {
+	case o.Err != nil:
+		s.retries++
+		s.reason = ReasonError
+		s.interval = s.backoff()
+		// 複数の sorabeat が同時に再試行しないようにずらす
+		if s.config.Jitter > 0 {
+			max := int64(float64(s.interval/time.Millisecond) * s.config.Jitter)
+			s.jitter = time.Duration(s.rand.Int63n(2*max+1)-max) * time.Millisecond
+		}
+	case o.Duration > s.config.SlowResponse:
+		s.retries = 0
+		s.reason = ReasonSlow
+		s.interval = s.backoff()
+	case o.Size > s.config.LargeResponse:
+		s.retries = 0
+		s.reason = ReasonLarge
+		s.interval = s.backoff()
+	case s.churned(o.Connections):
+		s.retries = 0
+		s.reason = ReasonChurn
+		s.interval /= 2
+		if s.interval < s.period {
+			s.interval = s.period
+		}
+	default:
+		s.retries = 0
+		s.reason = ReasonSteady
+		s.interval = s.relax()
+	}
+	if o.Err == nil && o.Connections >= 0 {
+		s.connections = o.Connections
+	}
+
+	s.next = s.now().Add(s.interval + s.jitter)
+	return common.MapStr{
+		"polling": common.MapStr{
+			"interval": int64((s.interval + s.jitter) / time.Millisecond),
+			"jitter":   int64(s.jitter / time.Millisecond),
+			"retries":  s.retries,
+			"reason":   s.reason,
+		},
+	}
+}
+
+// Interval returns the current interval without jitter.
+func (s *Scheduler) Interval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.interval
+}
+
+func (s *Scheduler) backoff() time.Duration {
+	interval := s.interval * 2
+	if interval > s.config.MaxInterval {
+		interval = s.config.MaxInterval
+	}
+	if interval < s.period {
+		interval = s.period
+	}
+	return interval
+}
+
+// relax moves the interval back towards the configured interval.
+func (s *Scheduler) relax() time.Duration {
+	base := s.config.Interval
+	if base < s.period {
+		base = s.period
+	}
+	switch {
+	case s.interval > base:
+		if interval := s.interval / 2; interval > base {
+			return interval
+		}
+	case s.interval < base:
+		if interval := s.interval * 2; interval < base {
+			return interval
+		}
+	}
+	return base
+}
+
+func (s *Scheduler) churned(connections int) bool {
+	if connections < 0 || s.connections < 0 {
+		return false
+	}
+	diff := connections - s.connections
+	if diff < 0 {
+		diff = -diff
+	}
+	last := s.connections
+	if last < 1 {
+		last = 1
+	}
+	return float64(diff)/float64(last) >= s.config.Churn
+}
+
+// Pipeline wraps the publisher pipeline of the beat so that the polling
+// fields the metricsets set under mb.ModuleDataKey are published under
+// metricset.polling with the other fields of the metricset. Metricsets can
+// only set fields under the module themselves.
+func Pipeline(p beat.Pipeline) beat.Pipeline {
+	return pollingPipeline{p}
+}
+
+type pollingPipeline struct {
+	beat.Pipeline
+}
+
+func (p pollingPipeline) Connect() (beat.Client, error) {
+	return p.ConnectWith(beat.ClientConfig{})
+}
+
+func (p pollingPipeline) ConnectWith(config beat.ClientConfig) (beat.Client, error) {
+	config.Processor = pollingProcessors{config.Processor}
+	return p.Pipeline.ConnectWith(config)
+}
+
+// pollingProcessors は設定された processor より先に polling を移して、
+// drop_fields などで metricset.polling を扱えるようにする
+type pollingProcessors struct {
+	beat.ProcessorList
+}
+
+func (p pollingProcessors) All() []beat.Processor {
+	all := []beat.Processor{movePolling{}}
+	if p.ProcessorList != nil {
+		all = append(all, p.ProcessorList.All()...)
+	}
+	return all
+}
+
+// movePolling moves sora.polling to metricset.polling.
+type movePolling struct{}
+
+func (movePolling) String() string {
+	return "sora_polling"
+}
+
+func (movePolling) Run(event *beat.Event) (*beat.Event, error) {
+	polling, err := event.Fields.GetValue("sora.polling")
+	if err != nil {
+		return event, nil
+	}
+	event.Fields.Delete("sora.polling")
+	event.Fields.Put("metricset.polling", polling)
+	return event, nil
+}
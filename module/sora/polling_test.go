@@ -0,0 +1,193 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func testPollingConfig() PollingConfig {
+	config := DefaultPollingConfig
+	config.Enabled = true
+	return config
+}
+
+func polling(fields common.MapStr) common.MapStr {
+	return fields["polling"].(common.MapStr)
+}
+
+func newTestScheduler(config PollingConfig) (*Scheduler, *clock) {
+	c := &clock{t: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)}
+	return newScheduler(config, time.Second, c.now), c
+}
+
+func TestSchedulerDisabled(t *testing.T) {
+	s, _ := newTestScheduler(DefaultPollingConfig)
+	assert.True(t, s.Due())
+	assert.Nil(t, s.Observe(Observation{Err: errors.New("down"), Connections: -1}))
+	assert.True(t, s.Due())
+}
+
+func TestSchedulerSkipsUntilInterval(t *testing.T) {
+	s, c := newTestScheduler(testPollingConfig())
+	assert.True(t, s.Due())
+
+	fields := s.Observe(Observation{Connections: 10})
+	assert.Equal(t, int64(10000), polling(fields)["interval"])
+	assert.Equal(t, ReasonSteady, polling(fields)["reason"])
+
+	c.advance(time.Second)
+	assert.False(t, s.Due())
+	c.advance(8 * time.Second)
+	assert.False(t, s.Due())
+	// 周期のずれを吸収する
+	c.advance(900 * time.Millisecond)
+	assert.True(t, s.Due())
+}
+
+func TestSchedulerBacksOff(t *testing.T) {
+	config := testPollingConfig()
+	config.MaxInterval = 30 * time.Second
+	s, _ := newTestScheduler(config)
+
+	fields := s.Observe(Observation{Duration: 3 * time.Second, Connections: -1})
+	assert.Equal(t, ReasonSlow, polling(fields)["reason"])
+	assert.Equal(t, 20*time.Second, s.Interval())
+
+	fields = s.Observe(Observation{Size: 20 * 1024 * 1024, Connections: -1})
+	assert.Equal(t, ReasonLarge, polling(fields)["reason"])
+	assert.Equal(t, 30*time.Second, s.Interval())
+
+	// 落ち着いたら設定の間隔に戻る
+	s.Observe(Observation{Connections: -1})
+	assert.Equal(t, 15*time.Second, s.Interval())
+	s.Observe(Observation{Connections: -1})
+	assert.Equal(t, 10*time.Second, s.Interval())
+}
+
+func TestSchedulerJitteredRetries(t *testing.T) {
+	s, c := newTestScheduler(testPollingConfig())
+
+	for i := 1; i <= 3; i++ {
+		fields := polling(s.Observe(Observation{Err: errors.New("down"), Connections: -1}))
+		assert.Equal(t, ReasonError, fields["reason"])
+		assert.Equal(t, i, fields["retries"])
+
+		interval := s.Interval()
+		jitter := time.Duration(fields["jitter"].(int64)) * time.Millisecond
+		assert.True(t, jitter <= interval/5 && jitter >= -interval/5, "jitter %v", jitter)
+		assert.Equal(t, int64((interval+jitter)/time.Millisecond), fields["interval"])
+
+		c.advance(interval + jitter)
+		assert.True(t, s.Due())
+	}
+	assert.Equal(t, 80*time.Second, s.Interval())
+
+	fields := polling(s.Observe(Observation{Connections: -1}))
+	assert.Equal(t, 0, fields["retries"])
+	assert.Equal(t, int64(0), fields["jitter"])
+}
+
+func TestSchedulerTightensOnChurn(t *testing.T) {
+	s, _ := newTestScheduler(testPollingConfig())
+
+	s.Observe(Observation{Connections: 100})
+	fields := s.Observe(Observation{Connections: 150})
+	assert.Equal(t, ReasonChurn, polling(fields)["reason"])
+	assert.Equal(t, 5*time.Second, s.Interval())
+
+	for _, n := range []int{200, 300, 450, 700} {
+		s.Observe(Observation{Connections: n})
+	}
+	// 周期より短くはならない
+	assert.Equal(t, time.Second, s.Interval())
+
+	// 小さな変化では元に戻っていく
+	s.Observe(Observation{Connections: 710})
+	assert.Equal(t, 2*time.Second, s.Interval())
+}
+
+func TestPollingConfigValidate(t *testing.T) {
+	config := DefaultPollingConfig
+	assert.NoError(t, config.Validate())
+
+	config.MaxInterval = time.Second
+	assert.Error(t, config.Validate())
+
+	config = DefaultPollingConfig
+	config.Jitter = 1
+	assert.Error(t, config.Validate())
+}
+
+// capturePipeline records the configuration of the clients.
+type capturePipeline struct {
+	beat.Pipeline
+	config beat.ClientConfig
+}
+
+func (p *capturePipeline) ConnectWith(config beat.ClientConfig) (beat.Client, error) {
+	p.config = config
+	return nil, nil
+}
+
+func TestPipelineMovesPolling(t *testing.T) {
+	captured := &capturePipeline{}
+	_, err := Pipeline(captured).Connect()
+	assert.NoError(t, err)
+	processors := captured.config.Processor.All()
+	if !assert.Len(t, processors, 1) {
+		return
+	}
+
+	event := &beat.Event{Fields: common.MapStr{
+		"metricset": common.MapStr{"module": "sora", "name": "stats"},
+		"sora": common.MapStr{
+			"stats":   common.MapStr{"total_ongoing_connections": 1},
+			"polling": common.MapStr{"reason": ReasonSteady},
+		},
+	}}
+	event, err = processors[0].Run(event)
+	assert.NoError(t, err)
+	assert.Equal(t, common.MapStr{
+		"metricset": common.MapStr{
+			"module":  "sora",
+			"name":    "stats",
+			"polling": common.MapStr{"reason": ReasonSteady},
+		},
+		"sora": common.MapStr{
+			"stats": common.MapStr{"total_ongoing_connections": 1},
+		},
+	}, event.Fields)
+
+	// polling のないイベントはそのまま
+	event, err = processors[0].Run(&beat.Event{Fields: common.MapStr{"sora": common.MapStr{}}})
+	assert.NoError(t, err)
+	assert.Equal(t, common.MapStr{"sora": common.MapStr{}}, event.Fields)
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+// minPseudonymizeKey is the shortest key accepted, in bytes.
+const minPseudonymizeKey = 16
+
+// PseudonymizeConfig configures the replacement of the client identifiers
+// by keyed hashes.
+type PseudonymizeConfig struct {
+	Enabled bool `config:"enabled"`
+	// Key is the HMAC key, usually a ${VAR} reference so that it is not
+	// written in the configuration file. Beats 6.0 has no keystore, so the
+	// reference is resolved from the environment of the process.
+	Key string `config:"key"`
+	// Fields are the names of the fields to replace, at any depth. The
+	// names are compared without case and underscores, so that address
+	// matches both remote_address and remoteAddress.
+	Fields []string `config:"fields"`
+}
+
+var defaultPseudonymizeConfig = PseudonymizeConfig{
+	Fields: []string{
+		"client_id", "connection_id",
+		"address", "ip", "ip_address", "remote_address", "local_address", "related_address",
+	},
+}
+
+// Validate checks that a long enough key is set when enabled.
+func (c *PseudonymizeConfig) Validate() error {
+	if c.Enabled && len(c.Key) < minPseudonymizeKey {
+		return errors.New("pseudonymize.key must be at least 16 bytes long")
+	}
+	return nil
+}
+
+// Pseudonymizer replaces the client identifiers and the addresses of the
+// events by HMAC-SHA256 hashes, so that the same value gets the same hash
+// and documents can still be joined.
+type Pseudonymizer struct {
+	key    []byte
+	fields map[string]bool
+}
+
+// NewPseudonymizer creates the Pseudonymizer of a metricset from the module
+// configuration. It changes nothing when pseudonymize.enabled is false.
+func NewPseudonymizer(base mb.BaseMetricSet) (*Pseudonymizer, error) {
+	config := struct {
+		Pseudonymize PseudonymizeConfig `config:"pseudonymize"`
+	}{
+		Pseudonymize: defaultPseudonymizeConfig,
+	}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	return newPseudonymizer(config.Pseudonymize), nil
+}
+
+func newPseudonymizer(config PseudonymizeConfig) *Pseudonymizer {
+	p := &Pseudonymizer{fields: map[string]bool{}}
+	if !config.Enabled {
+		return p
+	}
+	p.key = []byte(config.Key)
+	for _, field := range config.Fields {
+		p.fields[fieldName(field)] = true
+	}
+	return p
+}
+
+// fieldName は remote_address と remoteAddress を同じ名前として扱う
+func fieldName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+// Hash returns the hash of the value of the field, or the value when the
+// field is not pseudonymized.
+func (p *Pseudonymizer) Hash(field, value string) string {
+	if p.key == nil || value == "" || !p.fields[fieldName(field)] {
+		return value
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Apply replaces the string values of the pseudonymized fields of the event,
+// including the nested ones. It must run before the fields are combined,
+// e.g. into channel_client_id.
+func (p *Pseudonymizer) Apply(event common.MapStr) {
+	if p.key == nil {
+		return
+	}
+	p.apply(event)
+}
+
+func (p *Pseudonymizer) apply(m map[string]interface{}) {
+	for key, value := range m {
+		m[key] = p.applyValue(key, value)
+	}
+}
+
+// applyValue は配列の中も見る。getStats の候補の一覧などはマップの配列で、
+// 配列の要素の文字列はその配列のフィールドの名前で判断する
+func (p *Pseudonymizer) applyValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return p.Hash(key, v)
+	case common.MapStr:
+		p.apply(v)
+	case map[string]interface{}:
+		p.apply(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = p.applyValue(key, v[i])
+		}
+	case []common.MapStr:
+		for _, m := range v {
+			p.apply(m)
+		}
+	case []map[string]interface{}:
+		for _, m := range v {
+			p.apply(m)
+		}
+	case []string:
+		for i := range v {
+			v[i] = p.Hash(key, v[i])
+		}
+	}
+	return value
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPseudonymizeKey = "0123456789abcdef0123456789abcdef"
+
+func TestPseudonymizer(t *testing.T) {
+	config := defaultPseudonymizeConfig
+	config.Enabled = true
+	config.Key = testPseudonymizeKey
+	p := newPseudonymizer(config)
+
+	hash := p.Hash("client_id", "f43ca35b")
+	assert.Len(t, hash, 32)
+	assert.NotEqual(t, "f43ca35b", hash)
+	assert.Equal(t, hash, p.Hash("client_id", "f43ca35b"))
+	assert.Equal(t, "sora", p.Hash("channel_id", "sora"))
+	assert.Equal(t, "", p.Hash("client_id", ""))
+
+	// 鍵が違えば別の値になる
+	config.Key = testPseudonymizeKey + "x"
+	assert.NotEqual(t, hash, newPseudonymizer(config).Hash("client_id", "f43ca35b"))
+
+	event := common.MapStr{
+		"channel_id":    "sora",
+		"client_id":     "f43ca35b",
+		"connection_id": 1.,
+		"candidate": map[string]interface{}{
+			"remoteAddress": "192.0.2.1",
+			"port":          3478.,
+		},
+		"rtp": common.MapStr{"ip": "192.0.2.2"},
+	}
+	p.Apply(event)
+	assert.Equal(t, "sora", event["channel_id"])
+	assert.Equal(t, hash, event["client_id"])
+	// 文字列以外は変えない
+	assert.Equal(t, 1., event["connection_id"])
+	address, _ := event.GetValue("candidate.remoteAddress")
+	assert.Equal(t, p.Hash("remote_address", "192.0.2.1"), address)
+	ip, _ := event.GetValue("rtp.ip")
+	assert.Equal(t, p.Hash("ip", "192.0.2.2"), ip)
+}
+
+func TestPseudonymizerArrays(t *testing.T) {
+	config := defaultPseudonymizeConfig
+	config.Enabled = true
+	config.Key = testPseudonymizeKey
+	p := newPseudonymizer(config)
+
+	event := common.MapStr{
+		"candidates": []interface{}{
+			map[string]interface{}{"address": "192.0.2.1", "protocol": "udp"},
+			common.MapStr{"relatedAddress": "192.0.2.2"},
+			[]interface{}{map[string]interface{}{"ip": "192.0.2.3"}},
+		},
+		"ip":         []interface{}{"192.0.2.4", 1.},
+		"channel_id": []interface{}{"sora"},
+	}
+	p.Apply(event)
+	candidates := event["candidates"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"address": p.Hash("address", "192.0.2.1"), "protocol": "udp"}, candidates[0])
+	assert.Equal(t, common.MapStr{"relatedAddress": p.Hash("related_address", "192.0.2.2")}, candidates[1])
+	assert.Equal(t, []interface{}{map[string]interface{}{"ip": p.Hash("ip", "192.0.2.3")}}, candidates[2])
+	assert.Equal(t, []interface{}{p.Hash("ip", "192.0.2.4"), 1.}, event["ip"])
+	assert.Equal(t, []interface{}{"sora"}, event["channel_id"])
+}
+
+func TestPseudonymizerDisabled(t *testing.T) {
+	p := newPseudonymizer(defaultPseudonymizeConfig)
+	event := common.MapStr{"client_id": "f43ca35b"}
+	p.Apply(event)
+	assert.Equal(t, "f43ca35b", event["client_id"])
+	assert.Equal(t, "f43ca35b", p.Hash("client_id", "f43ca35b"))
+}
+
+func TestPseudonymizeConfigValidate(t *testing.T) {
+	config := defaultPseudonymizeConfig
+	assert.NoError(t, config.Validate())
+	config.Enabled = true
+	assert.Error(t, config.Validate())
+	config.Key = testPseudonymizeKey
+	assert.NoError(t, config.Validate())
+}
@@ -0,0 +1,235 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recording
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/elastic/beats/metricbeat/mb/parse"
+
+	"github.com/shiguredo/sorabeat/module/sora"
+)
+
+// init registers the MetricSet with the central registry.
+// The New method will be called after the setup of the module and before starting to fetch data
+func init() {
+	if err := mb.Registry.AddMetricSet("sora", "recording", New, hostParser); err != nil {
+		panic(err)
+	}
+}
+
+const (
+	defaultScheme = "http"
+	httpPath      = "/"
+	listTarget    = "Sora_20170814.ListRecording"
+)
+
+var (
+	hostParser = parse.URLHostParserBuilder{
+		DefaultScheme: defaultScheme,
+		DefaultPath:   httpPath,
+	}.Build()
+
+	debugf = logp.MakeDebug("sora.recording")
+)
+
+type config struct {
+	Recording struct {
+		// Listen is the address of the HTTP listener receiving the event
+		// webhooks. The webhooks are not received when empty. The webhooks
+		// do not tell which Sora sent them, so the module must have a
+		// single host.
+		Listen string `config:"listen"`
+		// Path is the HTTP path Sora posts the event webhooks to.
+		Path string `config:"path"`
+		// MaxBodySize limits the size of a request body in bytes.
+		MaxBodySize int64 `config:"max_body_size" validate:"min=1"`
+		// TrackUploads expects an archive.uploaded or archive.upload_failed
+		// event for every archive.
+		TrackUploads bool `config:"track_uploads"`
+		// StuckAfter is how long an upload may be pending, or a stopped
+		// recording may have no archive, before the recording is stuck.
+		StuckAfter time.Duration `config:"stuck_after" validate:"positive"`
+		// StateTTL is how long a recording that is no longer listed and no
+		// longer changes is reported.
+		StateTTL time.Duration `config:"state_ttl" validate:"positive"`
+	} `config:"recording"`
+}
+
+func defaultConfig() config {
+	c := config{}
+	c.Recording.Path = "/recording"
+	c.Recording.MaxBodySize = 1024 * 1024
+	c.Recording.TrackUploads = true
+	c.Recording.StuckAfter = time.Hour
+	c.Recording.StateTTL = 24 * time.Hour
+	return c
+}
+
+// MetricSet reports a document per recording every period, from the
+// recordings Sora lists and the recording and archive event webhooks. It is
+// a push metricset so that the webhook listener is served in Run and stops
+// with the module.
+type MetricSet struct {
+	mb.BaseMetricSet
+	list       *sora.Target
+	recordings *recordings
+	webhook    *sora.Webhook
+	features   *sora.Features
+}
+
+// New create a new instance of the MetricSet
+// Part of new is also setting up the configuration by processing additional
+// configuration entries if needed.
+func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
+	config := defaultConfig()
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	// ホストごとに listen すると 2 つめが失敗し、共有するとどの Sora の
+	// イベントかわからないので、ホストが 1 つのモジュールに限る
+	if hosts := len(base.Module().Config().Hosts); config.Recording.Listen != "" && hosts > 1 {
+		return nil, fmt.Errorf("recording.listen requires a module with a single host, got %d hosts; configure a module per Sora host with its own listen address", hosts)
+	}
+
+	list, err := sora.NewTarget(base, listTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	features, err := sora.NewFeatures(base)
+	if err != nil {
+		list.Close()
+		return nil, err
+	}
+
+	c := config.Recording
+	m := &MetricSet{
+		BaseMetricSet: base,
+		list:          list,
+		recordings:    newRecordings(c.Listen != "", c.TrackUploads, c.StuckAfter, c.StateTTL),
+		features:      features,
+	}
+	if c.Listen != "" {
+		m.webhook, err = sora.NewWebhook("recording", c.Listen, c.Path, c.MaxBodySize, func() interface{} {
+			return &message{}
+		}, m.handle)
+		if err != nil {
+			// Close は呼ばれないので、ここで取得先と通知を止める
+			m.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Run serves the event webhooks and reports the recordings every period
+// until the reporter is done. The reporter is only called from Run's own
+// goroutine: the error that stops the webhook is reported by the fetch loop.
+func (m *MetricSet) Run(r mb.PushReporter) {
+	// reporter は並行に呼べないので、webhook の goroutine は止まった理由を
+	// 渡すだけにする。受け取ったあとは nil にして select から外す
+	var served chan error
+	if m.webhook != nil {
+		served = make(chan error, 1)
+		go func() {
+			served <- m.webhook.Run(r.Done())
+		}()
+		defer func() {
+			if served != nil {
+				<-served
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(m.Module().Config().Period)
+	defer ticker.Stop()
+	for {
+		events, err := m.fetch()
+		if err != nil {
+			r.Error(err)
+		}
+		for _, event := range events {
+			if !r.Event(event) {
+				return
+			}
+		}
+
+		select {
+		case <-r.Done():
+			return
+		case err := <-served:
+			served = nil
+			if err != nil {
+				r.Error(err)
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetch lists the active recordings and returns an event per recording.
+func (m *MetricSet) fetch() ([]common.MapStr, error) {
+	return m.features.Fetch(m.events, nil)
+}
+
+// events returns an event per recording, also when the list cannot be
+// fetched.
+func (m *MetricSet) events(scrape *sora.Scrape) ([]common.MapStr, error) {
+	now := scrape.Start()
+	active, err := m.fetchList(scrape)
+	if err == nil {
+		m.recordings.list(active, now)
+	}
+
+	// 取得に失敗しても webhook で受け取った分は送る
+	return m.recordings.collect(now), err
+}
+
+func (m *MetricSet) fetchList(scrape *sora.Scrape) ([]common.MapStr, error) {
+	active, err := m.list.FetchList(scrape)
+	if err != nil {
+		return nil, err
+	}
+	scrape.Connections = len(active)
+	return active, nil
+}
+
+// Close closes the webhook in case Run was never called, stops the alert
+// notifications and releases the target.
+func (m *MetricSet) Close() error {
+	defer m.list.Close()
+	defer m.features.Close()
+	if m.webhook == nil {
+		return nil
+	}
+	return m.webhook.Close()
+}
+
+// handle applies the recording and archive events of a request. The other
+// events Sora posts to the same webhook are skipped.
+func (m *MetricSet) handle(messages []interface{}) {
+	now := time.Now()
+	for _, msg := range messages {
+		msg := *msg.(*message)
+		if err := m.recordings.event(msg, now); err != nil && err != errUnknownEvent {
+			debugf("dropping %s event of recording %v: %v", msg.Type, msg.RecordingID, err)
+		}
+	}
+}
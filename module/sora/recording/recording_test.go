@@ -0,0 +1,285 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package recording
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
+
+	"github.com/shiguredo/sorabeat/module/sora/soratest"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	recordingID = "3W8NBS5VK52PZ9ZT1C7Q3R0TSM"
+	otherID     = "7BZ9QTB5Y94CVCS9X4Q4V1XK8R"
+)
+
+func post(t *testing.T, m *MetricSet, body string) int {
+	w := httptest.NewRecorder()
+	m.webhook.ServeHTTP(w, httptest.NewRequest("POST", "/recording", strings.NewReader(body)))
+	return w.Code
+}
+
+func TestFetchEventContents(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	server.OnRequest(soratest.RequireTarget(t, soratest.ListRecording))
+
+	m := mbtest.NewPushMetricSet(t, getConfig(server.URL)).(*MetricSet)
+	defer m.Close()
+	events, err := m.fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 2) {
+		t.FailNow()
+	}
+
+	event := events[0]
+	assert.Equal(t, recordingID, event["recording_id"])
+	assert.Equal(t, "sora", event["channel_id"])
+	assert.Equal(t, StateRecording, event["state"])
+	assert.Equal(t, "2019-05-01T00:00:00Z", event["started_at"])
+	assert.Equal(t, int64(0), event["size"])
+	assert.Equal(t, UploadNone, event["upload"].(common.MapStr)["status"])
+	assert.Equal(t, false, event["stuck"])
+	assert.Equal(t, otherID, events[1]["recording_id"])
+
+	// 一覧から消えたら停止とする
+	server.SetFixture(soratest.ListRecording, []byte(`[]`))
+	events, err = m.fetch()
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, StateStopped, events[0]["state"])
+		assert.Contains(t, events[0], "stopped_at")
+	}
+}
+
+func TestFetchWebhook(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	config := getConfig(server.URL)
+	config["recording.listen"] = "127.0.0.1:0"
+	m := mbtest.NewPushMetricSet(t, config).(*MetricSet)
+	defer m.Close()
+
+	// ログから転送するときのように 1 行 1 メッセージでも受け付ける
+	code := post(t, m, `
+{"type": "connection.created", "channel_id": "sora"}
+{"type": "split-archive.available", "timestamp": "2019-05-01T00:01:00Z", "channel_id": "sora", "recording_id": "`+recordingID+`", "data": {"filename": "a-0001.webm", "size": 1000}}
+{"type": "split-archive.available", "timestamp": "2019-05-01T00:02:00Z", "channel_id": "sora", "recording_id": "`+recordingID+`", "data": {"filename": "a-0002.webm", "size": 2000}}
+{"type": "archive.uploaded", "channel_id": "sora", "recording_id": "`+recordingID+`", "data": {"filename": "a-0001.webm"}}
+{"type": "recording.report", "timestamp": "2019-05-01T00:32:30Z", "channel_id": "sorabeat", "recording_id": "`+otherID+`"}
+`)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	events, err := m.fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 2) {
+		t.FailNow()
+	}
+	event := events[0]
+	assert.Equal(t, int64(3000), event["size"])
+	assert.Equal(t, int64(2), event["split_count"])
+	upload := event["upload"].(common.MapStr)
+	assert.Equal(t, UploadPending, upload["status"])
+	assert.Equal(t, int64(1), upload["pending"])
+	assert.Equal(t, int64(1), upload["uploaded"])
+	// 2019 年のアップロード待ちなので止まっている
+	assert.Equal(t, true, event["stuck"])
+	assert.Equal(t, StuckUploadPending, event["stuck_reason"])
+
+	assert.Equal(t, StateStopped, events[1]["state"])
+	assert.Equal(t, "2019-05-01T00:32:30Z", events[1]["stopped_at"])
+	assert.InDelta(t, 1350., events[1]["duration_sec"], 0.01)
+
+	assert.Equal(t, http.StatusBadRequest, post(t, m, `{"type": `))
+}
+
+func TestRun(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	server.SetFixture(soratest.ListRecording, []byte(`[]`))
+
+	config := getConfig(server.URL)
+	config["recording.listen"] = "127.0.0.1:0"
+	config["period"] = "100ms"
+	ms := mbtest.NewPushMetricSet(t, config)
+	addr := ms.(*MetricSet).webhook.Addr().String()
+
+	status := make(chan int, 1)
+	go func() {
+		body := `{"type": "recording.started", "channel_id": "sora", "recording_id": "` + recordingID + `"}`
+		resp, err := http.Post("http://"+addr+"/recording", "application/json", strings.NewReader(body))
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	// Run の間は webhook を受け付け、period ごとに録画を送る
+	events, errs := mbtest.RunPushMetricSet(500*time.Millisecond, ms)
+	assert.Empty(t, errs)
+	assert.Equal(t, http.StatusNoContent, <-status)
+	if assert.NotEmpty(t, events) {
+		assert.Equal(t, recordingID, events[len(events)-1]["recording_id"])
+	}
+}
+
+func TestRunWebhookError(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	server.SetFixture(soratest.ListRecording, []byte(`[]`))
+
+	config := getConfig(server.URL)
+	config["recording.listen"] = "127.0.0.1:0"
+	config["period"] = "100ms"
+	ms := mbtest.NewPushMetricSet(t, config)
+	// listener が閉じていると webhook はすぐに止まる
+	ms.(*MetricSet).webhook.Close()
+
+	// webhook が止まった理由は取得のループから一度だけ送る
+	_, errs := mbtest.RunPushMetricSet(500*time.Millisecond, ms)
+	if assert.Len(t, errs, 1) {
+		assert.Contains(t, errs[0].Error(), "use of closed network connection")
+	}
+}
+
+func TestListenSingleHost(t *testing.T) {
+	config := getConfig("127.0.0.1:3000")
+	config["hosts"] = []string{"127.0.0.1:3000", "127.0.0.2:3000"}
+	config["recording.listen"] = "127.0.0.1:0"
+	c, err := common.NewConfigFrom(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = mb.NewModule(c, mb.Registry)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "recording.listen requires a module with a single host")
+	}
+}
+
+func TestListenFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	config := getConfig("127.0.0.1:3000")
+	config["recording.listen"] = busy.Addr().String()
+	c, err := common.NewConfigFrom(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = mb.NewModule(c, mb.Registry)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "recording listen on "+busy.Addr().String())
+	}
+}
+
+func TestRecordingsStuck(t *testing.T) {
+	now := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	r := newRecordings(true, true, time.Hour, 24*time.Hour)
+	event := func(typ, id, filename string) {
+		msg := message{Type: typ, ChannelID: "sora", RecordingID: id}
+		if filename != "" {
+			msg.Data = map[string]interface{}{"filename": filename}
+		}
+		assert.NoError(t, r.event(msg, now))
+	}
+
+	event("recording.started", "failed", "")
+	event("archive.available", "failed", "failed.webm")
+	event("archive.upload_failed", "failed", "failed.webm")
+	event("recording.started", "empty", "")
+	event("recording.report", "empty", "")
+	event("recording.started", "done", "")
+	event("archive.available", "done", "done.webm")
+	event("archive.uploaded", "done", "done.webm")
+	// 遅れて届いた archive.available でアップロード待ちに戻さない
+	event("archive.available", "done", "done.webm")
+	event("recording.report", "done", "")
+	event("split-archive.available", "split", "split-1.webm")
+	event("split-archive.available", "split", "split-1.webm")
+	r.list([]common.MapStr{{"recording_id": "running", "channel_id": "sora"}}, now)
+
+	assert.Equal(t, errUnknownEvent, r.event(message{Type: "connection.created"}, now))
+	assert.Equal(t, errNoRecording, r.event(message{Type: "recording.started"}, now))
+	assert.Equal(t, errNoArchive, r.event(message{Type: "archive.available", RecordingID: "x"}, now))
+
+	now = now.Add(2 * time.Hour)
+	stuck := map[string]interface{}{}
+	for _, e := range r.collect(now) {
+		stuck[e["recording_id"].(string)] = e["stuck_reason"]
+		if e["recording_id"] == "split" {
+			assert.Equal(t, int64(1), e["split_count"])
+		}
+	}
+	assert.Equal(t, map[string]interface{}{
+		"done":    nil,
+		"empty":   StuckNoArchive,
+		"failed":  StuckUploadFailed,
+		"running": nil,
+		"split":   StuckUploadPending,
+	}, stuck)
+
+	// 一覧に現れない録画は、recording.report を取りこぼして止まっていなくても
+	// 変化がなければ忘れる
+	now = now.Add(24 * time.Hour)
+	r.list([]common.MapStr{{"recording_id": "running", "channel_id": "sora"}}, now)
+	events := r.collect(now)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "running", events[0]["recording_id"])
+		assert.Equal(t, StateRecording, events[0]["state"])
+	}
+}
+
+func TestData(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	m := mbtest.NewPushMetricSet(t, getConfig(server.URL)).(*MetricSet)
+	defer m.Close()
+	events, err := m.fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ホストと時刻はテストのたびに変わるのでサンプルでは固定する
+	event := events[0]
+	event["duration_sec"] = 42.5
+	fullEvent := mbtest.CreateFullEvent(m, event)
+	fullEvent.Fields.Put("metricset.host", "localhost:3000")
+	mbtest.WriteEventToDataJSON(t, fullEvent)
+}
+
+func getConfig(host string) map[string]interface{} {
+	return map[string]interface{}{
+		"module":     "sora",
+		"metricsets": []string{"recording"},
+		"hosts":      []string{host},
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recording
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// States reported in sora.recording.state.
+const (
+	StateRecording = "recording"
+	StateStopped   = "stopped"
+)
+
+// Upload statuses reported in sora.recording.upload.status, from the best to
+// the worst.
+const (
+	UploadNone     = "none"
+	UploadUploaded = "uploaded"
+	UploadPending  = "pending"
+	UploadFailed   = "failed"
+)
+
+// Reasons reported in sora.recording.stuck_reason.
+const (
+	StuckUploadFailed  = "upload_failed"
+	StuckUploadPending = "upload_pending"
+	StuckNoArchive     = "no_archive"
+)
+
+// message is an event webhook request of Sora, or of the archive uploader
+// for the archive.uploaded and archive.upload_failed types.
+type message struct {
+	Type        string                 `json:"type"`
+	Timestamp   string                 `json:"timestamp"`
+	ChannelID   string                 `json:"channel_id"`
+	RecordingID string                 `json:"recording_id"`
+	Data        map[string]interface{} `json:"data"`
+}
+
+var (
+	errNoRecording  = errors.New("recording_id is missing")
+	errNoArchive    = errors.New("data.filename is missing")
+	errUnknownEvent = errors.New("not a recording event")
+)
+
+// eventTypes are the event webhook types applied to the recordings.
+var eventTypes = map[string]bool{
+	"recording.started":       true,
+	"recording.report":        true,
+	"archive.available":       true,
+	"split-archive.available": true,
+	"archive.uploaded":        true,
+	"archive.upload_failed":   true,
+}
+
+type archive struct {
+	size   int64
+	status string
+	split  bool
+	// アップロード待ちになった時刻
+	since time.Time
+}
+
+type recording struct {
+	channelID string
+	id        string
+	started   time.Time
+	stopped   time.Time
+	// ListRecording で前回見えていたか
+	listed   bool
+	splits   int
+	archives map[string]*archive
+	updated  time.Time
+}
+
+// recordings tracks the recordings from ListRecording and the event
+// webhooks, which arrive concurrently with Fetch.
+type recordings struct {
+	mu   sync.Mutex
+	byID map[string]*recording
+	// webhook は archive.* のイベントを受け取っているか
+	webhook      bool
+	trackUploads bool
+	stuckAfter   time.Duration
+	ttl          time.Duration
+}
+
+func newRecordings(webhook, trackUploads bool, stuckAfter, ttl time.Duration) *recordings {
+	return &recordings{
+		byID:         map[string]*recording{},
+		webhook:      webhook,
+		trackUploads: trackUploads,
+		stuckAfter:   stuckAfter,
+		ttl:          ttl,
+	}
+}
+
+// get must be called with r.mu held.
+func (r *recordings) get(channelID, id string, now time.Time) *recording {
+	rec, ok := r.byID[id]
+	if !ok {
+		rec = &recording{id: id, archives: map[string]*archive{}}
+		r.byID[id] = rec
+	}
+	if channelID != "" {
+		rec.channelID = channelID
+	}
+	rec.updated = now
+	return rec
+}
+
+// list updates the recordings from the ListRecording response. A recording
+// that is no longer listed stopped now unless an event said otherwise.
+func (r *recordings) list(active []common.MapStr, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, item := range active {
+		id, _ := item["recording_id"].(string)
+		if id == "" {
+			continue
+		}
+		channelID, _ := item["channel_id"].(string)
+		rec := r.get(channelID, id, now)
+		if created, ok := item["created_at"].(float64); ok && rec.started.IsZero() {
+			rec.started = time.Unix(int64(created), 0)
+		}
+		rec.listed = true
+		seen[id] = true
+	}
+	for id, rec := range r.byID {
+		if rec.listed && !seen[id] {
+			rec.listed = false
+			if rec.stopped.IsZero() {
+				rec.stopped = now
+			}
+			rec.updated = now
+		}
+	}
+}
+
+// event applies an event webhook message received at now.
+func (r *recordings) event(msg message, now time.Time) error {
+	if !eventTypes[msg.Type] {
+		return errUnknownEvent
+	}
+	if msg.RecordingID == "" {
+		return errNoRecording
+	}
+	at := now
+	if msg.Timestamp != "" {
+		t, err := time.Parse(time.RFC3339Nano, msg.Timestamp)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp '%s': %v", msg.Timestamp, err)
+		}
+		at = t
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch msg.Type {
+	case "recording.started":
+		r.get(msg.ChannelID, msg.RecordingID, now).started = at
+	case "recording.report":
+		r.get(msg.ChannelID, msg.RecordingID, now).stopped = at
+	case "archive.available", "split-archive.available":
+		name, _ := msg.Data["filename"].(string)
+		if name == "" {
+			return errNoArchive
+		}
+		rec := r.get(msg.ChannelID, msg.RecordingID, now)
+		a, ok := rec.archives[name]
+		if !ok {
+			a = &archive{status: UploadNone}
+			if r.trackUploads {
+				a.status, a.since = UploadPending, at
+			}
+			rec.archives[name] = a
+		}
+		// webhook は順番通りに届くとは限らないので、先に届いた
+		// archive.uploaded などの状態は戻さない
+		if size, ok := msg.Data["size"].(float64); ok {
+			a.size = int64(size)
+		}
+		if msg.Type == "split-archive.available" && !a.split {
+			a.split = true
+			rec.splits++
+		}
+	case "archive.uploaded", "archive.upload_failed":
+		name, _ := msg.Data["filename"].(string)
+		if name == "" {
+			return errNoArchive
+		}
+		rec := r.get(msg.ChannelID, msg.RecordingID, now)
+		a, ok := rec.archives[name]
+		if !ok {
+			// archive.available を受け取る前に起動したときなど
+			a = &archive{}
+			rec.archives[name] = a
+		}
+		a.status = UploadUploaded
+		if msg.Type == "archive.upload_failed" {
+			a.status = UploadFailed
+		}
+	}
+	return nil
+}
+
+// collect returns an event per recording and forgets the recordings that are
+// not listed and did not change for the TTL. They include the recordings known
+// only from webhooks whose recording.report was missed.
+func (r *recordings) collect(now time.Time) []common.MapStr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var recs []*recording
+	for id, rec := range r.byID {
+		if !rec.listed && now.Sub(rec.updated) > r.ttl {
+			delete(r.byID, id)
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		if !recs[i].started.Equal(recs[j].started) {
+			return recs[i].started.Before(recs[j].started)
+		}
+		return recs[i].id < recs[j].id
+	})
+
+	events := make([]common.MapStr, 0, len(recs))
+	for _, rec := range recs {
+		events = append(events, r.document(rec, now))
+	}
+	return events
+}
+
+// document must be called with r.mu held.
+func (r *recordings) document(rec *recording, now time.Time) common.MapStr {
+	event := common.MapStr{
+		"recording_id": rec.id,
+		"state":        StateRecording,
+		"split_count":  int64(rec.splits),
+		"archives":     int64(len(rec.archives)),
+	}
+	if rec.channelID != "" {
+		event["channel_id"] = rec.channelID
+	}
+	end := now
+	if !rec.stopped.IsZero() {
+		end = rec.stopped
+		event["state"] = StateStopped
+		event["stopped_at"] = rec.stopped.UTC().Format(time.RFC3339Nano)
+	}
+	if !rec.started.IsZero() {
+		event["started_at"] = rec.started.UTC().Format(time.RFC3339Nano)
+		event["duration_sec"] = end.Sub(rec.started).Seconds()
+	}
+
+	var size int64
+	counts := map[string]int64{}
+	var oldest time.Time
+	for _, a := range rec.archives {
+		size += a.size
+		counts[a.status]++
+		if a.status == UploadPending && (oldest.IsZero() || a.since.Before(oldest)) {
+			oldest = a.since
+		}
+	}
+	event["size"] = size
+
+	status := UploadNone
+	for _, s := range []string{UploadUploaded, UploadPending, UploadFailed} {
+		if counts[s] > 0 {
+			status = s
+		}
+	}
+	upload := common.MapStr{
+		"status":   status,
+		"pending":  counts[UploadPending],
+		"uploaded": counts[UploadUploaded],
+		"failed":   counts[UploadFailed],
+	}
+	if !oldest.IsZero() {
+		upload["pending_age_sec"] = now.Sub(oldest).Seconds()
+	}
+	event["upload"] = upload
+
+	reason := ""
+	switch {
+	case counts[UploadFailed] > 0:
+		reason = StuckUploadFailed
+	case !oldest.IsZero() && now.Sub(oldest) > r.stuckAfter:
+		reason = StuckUploadPending
+	case r.webhook && !rec.stopped.IsZero() && len(rec.archives) == 0 && now.Sub(rec.stopped) > r.stuckAfter:
+		reason = StuckNoArchive
+	}
+	event["stuck"] = reason != ""
+	if reason != "" {
+		event["stuck_reason"] = reason
+	}
+	return event
+}
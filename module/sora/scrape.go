@@ -0,0 +1,221 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/helper"
+)
+
+// Error classes reported in sora.scrape.error.class.
+const (
+	ScrapeConnect    = "connect"
+	ScrapeTimeout    = "timeout"
+	ScrapeHTTPStatus = "http_status"
+	ScrapeDecode     = "decode"
+)
+
+// Scrape is the outcome of a fetch of a metricset. The metricset fetches and
+// decodes the responses through it and records it in the Scrapes of its host.
+type Scrape struct {
+	metricset string
+	start     time.Time
+	// Status is the HTTP status of the last response.
+	Status int
+	// Bytes is the size of the responses.
+	Bytes      int
+	DecodeTime time.Duration
+	// Connections is the connection count seen by the fetch, -1 when unknown.
+	Connections int
+	// Wait is the time spent waiting for the rate limit of the host.
+	Wait time.Duration
+	// Shared is true when a response fetched by another metricset was used.
+	Shared bool
+	class  string
+}
+
+// NewScrape starts the scrape of a fetch of the metricset started at start.
+func NewScrape(metricset string, start time.Time) *Scrape {
+	return &Scrape{
+		metricset:   metricset,
+		start:       start,
+		Connections: -1,
+	}
+}
+
+// Start returns when the fetch started.
+func (s *Scrape) Start() time.Time {
+	return s.start
+}
+
+// Fetch makes the request of h and returns the body of a 200 response.
+func (s *Scrape) Fetch(h *helper.HTTP) ([]byte, error) {
+	resp, err := h.FetchResponse()
+	if err != nil {
+		s.class = classify(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	s.Status = resp.StatusCode
+	if resp.StatusCode != 200 {
+		s.class = ScrapeHTTPStatus
+		return nil, fmt.Errorf("HTTP error %d in %s: %s", resp.StatusCode, s.metricset, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	s.Bytes += len(body)
+	if err != nil {
+		s.class = classify(err)
+		return nil, err
+	}
+	return body, nil
+}
+
+// Decode unmarshals the JSON body into v.
+func (s *Scrape) Decode(body []byte, v interface{}) error {
+	start := time.Now()
+	err := json.Unmarshal(body, v)
+	s.DecodeTime += time.Since(start)
+	if err != nil {
+		s.class = ScrapeDecode
+	}
+	return err
+}
+
+// classify は接続できなかったのか時間切れなのかを分ける
+func classify(err error) string {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return ScrapeTimeout
+	}
+	// helper.HTTP は元のエラーを文字列にしてしまうので文言で判定する
+	message := err.Error()
+	if strings.Contains(message, "Timeout") || strings.Contains(message, "timeout") ||
+		strings.Contains(message, "deadline exceeded") {
+		return ScrapeTimeout
+	}
+	return ScrapeConnect
+}
+
+// Scrapes collects the scrapes of the metricsets polling a host for the
+// scrape metricset.
+type Scrapes struct {
+	mu         sync.Mutex
+	metricsets map[string]*scrapeState
+}
+
+type scrapeState struct {
+	last     common.MapStr
+	attempts int
+	failures int
+}
+
+var scrapes = struct {
+	sync.Mutex
+	hosts map[string]*Scrapes
+}{hosts: map[string]*Scrapes{}}
+
+// ScrapesOf returns the Scrapes of the host, shared by all metricsets.
+func ScrapesOf(host string) *Scrapes {
+	scrapes.Lock()
+	defer scrapes.Unlock()
+	s, ok := scrapes.hosts[host]
+	if !ok {
+		s = &Scrapes{metricsets: map[string]*scrapeState{}}
+		scrapes.hosts[host] = s
+	}
+	return s
+}
+
+// Record records the scrape finished now with the error of the fetch.
+func (s *Scrapes) Record(scrape *Scrape, err error) {
+	now := time.Now()
+	fields := common.MapStr{
+		"metricset":     scrape.metricset,
+		"success":       err == nil,
+		"time":          scrape.start.UTC().Format(time.RFC3339Nano),
+		"duration_msec": now.Sub(scrape.start).Seconds() * 1000,
+		"bytes":         int64(scrape.Bytes),
+	}
+	if scrape.Status != 0 {
+		fields["status"] = int64(scrape.Status)
+	}
+	if scrape.DecodeTime > 0 {
+		fields["decode_time_msec"] = scrape.DecodeTime.Seconds() * 1000
+	}
+	if scrape.Connections >= 0 {
+		fields["connections"] = int64(scrape.Connections)
+	}
+	if scrape.Wait > 0 {
+		fields["wait_msec"] = scrape.Wait.Seconds() * 1000
+	}
+	if scrape.Shared {
+		fields["shared"] = true
+	}
+	if err != nil {
+		e := common.MapStr{"message": err.Error()}
+		if scrape.class != "" {
+			e["class"] = scrape.class
+		}
+		fields["error"] = e
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.metricsets[scrape.metricset]
+	if !ok {
+		state = &scrapeState{}
+		s.metricsets[scrape.metricset] = state
+	}
+	state.last = fields
+	state.attempts++
+	if err != nil {
+		state.failures++
+	}
+}
+
+// Collect returns an event per metricset with its last scrape and the
+// attempts and failures since the previous call. A metricset that did not
+// fetch since then, e.g. because adaptive polling backed off, reports 0
+// attempts with its last scrape.
+func (s *Scrapes) Collect() []common.MapStr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.metricsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	events := make([]common.MapStr, 0, len(names))
+	for _, name := range names {
+		state := s.metricsets[name]
+		event := state.last.Clone()
+		event["attempts"] = int64(state.attempts)
+		event["failures"] = int64(state.failures)
+		events = append(events, event)
+		state.attempts, state.failures = 0, 0
+	}
+	return events
+}
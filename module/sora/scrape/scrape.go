@@ -0,0 +1,58 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scrape
+
+import (
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/elastic/beats/metricbeat/mb/parse"
+
+	"github.com/shiguredo/sorabeat/module/sora"
+)
+
+// init registers the MetricSet with the central registry.
+// The New method will be called after the setup of the module and before starting to fetch data
+func init() {
+	if err := mb.Registry.AddMetricSet("sora", "scrape", New, hostParser); err != nil {
+		panic(err)
+	}
+}
+
+// 他のメトリックセットと同じホスト名になるように同じ解釈をする
+var hostParser = parse.URLHostParserBuilder{
+	DefaultScheme: "http",
+	DefaultPath:   "/",
+}.Build()
+
+// MetricSet reports the outcome of the fetches of the other metricsets
+// polling the same host.
+type MetricSet struct {
+	mb.BaseMetricSet
+	scrapes *sora.Scrapes
+}
+
+// New create a new instance of the MetricSet
+func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
+	return &MetricSet{
+		BaseMetricSet: base,
+		scrapes:       sora.ScrapesOf(base.Host()),
+	}, nil
+}
+
+// Fetch returns an event per metricset that fetched from the host, with its
+// last scrape and the attempts and failures since the previous Fetch.
+func (m *MetricSet) Fetch() ([]common.MapStr, error) {
+	return m.scrapes.Collect(), nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package scrape
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
+
+	_ "github.com/shiguredo/sorabeat/module/sora/connections"
+	"github.com/shiguredo/sorabeat/module/sora/soratest"
+	_ "github.com/shiguredo/sorabeat/module/sora/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetch(t *testing.T) {
+	server := soratest.NewServer(t, "18.10.04")
+	defer server.Close()
+
+	stats := mbtest.NewEventsFetcher(t, getConfig(server.URL, "stats"))
+	connections := mbtest.NewEventsFetcher(t, getConfig(server.URL, "connections"))
+	scrape := mbtest.NewEventsFetcher(t, getConfig(server.URL, "scrape"))
+
+	events, err := scrape.Fetch()
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	_, err = stats.Fetch()
+	assert.NoError(t, err)
+	server.Inject(soratest.GetStatsAllConnections, soratest.Fault{Status: 503, Times: 1})
+	_, err = connections.Fetch()
+	assert.Error(t, err)
+	server.Inject(soratest.GetStatsAllConnections, soratest.Fault{Malformed: true, Times: 1})
+	_, err = connections.Fetch()
+	assert.Error(t, err)
+
+	events, err = scrape.Fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 2) {
+		t.FailNow()
+	}
+	c, s := events[0], events[1]
+	assert.Equal(t, "connections", c["metricset"])
+	assert.Equal(t, false, c["success"])
+	assert.Equal(t, int64(200), c["status"])
+	assert.Equal(t, "decode", c["error"].(common.MapStr)["class"])
+	assert.Equal(t, int64(2), c["attempts"])
+	assert.Equal(t, int64(2), c["failures"])
+
+	assert.Equal(t, "stats", s["metricset"])
+	assert.Equal(t, true, s["success"])
+	assert.Equal(t, int64(200), s["status"])
+	assert.True(t, s["bytes"].(int64) > 0)
+	assert.Contains(t, s, "decode_time_msec")
+	assert.Contains(t, s, "connections")
+	assert.Equal(t, int64(1), s["attempts"])
+	assert.Equal(t, int64(0), s["failures"])
+}
+
+func TestFetchFailureClasses(t *testing.T) {
+	server := soratest.NewServer(t, "18.10.04")
+	defer server.Close()
+
+	config := getConfig(server.URL, "stats")
+	config["timeout"] = "50ms"
+	stats := mbtest.NewEventsFetcher(t, config)
+	scrape := mbtest.NewEventsFetcher(t, getConfig(server.URL, "scrape"))
+
+	server.Inject(soratest.GetStatsReport, soratest.Fault{Status: 500, Times: 1})
+	stats.Fetch()
+	events, _ := scrape.Fetch()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "http_status", events[0]["error"].(common.MapStr)["class"])
+		assert.Equal(t, int64(500), events[0]["status"])
+	}
+
+	server.Inject(soratest.GetStatsReport, soratest.Fault{Latency: time.Second, Times: 1})
+	stats.Fetch()
+	events, _ = scrape.Fetch()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "timeout", events[0]["error"].(common.MapStr)["class"])
+		assert.NotContains(t, events[0], "status")
+	}
+
+	server.Close()
+	stats.Fetch()
+	events, _ = scrape.Fetch()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "connect", events[0]["error"].(common.MapStr)["class"])
+	}
+}
+
+func TestData(t *testing.T) {
+	versions := soratest.Versions()
+	server := soratest.NewServer(t, versions[len(versions)-1])
+	defer server.Close()
+
+	stats := mbtest.NewEventsFetcher(t, getConfig(server.URL, "stats"))
+	if _, err := stats.Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL, "scrape"))
+	events, err := f.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ホストと時間はテストのたびに変わるのでサンプルでは固定する
+	event := events[0]
+	event["time"] = "2016-05-23T08:05:34.853Z"
+	event["duration_msec"] = 3.2
+	event["decode_time_msec"] = 0.41
+	fullEvent := mbtest.CreateFullEvent(f, event)
+	fullEvent.Fields.Put("metricset.host", "localhost:3000")
+	mbtest.WriteEventToDataJSON(t, fullEvent)
+}
+
+func getConfig(host, metricset string) map[string]interface{} {
+	return map[string]interface{}{
+		"module":     "sora",
+		"metricsets": []string{metricset},
+		"hosts":      []string{host},
+		// Sora の ID をパッケージのディレクトリに保存しない
+		"server.path": filepath.Join(os.TempDir(), "sorabeat-scrape-test"),
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, ScrapeTimeout, classify(timeoutError{}))
+	assert.Equal(t, ScrapeTimeout, classify(errors.New("HTTP error in stats: Post http://127.0.0.1:3000/: net/http: request canceled (Client.Timeout exceeded while awaiting headers)")))
+	assert.Equal(t, ScrapeConnect, classify(errors.New("HTTP error in stats: Post http://127.0.0.1:3000/: dial tcp 127.0.0.1:3000: connect: connection refused")))
+}
+
+func TestScrapeDecode(t *testing.T) {
+	s := NewScrape("stats", time.Now())
+	var v map[string]interface{}
+	assert.NoError(t, s.Decode([]byte(`{"a": 1}`), &v))
+	assert.Empty(t, s.class)
+	assert.Error(t, s.Decode([]byte(`{"a": `), &v))
+	assert.Equal(t, ScrapeDecode, s.class)
+}
+
+func TestScrapesCollect(t *testing.T) {
+	host := testHost("scrape")
+	scrapes := ScrapesOf(host)
+	assert.Equal(t, scrapes, ScrapesOf(host))
+	assert.Empty(t, scrapes.Collect())
+
+	start := time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+	ok := NewScrape("stats", start)
+	ok.Status, ok.Bytes, ok.Connections = 200, 1024, 3
+	ok.DecodeTime = 2 * time.Millisecond
+	scrapes.Record(ok, nil)
+
+	failed := NewScrape("connections", start)
+	failed.Status, failed.class = 503, ScrapeHTTPStatus
+	scrapes.Record(NewScrape("connections", start), nil)
+	scrapes.Record(failed, errors.New("HTTP error 503 in connections: 503 Service Unavailable"))
+
+	events := scrapes.Collect()
+	if assert.Len(t, events, 2) {
+		connections, stats := events[0], events[1]
+		assert.Equal(t, "connections", connections["metricset"])
+		assert.Equal(t, false, connections["success"])
+		assert.Equal(t, int64(503), connections["status"])
+		assert.Equal(t, ScrapeHTTPStatus, connections["error"].(common.MapStr)["class"])
+		assert.NotContains(t, connections, "connections")
+		assert.Equal(t, int64(2), connections["attempts"])
+		assert.Equal(t, int64(1), connections["failures"])
+
+		assert.Equal(t, "stats", stats["metricset"])
+		assert.Equal(t, true, stats["success"])
+		assert.Equal(t, "2017-10-10T00:00:00Z", stats["time"])
+		assert.Equal(t, int64(1024), stats["bytes"])
+		assert.Equal(t, int64(3), stats["connections"])
+		assert.InDelta(t, 2., stats["decode_time_msec"], 0.01)
+		assert.NotContains(t, stats, "error")
+	}
+
+	// 取得がなければ前回の結果を回数 0 で送る
+	events = scrapes.Collect()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, int64(0), events[0]["attempts"])
+		assert.Equal(t, int64(0), events[0]["failures"])
+		assert.Equal(t, false, events[0]["success"])
+	}
+}
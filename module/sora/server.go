@@ -0,0 +1,303 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/paths"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+// Reasons reported in sora.server.reason for a detected restart.
+const (
+	RestartUptime   = "uptime"
+	RestartCounters = "counters"
+)
+
+// uptimeField is the milliseconds since the Erlang VM of Sora started.
+const uptimeField = "erlang_vm.statistics.wall_clock.total_wallclock_time"
+
+// restartCounters are the cumulative counters of the stats report that only
+// go back when Sora restarts.
+var restartCounters = []string{
+	"total_successful_connections",
+	"total_failed_connections",
+	"total_duration_sec",
+}
+
+// startTolerance absorbs the response time in the start time derived from
+// the uptime.
+const startTolerance = 5 * time.Second
+
+// instanceIDPrecision is the unit the start time is truncated to for the
+// instance ID, so that Sorabeat processes polling the same Sora usually derive
+// the same ID. A Sorabeat restart keeps the ID from the saved instance instead.
+const instanceIDPrecision = time.Minute
+
+// ServerConfig configures where the instances of the Sora hosts are saved.
+type ServerConfig struct {
+	// Path is the directory the instance IDs are saved to, so that a Sorabeat
+	// restart keeps the ID of a Sora that did not restart.
+	Path string `config:"path"`
+}
+
+// Server tracks the Sora process behind a host, so that the metricsets
+// polling the same host share its instance ID. Only the stats metricset feeds
+// it, the other metricsets just annotate their events.
+type Server struct {
+	mu       sync.Mutex
+	host     string
+	id       string
+	started  time.Time
+	counters map[string]float64
+	// file is where the instance is saved, empty when it is not saved.
+	file string
+	// saved is the instance loaded from file, until the first report tells
+	// whether Sora is still the same process.
+	saved *savedServer
+}
+
+type savedServer struct {
+	ID      string    `json:"instance_id"`
+	Started time.Time `json:"started_at"`
+}
+
+var servers = struct {
+	sync.Mutex
+	hosts map[string]*Server
+}{hosts: map[string]*Server{}}
+
+// ServerOf returns the Server of the host, shared by all metricsets.
+func ServerOf(host string) *Server {
+	servers.Lock()
+	defer servers.Unlock()
+	s, ok := servers.hosts[host]
+	if !ok {
+		s = &Server{host: host}
+		servers.hosts[host] = s
+	}
+	return s
+}
+
+// PersistServer makes the Server of the metricset host save its instance to
+// the directory configured with server.path, and loads the instance saved
+// before Sorabeat restarted. The Server is not saved when the module does not
+// persist.
+func PersistServer(base mb.BaseMetricSet) (*Server, error) {
+	persist, err := Persists(base)
+	if err != nil || !persist {
+		return ServerOf(base.Host()), err
+	}
+	config := struct {
+		Server ServerConfig `config:"server"`
+	}{}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	if config.Server.Path == "" {
+		config.Server.Path = paths.Resolve(paths.Data, "server")
+	}
+	s := ServerOf(base.Host())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != "" {
+		return s, nil
+	}
+	s.file = filepath.Join(config.Server.Path, unsafeFileChars.ReplaceAllString(base.Host(), "_")+".json")
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Observe detects a restart from the stats report fetched at now, either
+// because the start time derived from the uptime moved forward or because a
+// cumulative counter went back. It returns the sora.server.restarted event,
+// with the fields under mb.ModuleDataKey, or nil.
+func (s *Server) Observe(report common.MapStr, now time.Time) common.MapStr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	started, hasUptime := time.Time{}, false
+	if uptime, ok := Number(report, uptimeField); ok && uptime >= 0 {
+		started = now.Add(-time.Duration(uptime) * time.Millisecond)
+		hasUptime = true
+	}
+	counters := map[string]float64{}
+	for _, key := range restartCounters {
+		if value, ok := Number(report, key); ok {
+			counters[key] = value
+		}
+	}
+
+	// Sorabeat が止まっている間に再起動した Sora の ID は保存した ID と区別する
+	stale := ""
+	if s.saved != nil {
+		saved := s.saved
+		s.saved = nil
+		// 起動時刻が保存したものと変わらない、つまり uptime が経った時間だけ
+		// 増えていれば、Sorabeat の再起動の前と同じプロセスとして ID を引き継ぐ
+		if s.id == "" && hasUptime && absDuration(started.Sub(saved.Started)) <= startTolerance {
+			s.id, s.started = saved.ID, saved.Started
+		} else {
+			stale = saved.ID
+		}
+	}
+
+	reason := ""
+	if s.id != "" {
+		if hasUptime && !s.started.IsZero() && started.Sub(s.started) > startTolerance {
+			reason = RestartUptime
+		}
+		for key, value := range counters {
+			if last, ok := s.counters[key]; ok && value < last && reason == "" {
+				reason = RestartCounters
+			}
+		}
+	}
+	s.counters = counters
+
+	if s.id != "" && reason == "" {
+		// 起動時刻は応答時間の分だけぶれるので最初の値を使い続ける
+		if s.started.IsZero() && hasUptime {
+			s.started = started
+		}
+		return nil
+	}
+
+	previous := s.id
+	s.started = started
+	if !hasUptime {
+		// 起動時刻がわからないときは検知した時刻から作る
+		started = now
+	}
+	s.id = instanceID(s.host, started, instanceIDPrecision)
+	if s.id == previous || s.id == stale {
+		// 同じ分のうちに再起動したときは秒まで使って前の ID と区別する
+		s.id = instanceID(s.host, started, time.Second)
+	}
+	if hasUptime {
+		if err := s.save(); err != nil {
+			logp.Err("Failed to save the Sora instance to %s: %v", s.file, err)
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+
+	logp.Info("Sora at %s restarted (%s), instance ID %s", s.host, reason, s.id)
+	server := common.MapStr{
+		"restarted":            true,
+		"reason":               reason,
+		"instance_id":          s.id,
+		"previous_instance_id": previous,
+	}
+	if hasUptime {
+		server["started_at"] = started.UTC().Format(time.RFC3339Nano)
+	}
+	return common.MapStr{mb.ModuleDataKey: common.MapStr{"server": server}}
+}
+
+// instanceID は同じ Sora のプロセスなら別の Sorabeat から見ても同じになるよう
+// ホストと precision で切り捨てた起動時刻から作る
+func instanceID(host string, started time.Time, precision time.Duration) string {
+	sum := sha256.Sum256([]byte(host + "/" + strconv.FormatInt(started.Truncate(precision).Unix(), 10)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// load must be called with s.mu held.
+func (s *Server) load() error {
+	body, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved savedServer
+	if err := json.Unmarshal(body, &saved); err != nil || saved.ID == "" {
+		// 読めないときは新しい ID を作る
+		logp.Warn("Discarding unreadable Sora instance %s: %v", s.file, err)
+		return nil
+	}
+	s.saved = &saved
+	return nil
+}
+
+// save writes the instance atomically. It must be called with s.mu held.
+func (s *Server) save() error {
+	if s.file == "" {
+		return nil
+	}
+	body, err := json.Marshal(savedServer{ID: s.id, Started: s.started})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0750); err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// Annotate adds sora.server.instance_id, and sora.server.started_at when it
+// is known, to the events. It does nothing before the first stats report, so
+// the events of a host get these fields only when the stats metricset polls
+// that host.
+func (s *Server) Annotate(events []common.MapStr) {
+	s.mu.Lock()
+	id, started := s.id, s.started
+	s.mu.Unlock()
+	if id == "" {
+		return
+	}
+	for _, event := range events {
+		module, ok := event[mb.ModuleDataKey].(common.MapStr)
+		if !ok {
+			module = common.MapStr{}
+			event[mb.ModuleDataKey] = module
+		}
+		server, ok := module["server"].(common.MapStr)
+		if !ok {
+			server = common.MapStr{}
+			module["server"] = server
+		}
+		server["instance_id"] = id
+		if !started.IsZero() {
+			server["started_at"] = started.UTC().Format(time.RFC3339Nano)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/stretchr/testify/assert"
+)
+
+var testHosts int64
+
+// testHost returns a host that no other test uses. ServerOf and the other
+// per-host registries are global, so a fixed host would carry the state of
+// the previous run with -count.
+func testHost(name string) string {
+	return fmt.Sprintf("%s-%d.example.com:3000", name, atomic.AddInt64(&testHosts, 1))
+}
+
+func report(uptime time.Duration, successful float64) common.MapStr {
+	return common.MapStr{
+		"erlang_vm": map[string]interface{}{
+			"statistics": map[string]interface{}{
+				"wall_clock": map[string]interface{}{
+					"total_wallclock_time": float64(uptime / time.Millisecond),
+				},
+			},
+		},
+		"total_successful_connections": successful,
+	}
+}
+
+func serverFields(event common.MapStr) common.MapStr {
+	return event[mb.ModuleDataKey].(common.MapStr)["server"].(common.MapStr)
+}
+
+func TestServerUptimeRestart(t *testing.T) {
+	s := &Server{host: "127.0.0.1:3000"}
+	now := time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, s.Observe(report(time.Hour, 100), now))
+	id := s.id
+	assert.NotEmpty(t, id)
+
+	// 応答時間のぶれでは再起動としない
+	now = now.Add(10 * time.Second)
+	assert.Nil(t, s.Observe(report(time.Hour+8*time.Second, 110), now))
+	assert.Equal(t, id, s.id)
+
+	// 累計が前回より増えていても、起動時刻が進んでいれば再起動
+	now = now.Add(time.Minute)
+	restart := s.Observe(report(30*time.Second, 120), now)
+	if assert.NotNil(t, restart) {
+		server := serverFields(restart)
+		assert.Equal(t, true, server["restarted"])
+		assert.Equal(t, RestartUptime, server["reason"])
+		assert.Equal(t, id, server["previous_instance_id"])
+		assert.Equal(t, s.id, server["instance_id"])
+		assert.Equal(t, "2017-10-10T00:00:40Z", server["started_at"])
+	}
+	assert.NotEqual(t, id, s.id)
+
+	// 同じ起動時刻なら別のプロセスで見ても同じ ID
+	other := &Server{host: "127.0.0.1:3000"}
+	other.Observe(report(time.Minute, 0), now.Add(30*time.Second))
+	assert.Equal(t, s.id, other.id)
+
+	// 秒の境目をまたいで起動時刻がぶれても同じ ID
+	other = &Server{host: "127.0.0.1:3000"}
+	other.Observe(report(time.Minute+1200*time.Millisecond, 0), now.Add(30*time.Second))
+	assert.Equal(t, s.id, other.id)
+
+	// 同じ分のうちに再起動しても前の ID とは別になる
+	id = s.id
+	now = now.Add(10 * time.Second)
+	restart = s.Observe(report(30*time.Second, 0), now)
+	if assert.NotNil(t, restart) {
+		assert.Equal(t, "2017-10-10T00:00:50Z", serverFields(restart)["started_at"])
+	}
+	assert.NotEqual(t, id, s.id)
+}
+
+func TestServerSavedInstance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sorabeat-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sora.json")
+	restart := func() *Server {
+		s := &Server{host: "127.0.0.1:3000", file: file}
+		if err := s.load(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// 起動時刻は 00:00:59.8
+	now := time.Date(2017, 10, 10, 0, 10, 0, 0, time.UTC)
+	s := restart()
+	assert.Nil(t, s.Observe(report(9*time.Minute+200*time.Millisecond, 100), now))
+	id := s.id
+
+	// Sorabeat を再起動したときに応答時間のぶれで起動時刻が 00:01:00.5 と分の境目を
+	// またいでも、uptime が増え続けていれば同じ ID
+	now = now.Add(10*time.Minute + 500*time.Millisecond)
+	started := now.Add(-19 * time.Minute)
+	assert.NotEqual(t, id, instanceID(s.host, started, instanceIDPrecision))
+	s = restart()
+	assert.Nil(t, s.Observe(report(19*time.Minute, 200), now))
+	assert.Equal(t, id, s.id)
+
+	// Sorabeat が止まっている間に Sora が再起動していれば別の ID
+	now = now.Add(time.Hour)
+	s = restart()
+	assert.Nil(t, s.Observe(report(30*time.Minute, 10), now))
+	assert.NotEqual(t, id, s.id)
+	id = s.id
+	s = restart()
+	assert.Nil(t, s.Observe(report(30*time.Minute+10*time.Second, 20), now.Add(10*time.Second)))
+	assert.Equal(t, id, s.id)
+}
+
+func TestPersistServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sorabeat-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	host := testHost("persist")
+	s, err := PersistServer(testBase(t, map[string]interface{}{"hosts": []string{host}, "server.path": dir}))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, unsafeFileChars.ReplaceAllString(host, "_")+".json"), s.file)
+
+	// persist: false のときは保存しない
+	host = testHost("persist")
+	s, err = PersistServer(testBase(t, map[string]interface{}{"hosts": []string{host}, "server.path": dir, "persist": false}))
+	assert.NoError(t, err)
+	assert.Equal(t, "", s.file)
+	s.Observe(report(time.Minute, 1), time.Now())
+	names, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestServerCounterRestart(t *testing.T) {
+	s := &Server{host: "127.0.0.1:3000"}
+	now := time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+	counters := func(successful float64) common.MapStr {
+		return common.MapStr{"total_successful_connections": successful}
+	}
+
+	assert.Nil(t, s.Observe(counters(100), now))
+	id := s.id
+	assert.Nil(t, s.Observe(counters(100), now.Add(10*time.Second)))
+
+	restart := s.Observe(counters(3), now.Add(20*time.Second))
+	if assert.NotNil(t, restart) {
+		server := serverFields(restart)
+		assert.Equal(t, RestartCounters, server["reason"])
+		assert.NotContains(t, server, "started_at")
+	}
+	assert.NotEqual(t, id, s.id)
+	assert.Nil(t, s.Observe(counters(4), now.Add(30*time.Second)))
+}
+
+func TestServerAnnotate(t *testing.T) {
+	host := testHost("annotate")
+	s := ServerOf(host)
+	assert.Equal(t, s, ServerOf(host))
+
+	events := []common.MapStr{{"channel_id": "sora"}}
+	// stats を取得するまでは付けない
+	s.Annotate(events)
+	assert.NotContains(t, events[0], mb.ModuleDataKey)
+
+	s.Observe(report(time.Hour, 1), time.Date(2017, 10, 10, 1, 0, 0, 0, time.UTC))
+	events = []common.MapStr{
+		{"channel_id": "sora"},
+		{mb.ModuleDataKey: common.MapStr{"polling": common.MapStr{"reason": ReasonSteady}}},
+	}
+	s.Annotate(events)
+	for _, event := range events {
+		server := serverFields(event)
+		assert.Equal(t, s.id, server["instance_id"])
+		assert.Equal(t, "2017-10-10T00:00:00Z", server["started_at"])
+	}
+	assert.Contains(t, events[1][mb.ModuleDataKey], "polling")
+}
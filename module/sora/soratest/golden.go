@@ -0,0 +1,101 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package soratest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+var (
+	// Use `SORABEAT_UPDATE_GOLDEN=1 go test` to rewrite the golden files. A
+	// test flag would make `go test ./module/sora/...` fail in the packages
+	// that do not import soratest.
+	updateGolden = os.Getenv("SORABEAT_UPDATE_GOLDEN") != ""
+)
+
+// AssertGolden compares the JSON encoding of actual with the golden file
+// testdata/<name>.golden.json of the package under test. With
+// SORABEAT_UPDATE_GOLDEN=1 the golden file is rewritten instead.
+func AssertGolden(t testing.TB, name string, actual interface{}) {
+	path := filepath.Join("testdata", name+".golden.json")
+
+	got, err := json.MarshalIndent(actual, "", "    ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	if updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run SORABEAT_UPDATE_GOLDEN=1 go test to create it)", err)
+	}
+	if line, w, g, ok := firstDiff(string(want), string(got)); ok {
+		t.Errorf("%s differs from the golden file at line %d, run SORABEAT_UPDATE_GOLDEN=1 go test and review the diff\n want: %s\n  got: %s",
+			path, line, w, g)
+	}
+}
+
+// WithoutServer removes sora.server from the events, whose instance ID
+// depends on when the test ran, so that they can be compared with a golden
+// file.
+func WithoutServer(events []common.MapStr) []common.MapStr {
+	for _, event := range events {
+		module, ok := event[mb.ModuleDataKey].(common.MapStr)
+		if !ok {
+			continue
+		}
+		delete(module, "server")
+		if len(module) == 0 {
+			delete(event, mb.ModuleDataKey)
+		}
+	}
+	return events
+}
+
+func firstDiff(want, got string) (int, string, string, bool) {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return i + 1, w, g, true
+		}
+	}
+	return 0, "", "", false
+}
@@ -0,0 +1,353 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package soratest provides a fake Sora API server for testing the sora
+metricsets.
+
+The server routes requests on the x-sora-target header the same way Sora does,
+answers with the fixtures recorded for a given Sora release, and can simulate a
+growing connection set, slow responses, HTTP errors and malformed JSON.
+
+	server := soratest.NewServer(t, "18.10.04")
+	defer server.Close()
+	server.OnRequest(soratest.RequireTarget(t, soratest.GetStatsReport))
+
+	config := map[string]interface{}{
+		"module":     "sora",
+		"metricsets": []string{"stats"},
+		"hosts":      []string{server.URL},
+	}
+*/
+package soratest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// TargetHeaderKey is the header Sora uses to select the API.
+	TargetHeaderKey = "x-sora-target"
+
+	// GetStatsReport is the target of the stats metricset.
+	GetStatsReport = "Sora_20171010.GetStatsReport"
+	// GetStatsAllConnections is the target of the connections metricset.
+	GetStatsAllConnections = "Sora_20171101.GetStatsAllConnections"
+	// GetStatsConnection is the target of the connection_detail metricset.
+	GetStatsConnection = "Sora_20171101.GetStatsConnection"
+	// GetLicense is the target of the license metricset.
+	GetLicense = "Sora_20171218.GetLicense"
+	// ListRecording is the target of the recording metricset.
+	ListRecording = "Sora_20170814.ListRecording"
+)
+
+// Request is a request received by the fake server.
+type Request struct {
+	Method string
+	Target string
+	Header http.Header
+	Body   []byte
+}
+
+// Fault describes a failure injected into the responses for a target.
+type Fault struct {
+	// Status is the HTTP status code returned instead of the fixture.
+	Status int
+	// Latency delays the response.
+	Latency time.Duration
+	// Malformed truncates the fixture so that it is not valid JSON.
+	Malformed bool
+	// Body replaces the fixture when it is not nil.
+	Body []byte
+	// Times limits the fault to the next n requests. Zero means forever.
+	Times int
+}
+
+// Server is a fake Sora API server backed by recorded fixtures.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	version  string
+	fixtures map[string][]byte
+	faults   map[string]*Fault
+	latency  time.Duration
+	hooks    []func(r *Request)
+	requests []Request
+	sim      *simulation
+}
+
+// NewServer starts a fake Sora server answering with the fixtures of the given
+// Sora release. The caller must Close the server.
+func NewServer(t testing.TB, version string) *Server {
+	s := &Server{
+		faults: map[string]*Fault{},
+	}
+	if err := s.SetVersion(version); err != nil {
+		t.Fatal(err)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Versions returns the Sora releases for which fixtures are available.
+func Versions() []string {
+	entries, err := ioutil.ReadDir(fixturesDir())
+	if err != nil {
+		return nil
+	}
+	var versions []string
+	for _, e := range entries {
+		if e.IsDir() {
+			versions = append(versions, e.Name())
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Fixture returns the recorded response of a Sora release for the target.
+func Fixture(version, target string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(fixturesDir(), version, methodOf(target)+".json"))
+}
+
+// fixturesDir は testdata ディレクトリの場所を返す。
+// 呼び出し元のパッケージのテストからも読めるようにソースの位置から辿る
+func fixturesDir() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "testdata")
+}
+
+// SetVersion switches the fixtures to the given Sora release.
+func (s *Server) SetVersion(version string) error {
+	dir := filepath.Join(fixturesDir(), version)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("no fixtures for Sora %s: %v", version, err)
+	}
+
+	fixtures := map[string][]byte{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || filepath.Ext(name) != ".json" {
+			continue
+		}
+		body, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		fixtures[strings.TrimSuffix(name, ".json")] = body
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = version
+	s.fixtures = fixtures
+	return nil
+}
+
+// Version returns the Sora release the server currently emulates.
+func (s *Server) Version() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// SetFixture overrides the response body for a target.
+func (s *Server) SetFixture(target string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fixtures[methodOf(target)] = body
+}
+
+// Inject makes the responses for target fail as described by fault.
+func (s *Server) Inject(target string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[target] = &fault
+}
+
+// ClearFaults removes all injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = map[string]*Fault{}
+	s.latency = 0
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// OnRequest registers a hook called with every request before it is answered.
+func (s *Server) OnRequest(hook func(r *Request)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]Request, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+// RequestCount returns the number of requests received for target.
+func (s *Server) RequestCount(target string) int {
+	n := 0
+	for _, r := range s.Requests() {
+		if r.Target == target {
+			n++
+		}
+	}
+	return n
+}
+
+// RequireTarget returns a hook that fails the test when a request is not a
+// POST carrying one of the given x-sora-target.
+func RequireTarget(t testing.TB, targets ...string) func(r *Request) {
+	return func(r *Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected method %s for %s", r.Method, r.Target)
+		}
+		for _, target := range targets {
+			if r.Target == target {
+				return
+			}
+		}
+		t.Errorf("unexpected %s: got %q, want one of %q", TargetHeaderKey, r.Target, targets)
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	req := Request{
+		Method: r.Method,
+		Target: r.Header.Get(TargetHeaderKey),
+		Header: r.Header,
+		Body:   body,
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	hooks := s.hooks
+	latency := s.latency
+	fault := s.takeFault(req.Target)
+	s.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(&req)
+	}
+
+	if fault != nil {
+		latency += fault.Latency
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	if fault != nil && fault.Status != 0 {
+		writeError(w, fault.Status, "injected fault")
+		return
+	}
+
+	// Sora の API は POST のみ受け付ける
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	response, ok := s.response(req.Target)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "unknown target: "+req.Target)
+		return
+	}
+	if fault != nil && fault.Body != nil {
+		response = fault.Body
+	}
+	if fault != nil && fault.Malformed {
+		response = response[:len(response)/2]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// takeFault returns the fault for target and consumes one of its uses.
+// Must be called with s.mu held.
+func (s *Server) takeFault(target string) *Fault {
+	fault, ok := s.faults[target]
+	if !ok {
+		return nil
+	}
+	current := *fault
+	if fault.Times > 0 {
+		fault.Times--
+		if fault.Times == 0 {
+			delete(s.faults, target)
+		}
+	}
+	return &current
+}
+
+func (s *Server) response(target string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(target, "Sora_") {
+		return nil, false
+	}
+	method := methodOf(target)
+	if s.sim != nil {
+		if body, ok := s.sim.response(method); ok {
+			return body, true
+		}
+	}
+	body, ok := s.fixtures[method]
+	return body, ok
+}
+
+func methodOf(target string) string {
+	if i := strings.LastIndex(target, "."); i >= 0 {
+		return target[i+1:]
+	}
+	return target
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error_type": http.StatusText(status),
+		"message":    message,
+	})
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package soratest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func post(t *testing.T, s *Server, target string) (int, []byte) {
+	req, err := http.NewRequest("POST", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(TargetHeaderKey, target)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+func TestFixturesForAllVersions(t *testing.T) {
+	versions := Versions()
+	assert.Contains(t, versions, "17.10")
+	assert.Contains(t, versions, "18.10.04")
+	assert.Contains(t, versions, "19.04")
+
+	for _, version := range versions {
+		for _, target := range []string{GetStatsReport, GetStatsAllConnections} {
+			body, err := Fixture(version, target)
+			if !assert.NoError(t, err, version) {
+				continue
+			}
+			var v interface{}
+			assert.NoError(t, json.Unmarshal(body, &v), "%s %s", version, target)
+		}
+	}
+}
+
+func TestRoutesOnTarget(t *testing.T) {
+	s := NewServer(t, "17.10")
+	defer s.Close()
+
+	status, body := post(t, s, GetStatsReport)
+	assert.Equal(t, 200, status)
+	expected, _ := Fixture("17.10", GetStatsReport)
+	assert.Equal(t, expected, body)
+
+	status, _ = post(t, s, "Sora_20171010.Unknown")
+	assert.Equal(t, 400, status)
+
+	status, _ = post(t, s, "")
+	assert.Equal(t, 400, status)
+
+	resp, err := http.Get(s.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 405, resp.StatusCode)
+	}
+
+	assert.Equal(t, 1, s.RequestCount(GetStatsReport))
+	assert.Len(t, s.Requests(), 4)
+}
+
+func TestHooks(t *testing.T) {
+	s := NewServer(t, "18.10.04")
+	defer s.Close()
+
+	var targets []string
+	s.OnRequest(func(r *Request) {
+		targets = append(targets, r.Target)
+	})
+	s.OnRequest(RequireTarget(t, GetStatsAllConnections))
+
+	post(t, s, GetStatsAllConnections)
+	assert.Equal(t, []string{GetStatsAllConnections}, targets)
+}
+
+func TestFaults(t *testing.T) {
+	s := NewServer(t, "18.10.04")
+	defer s.Close()
+
+	s.Inject(GetStatsReport, Fault{Status: 503, Times: 1})
+	status, _ := post(t, s, GetStatsReport)
+	assert.Equal(t, 503, status)
+	status, _ = post(t, s, GetStatsReport)
+	assert.Equal(t, 200, status)
+
+	s.Inject(GetStatsReport, Fault{Malformed: true})
+	_, body := post(t, s, GetStatsReport)
+	var v interface{}
+	assert.Error(t, json.Unmarshal(body, &v))
+
+	s.Inject(GetStatsReport, Fault{Body: []byte(`{}`)})
+	_, body = post(t, s, GetStatsReport)
+	assert.Equal(t, []byte(`{}`), body)
+
+	s.ClearFaults()
+	s.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	_, body = post(t, s, GetStatsReport)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.False(t, bytes.Equal(body, []byte(`{}`)))
+}
+
+func TestGrow(t *testing.T) {
+	s := NewServer(t, "18.10.04")
+	defer s.Close()
+	s.Grow(2)
+
+	var first, second []map[string]interface{}
+	_, body := post(t, s, GetStatsAllConnections)
+	assert.NoError(t, json.Unmarshal(body, &first))
+	_, body = post(t, s, GetStatsAllConnections)
+	assert.NoError(t, json.Unmarshal(body, &second))
+
+	assert.Len(t, first, 2)
+	assert.Len(t, second, 4)
+	assert.Equal(t, 4, s.Connections())
+	assert.Equal(t, first[0]["client_id"], second[0]["client_id"])
+	assert.NotEqual(t, second[0]["client_id"], second[1]["client_id"])
+
+	rtp0 := first[0]["rtp"].(map[string]interface{})
+	rtp1 := second[0]["rtp"].(map[string]interface{})
+	assert.True(t, rtp1["total_sent_byte_size"].(float64) > rtp0["total_sent_byte_size"].(float64))
+
+	var report map[string]interface{}
+	_, body = post(t, s, GetStatsReport)
+	assert.NoError(t, json.Unmarshal(body, &report))
+	assert.Equal(t, 4., report["total_ongoing_connections"])
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package soratest
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// simulation generates GetStatsAllConnections responses for a connection set
+// that grows on every request. Counters of a connection are the counters of
+// the fixture's first connection multiplied by the number of requests the
+// connection has been alive for, so they always advance.
+type simulation struct {
+	template map[string]interface{}
+	report   map[string]interface{}
+	perStep  int
+	step     int
+	joined   []int
+}
+
+// Grow switches GetStatsAllConnections to a simulated connection set. Every
+// request adds n connections and advances the counters of the existing ones.
+// GetStatsReport reports the simulated number of connections.
+func (s *Server) Grow(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var connections []map[string]interface{}
+	if err := json.Unmarshal(s.fixtures["GetStatsAllConnections"], &connections); err != nil || len(connections) == 0 {
+		panic(fmt.Sprintf("soratest: Sora %s has no connection fixture to simulate", s.version))
+	}
+	var report map[string]interface{}
+	json.Unmarshal(s.fixtures["GetStatsReport"], &report)
+
+	s.sim = &simulation{
+		template: connections[0],
+		report:   report,
+		perStep:  n,
+	}
+}
+
+// Connections returns the number of simulated connections.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sim == nil {
+		return 0
+	}
+	return len(s.sim.joined)
+}
+
+func (sim *simulation) response(method string) ([]byte, bool) {
+	switch method {
+	case "GetStatsAllConnections":
+		sim.step++
+		for i := 0; i < sim.perStep; i++ {
+			sim.joined = append(sim.joined, sim.step)
+		}
+		connections := make([]map[string]interface{}, 0, len(sim.joined))
+		for i, joined := range sim.joined {
+			connections = append(connections, sim.connection(i, sim.step-joined+1))
+		}
+		body, _ := json.Marshal(connections)
+		return body, true
+	case "GetStatsReport":
+		if sim.report == nil {
+			return nil, false
+		}
+		report := copyMap(sim.report)
+		report["total_ongoing_connections"] = len(sim.joined)
+		report["total_successful_connections"] = len(sim.joined)
+		body, _ := json.Marshal(report)
+		return body, true
+	}
+	return nil, false
+}
+
+func (sim *simulation) connection(index int, age int) map[string]interface{} {
+	conn := scale(sim.template, float64(age)).(map[string]interface{})
+	conn["client_id"] = fmt.Sprintf("client-%04d", index)
+	if _, ok := conn["connection_id"]; ok {
+		conn["connection_id"] = fmt.Sprintf("connection-%04d", index)
+	}
+	return conn
+}
+
+// scale はネストしたマップの数値を factor 倍したコピーを返す
+func scale(v interface{}, factor float64) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, e := range value {
+			m[k] = scale(e, factor)
+		}
+		return m
+	case float64:
+		return value * factor
+	default:
+		return value
+	}
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// vmCounters are the cumulative counters of erlang_vm.statistics turned into
+// per second rates, by the name of the rate field.
+var vmCounters = map[string]string{
+	"gcs":              "garbage_collection.number_of_gcs",
+	"words_reclaimed":  "garbage_collection.words_reclaimed",
+	"reductions":       "exact_reductions.total_exact_reductions",
+	"context_switches": "context_switches",
+}
+
+type vmSample struct {
+	time     time.Time
+	counters map[string]float64
+}
+
+// erlangVM derives the memory shares and the counter rates of the Erlang VM.
+type erlangVM struct {
+	previous *vmSample
+}
+
+// derive adds memory_share, atom_usage and rate to the erlang_vm block of the
+// report. The rates are missing on the first report, and replaced by
+// rate.reset when Sora restarted in the interval, i.e. restarted is set or a
+// counter went back.
+func (e *erlangVM) derive(stats common.MapStr, now time.Time, restarted bool) {
+	vm, _ := stats["erlang_vm"].(map[string]interface{})
+	if vm == nil {
+		return
+	}
+
+	memory, _ := vm["memory"].(map[string]interface{})
+	if total, ok := memory["total"].(float64); ok && total > 0 {
+		share := common.MapStr{}
+		for class, value := range memory {
+			if value, ok := value.(float64); ok && class != "total" {
+				share[class] = value / total
+			}
+		}
+		vm["memory_share"] = share
+	}
+	atom, _ := memory["atom"].(float64)
+	atomUsed, ok := memory["atom_used"].(float64)
+	if ok && atom > 0 {
+		vm["atom_usage"] = atomUsed / atom
+	}
+
+	statistics, _ := vm["statistics"].(map[string]interface{})
+	current := &vmSample{time: now, counters: map[string]float64{}}
+	for name, path := range vmCounters {
+		if value, err := common.MapStr(statistics).GetValue(path); err == nil {
+			if value, ok := value.(float64); ok {
+				current.counters[name] = value
+			}
+		}
+	}
+	previous := e.previous
+	e.previous = current
+	if previous == nil || len(current.counters) == 0 {
+		return
+	}
+
+	interval := current.time.Sub(previous.time)
+	rate := common.MapStr{"interval": int64(interval / time.Millisecond)}
+	for name, value := range current.counters {
+		// Erlang のカウンタは溢れないので、戻ったときは Sora の再起動
+		if last, ok := previous.counters[name]; ok && value < last {
+			restarted = true
+		}
+	}
+	if restarted {
+		rate["reset"] = true
+		vm["rate"] = rate
+		return
+	}
+	for name, value := range current.counters {
+		if last, ok := previous.counters[name]; ok && interval > 0 {
+			rate[name] = (value - last) / interval.Seconds()
+		}
+	}
+	rate["reset"] = false
+	vm["rate"] = rate
+}
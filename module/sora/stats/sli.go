@@ -0,0 +1,169 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// SLOConfig holds the SLO targets the burn rates are computed against. A
+// zero target disables its burn rate.
+type SLOConfig struct {
+	// SuccessRatio is the target ratio of successful connections, e.g. 0.99.
+	SuccessRatio float64 `config:"success_ratio"`
+	// SetupTime is the target average setup time.
+	SetupTime time.Duration `config:"setup_time" validate:"min=0"`
+}
+
+// Validate checks the SLO targets.
+func (c *SLOConfig) Validate() error {
+	if c.SuccessRatio < 0 || c.SuccessRatio >= 1 {
+		return errors.New("stats.slo.success_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// sliSample is the part of a report the SLIs are derived from.
+type sliSample struct {
+	time       time.Time
+	successful float64
+	failed     float64
+	setupTime  float64
+	// ブラウザごとの失敗の累計
+	failedByBrowser map[string]float64
+}
+
+func newSLISample(stats common.MapStr, now time.Time) (*sliSample, bool) {
+	successful, ok1 := stats["total_successful_connections"].(float64)
+	failed, ok2 := stats["total_failed_connections"].(float64)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	s := &sliSample{
+		time:            now,
+		successful:      successful,
+		failed:          failed,
+		failedByBrowser: map[string]float64{},
+	}
+	s.setupTime, _ = stats["average_setup_time_msec"].(float64)
+	browser, _ := stats["browser"].(map[string]interface{})
+	failedTypes, _ := browser["total_failed_browser_type"].(map[string]interface{})
+	for name, count := range failedTypes {
+		if count, ok := count.(float64); ok {
+			s.failedByBrowser[name] = count
+		}
+	}
+	return s, true
+}
+
+// sli derives the SLIs of the interval between two reports.
+type sli struct {
+	slo      SLOConfig
+	previous *sliSample
+}
+
+// observe returns the sli and slo fields for the report, or nils on the first
+// report, when the report lacks the connection counters or when Sora
+// restarted in the interval.
+func (s *sli) observe(stats common.MapStr, now time.Time, restarted bool) (common.MapStr, common.MapStr) {
+	current, ok := newSLISample(stats, now)
+	if !ok {
+		return nil, nil
+	}
+	previous := s.previous
+	s.previous = current
+	if previous == nil {
+		return nil, nil
+	}
+	// Sora が再起動した期間は累計の差が意味を持たないので出さない
+	if restarted || current.successful < previous.successful || current.failed < previous.failed {
+		return nil, nil
+	}
+
+	successful := current.successful - previous.successful
+	failed := current.failed - previous.failed
+	fields := common.MapStr{
+		"interval":   int64(current.time.Sub(previous.time) / time.Millisecond),
+		"successful": int64(successful),
+		"failed":     int64(failed),
+	}
+	if change := current.setupTime - previous.setupTime; finite(change) {
+		fields.Put("setup_time.change_msec", change)
+	}
+
+	failedByBrowser := common.MapStr{}
+	for name, count := range current.failedByBrowser {
+		delta := count - previous.failedByBrowser[name]
+		if delta < 0 {
+			delta = count
+		}
+		failedByBrowser[name] = int64(delta)
+	}
+	if len(failedByBrowser) > 0 {
+		fields["failed_by_browser"] = failedByBrowser
+	}
+
+	if ratio := successful / (successful + failed); successful+failed > 0 && finite(ratio) {
+		fields["success_ratio"] = ratio
+	}
+
+	// 累計の平均から期間中に成功した接続の平均を求める
+	intervalSetupTime := math.NaN()
+	if successful > 0 {
+		total := current.setupTime*current.successful - previous.setupTime*previous.successful
+		// 平均は整数に丸められているので負になることがある
+		if average := math.Max(total/successful, 0); finite(average) {
+			intervalSetupTime = average
+			fields.Put("setup_time.interval_msec", intervalSetupTime)
+		}
+	}
+
+	return fields, s.burnRates(successful, failed, intervalSetupTime)
+}
+
+// burnRates returns how fast the interval consumes the error budget of the
+// success ratio SLO; 1 consumes it exactly at the allowed pace. Sora reports
+// only the average setup time, not how many setups exceeded the target, so
+// the setup time SLO gets the ratio of the average of the interval to the
+// target instead of a burn rate.
+func (s *sli) burnRates(successful, failed, setupTime float64) common.MapStr {
+	slo := common.MapStr{}
+	if target := s.slo.SuccessRatio; target > 0 && successful+failed > 0 && finite(successful+failed) {
+		slo["success_ratio"] = common.MapStr{
+			"target":    target,
+			"burn_rate": (failed / (successful + failed)) / (1 - target),
+		}
+	}
+	if target := s.slo.SetupTime; target > 0 && !math.IsNaN(setupTime) {
+		targetMsec := float64(target) / float64(time.Millisecond)
+		slo["setup_time"] = common.MapStr{
+			"target_msec":  targetMsec,
+			"target_ratio": setupTime / targetMsec,
+		}
+	}
+	if len(slo) == 0 {
+		return nil
+	}
+	return slo
+}
+
+// finite は JSON にできない Inf と NaN を除く
+func finite(x float64) bool {
+	return !math.IsInf(x, 0) && !math.IsNaN(x)
+}
@@ -15,14 +15,15 @@
 package stats
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"math"
+	"regexp"
+	"sort"
 
 	"github.com/elastic/beats/libbeat/common"
-	"github.com/elastic/beats/metricbeat/helper"
 	"github.com/elastic/beats/metricbeat/mb"
 	"github.com/elastic/beats/metricbeat/mb/parse"
+
+	"github.com/shiguredo/sorabeat/module/sora"
 )
 
 // init registers the MetricSet with the central registry.
@@ -34,11 +35,9 @@ func init() {
 }
 
 const (
-	defaultScheme     = "http"
-	httpPath          = "/"
-	httpMethod        = "POST"
-	targetHeaderKey   = "x-sora-target"
-	targetHeaderValue = "Sora_20171010.GetStatsReport"
+	defaultScheme = "http"
+	httpPath      = "/"
+	target        = "Sora_20171010.GetStatsReport"
 )
 
 var (
@@ -49,15 +48,35 @@ var (
 
 	float_array_keys = []string{"active_tasks", "active_tasks_all",
 		"run_queue_lengths", "run_queue_lengths_all"}
+
+	// browser.total_successful_browser_type のような内訳のキー
+	breakdownKey = regexp.MustCompile(`^total_([a-z]+)_([a-z]+)_type$`)
 )
 
+type config struct {
+	Stats struct {
+		// Breakdown emits a document per browser, SDK or OS and result in
+		// addition to the report. It is disabled by default.
+		Breakdown bool `config:"breakdown"`
+		// SLO holds the targets of the burn rates.
+		SLO SLOConfig `config:"slo"`
+	} `config:"stats"`
+}
+
 // MetricSet type defines all fields of the MetricSet
 // As a minimum it must inherit the mb.BaseMetricSet fields, but can be extended with
 // additional entries. These variables can be used to persist data or configuration between
 // multiple fetch calls.
 type MetricSet struct {
 	mb.BaseMetricSet
-	http *helper.HTTP
+	target    *sora.Target
+	features  *sora.Features
+	server    *sora.Server
+	breakdown bool
+	// 前回の内訳の件数。差分の計算に使う
+	counts map[breakdownID]int64
+	sli    *sli
+	vm     *erlangVM
 }
 
 // New create a new instance of the MetricSet
@@ -65,39 +84,92 @@ type MetricSet struct {
 // configuration entries if needed.
 func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
 
-	config := struct{}{}
-
+	config := config{}
 	if err := base.Module().UnpackConfig(&config); err != nil {
 		return nil, err
 	}
 
-	http := helper.NewHTTP(base)
-	http.SetMethod(httpMethod)
-	http.SetHeader(targetHeaderKey, targetHeaderValue)
+	server, err := sora.PersistServer(base)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := sora.NewTarget(base, target)
+	if err != nil {
+		return nil, err
+	}
+
+	features, err := sora.NewFeatures(base)
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+
 	return &MetricSet{
 		BaseMetricSet: base,
-		http:          http,
+		target:        target,
+		features:      features,
+		server:        server,
+		breakdown:     config.Stats.Breakdown,
+		counts:        map[breakdownID]int64{},
+		sli:           &sli{slo: config.Stats.SLO},
+		vm:            &erlangVM{},
 	}, nil
 }
 
 // Fetch methods implements the data gathering and data conversion to the right format
 // It returns the event which is then forward to the output. In case of an error, a
-// descriptive error must be returned.
-func (m *MetricSet) Fetch() (common.MapStr, error) {
+// descriptive error must be returned. The report is the first event, followed
+// by the breakdown events when enabled and the sora.server.restarted event
+// when Sora restarted.
+func (m *MetricSet) Fetch() ([]common.MapStr, error) {
+	return m.features.Fetch(m.events, nil)
+}
 
-	response, err := m.http.FetchResponse()
+// Close stops the alert notifications, releases the target and saves the
+// anomaly models.
+func (m *MetricSet) Close() error {
+	m.target.Close()
+	return m.features.Close()
+}
+
+// events returns the report, the breakdown events and the restart event of
+// a fetch.
+func (m *MetricSet) events(scrape *sora.Scrape) ([]common.MapStr, error) {
+	stats, err := m.fetch(scrape)
 	if err != nil {
 		return nil, err
 	}
-	defer response.Body.Close()
+	if n, ok := stats["total_ongoing_connections"].(float64); ok {
+		scrape.Connections = int(n)
+	}
 
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
+	// Sora が再起動した期間の差分や毎秒の値は出さない
+	start := scrape.Start()
+	restart := m.server.Observe(stats, start)
+	restarted := restart != nil
+	m.vm.derive(stats, start, restarted)
+	if sli, slo := m.sli.observe(stats, start, restarted); sli != nil {
+		stats["sli"] = sli
+		if slo != nil {
+			stats["slo"] = slo
+		}
 	}
+	events := []common.MapStr{stats}
+	if m.breakdown {
+		if restarted {
+			m.counts = map[breakdownID]int64{}
+		}
+		events = append(events, m.breakdownEvents(stats)...)
+	}
+	if restart != nil {
+		events = append(events, restart)
+	}
+	return events, nil
+}
 
-	var stats map[string]interface{}
-	err = json.Unmarshal(body, &stats)
+func (m *MetricSet) fetch(scrape *sora.Scrape) (common.MapStr, error) {
+	stats, err := m.target.FetchMap(scrape)
 	if err != nil {
 		return nil, err
 	}
@@ -114,15 +186,81 @@ func (m *MetricSet) Fetch() (common.MapStr, error) {
 	return stats, nil
 }
 
+type breakdownID struct {
+	dimension, name, result string
+}
+
+// breakdownEvents returns a document per browser (and SDK or OS when Sora
+// reports them) and result, e.g. one for browser.total_successful_browser_type.chrome,
+// with the count and the difference from the previous fetch.
+func (m *MetricSet) breakdownEvents(stats common.MapStr) []common.MapStr {
+	var ids []breakdownID
+	counts := map[breakdownID]int64{}
+	for _, group := range stats {
+		group, _ := group.(map[string]interface{})
+		for key, value := range group {
+			match := breakdownKey.FindStringSubmatch(key)
+			values, ok := value.(map[string]interface{})
+			if match == nil || !ok {
+				continue
+			}
+			for name, count := range values {
+				count, ok := count.(float64)
+				if !ok {
+					continue
+				}
+				id := breakdownID{dimension: match[2], name: name, result: match[1]}
+				ids = append(ids, id)
+				counts[id] = int64(count)
+			}
+		}
+	}
+	// イベントの順を毎回同じにする
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if a.dimension != b.dimension {
+			return a.dimension < b.dimension
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.result < b.result
+	})
+
+	events := make([]common.MapStr, 0, len(ids))
+	for _, id := range ids {
+		count := counts[id]
+		breakdown := common.MapStr{
+			"type":       id.dimension,
+			id.dimension: id.name,
+			"result":     id.result,
+			"count":      count,
+		}
+		if last, ok := m.counts[id]; ok {
+			// Sora の再起動で件数が戻ったときは差分を出さない
+			if delta := count - last; delta >= 0 {
+				breakdown["delta"] = delta
+			}
+		}
+		events = append(events, common.MapStr{"breakdown": breakdown})
+	}
+	m.counts = counts
+	return events
+}
+
 func addStats(key string, m map[string]interface{}) {
 	value, has_key := m[key]
 	if !has_key {
 		return
 	}
 
+	// 想定外の型が来ても落ちないよう、数値以外は無視する
+	values, _ := value.([]interface{})
 	var numbers []float64
-	for _, v := range value.([]interface{}) {
-		numbers = append(numbers, v.(float64))
+	for _, v := range values {
+		if number, ok := v.(float64); ok {
+			numbers = append(numbers, number)
+		}
 	}
 
 	if len(numbers) == 0 {
@@ -139,7 +277,12 @@ func addStats(key string, m map[string]interface{}) {
 	m[key+"_imbalance"] = max / math.Max(min, 1.)
 }
 
+// MinMax returns the smallest and the largest of numbers, or zeros when
+// numbers is empty.
 func MinMax(numbers []float64) (min float64, max float64) {
+	if len(numbers) == 0 {
+		return 0, 0
+	}
 	max = numbers[0]
 	min = numbers[0]
 	for _, value := range numbers {
@@ -154,8 +297,23 @@ func MinMax(numbers []float64) (min float64, max float64) {
 }
 
 func mean(numbers []float64) float64 {
+	if len(numbers) == 0 {
+		return 0
+	}
+	n := float64(len(numbers))
 	total := calcTotal(numbers)
-	return total / float64(len(numbers))
+	if math.IsInf(total, 0) {
+		// 合計が float64 の範囲を超える場合は要素ごとに割ってから足す
+		total = 0
+		for _, x := range numbers {
+			total += x / n
+		}
+	} else {
+		total = total / n
+	}
+	// 丸め誤差で最小値、最大値からはみ出さないようにする
+	min, max := MinMax(numbers)
+	return math.Min(math.Max(total, min), max)
 }
 
 func calcTotal(numbers []float64) (total float64) {
@@ -166,10 +324,25 @@ func calcTotal(numbers []float64) (total float64) {
 }
 
 func calcStdDev(numbers []float64, mean float64) float64 {
+	if len(numbers) == 0 {
+		return 0
+	}
 	total := 0.0
 	for _, number := range numbers {
 		total += math.Pow(number-mean, 2)
 	}
 	variance := total / float64(len(numbers))
-	return math.Sqrt(variance)
+	if !math.IsInf(variance, 0) && !math.IsNaN(variance) {
+		return math.Sqrt(variance)
+	}
+
+	// 偏差の二乗が Inf になる場合は最大の絶対値で正規化して計算する
+	min, max := MinMax(numbers)
+	scale := math.Max(math.Abs(min), math.Abs(max))
+	total = 0.0
+	for _, number := range numbers {
+		d := number/scale - mean/scale
+		total += d * d
+	}
+	return scale * math.Sqrt(total/float64(len(numbers)))
 }
@@ -0,0 +1,79 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18 && !integration
+// +build go1.18,!integration
+
+package stats
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
+
+	"github.com/shiguredo/sorabeat/module/sora/soratest"
+)
+
+// FuzzFetch feeds arbitrary response bodies into Fetch.
+// Run with `go test -fuzz=FuzzFetch ./module/sora/stats/`.
+func FuzzFetch(f *testing.F) {
+	for _, version := range soratest.Versions() {
+		body, err := soratest.Fixture(version, soratest.GetStatsReport)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body)
+	}
+	f.Add([]byte(`null`))
+	f.Add([]byte(`{"erlang_vm": null}`))
+	f.Add([]byte(`{"erlang_vm": {"statistics": {"active_tasks": []}}}`))
+	f.Add([]byte(`{"erlang_vm": {"statistics": {"active_tasks": "1"}}}`))
+	f.Add([]byte(`{"erlang_vm": {"statistics": {"run_queue_lengths": [1e308, -1e308, null]}}}`))
+
+	server := soratest.NewServer(f, "18.10.04")
+	defer server.Close()
+	fetcher := mbtest.NewEventsFetcher(f, getConfig(server.URL))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		server.SetFixture(soratest.GetStatsReport, body)
+		events, err := fetcher.Fetch()
+		if err != nil {
+			return
+		}
+		// イベントは Elasticsearch に送れる JSON でなければならない
+		if _, err := json.Marshal(events); err != nil {
+			t.Fatalf("event can not be encoded: %v", err)
+		}
+		if len(events) == 0 {
+			return
+		}
+		event := events[0]
+		erlangVM, _ := event["erlang_vm"].(map[string]interface{})
+		statistics, _ := erlangVM["statistics"].(map[string]interface{})
+		for _, key := range float_array_keys {
+			min, ok := statistics[key+"_min"].(float64)
+			if !ok {
+				continue
+			}
+			max := statistics[key+"_max"].(float64)
+			mean := statistics[key+"_mean"].(float64)
+			stddev := statistics[key+"_stddev"].(float64)
+			if !(min <= mean && mean <= max) || !(stddev >= 0) || math.IsInf(stddev, 0) {
+				t.Fatalf("%s: min=%v mean=%v max=%v stddev=%v", key, min, mean, max, stddev)
+			}
+		}
+	})
+}
@@ -17,108 +17,20 @@
 package stats
 
 import (
-	"net/http"
-	"net/http/httptest"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/quick"
+	"time"
 
+	"github.com/elastic/beats/libbeat/common"
 	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
 
+	"github.com/shiguredo/sorabeat/module/sora/soratest"
 	"github.com/stretchr/testify/assert"
 )
 
-// dummy response body
-const response = `{
-    "average_duration_sec": 0,
-    "average_setup_time_msec": 107,
-    "browser": {
-        "total_failed_browser_type": {
-            "chrome": 0,
-            "edge": 0,
-            "firefox": 0,
-            "safari": 0,
-            "unknown": 0
-        },
-        "total_successful_browser_type": {
-            "chrome": 3,
-            "edge": 0,
-            "firefox": 0,
-            "safari": 0,
-            "unknown": 0
-        }
-    },
-    "erlang_vm": {
-        "memory": {
-            "atom": 883657,
-            "atom_used": 859810,
-            "binary": 1973208,
-            "code": 22650901,
-            "ets": 1398248,
-            "processes": 13500928,
-            "processes_used": 13499712,
-            "system": 54879552,
-            "total": 68380480
-        },
-        "statistics": {
-            "active_tasks": [
-                1,
-                0,
-                0
-            ],
-            "active_tasks_all": [
-                4,
-                10,
-                2,
-                5
-            ],
-            "context_switches": 136176,
-            "exact_reductions": {
-                "exact_reductions_since_last_call": 476833,
-                "total_exact_reductions": 513356807
-            },
-            "garbage_collection": {
-                "number_of_gcs": 2436,
-                "words_reclaimed": 8426652
-            },
-            "io": {
-                "input": 55716009,
-                "output": 446654
-            },
-            "reductions": {
-                "reductions_since_last_call": 476387,
-                "total_reductions": 513404228
-            },
-            "run_queue": 0,
-            "run_queue_lengths": [
-                0,
-                0,
-                0
-            ],
-            "run_queue_lengths_all": [
-                0,
-                0,
-                0,
-                0
-            ],
-            "runtime": {
-                "time_since_last_call": 132,
-                "total_run_time": 1180
-            },
-            "total_active_tasks": 1,
-            "total_active_tasks_all": 1,
-            "total_run_queue_lengths": 0,
-            "total_run_queue_lengths_all": 0,
-            "wall_clock": {
-                "total_wallclock_time": 26923,
-                "wallclock_time_since_last_call": 11907
-            }
-        }
-    },
-    "total_duration_sec": 0,
-    "total_failed_connections": 0,
-    "total_ongoing_connections": 3,
-    "total_successful_connections": 3
-}`
-
 const delta = 0.01
 
 func TestAddStats(t *testing.T) {
@@ -133,25 +45,112 @@ func TestAddStats(t *testing.T) {
 	assert.InDelta(t, 3.00, m["vs_imbalance"], delta)
 }
 
-func TestFetchEventContents(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte(response))
-	}))
-	defer server.Close()
+func TestMinMaxEmpty(t *testing.T) {
+	min, max := MinMax(nil)
+	assert.Equal(t, 0., min)
+	assert.Equal(t, 0., max)
+	assert.Equal(t, 0., mean(nil))
+	assert.Equal(t, 0., calcStdDev(nil, 0))
+}
 
-	config := map[string]interface{}{
-		"module":     "sora",
-		"metricsets": []string{"stats"},
-		"hosts":      []string{server.URL},
+func addStatsFor(numbers []float64) map[string]interface{} {
+	values := make([]interface{}, len(numbers))
+	for i, n := range numbers {
+		values[i] = n
+	}
+	m := map[string]interface{}{"vs": values}
+	addStats("vs", m)
+	return m
+}
+
+// checkProperties は addStats の結果が満たすべき性質を確認する
+func checkProperties(m map[string]interface{}) bool {
+	min := m["vs_min"].(float64)
+	max := m["vs_max"].(float64)
+	mean := m["vs_mean"].(float64)
+	stddev := m["vs_stddev"].(float64)
+	imbalance := m["vs_imbalance"].(float64)
+
+	if !(min <= mean && mean <= max) {
+		return false
+	}
+	if !(stddev >= 0) || math.IsInf(stddev, 0) {
+		return false
+	}
+	if min >= 1 && !(imbalance >= 1) {
+		return false
+	}
+	return true
+}
+
+func TestAddStatsProperties(t *testing.T) {
+	// 任意の float64 (非常に大きな値を含む)
+	property := func(numbers []float64) bool {
+		if len(numbers) == 0 {
+			_, ok := addStatsFor(numbers)["vs_mean"]
+			return !ok
+		}
+		return checkProperties(addStatsFor(numbers))
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+
+	// run_queue_lengths のような 1 以上の整数
+	positive := func(counts []uint16) bool {
+		if len(counts) == 0 {
+			return true
+		}
+		numbers := make([]float64, len(counts))
+		for i, c := range counts {
+			numbers[i] = float64(c) + 1
+		}
+		return checkProperties(addStatsFor(numbers))
+	}
+	if err := quick.Check(positive, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddStatsIgnoresUnexpectedTypes(t *testing.T) {
+	m := map[string]interface{}{
+		"scalar": 1.,
+		"mixed":  []interface{}{"a", 2., nil, map[string]interface{}{}, 4.},
+		"empty":  []interface{}{"a"},
 	}
+	addStats("scalar", m)
+	addStats("mixed", m)
+	addStats("empty", m)
 
-	f := mbtest.NewEventFetcher(t, config)
-	event, err := f.Fetch()
+	assert.NotContains(t, m, "scalar_mean")
+	assert.NotContains(t, m, "empty_mean")
+	assert.InDelta(t, 3.00, m["mixed_mean"], delta)
+	assert.InDelta(t, 2.00, m["mixed_min"], delta)
+}
+
+func TestFetchHTTPStatusError(t *testing.T) {
+	server := soratest.NewServer(t, "18.10.04")
+	defer server.Close()
+	server.Inject(soratest.GetStatsReport, soratest.Fault{Status: 500})
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	events, err := f.Fetch()
+	assert.Error(t, err)
+	assert.Nil(t, events)
+}
+
+func TestFetchEventContents(t *testing.T) {
+	server := soratest.NewServer(t, "17.10")
+	defer server.Close()
+	server.OnRequest(soratest.RequireTarget(t, soratest.GetStatsReport))
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	events, err := f.Fetch()
 	if !assert.NoError(t, err) {
 		t.FailNow()
 	}
 
+	event := events[0]
 	assert.Equal(t, 0., event["total_duration_sec"])
 	erlang_vm, _ := event["erlang_vm"].(map[string]interface{})
 	statistics, _ := erlang_vm["statistics"].(map[string]interface{})
@@ -168,3 +167,338 @@ func TestFetchEventContents(t *testing.T) {
 	assert.InDelta(t, 2.95, statistics["active_tasks_all_stddev"], delta)
 	assert.InDelta(t, 5., statistics["active_tasks_all_imbalance"], delta)
 }
+
+func TestFetchMalformedJSON(t *testing.T) {
+	server := soratest.NewServer(t, "18.10.04")
+	defer server.Close()
+	server.Inject(soratest.GetStatsReport, soratest.Fault{Malformed: true})
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	_, err := f.Fetch()
+	assert.Error(t, err)
+	assert.Equal(t, 1, server.RequestCount(soratest.GetStatsReport))
+}
+
+func TestFetchBreakdown(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	config := getConfig(server.URL)
+	config["stats.breakdown"] = true
+	f := mbtest.NewEventsFetcher(t, config)
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// レポートとブラウザ 5 種類 x 成功、失敗
+	if !assert.Len(t, events, 11) {
+		t.FailNow()
+	}
+	assert.Contains(t, events[0], "erlang_vm")
+	assert.Equal(t, common.MapStr{
+		"type":    "browser",
+		"browser": "chrome",
+		"result":  "successful",
+		"count":   int64(3),
+	}, events[2]["breakdown"])
+
+	// SDK や OS の内訳があればそれも分ける
+	server.SetFixture(soratest.GetStatsReport, []byte(`{
+		"browser": {"total_successful_browser_type": {"chrome": 5}},
+		"sdk": {"total_successful_sdk_type": {"ios": 2}, "total_failed_sdk_type": {"ios": 1}},
+		"total_ongoing_connections": 1
+	}`))
+	events, err = f.Fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 4) {
+		t.FailNow()
+	}
+	assert.Equal(t, common.MapStr{"type": "browser", "browser": "chrome", "result": "successful", "count": int64(5), "delta": int64(2)}, events[1]["breakdown"])
+	assert.Equal(t, common.MapStr{"type": "sdk", "sdk": "ios", "result": "failed", "count": int64(1)}, events[2]["breakdown"])
+	assert.Equal(t, common.MapStr{"type": "sdk", "sdk": "ios", "result": "successful", "count": int64(2)}, events[3]["breakdown"])
+
+	// Sora が再起動して件数が戻ったときは差分を出さない
+	server.SetFixture(soratest.GetStatsReport, []byte(`{"browser": {"total_successful_browser_type": {"chrome": 1}}}`))
+	events, err = f.Fetch()
+	if assert.NoError(t, err) && assert.Len(t, events, 2) {
+		assert.NotContains(t, events[1]["breakdown"], "delta")
+	}
+}
+
+func TestFetchBreakdownDisabled(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	// デフォルトではレポートだけを送る
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	events, err := f.Fetch()
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+}
+
+func TestFetchSLI(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	config := getConfig(server.URL)
+	config["stats.slo.success_ratio"] = 0.99
+	config["stats.slo.setup_time"] = "200ms"
+	f := mbtest.NewEventsFetcher(t, config)
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// 初回は前回の値がないので出さない
+	assert.NotContains(t, events[0], "sli")
+	assert.NotContains(t, events[0], "slo")
+
+	server.SetFixture(soratest.GetStatsReport, []byte(`{
+		"average_setup_time_msec": 100,
+		"browser": {"total_failed_browser_type": {"chrome": 2, "firefox": 0}},
+		"total_failed_connections": 2,
+		"total_successful_connections": 13
+	}`))
+	events, err = f.Fetch()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	event := events[0]
+	sli := event["sli"].(common.MapStr)
+	assert.Equal(t, int64(10), sli["successful"])
+	assert.Equal(t, int64(2), sli["failed"])
+	assert.InDelta(t, 10./12, sli["success_ratio"], delta)
+	assert.Equal(t, common.MapStr{"chrome": int64(2), "firefox": int64(0)}, sli["failed_by_browser"])
+	assert.True(t, sli["interval"].(int64) >= 0)
+	changed, _ := event.GetValue("sli.setup_time.change_msec")
+	assert.Equal(t, 2., changed)
+	// (100 * 13 - 98 * 3) / 10
+	setupTime, _ := event.GetValue("sli.setup_time.interval_msec")
+	assert.InDelta(t, 100.6, setupTime, delta)
+
+	burnRate, _ := event.GetValue("slo.success_ratio.burn_rate")
+	assert.InDelta(t, 16.67, burnRate, delta)
+	targetRatio, _ := event.GetValue("slo.setup_time.target_ratio")
+	assert.InDelta(t, 0.503, targetRatio, delta)
+}
+
+func TestSLIReset(t *testing.T) {
+	s := &sli{}
+	now := time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+	report := func(successful, failed, setupTime float64) common.MapStr {
+		return common.MapStr{
+			"average_setup_time_msec":      setupTime,
+			"total_failed_connections":     failed,
+			"total_successful_connections": successful,
+		}
+	}
+
+	fields, slo := s.observe(report(100, 10, 50), now, false)
+	assert.Nil(t, fields)
+	assert.Nil(t, slo)
+
+	// Sora が再起動して累計が戻った期間は出さない
+	fields, slo = s.observe(report(4, 0, 80), now.Add(10*time.Second), false)
+	assert.Nil(t, fields)
+	assert.Nil(t, slo)
+
+	// 再起動後の累計からの増加を出す
+	fields, slo = s.observe(report(8, 0, 80), now.Add(20*time.Second), false)
+	assert.Nil(t, slo)
+	assert.Equal(t, int64(10000), fields["interval"])
+	assert.Equal(t, int64(4), fields["successful"])
+	assert.Equal(t, 1., fields["success_ratio"])
+	setupTime, _ := fields.GetValue("setup_time.interval_msec")
+	assert.Equal(t, 80., setupTime)
+
+	// 接続がなかった期間は比率を出さない
+	fields, _ = s.observe(report(8, 0, 80), now.Add(30*time.Second), false)
+	assert.NotContains(t, fields, "success_ratio")
+	_, err := fields.GetValue("setup_time.interval_msec")
+	assert.Error(t, err)
+
+	// 累計が増えていても再起動を検知した期間は出さない
+	fields, _ = s.observe(report(20, 0, 80), now.Add(40*time.Second), true)
+	assert.Nil(t, fields)
+
+	// 累計がない古い Sora では出さない
+	fields, _ = s.observe(common.MapStr{}, now, false)
+	assert.Nil(t, fields)
+}
+
+func TestErlangVM(t *testing.T) {
+	e := &erlangVM{}
+	now := time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+	report := func(gcs, contextSwitches float64) common.MapStr {
+		return common.MapStr{"erlang_vm": map[string]interface{}{
+			"memory": map[string]interface{}{
+				"atom":      1000.,
+				"atom_used": 250.,
+				"processes": 300.,
+				"system":    700.,
+				"total":     1000.,
+			},
+			"statistics": map[string]interface{}{
+				"context_switches": contextSwitches,
+				"exact_reductions": map[string]interface{}{"total_exact_reductions": 5000.},
+				"garbage_collection": map[string]interface{}{
+					"number_of_gcs":   gcs,
+					"words_reclaimed": gcs * 100,
+				},
+			},
+		}}
+	}
+
+	stats := report(100, 1000)
+	e.derive(stats, now, false)
+	share, _ := stats.GetValue("erlang_vm.memory_share")
+	assert.Equal(t, common.MapStr{"atom": 1., "atom_used": 0.25, "processes": 0.3, "system": 0.7}, share)
+	usage, _ := stats.GetValue("erlang_vm.atom_usage")
+	assert.Equal(t, 0.25, usage)
+	// 初回は前回の値がないので出さない
+	_, err := stats.GetValue("erlang_vm.rate")
+	assert.Error(t, err)
+
+	stats = report(150, 3000)
+	e.derive(stats, now.Add(10*time.Second), false)
+	rate, _ := stats.GetValue("erlang_vm.rate")
+	assert.Equal(t, common.MapStr{
+		"interval":         int64(10000),
+		"gcs":              5.,
+		"words_reclaimed":  500.,
+		"reductions":       0.,
+		"context_switches": 200.,
+		"reset":            false,
+	}, rate)
+
+	// Sora が再起動してカウンタが戻ったときは印を付けて値を出さない
+	stats = report(10, 3500)
+	e.derive(stats, now.Add(20*time.Second), false)
+	rate, _ = stats.GetValue("erlang_vm.rate")
+	assert.Equal(t, common.MapStr{"interval": int64(10000), "reset": true}, rate)
+
+	stats = report(20, 4500)
+	e.derive(stats, now.Add(30*time.Second), false)
+	gcs, _ := stats.GetValue("erlang_vm.rate.gcs")
+	assert.Equal(t, 1., gcs)
+
+	// 再起動を検知した期間はカウンタが増えていても出さない
+	stats = report(30, 5500)
+	e.derive(stats, now.Add(40*time.Second), true)
+	rate, _ = stats.GetValue("erlang_vm.rate")
+	assert.Equal(t, common.MapStr{"interval": int64(10000), "reset": true}, rate)
+
+	// erlang_vm がない古い形式では何もしない
+	stats = common.MapStr{}
+	e.derive(stats, now, false)
+	assert.Empty(t, stats)
+}
+
+func TestFetchRestart(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 1) {
+		t.FailNow()
+	}
+	id, _ := events[0].GetValue("_module.server.instance_id")
+	assert.NotEmpty(t, id)
+
+	// 起動からの時間が戻ったら再起動
+	server.SetFixture(soratest.GetStatsReport, []byte(`{
+		"erlang_vm": {"statistics": {
+			"garbage_collection": {"number_of_gcs": 5000},
+			"wall_clock": {"total_wallclock_time": 1000}
+		}},
+		"total_failed_connections": 0,
+		"total_successful_connections": 10
+	}`))
+	events, err = f.Fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 2) {
+		t.FailNow()
+	}
+	// 再起動した期間の SLI は出さない
+	assert.NotContains(t, events[0], "sli")
+	restarted, _ := events[1].GetValue("_module.server.restarted")
+	assert.Equal(t, true, restarted)
+	previous, _ := events[1].GetValue("_module.server.previous_instance_id")
+	assert.Equal(t, id, previous)
+	newID, _ := events[0].GetValue("_module.server.instance_id")
+	assert.NotEqual(t, id, newID)
+	rate, _ := events[0].GetValue("erlang_vm.rate")
+	assert.Equal(t, true, rate.(common.MapStr)["reset"])
+}
+
+func TestSLOConfigValidate(t *testing.T) {
+	assert.NoError(t, (&SLOConfig{SuccessRatio: 0.999}).Validate())
+	assert.Error(t, (&SLOConfig{SuccessRatio: 1}).Validate())
+	assert.Error(t, (&SLOConfig{SuccessRatio: -0.1}).Validate())
+}
+
+func TestFetchAlert(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+
+	config := getConfig(server.URL)
+	config["alerts.rules"] = []map[string]interface{}{{
+		"name":      "imbalance",
+		"condition": "erlang_vm.statistics.active_tasks_all_imbalance > 4",
+	}}
+	f := mbtest.NewEventsFetcher(t, config)
+	events, err := f.Fetch()
+	if !assert.NoError(t, err) || !assert.Len(t, events, 2) {
+		t.FailNow()
+	}
+	state, _ := events[1].GetValue("_module.alert.state")
+	assert.Equal(t, "firing", state)
+	value, _ := events[1].GetValue("_module.alert.value")
+	assert.Equal(t, 5., value)
+
+	// 発火中は同じアラートを繰り返さない
+	events, err = f.Fetch()
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+}
+
+func TestFetchGolden(t *testing.T) {
+	for _, version := range soratest.Versions() {
+		t.Run(version, func(t *testing.T) {
+			server := soratest.NewServer(t, version)
+			defer server.Close()
+
+			f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+			events, err := f.Fetch()
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			soratest.AssertGolden(t, version, soratest.WithoutServer(events))
+		})
+	}
+}
+
+func TestData(t *testing.T) {
+	versions := soratest.Versions()
+	server := soratest.NewServer(t, versions[len(versions)-1])
+	defer server.Close()
+
+	f := mbtest.NewEventsFetcher(t, getConfig(server.URL))
+	events, err := f.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ホストはテストのたびに変わるのでサンプルでは固定する
+	fullEvent := mbtest.CreateFullEvent(f, events[0])
+	fullEvent.Fields.Put("metricset.host", "localhost:3000")
+	mbtest.WriteEventToDataJSON(t, fullEvent)
+}
+
+func getConfig(host string) map[string]interface{} {
+	return map[string]interface{}{
+		"module":     "sora",
+		"metricsets": []string{"stats"},
+		"hosts":      []string{host},
+		// Sora の ID をパッケージのディレクトリに保存しない
+		"server.path": filepath.Join(os.TempDir(), "sorabeat-stats-test"),
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/metricbeat/mb"
+	"gopkg.in/yaml.v2"
+)
+
+// TenantConfig configures the mapping of the channels to the tenants.
+type TenantConfig struct {
+	// Path is the YAML or CSV mapping file. Events are not enriched when
+	// empty.
+	Path string `config:"path"`
+	// ReloadInterval is how often the file is checked for changes.
+	ReloadInterval time.Duration `config:"reload_interval" validate:"positive"`
+	// Default is the tenant of the channels that match no entry.
+	Default TenantInfo `config:"default"`
+}
+
+// TenantInfo is what an entry of the mapping sets on the events.
+type TenantInfo struct {
+	Tenant  string `config:"tenant" yaml:"tenant"`
+	Project string `config:"project" yaml:"project"`
+	Plan    string `config:"plan" yaml:"plan"`
+}
+
+var defaultTenantConfig = TenantConfig{
+	ReloadInterval: 10 * time.Second,
+	Default:        TenantInfo{Tenant: "default"},
+}
+
+// tenantEntry matches a channel either exactly or with a regular expression,
+// whose named groups can be used as ${name} in the values.
+type tenantEntry struct {
+	TenantInfo `config:",inline" yaml:",inline"`
+	Channel    string `config:"channel" yaml:"channel"`
+	Pattern    string `config:"pattern" yaml:"pattern"`
+	re         *regexp.Regexp
+}
+
+type tenantMapping struct {
+	channels map[string]TenantInfo
+	patterns []tenantEntry
+}
+
+// maxTenantCache bounds the channels whose lookup is cached.
+const maxTenantCache = 10000
+
+// Tenants enriches the events that have a channel_id with the tenant,
+// project and plan of the channel, reloading the mapping file when it
+// changes.
+type Tenants struct {
+	mu       sync.Mutex
+	config   TenantConfig
+	mapping  *tenantMapping
+	modTime  time.Time
+	size     int64
+	checked  time.Time
+	cache    map[string]common.MapStr
+	now      func() time.Time
+	disabled bool
+}
+
+// NewTenants creates the Tenants of a metricset from the module
+// configuration and loads the mapping file.
+func NewTenants(base mb.BaseMetricSet) (*Tenants, error) {
+	config := struct {
+		Tenants TenantConfig `config:"tenants"`
+	}{
+		Tenants: defaultTenantConfig,
+	}
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	return newTenants(config.Tenants, time.Now)
+}
+
+func newTenants(config TenantConfig, now func() time.Time) (*Tenants, error) {
+	t := &Tenants{
+		config:   config,
+		now:      now,
+		disabled: config.Path == "",
+	}
+	if t.disabled {
+		return t, nil
+	}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Annotate adds sora.tenant.name, project, plan and default to the events
+// with a channel_id.
+func (t *Tenants) Annotate(events []common.MapStr) {
+	if t.disabled {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now := t.now(); now.Sub(t.checked) >= t.config.ReloadInterval {
+		t.checked = now
+		if err := t.reload(); err != nil {
+			// 書きかけのファイルなどで読めないときは前のマッピングを使い続ける
+			logp.Err("Failed to reload tenants from %s: %v", t.config.Path, err)
+		}
+	}
+
+	for _, event := range events {
+		channelID, ok := event["channel_id"].(string)
+		if !ok {
+			continue
+		}
+		tenant, ok := t.cache[channelID]
+		if !ok {
+			tenant = t.lookup(channelID)
+			if len(t.cache) >= maxTenantCache {
+				t.cache = map[string]common.MapStr{}
+			}
+			t.cache[channelID] = tenant
+		}
+		module, ok := event[mb.ModuleDataKey].(common.MapStr)
+		if !ok {
+			module = common.MapStr{}
+			event[mb.ModuleDataKey] = module
+		}
+		module["tenant"] = tenant.Clone()
+	}
+}
+
+// lookup must be called with t.mu held.
+func (t *Tenants) lookup(channelID string) common.MapStr {
+	info, matched := t.mapping.channels[channelID]
+	if !matched {
+		for _, e := range t.mapping.patterns {
+			match := e.re.FindStringSubmatchIndex(channelID)
+			if match == nil {
+				continue
+			}
+			expand := func(s string) string {
+				return string(e.re.ExpandString(nil, s, channelID, match))
+			}
+			info = TenantInfo{
+				Tenant:  expand(e.Tenant),
+				Project: expand(e.Project),
+				Plan:    expand(e.Plan),
+			}
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		info = t.config.Default
+	}
+
+	tenant := common.MapStr{"name": info.Tenant, "default": !matched}
+	if info.Project != "" {
+		tenant["project"] = info.Project
+	}
+	if info.Plan != "" {
+		tenant["plan"] = info.Plan
+	}
+	return tenant
+}
+
+// reload loads the mapping file when its modification time or size changed.
+// It must be called with t.mu held, or before t is shared.
+func (t *Tenants) reload() error {
+	info, err := os.Stat(t.config.Path)
+	if err != nil {
+		return err
+	}
+	if t.mapping != nil && info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return nil
+	}
+
+	var entries []tenantEntry
+	switch strings.ToLower(filepath.Ext(t.config.Path)) {
+	case ".csv":
+		entries, err = readTenantsCSV(t.config.Path)
+	default:
+		entries, err = readTenantsYAML(t.config.Path)
+	}
+	if err != nil {
+		return err
+	}
+	mapping, err := newTenantMapping(entries)
+	if err != nil {
+		return fmt.Errorf("%s: %v", t.config.Path, err)
+	}
+
+	if t.mapping != nil {
+		logp.Info("Reloaded %d tenant entries from %s", len(entries), t.config.Path)
+	}
+	t.mapping = mapping
+	t.modTime, t.size = info.ModTime(), info.Size()
+	t.cache = map[string]common.MapStr{}
+	return nil
+}
+
+func newTenantMapping(entries []tenantEntry) (*tenantMapping, error) {
+	m := &tenantMapping{channels: map[string]TenantInfo{}}
+	for i, e := range entries {
+		switch {
+		case e.Channel != "" && e.Pattern != "":
+			return nil, fmt.Errorf("entry %d has both channel and pattern", i+1)
+		case e.Channel != "":
+			m.channels[e.Channel] = e.TenantInfo
+		case e.Pattern != "":
+			re, err := regexp.Compile(e.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern '%s' in entry %d: %v", e.Pattern, i+1, err)
+			}
+			e.re = re
+			m.patterns = append(m.patterns, e)
+		default:
+			return nil, fmt.Errorf("entry %d has neither channel nor pattern", i+1)
+		}
+	}
+	return m, nil
+}
+
+// readTenantsYAML は ${name} をパターンの名前付きグループとして残すため、
+// 変数を展開する common.LoadFile ではなく素の YAML として読む
+func readTenantsYAML(path string) ([]tenantEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := struct {
+		Tenants []tenantEntry `yaml:"tenants"`
+	}{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return file.Tenants, nil
+}
+
+// readTenantsCSV は 1 行目を見出しとして channel, pattern, tenant, project,
+// plan の列を読む
+func readTenantsCSV(path string) ([]tenantEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["tenant"]; !ok {
+		return nil, fmt.Errorf("%s: the header has no tenant column", path)
+	}
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var entries []tenantEntry
+	for _, record := range records[1:] {
+		entries = append(entries, tenantEntry{
+			TenantInfo: TenantInfo{
+				Tenant:  column(record, "tenant"),
+				Project: column(record, "project"),
+				Plan:    column(record, "plan"),
+			},
+			Channel: column(record, "channel"),
+			Pattern: column(record, "pattern"),
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/stretchr/testify/assert"
+)
+
+const tenantsYAML = `
+tenants:
+  - channel: shiguredo-lobby
+    tenant: shiguredo
+    project: lobby
+    plan: enterprise
+  - pattern: '^(?P<tenant>[a-z0-9]+)-(?P<project>.+)$'
+    tenant: '${tenant}'
+    project: '${project}'
+    plan: standard
+`
+
+func tenantsDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sorabeat-tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tenantOf(t *Tenants, channelID string) common.MapStr {
+	events := []common.MapStr{{"channel_id": channelID}}
+	t.Annotate(events)
+	return events[0][mb.ModuleDataKey].(common.MapStr)["tenant"].(common.MapStr)
+}
+
+func TestTenantsYAML(t *testing.T) {
+	dir := tenantsDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tenants.yml")
+	modTime := time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC)
+	writeFile(t, path, tenantsYAML, modTime)
+
+	now := modTime
+	config := defaultTenantConfig
+	config.Path = path
+	tenants, err := newTenants(config, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, common.MapStr{"name": "shiguredo", "project": "lobby", "plan": "enterprise", "default": false}, tenantOf(tenants, "shiguredo-lobby"))
+	assert.Equal(t, common.MapStr{"name": "tenanta", "project": "room42", "plan": "standard", "default": false}, tenantOf(tenants, "tenanta-room42"))
+	assert.Equal(t, common.MapStr{"name": "default", "default": true}, tenantOf(tenants, "sora"))
+
+	// channel_id のないイベントには付けない
+	events := []common.MapStr{{"total_ongoing_connections": 1.}}
+	tenants.Annotate(events)
+	assert.NotContains(t, events[0], mb.ModuleDataKey)
+
+	// 変更は reload_interval ごとに読み直す
+	writeFile(t, path, "tenants:\n  - channel: sora\n    tenant: shiguredo\n", modTime.Add(time.Minute))
+	assert.Equal(t, true, tenantOf(tenants, "sora")["default"])
+	now = now.Add(config.ReloadInterval)
+	assert.Equal(t, "shiguredo", tenantOf(tenants, "sora")["name"])
+	assert.Equal(t, true, tenantOf(tenants, "tenanta-room42")["default"])
+
+	// 読めないファイルのときは前のマッピングを使い続ける
+	writeFile(t, path, "tenants:\n  - pattern: '('\n", modTime.Add(2*time.Minute))
+	now = now.Add(config.ReloadInterval)
+	assert.Equal(t, "shiguredo", tenantOf(tenants, "sora")["name"])
+}
+
+func TestTenantsYAMLWithoutExpansion(t *testing.T) {
+	dir := tenantsDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tenants.yml")
+	writeFile(t, path, tenantsYAML, time.Now())
+
+	// ${tenant} や ${project} は同じ名前の環境変数ではなく名前付きグループで置き換える
+	for name, value := range map[string]string{"tenant": "from-env", "project": "from-env"} {
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	config := defaultTenantConfig
+	config.Path = path
+	tenants, err := newTenants(config, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, common.MapStr{"name": "tenanta", "project": "room42", "plan": "standard", "default": false}, tenantOf(tenants, "tenanta-room42"))
+}
+
+func TestTenantsCSV(t *testing.T) {
+	dir := tenantsDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tenants.csv")
+	writeFile(t, path, `# テナントの一覧
+channel,pattern,tenant,project,plan
+shiguredo-lobby,,shiguredo,lobby,enterprise
+,^trial-,trial,,free
+`, time.Now())
+
+	config := defaultTenantConfig
+	config.Path = path
+	config.Default = TenantInfo{Tenant: "unknown", Plan: "standard"}
+	tenants, err := newTenants(config, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "lobby", tenantOf(tenants, "shiguredo-lobby")["project"])
+	assert.Equal(t, common.MapStr{"name": "trial", "plan": "free", "default": false}, tenantOf(tenants, "trial-1"))
+	assert.Equal(t, common.MapStr{"name": "unknown", "plan": "standard", "default": true}, tenantOf(tenants, "sora"))
+}
+
+func TestTenantsInvalid(t *testing.T) {
+	dir := tenantsDir(t)
+	defer os.RemoveAll(dir)
+
+	config := defaultTenantConfig
+	config.Path = filepath.Join(dir, "missing.yml")
+	_, err := newTenants(config, time.Now)
+	assert.Error(t, err)
+
+	for name, content := range map[string]string{
+		"both.yml":    "tenants:\n  - channel: a\n    pattern: b\n    tenant: c\n",
+		"neither.yml": "tenants:\n  - tenant: c\n",
+		"header.csv":  "channel,name\na,b\n",
+	} {
+		config.Path = filepath.Join(dir, name)
+		writeFile(t, config.Path, content, time.Now())
+		_, err := newTenants(config, time.Now)
+		assert.Error(t, err, name)
+	}
+
+	// 設定がなければ何もしない
+	tenants, err := newTenants(defaultTenantConfig, time.Now)
+	assert.NoError(t, err)
+	events := []common.MapStr{{"channel_id": "sora"}}
+	tenants.Annotate(events)
+	assert.NotContains(t, events[0], mb.ModuleDataKey)
+}
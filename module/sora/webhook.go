@@ -0,0 +1,142 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sora
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookShutdownTimeout is how long Run waits for the requests in progress
+// once done is closed.
+const webhookShutdownTimeout = 5 * time.Second
+
+// Webhook is the HTTP listener of a push metricset receiving the JSON
+// messages Sora posts, e.g. webhook requests or newline delimited messages
+// forwarded from the Sora log. NewWebhook listens so that an address in use
+// fails the setup of the metricset, Run serves until the reporter is done
+// and Close closes the listener when Run was never called.
+type Webhook struct {
+	listener    net.Listener
+	path        string
+	maxBodySize int64
+	newMessage  func() interface{}
+	handle      func(messages []interface{})
+
+	mu      sync.Mutex
+	running bool
+}
+
+// NewWebhook listens on the address for the messages posted to the path.
+// Each message of a request is decoded into a value returned by newMessage
+// and handle is called with all of them once the body is read.
+func NewWebhook(name, address, path string, maxBodySize int64, newMessage func() interface{}, handle func(messages []interface{})) (*Webhook, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("%s listen on %s failed: %v", name, address, err)
+	}
+	return &Webhook{
+		listener:    listener,
+		path:        path,
+		maxBodySize: maxBodySize,
+		newMessage:  newMessage,
+		handle:      handle,
+	}, nil
+}
+
+// Addr is the address the webhook listens on.
+func (w *Webhook) Addr() net.Addr {
+	return w.listener.Addr()
+}
+
+// Run serves the webhook until done is closed, then waits for the requests
+// in progress. It returns the error that stopped the server.
+func (w *Webhook) Run(done <-chan struct{}) error {
+	w.mu.Lock()
+	w.running = true
+	w.mu.Unlock()
+
+	mux := http.NewServeMux()
+	mux.Handle(w.path, w)
+	server := &http.Server{Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(w.listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-done:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+	defer cancel()
+	server.Shutdown(ctx)
+	if err := <-errs; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Close closes the listener in case Run was never called.
+func (w *Webhook) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Run の後は Serve が閉じている
+	if w.running {
+		return nil
+	}
+	return w.listener.Close()
+}
+
+// ServeHTTP accepts a POST body of one or more JSON messages.
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := http.MaxBytesReader(rw, req.Body, w.maxBodySize)
+	decoder := json.NewDecoder(body)
+	var messages []interface{}
+	for {
+		msg := w.newMessage()
+		err := decoder.Decode(msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// MaxBytesReader は上限を超えるとこのエラーを返す
+			if err.Error() == "http: request body too large" {
+				http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		messages = append(messages, msg)
+	}
+
+	w.handle(messages)
+	rw.WriteHeader(http.StatusNoContent)
+}
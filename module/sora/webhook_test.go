@@ -0,0 +1,126 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package sora
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookMessage struct {
+	Type string `json:"type"`
+}
+
+func newTestWebhook(t *testing.T, received *[]string) *Webhook {
+	w, err := NewWebhook("test", "127.0.0.1:0", "/webhook", 64, func() interface{} {
+		return &webhookMessage{}
+	}, func(messages []interface{}) {
+		for _, msg := range messages {
+			*received = append(*received, msg.(*webhookMessage).Type)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestWebhookServeHTTP(t *testing.T) {
+	var received []string
+	w := newTestWebhook(t, &received)
+	defer w.Close()
+
+	post := func(body string) int {
+		rw := httptest.NewRecorder()
+		w.ServeHTTP(rw, httptest.NewRequest("POST", "/webhook", strings.NewReader(body)))
+		return rw.Code
+	}
+
+	// 1 行 1 メッセージでも受け付ける
+	assert.Equal(t, http.StatusNoContent, post("{\"type\": \"a\"}\n{\"type\": \"b\"}\n"))
+	assert.Equal(t, []string{"a", "b"}, received)
+
+	// 途中で読めなくなったリクエストは何も渡さない
+	received = nil
+	assert.Equal(t, http.StatusBadRequest, post(`{"type": "a"} {"type": `))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(`{"type": "`+strings.Repeat("a", 100)+`"}`))
+	assert.Empty(t, received)
+
+	rw := httptest.NewRecorder()
+	w.ServeHTTP(rw, httptest.NewRequest("GET", "/webhook", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+	assert.Equal(t, "POST", rw.Header().Get("Allow"))
+}
+
+func TestWebhookRun(t *testing.T) {
+	var received []string
+	w := newTestWebhook(t, &received)
+	addr := w.Addr().String()
+
+	done := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- w.Run(done)
+	}()
+
+	resp, err := http.Post("http://"+addr+"/webhook", "application/json", strings.NewReader(`{"type": "a"}`))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	assert.Equal(t, []string{"a"}, received)
+
+	// 止めたあとはポートを空けて、Close は何もしない
+	close(done)
+	assert.NoError(t, <-stopped)
+	assert.NoError(t, w.Close())
+	l, err := net.Listen("tcp", addr)
+	if assert.NoError(t, err) {
+		l.Close()
+	}
+}
+
+func TestWebhookClose(t *testing.T) {
+	var received []string
+	w := newTestWebhook(t, &received)
+	addr := w.Addr().String()
+
+	// Run を呼ばずに閉じてもポートを空ける
+	assert.NoError(t, w.Close())
+	l, err := net.Listen("tcp", addr)
+	if assert.NoError(t, err) {
+		l.Close()
+	}
+}
+
+func TestWebhookListenFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	_, err = NewWebhook("test", busy.Addr().String(), "/webhook", 64, nil, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "test listen on "+busy.Addr().String())
+	}
+}
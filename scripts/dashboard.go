@@ -115,7 +115,7 @@ func processConnectionsNode(connections Node, visualizations *[]map[string]inter
 	for _, field := range connections.Fields {
 		prefix := "sora.connections."
 		splitMode := "terms"
-		termsField := "sora.connections.channel_client_id"
+		termsField := "sora.connections.identity"
 		visualization, err := processField(prefix, field, splitMode, termsField)
 		if err != nil {
 			return err
@@ -264,7 +264,7 @@ func processField(prefix string, field Node, splitMode string,
 //                 "seperate_axis": 0,
 //                 "split_mode": "terms",
 //                 "stacked": "none",
-//                 "terms_field": "sora.connections.channel_client_id",
+//                 "terms_field": "sora.connections.identity",
 //                 "terms_order_by": "e8f96551-bfaf-11e7-ba99-7dd83649120a",
 //                 "terms_size": "10",
 //                 "value_template": "{{value}}/s"
@@ -328,7 +328,7 @@ func processField(prefix string, field Node, splitMode string,
 //                 ],
 //                 "split_mode": "terms",
 //                 "stacked": "none",
-//                 "terms_field": "sora.connections.channel_client_id",
+//                 "terms_field": "sora.connections.identity",
 //                 "terms_order_by": "a9b0f6f1-c370-11e7-9e32-ff5b8223c99f",
 //                 "terms_size": "1000",
 //                 "value_template": "{{value}}/s"
@@ -371,7 +371,7 @@ func processField(prefix string, field Node, splitMode string,
 //                 ],
 //                 "split_mode": "terms",
 //                 "stacked": "none",
-//                 "terms_field": "sora.connections.channel_client_id",
+//                 "terms_field": "sora.connections.identity",
 //                 "terms_order_by": "55703561-c370-11e7-9e32-ff5b8223c99f",
 //                 "terms_size": "1000",
 //                 "value_template": "{{value}}/s"
@@ -452,7 +452,7 @@ func visualizationJson(
 
 						series0["split_mode"] = splitMode // "everything" or "terms"
 						if splitMode == "terms" {
-							series0["terms_field"] = termsField // e.g. "sora.connections.channel_client_id"
+							series0["terms_field"] = termsField // e.g. "sora.connections.identity"
 							series0["terms_order_by"] = metrics0Id
 							series0["terms_size"] = 20 // TODO: sufficient??
 							series0["value_template"] = "{{value}}/s"
@@ -0,0 +1,121 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// export_columns generates the columns of the export output from the fields
+// declared in sora_fields.yml.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+type rootNode struct {
+	Key    string
+	Fields []node `yaml:"fields,omitempty"`
+}
+
+type node struct {
+	Name   string
+	Type   string
+	Fields []node `yaml:"fields,omitempty"`
+}
+
+// kinds are the column kinds of the field types. Sora returns every number
+// as a JSON number and some fields declared long, e.g. the means of the
+// scheduler statistics, have fractions, so all numbers are doubles.
+var kinds = map[string]string{
+	"keyword":      "kindString",
+	"text":         "kindString",
+	"date":         "kindString",
+	"boolean":      "kindString",
+	"long":         "kindNumber",
+	"bytes":        "kindNumber",
+	"integer":      "kindNumber",
+	"float":        "kindNumber",
+	"double":       "kindNumber",
+	"scaled_float": "kindNumber",
+}
+
+func main() {
+	input := flag.String("i", "scripts/sora_fields.yml", "Definitions of Sora fields")
+	output := flag.String("o", "export/columns.go", "Generated Go file")
+	flag.Parse()
+
+	if err := generate(*input, *output); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func generate(input, output string) error {
+	data, err := ioutil.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	var roots []rootNode
+	if err := yaml.Unmarshal(data, &roots); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by scripts/export_columns from %s. DO NOT EDIT.\n\n", filepath.Base(input))
+	buf.WriteString("package export\n\n")
+	buf.WriteString("// columns are the columns of each metricset after @timestamp and host.\n")
+	buf.WriteString("var columns = map[string][]column{\n")
+	for _, root := range roots {
+		if root.Key != "sora" {
+			continue
+		}
+		for _, metricset := range root.Fields {
+			fmt.Fprintf(&buf, "%q: {\n", metricset.Name)
+			if err := writeColumns(&buf, "", metricset.Fields); err != nil {
+				return err
+			}
+			buf.WriteString("},\n")
+		}
+	}
+	buf.WriteString("}\n")
+
+	source, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output, source, 0644)
+}
+
+func writeColumns(buf *bytes.Buffer, prefix string, fields []node) error {
+	for _, field := range fields {
+		name := prefix + field.Name
+		if field.Type == "group" {
+			if err := writeColumns(buf, name+".", field.Fields); err != nil {
+				return err
+			}
+			continue
+		}
+		kind, ok := kinds[field.Type]
+		if !ok {
+			return fmt.Errorf("unknown type %q of %s", field.Type, name)
+		}
+		fmt.Fprintf(buf, "{%q, %s},\n", name, kind)
+	}
+	return nil
+}
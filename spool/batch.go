@@ -0,0 +1,97 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spool
+
+import (
+	"github.com/elastic/beats/libbeat/publisher"
+)
+
+type signalKind uint8
+
+const (
+	signalRetry signalKind = iota
+	signalACK
+	signalDrop
+	signalCancelled
+)
+
+type batchSignal struct {
+	kind signalKind
+	// events are the events left to send, nil when all of them are.
+	events []publisher.Event
+}
+
+// replayBatch is the publisher.Batch handed to the wrapped output. The output
+// reports the outcome through one of the signal methods, possibly from
+// another goroutine.
+type replayBatch struct {
+	events []publisher.Event
+	signal chan batchSignal
+}
+
+func newReplayBatch(events []publisher.Event) *replayBatch {
+	return &replayBatch{
+		events: events,
+		signal: make(chan batchSignal, 1),
+	}
+}
+
+func (b *replayBatch) Events() []publisher.Event {
+	return b.events
+}
+
+func (b *replayBatch) ACK()   { b.send(batchSignal{kind: signalACK}) }
+func (b *replayBatch) Drop()  { b.send(batchSignal{kind: signalDrop}) }
+func (b *replayBatch) Retry() { b.send(batchSignal{kind: signalRetry}) }
+
+func (b *replayBatch) RetryEvents(events []publisher.Event) {
+	b.send(batchSignal{kind: signalRetry, events: events})
+}
+
+func (b *replayBatch) Cancelled() { b.send(batchSignal{kind: signalCancelled}) }
+
+func (b *replayBatch) CancelledEvents(events []publisher.Event) {
+	b.send(batchSignal{kind: signalCancelled, events: events})
+}
+
+func (b *replayBatch) send(sig batchSignal) {
+	// 2 回目以降のシグナルは出力側の誤りなので捨てる
+	select {
+	case b.signal <- sig:
+	default:
+	}
+}
+
+// wait blocks until the output signals the batch. It returns false when done
+// is closed first.
+func (b *replayBatch) wait(done <-chan struct{}) (batchSignal, bool) {
+	select {
+	case sig := <-b.signal:
+		return sig, true
+	case <-done:
+		return batchSignal{}, false
+	}
+}
+
+// poll returns the signal if the output has already sent one, and asks for a
+// retry of all events otherwise.
+func (b *replayBatch) poll() batchSignal {
+	select {
+	case sig := <-b.signal:
+		return sig
+	default:
+		return batchSignal{kind: signalRetry}
+	}
+}
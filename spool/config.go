@@ -0,0 +1,78 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+const (
+	// FullPolicyBlock makes publishing wait until the spool has room again.
+	FullPolicyBlock = "block"
+	// FullPolicyDropOldest removes the oldest events to make room.
+	FullPolicyDropOldest = "drop_oldest"
+)
+
+type config struct {
+	Path         string                 `config:"path"`
+	MaxBytes     int64                  `config:"max_bytes" validate:"min=1"`
+	SegmentBytes int64                  `config:"segment_bytes" validate:"min=1"`
+	FullPolicy   string                 `config:"full_policy"`
+	Sync         bool                   `config:"sync"`
+	BulkMaxSize  int                    `config:"bulk_max_size"`
+	Backoff      backoff                `config:"backoff"`
+	Output       common.ConfigNamespace `config:"output"`
+}
+
+type backoff struct {
+	Init time.Duration `config:"init" validate:"nonzero"`
+	Max  time.Duration `config:"max" validate:"nonzero"`
+}
+
+var defaultConfig = config{
+	MaxBytes:     100 * 1024 * 1024,
+	SegmentBytes: 10 * 1024 * 1024,
+	FullPolicy:   FullPolicyBlock,
+	BulkMaxSize:  2048,
+	Backoff: backoff{
+		Init: 1 * time.Second,
+		Max:  60 * time.Second,
+	},
+}
+
+func (c *config) Validate() error {
+	switch c.FullPolicy {
+	case FullPolicyBlock, FullPolicyDropOldest:
+	default:
+		return fmt.Errorf("unknown full_policy '%s', must be %s or %s", c.FullPolicy, FullPolicyBlock, FullPolicyDropOldest)
+	}
+	if c.SegmentBytes > c.MaxBytes {
+		return errors.New("segment_bytes must not be larger than max_bytes")
+	}
+	if c.Backoff.Max < c.Backoff.Init {
+		return errors.New("backoff.max must not be smaller than backoff.init")
+	}
+	if !c.Output.IsSet() {
+		return errors.New("no output configured for the spool")
+	}
+	if c.Output.Name() == "spool" {
+		return errors.New("the spool can not forward to another spool")
+	}
+	return nil
+}
@@ -0,0 +1,522 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	segmentSuffix = ".seg"
+	positionFile  = "position.json"
+
+	// headerSize is the size of the record header: payload length and CRC32.
+	headerSize = 8
+)
+
+var (
+	errQueueClosed = errors.New("spool is closed")
+
+	// errRecordTooLarge is returned for a record that never fits into the spool.
+	errRecordTooLarge = errors.New("record is larger than spool.max_bytes")
+)
+
+// position points at a record in a segment file.
+type position struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// mark is the end of the records returned by peek. seq counts the records
+// read since the spool was opened, so that records removed by drop_oldest
+// while they are replayed are not accounted twice.
+type mark struct {
+	pos position
+	seq uint64
+}
+
+// segmentWriter is the file records are appended to. It is an interface so
+// that tests can inject write failures.
+type segmentWriter interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+	Seek(offset int64, whence int) (int64, error)
+}
+
+type segment struct {
+	id   uint64
+	size int64
+}
+
+// queue is a FIFO of records persisted in segment files. Records are appended
+// to the last segment and read from the committed read position. The read
+// position is persisted, so records not committed before a restart are read
+// again.
+type queue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	fsync        bool
+
+	segments []segment
+	writer   segmentWriter
+	read     position
+	readSeq  uint64
+
+	events int
+	size   int64
+	closed bool
+
+	// wakeup is signaled when records are appended.
+	wakeup chan struct{}
+}
+
+// openQueue opens the spool in dir, creating it when necessary. A truncated
+// or corrupted tail left by a crash is cut off.
+func openQueue(dir string, maxBytes, segmentBytes int64, fsync bool) (*queue, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	q := &queue{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		fsync:        fsync,
+		wakeup:       make(chan struct{}, 1),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *queue) load() error {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, segment{id: id, size: e.Size()})
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].id < q.segments[j].id })
+
+	if body, err := ioutil.ReadFile(filepath.Join(q.dir, positionFile)); err == nil {
+		if err := json.Unmarshal(body, &q.read); err != nil {
+			logp.Warn("Ignoring broken spool position in %s: %v", q.dir, err)
+			q.read = position{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// 読み込み済みのセグメントは消す
+	for len(q.segments) > 0 && q.segments[0].id < q.read.Segment {
+		if err := os.Remove(q.segmentPath(q.segments[0].id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) == 0 || q.segments[0].id != q.read.Segment {
+		var first uint64
+		if len(q.segments) > 0 {
+			first = q.segments[0].id
+		}
+		q.read = position{Segment: first}
+	}
+
+	for i := range q.segments {
+		seg := &q.segments[i]
+		from := int64(0)
+		if seg.id == q.read.Segment {
+			from = q.read.Offset
+		}
+		n, valid, err := scanSegment(q.segmentPath(seg.id), from)
+		if err != nil {
+			return err
+		}
+		if valid < seg.size {
+			logp.Warn("Truncating spool segment %d from %d to %d bytes: broken record", seg.id, seg.size, valid)
+			if err := os.Truncate(q.segmentPath(seg.id), valid); err != nil {
+				return err
+			}
+			seg.size = valid
+		}
+		q.events += n
+		q.size += seg.size - from
+	}
+	if len(q.segments) > 0 && q.read.Offset > q.segments[0].size {
+		q.size += q.read.Offset - q.segments[0].size
+		q.read.Offset = q.segments[0].size
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = append(q.segments, segment{id: q.read.Segment})
+	}
+	last := q.segments[len(q.segments)-1]
+	writer, err := os.OpenFile(q.segmentPath(last.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	q.writer = writer
+	return nil
+}
+
+// scanSegment counts the valid records of a segment file starting at offset
+// from and returns the offset where the valid records end.
+func scanSegment(path string, from int64) (int, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	n := 0
+	offset := from
+	for {
+		payload, err := readRecord(f)
+		if err != nil {
+			return n, offset, nil
+		}
+		n++
+		offset += headerSize + int64(len(payload))
+	}
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return payload, nil
+}
+
+func encodeRecord(payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+func (q *queue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// push appends a record. When the spool is full, push blocks until enough
+// records are committed, or removes the oldest records when dropOldest is set.
+// It returns the number of records removed to make room.
+func (q *queue) push(payload []byte, dropOldest bool) (int, error) {
+	record := encodeRecord(payload)
+	size := int64(len(record))
+	if size > q.maxBytes {
+		return 0, errRecordTooLarge
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dropped := 0
+	for !q.closed && q.size+size > q.maxBytes {
+		if !dropOldest {
+			q.cond.Wait()
+			continue
+		}
+		n, err := q.dropOldest(q.size + size - q.maxBytes)
+		if err != nil {
+			return dropped, err
+		}
+		if n == 0 {
+			break
+		}
+		dropped += n
+	}
+	if q.closed {
+		return dropped, errQueueClosed
+	}
+
+	last := &q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+size > q.segmentBytes {
+		if err := q.rotate(); err != nil {
+			return dropped, err
+		}
+		last = &q.segments[len(q.segments)-1]
+	}
+
+	if err := q.append(record, last.size); err != nil {
+		return dropped, err
+	}
+	last.size += size
+	q.size += size
+	q.events++
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	return dropped, nil
+}
+
+// append writes a record at offset, the end of the last segment. When the
+// write or the sync fails, the segment is cut back to offset: a partial record
+// would make the records appended after it unreadable, and a complete but
+// uncounted record would be spooled twice when the event is retried.
+func (q *queue) append(record []byte, offset int64) error {
+	_, err := q.writer.Write(record)
+	if err == nil && q.fsync {
+		err = q.writer.Sync()
+	}
+	if err == nil {
+		return nil
+	}
+	if terr := q.writer.Truncate(offset); terr != nil {
+		logp.Err("Failed to truncate the spool segment after a failed write: %v", terr)
+	} else if _, serr := q.writer.Seek(offset, io.SeekStart); serr != nil {
+		logp.Err("Failed to seek the spool segment after a failed write: %v", serr)
+	}
+	return err
+}
+
+func (q *queue) rotate() error {
+	last := q.segments[len(q.segments)-1]
+	if err := q.writer.Close(); err != nil {
+		return err
+	}
+	next := segment{id: last.id + 1}
+	writer, err := os.OpenFile(q.segmentPath(next.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	q.writer = writer
+	q.segments = append(q.segments, next)
+	return nil
+}
+
+// dropOldest removes records from the head of the spool until at least n
+// bytes are freed or the spool is empty. Must be called with q.mu held.
+func (q *queue) dropOldest(n int64) (int, error) {
+	dropped := 0
+	freed := int64(0)
+	for freed < n && q.events > 0 {
+		records, end, err := q.readLocked(1)
+		if err != nil {
+			return dropped, err
+		}
+		if len(records) == 0 {
+			break
+		}
+		freed += q.distance(q.read, end.pos)
+		if err := q.commitLocked(end); err != nil {
+			return dropped, err
+		}
+		dropped += len(records)
+	}
+	return dropped, nil
+}
+
+// distance returns the number of bytes between two positions.
+// Must be called with q.mu held.
+func (q *queue) distance(from, to position) int64 {
+	if from.Segment == to.Segment {
+		return to.Offset - from.Offset
+	}
+	d := int64(0)
+	for _, seg := range q.segments {
+		switch {
+		case seg.id == from.Segment:
+			d += seg.size - from.Offset
+		case seg.id == to.Segment:
+			d += to.Offset
+		case seg.id > from.Segment && seg.id < to.Segment:
+			d += seg.size
+		}
+	}
+	return d
+}
+
+// peek returns up to max records from the read position without removing
+// them, and the mark to commit once they are processed.
+func (q *queue) peek(max int) ([][]byte, mark, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.readLocked(max)
+}
+
+func (q *queue) readLocked(max int) ([][]byte, mark, error) {
+	records, pos, err := q.readFrom(q.read, max)
+	return records, mark{pos: pos, seq: q.readSeq + uint64(len(records))}, err
+}
+
+// readFrom reads up to max records starting at pos.
+// Must be called with q.mu held.
+func (q *queue) readFrom(pos position, max int) ([][]byte, position, error) {
+	start := pos
+	var records [][]byte
+	for _, seg := range q.segments {
+		if seg.id < pos.Segment {
+			continue
+		}
+		if seg.id > pos.Segment {
+			pos = position{Segment: seg.id}
+		}
+		if pos.Offset >= seg.size {
+			continue
+		}
+
+		f, err := os.Open(q.segmentPath(seg.id))
+		if err != nil {
+			return nil, start, err
+		}
+		if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, start, err
+		}
+		for len(records) < max && pos.Offset < seg.size {
+			payload, err := readRecord(f)
+			if err != nil {
+				f.Close()
+				return nil, start, fmt.Errorf("reading spool segment %d at %d: %v", seg.id, pos.Offset, err)
+			}
+			records = append(records, payload)
+			pos.Offset += headerSize + int64(len(payload))
+		}
+		f.Close()
+		if len(records) >= max {
+			break
+		}
+	}
+	return records, pos, nil
+}
+
+// commit removes the records up to end from the spool. Records removed by
+// drop_oldest in the meantime are skipped.
+func (q *queue) commit(end mark) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if end.seq <= q.readSeq {
+		return nil
+	}
+	return q.commitLocked(end)
+}
+
+func (q *queue) commitLocked(end mark) error {
+	q.size -= q.distance(q.read, end.pos)
+	q.events -= int(end.seq - q.readSeq)
+	q.read = end.pos
+	q.readSeq = end.seq
+
+	// 読み終わったセグメントを消す。書き込み中のセグメントは残す
+	for len(q.segments) > 1 && q.segments[0].id < q.read.Segment {
+		if err := os.Remove(q.segmentPath(q.segments[0].id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+
+	if err := q.savePosition(); err != nil {
+		return err
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// savePosition persists the read position atomically.
+// Must be called with q.mu held.
+func (q *queue) savePosition() error {
+	body, err := json.Marshal(q.read)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(q.dir, positionFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return err
+	}
+	if q.fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.dir, positionFile))
+}
+
+// state returns the number of records, bytes and segment files in the spool.
+func (q *queue) state() (events int, size int64, segments int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.events, q.size, len(q.segments)
+}
+
+// close wakes up blocked writers and closes the segment file.
+func (q *queue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	return q.writer.Close()
+}
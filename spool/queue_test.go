@@ -0,0 +1,297 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sorabeat-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func openTestQueue(t *testing.T, dir string, maxBytes, segmentBytes int64) *queue {
+	q, err := openQueue(dir, maxBytes, segmentBytes, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func pushN(t *testing.T, q *queue, from, to int) {
+	for i := from; i < to; i++ {
+		if _, err := q.push([]byte(fmt.Sprintf("record-%04d", i)), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readAll(t *testing.T, q *queue) []string {
+	records, end, err := q.peek(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.commit(end); err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, r := range records {
+		out = append(out, string(r))
+	}
+	return out
+}
+
+func TestQueueOrderAcrossRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir, 1<<20, 256)
+	pushN(t, q, 0, 100)
+
+	records, end, err := q.peek(10)
+	assert.NoError(t, err)
+	assert.Len(t, records, 10)
+	assert.Equal(t, "record-0000", string(records[0]))
+	assert.NoError(t, q.commit(end))
+
+	// コミットしていないレコードは再起動後にもう一度読まれる
+	records, _, err = q.peek(5)
+	assert.NoError(t, err)
+	assert.Equal(t, "record-0010", string(records[0]))
+	assert.NoError(t, q.close())
+
+	q = openTestQueue(t, dir, 1<<20, 256)
+	defer q.close()
+	events, _, _ := q.state()
+	assert.Equal(t, 90, events)
+
+	pushN(t, q, 100, 110)
+	all := readAll(t, q)
+	if assert.Len(t, all, 100) {
+		for i, r := range all {
+			assert.Equal(t, fmt.Sprintf("record-%04d", i+10), r)
+		}
+	}
+
+	events, size, segments := q.state()
+	assert.Equal(t, 0, events)
+	assert.Equal(t, int64(0), size)
+	assert.Equal(t, 1, segments)
+}
+
+func TestQueueRemovesReadSegments(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir, 1<<20, 64)
+	defer q.close()
+	pushN(t, q, 0, 20)
+
+	_, _, segments := q.state()
+	assert.True(t, segments > 1)
+
+	readAll(t, q)
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Len(t, files, 1)
+}
+
+func TestQueueTruncatedTail(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir, 1<<20, 1<<20)
+	pushN(t, q, 0, 3)
+	q.close()
+
+	// 書き込み途中で落ちたときのように壊れたレコードを足す
+	f, err := os.OpenFile(q.segmentPath(0), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeRecord([]byte("record-0003"))[:10])
+	f.Close()
+
+	q = openTestQueue(t, dir, 1<<20, 1<<20)
+	defer q.close()
+	events, _, _ := q.state()
+	assert.Equal(t, 3, events)
+
+	pushN(t, q, 3, 5)
+	assert.Equal(t, []string{"record-0000", "record-0001", "record-0002", "record-0003", "record-0004"}, readAll(t, q))
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	record := int64(headerSize + len("record-0000"))
+	q := openTestQueue(t, dir, 3*record, record)
+	defer q.close()
+
+	for i := 0; i < 5; i++ {
+		dropped, err := q.push([]byte(fmt.Sprintf("record-%04d", i)), true)
+		assert.NoError(t, err)
+		if i < 3 {
+			assert.Equal(t, 0, dropped)
+		} else {
+			assert.Equal(t, 1, dropped)
+		}
+	}
+
+	events, size, _ := q.state()
+	assert.Equal(t, 3, events)
+	assert.Equal(t, 3*record, size)
+	assert.Equal(t, []string{"record-0002", "record-0003", "record-0004"}, readAll(t, q))
+}
+
+func TestQueueDropOldestWhileReplaying(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	record := int64(headerSize + len("record-0000"))
+	q := openTestQueue(t, dir, 3*record, record)
+	defer q.close()
+	pushN(t, q, 0, 3)
+
+	_, end, err := q.peek(2)
+	assert.NoError(t, err)
+
+	// 送信中のレコードが押し出されても二重に数えない
+	q.push([]byte("record-0003"), true)
+	q.push([]byte("record-0004"), true)
+	q.push([]byte("record-0005"), true)
+	assert.NoError(t, q.commit(end))
+
+	events, size, _ := q.state()
+	assert.Equal(t, 3, events)
+	assert.Equal(t, 3*record, size)
+}
+
+func TestQueueBlocksWhenFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	record := int64(headerSize + len("record-0000"))
+	q := openTestQueue(t, dir, 2*record, record)
+	defer q.close()
+	pushN(t, q, 0, 2)
+
+	done := make(chan error)
+	go func() {
+		_, err := q.push([]byte("record-0002"), false)
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("push must block while the spool is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, end, _ := q.peek(1)
+	assert.NoError(t, q.commit(end))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("push must resume once there is room")
+	}
+
+	_, err := q.push(make([]byte, 3*record), false)
+	assert.Equal(t, errRecordTooLarge, err)
+}
+
+func TestQueueCloseUnblocksPush(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	record := int64(headerSize + len("record-0000"))
+	q := openTestQueue(t, dir, record, record)
+	pushN(t, q, 0, 1)
+
+	done := make(chan error)
+	go func() {
+		_, err := q.push([]byte("record-0001"), false)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.close()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, errQueueClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("close must unblock push")
+	}
+}
+
+// failingWriter writes only the first half of a record and fails, like a
+// disk running out of space in the middle of a write.
+type failingWriter struct {
+	*os.File
+	fail bool
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if !w.fail {
+		return w.File.Write(p)
+	}
+	n, _ := w.File.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestQueueFailedWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir, 1<<20, 1<<20)
+	writer := &failingWriter{File: q.writer.(*os.File)}
+	q.writer = writer
+	pushN(t, q, 0, 2)
+
+	writer.fail = true
+	_, err := q.push([]byte("record-0002"), false)
+	assert.Error(t, err)
+	writer.fail = false
+	pushN(t, q, 2, 4)
+
+	// 書きかけのレコードは切り捨てられ、後ろに書いたレコードも読める
+	events, size, _ := q.state()
+	assert.Equal(t, 4, events)
+	info, err := os.Stat(q.segmentPath(q.segments[0].id))
+	assert.NoError(t, err)
+	assert.Equal(t, size, info.Size())
+	assert.Equal(t, []string{"record-0000", "record-0001", "record-0002", "record-0003"}, readAll(t, q))
+	assert.NoError(t, q.close())
+
+	q = openTestQueue(t, dir, 1<<20, 1<<20)
+	defer q.close()
+	events, _, _ = q.state()
+	assert.Equal(t, 0, events)
+}
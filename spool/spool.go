@@ -0,0 +1,487 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package spool provides the spool output. It writes every event to a size
+limited on-disk buffer first and forwards the buffered events to the wrapped
+output in the order they were written. When the wrapped output is down, for
+example during an Elasticsearch outage, the events stay on disk, also across
+restarts, and are replayed once the output is back.
+
+	output.spool:
+	  max_bytes: 104857600
+	  output.elasticsearch:
+	    hosts: ["localhost:9200"]
+*/
+package spool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/monitoring"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/paths"
+	"github.com/elastic/beats/libbeat/publisher"
+)
+
+var (
+	debugf = logp.MakeDebug("spool")
+
+	errNoClients = errors.New("the spooled output has no clients")
+)
+
+// スプールの状態は libbeat の定期メトリクスのログに spool.* として出る
+var (
+	spoolMetrics = monitoring.Default.NewRegistry("spool")
+
+	metricEvents    = monitoring.NewInt(spoolMetrics, "events")
+	metricBytes     = monitoring.NewInt(spoolMetrics, "bytes")
+	metricMaxBytes  = monitoring.NewInt(spoolMetrics, "max_bytes")
+	metricFillRatio = monitoring.NewFloat(spoolMetrics, "fill_ratio")
+	metricSegments  = monitoring.NewInt(spoolMetrics, "segments")
+	metricWritten   = monitoring.NewUint(spoolMetrics, "written")
+	metricReplayed  = monitoring.NewUint(spoolMetrics, "replayed")
+	metricDropped   = monitoring.NewUint(spoolMetrics, "dropped")
+)
+
+func init() {
+	outputs.RegisterType("spool", makeSpool)
+}
+
+type spool struct {
+	queue      *queue
+	client     outputs.Client
+	stats      *outputs.Stats
+	dropOldest bool
+	batchSize  int
+	backoff    backoff
+	// ディスクに書けなかったときに次の Publish まで待つ時間
+	writeWait time.Duration
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func makeSpool(
+	beat beat.Info,
+	stats *outputs.Stats,
+	cfg *common.Config,
+) (outputs.Group, error) {
+	config := defaultConfig
+	if err := cfg.Unpack(&config); err != nil {
+		return outputs.Fail(err)
+	}
+	if config.Path == "" {
+		config.Path = paths.Resolve(paths.Data, "spool")
+	}
+
+	// 転送先の統計は spool の統計と混ざらないように取らない
+	group, err := outputs.Load(beat, nil, config.Output.Name(), config.Output.Config())
+	if err != nil {
+		return outputs.Fail(err)
+	}
+	if len(group.Clients) == 0 {
+		return outputs.Fail(errNoClients)
+	}
+	if len(group.Clients) > 1 {
+		// 複数のクライアントに並行して送ると順序が保てない
+		logp.Warn("spool: output %s has %d clients, only the first one is used to keep the event order",
+			config.Output.Name(), len(group.Clients))
+	}
+
+	s, err := newSpool(config, group.Clients[0], group.BatchSize, stats)
+	if err != nil {
+		return outputs.Fail(err)
+	}
+	logp.Info("Spool path set to: %v", config.Path)
+
+	// スプールへの書き込みは諦めずに再送してもらう
+	return outputs.Success(config.BulkMaxSize, -1, s)
+}
+
+func newSpool(config config, client outputs.Client, batchSize int, stats *outputs.Stats) (*spool, error) {
+	q, err := openQueue(config.Path, config.MaxBytes, config.SegmentBytes, config.Sync)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize <= 0 {
+		batchSize = defaultConfig.BulkMaxSize
+	}
+
+	s := &spool{
+		queue:      q,
+		client:     client,
+		stats:      stats,
+		dropOldest: config.FullPolicy == FullPolicyDropOldest,
+		batchSize:  batchSize,
+		backoff:    config.Backoff,
+		writeWait:  config.Backoff.Init,
+		done:       make(chan struct{}),
+	}
+	metricMaxBytes.Set(config.MaxBytes)
+	s.updateMetrics()
+
+	s.wg.Add(1)
+	go s.replay()
+	return s, nil
+}
+
+// Close stops the replay and closes the wrapped output. Events not replayed
+// yet stay on disk.
+func (s *spool) Close() error {
+	close(s.done)
+	s.queue.close()
+	s.wg.Wait()
+	return s.client.Close()
+}
+
+// Publish writes the batch to disk and ACKs it. With the block policy Publish
+// waits while the spool is full. Events that cannot be written are retried
+// after a backoff and the error is only logged, which keeps the output worker
+// running.
+func (s *spool) Publish(batch publisher.Batch) error {
+	events := batch.Events()
+	s.stats.NewBatch(len(events))
+
+	written, dropped := 0, 0
+	for i := range events {
+		payload, err := encodeEvent(&events[i].Content)
+		if err != nil {
+			logp.Warn("spool: failed to serialize the event: %v", err)
+			dropped++
+			continue
+		}
+
+		removed, err := s.queue.push(payload, s.dropOldest)
+		metricDropped.Add(uint64(removed))
+		switch err {
+		case nil:
+		case errRecordTooLarge:
+			logp.Warn("spool: dropping an event of %d bytes, it does not fit into the spool", len(payload))
+			dropped++
+			continue
+		case errQueueClosed:
+			// 書けなかったイベントはパイプラインに戻す
+			s.stats.Acked(written)
+			s.stats.Dropped(dropped)
+			batch.CancelledEvents(events[i:])
+			return nil
+		default:
+			// Connect のない出力はエラーを返すとワーカーが止まるので、
+			// 記録して再送に回すだけにする
+			logp.Err("spool: failed to write %d events, retrying: %v", len(events)-i, err)
+			s.stats.WriteError()
+			s.stats.Acked(written)
+			s.stats.Dropped(dropped)
+			batch.RetryEvents(events[i:])
+			s.backoffWrite()
+			return nil
+		}
+		s.stats.WriteBytes(headerSize + len(payload))
+		written++
+	}
+
+	metricWritten.Add(uint64(written))
+	metricDropped.Add(uint64(dropped))
+	s.updateMetrics()
+
+	s.stats.Acked(written)
+	s.stats.Dropped(dropped)
+	batch.ACK()
+	s.writeWait = s.backoff.Init
+	return nil
+}
+
+// backoffWrite は書けないディスクへの再送を続けて空回りしないように、
+// 失敗が続くほど長く待つ
+func (s *spool) backoffWrite() {
+	s.sleep(s.writeWait)
+	s.writeWait *= 2
+	if s.writeWait > s.backoff.Max {
+		s.writeWait = s.backoff.Max
+	}
+}
+
+func (s *spool) updateMetrics() {
+	events, size, segments := s.queue.state()
+	metricEvents.Set(int64(events))
+	metricBytes.Set(size)
+	metricSegments.Set(int64(segments))
+	metricFillRatio.Set(float64(size) / float64(s.queue.maxBytes))
+}
+
+// replay forwards the spooled events to the wrapped output one batch at a
+// time. A batch is removed from disk only after the output has ACKed or
+// dropped all of its events, so the order is kept and nothing is lost when
+// the output fails.
+func (s *spool) replay() {
+	defer s.wg.Done()
+
+	var (
+		connected bool
+		wait      = s.backoff.Init
+	)
+	fail := func() bool {
+		if !s.sleep(wait) {
+			return false
+		}
+		wait *= 2
+		if wait > s.backoff.Max {
+			wait = s.backoff.Max
+		}
+		return true
+	}
+
+	for {
+		records, end, err := s.queue.peek(s.batchSize)
+		if err != nil {
+			logp.Err("spool: failed to read events: %v", err)
+			if !fail() {
+				return
+			}
+			continue
+		}
+		if len(records) == 0 {
+			select {
+			case <-s.done:
+				return
+			case <-s.queue.wakeup:
+			}
+			continue
+		}
+
+		pending := make([]publisher.Event, 0, len(records))
+		for _, record := range records {
+			event, err := decodeEvent(record)
+			if err != nil {
+				logp.Warn("spool: dropping a broken event: %v", err)
+				metricDropped.Inc()
+				continue
+			}
+			pending = append(pending, publisher.Event{Content: event, Flags: publisher.GuaranteedSend})
+		}
+		total := len(pending)
+
+		for len(pending) > 0 {
+			if !connected {
+				if err := connect(s.client); err != nil {
+					logp.Err("spool: failed to connect to the output: %v", err)
+					if !fail() {
+						return
+					}
+					continue
+				}
+				connected = true
+			}
+
+			batch := newReplayBatch(pending)
+			var sig batchSignal
+			if err := s.client.Publish(batch); err != nil {
+				logp.Err("spool: failed to publish events: %v", err)
+				// ネットワーククライアントは繋ぎ直す
+				if _, ok := s.client.(outputs.NetworkClient); ok {
+					s.client.Close()
+					connected = false
+				}
+				sig = batch.poll()
+			} else {
+				var ok bool
+				if sig, ok = batch.wait(s.done); !ok {
+					return
+				}
+			}
+			switch sig.kind {
+			case signalACK, signalDrop:
+				pending = nil
+				wait = s.backoff.Init
+			default:
+				if sig.events != nil {
+					pending = sig.events
+				}
+				debugf("output asked to retry %d events", len(pending))
+				if !fail() {
+					return
+				}
+			}
+		}
+
+		if err := s.queue.commit(end); err != nil {
+			logp.Err("spool: failed to commit replayed events: %v", err)
+		}
+		metricReplayed.Add(uint64(total))
+		s.updateMetrics()
+	}
+}
+
+// sleep waits for d and returns false when the spool is closed meanwhile.
+func (s *spool) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func connect(client outputs.Client) error {
+	if c, ok := client.(outputs.Connectable); ok {
+		return c.Connect()
+	}
+	return nil
+}
+
+// spooledEvent is the on-disk representation of an event.
+type spooledEvent struct {
+	Timestamp time.Time     `json:"@timestamp"`
+	Meta      common.MapStr `json:"@metadata,omitempty"`
+	Fields    common.MapStr `json:"fields"`
+}
+
+func encodeEvent(event *beat.Event) ([]byte, error) {
+	return json.Marshal(spooledEvent{
+		Timestamp: event.Timestamp,
+		Meta:      markFloats(event.Meta),
+		Fields:    markFloats(event.Fields),
+	})
+}
+
+// floatValue は整数値の float も小数点付きで書き、読み戻したときに float に戻せるようにする
+type floatValue float64
+
+func (f floatValue) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, &json.UnsupportedValueError{Str: strconv.FormatFloat(v, 'g', -1, 64)}
+	}
+	s := strconv.FormatFloat(v, 'g', -1, 64)
+	if !isFloat(s) {
+		s += ".0"
+	}
+	return []byte(s), nil
+}
+
+// markFloats は float の値を floatValue に置き換えたコピーを返す
+func markFloats(m common.MapStr) common.MapStr {
+	if m == nil {
+		return nil
+	}
+	out := make(common.MapStr, len(m))
+	for k, v := range m {
+		out[k] = markFloat(v)
+	}
+	return out
+}
+
+func markFloat(v interface{}) interface{} {
+	switch value := v.(type) {
+	case common.MapStr:
+		return markFloats(value)
+	case map[string]interface{}:
+		return markFloats(value)
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, e := range value {
+			out[i] = markFloat(e)
+		}
+		return out
+	case []float64:
+		out := make([]floatValue, len(value))
+		for i, e := range value {
+			out[i] = floatValue(e)
+		}
+		return out
+	case float64:
+		return floatValue(value)
+	case float32:
+		return floatValue(value)
+	default:
+		return value
+	}
+}
+
+func isFloat(number string) bool {
+	return strings.ContainsAny(number, ".eE")
+}
+
+func decodeEvent(payload []byte) (beat.Event, error) {
+	var raw struct {
+		Timestamp time.Time              `json:"@timestamp"`
+		Meta      map[string]interface{} `json:"@metadata"`
+		Fields    map[string]interface{} `json:"fields"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	// カウンタの値を float64 にして精度を落とさないように数値は文字列のまま読み、
+	// 書いたときの型に戻す
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return beat.Event{}, err
+	}
+
+	event := beat.Event{Timestamp: raw.Timestamp}
+	if raw.Meta != nil {
+		event.Meta = toMapStr(raw.Meta)
+	}
+	if raw.Fields != nil {
+		event.Fields = toMapStr(raw.Fields)
+	}
+	return event, nil
+}
+
+func toMapStr(m map[string]interface{}) common.MapStr {
+	out := make(common.MapStr, len(m))
+	for k, v := range m {
+		out[k] = normalize(v)
+	}
+	return out
+}
+
+// normalize はデコードした値をイベントを作ったときの型に戻す
+func normalize(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return toMapStr(value)
+	case []interface{}:
+		for i, e := range value {
+			value[i] = normalize(e)
+		}
+		return value
+	case json.Number:
+		if isFloat(string(value)) {
+			f, _ := value.Float64()
+			return f
+		}
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return u
+		}
+		f, _ := value.Float64()
+		return f
+	default:
+		return value
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/outputs/outest"
+	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOutput is an output that is down until up is called and records the
+// events it receives.
+type fakeOutput struct {
+	mu        sync.Mutex
+	up        bool
+	partial   bool
+	connects  int
+	published []beat.Event
+	closed    bool
+}
+
+func (o *fakeOutput) setUp(up bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.up = up
+}
+
+func (o *fakeOutput) events() []beat.Event {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]beat.Event(nil), o.published...)
+}
+
+func (o *fakeOutput) Connect() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.connects++
+	if !o.up {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (o *fakeOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	return nil
+}
+
+func (o *fakeOutput) Publish(batch publisher.Batch) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	events := batch.Events()
+	if !o.up {
+		batch.Retry()
+		return errors.New("connection lost")
+	}
+	// Elasticsearch のように一部だけ受け付けて残りの再送を求める
+	if o.partial && len(events) > 1 {
+		half := len(events) / 2
+		for _, e := range events[:half] {
+			o.published = append(o.published, e.Content)
+		}
+		batch.RetryEvents(events[half:])
+		return nil
+	}
+	for _, e := range events {
+		o.published = append(o.published, e.Content)
+	}
+	batch.ACK()
+	return nil
+}
+
+// loadedOutput is the client of the spooltest output type.
+var loadedOutput *fakeOutput
+
+func init() {
+	outputs.RegisterType("spooltest", func(beat.Info, *outputs.Stats, *common.Config) (outputs.Group, error) {
+		return outputs.Success(16, 3, loadedOutput)
+	})
+}
+
+func testConfig(dir string) config {
+	c := defaultConfig
+	c.Path = dir
+	c.Backoff = backoff{Init: time.Millisecond, Max: 10 * time.Millisecond}
+	return c
+}
+
+func makeEvents(from, to int) []beat.Event {
+	var events []beat.Event
+	for i := from; i < to; i++ {
+		events = append(events, beat.Event{
+			Timestamp: time.Date(2017, 10, 10, 0, 0, i, 0, time.UTC),
+			Fields: common.MapStr{
+				"sora": common.MapStr{
+					"connections": common.MapStr{
+						"channel_client_id": fmt.Sprintf("sora/client-%04d", i),
+						"rtp": common.MapStr{
+							"total_sent_byte_size": uint64(1<<60) + uint64(i),
+						},
+					},
+				},
+			},
+		})
+	}
+	return events
+}
+
+func waitEvents(t *testing.T, out *fakeOutput, n int) []beat.Event {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if events := out.events(); len(events) >= n {
+			return events
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("output received %d events, want %d", len(out.events()), n)
+	return nil
+}
+
+func assertOrdered(t *testing.T, events []beat.Event, from int) {
+	for i, e := range events {
+		id, _ := e.Fields.GetValue("sora.connections.channel_client_id")
+		assert.Equal(t, fmt.Sprintf("sora/client-%04d", from+i), id)
+	}
+}
+
+func TestReplayAfterOutage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out := &fakeOutput{}
+	s, err := newSpool(testConfig(dir), out, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	batch := outest.NewBatch(makeEvents(0, 10)...)
+	assert.NoError(t, s.Publish(batch))
+	if assert.Len(t, batch.Signals, 1) {
+		assert.Equal(t, outest.BatchACK, batch.Signals[0].Tag)
+	}
+	assert.NoError(t, s.Publish(outest.NewBatch(makeEvents(10, 20)...)))
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, out.events())
+	assert.Equal(t, int64(20), metricEvents.Get())
+	assert.True(t, metricFillRatio.Get() > 0)
+
+	out.setUp(true)
+	events := waitEvents(t, out, 20)
+	assert.Len(t, events, 20)
+	assertOrdered(t, events, 0)
+
+	// カウンタの値が float64 に丸められていない
+	v, _ := events[3].Fields.GetValue("sora.connections.rtp.total_sent_byte_size")
+	assert.EqualValues(t, uint64(1<<60)+3, v)
+	assert.Equal(t, time.Date(2017, 10, 10, 0, 0, 3, 0, time.UTC), events[3].Timestamp.UTC())
+}
+
+func TestReplayPartialRetry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out := &fakeOutput{up: true, partial: true}
+	s, err := newSpool(testConfig(dir), out, 8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	assert.NoError(t, s.Publish(outest.NewBatch(makeEvents(0, 30)...)))
+	waitEvents(t, out, 30)
+	time.Sleep(20 * time.Millisecond)
+	events := out.events()
+	assert.Len(t, events, 30)
+	assertOrdered(t, events, 0)
+}
+
+func TestEncodeEventKeepsNumberKinds(t *testing.T) {
+	event := beat.Event{
+		Timestamp: time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC),
+		Fields: common.MapStr{
+			"sora": common.MapStr{
+				"average_setup_time_msec": 2.0,
+				"total_connections":       int64(2),
+				"total_sent_byte_size":    uint64(1<<63) + 1,
+				"rates":                   []interface{}{1.0, 0.5, int64(1)},
+				"memory":                  map[string]interface{}{"ratio": 1e21},
+			},
+		},
+	}
+	payload, err := encodeEvent(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeEvent(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 整数値の float も float のまま戻る
+	assert.Equal(t, common.MapStr{
+		"sora": common.MapStr{
+			"average_setup_time_msec": 2.0,
+			"total_connections":       int64(2),
+			"total_sent_byte_size":    uint64(1<<63) + 1,
+			"rates":                   []interface{}{1.0, 0.5, int64(1)},
+			"memory":                  common.MapStr{"ratio": 1e21},
+		},
+	}, decoded.Fields)
+	// 元のイベントは書き換えない
+	assert.Equal(t, 2.0, event.Fields["sora"].(common.MapStr)["average_setup_time_msec"])
+
+	_, err = encodeEvent(&beat.Event{Fields: common.MapStr{"value": math.NaN()}})
+	assert.Error(t, err)
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	down := &fakeOutput{}
+	s, err := newSpool(testConfig(dir), down, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, s.Publish(outest.NewBatch(makeEvents(0, 10)...)))
+	assert.NoError(t, s.Close())
+	assert.True(t, down.closed)
+	assert.Empty(t, down.events())
+
+	up := &fakeOutput{up: true}
+	s, err = newSpool(testConfig(dir), up, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assert.NoError(t, s.Publish(outest.NewBatch(makeEvents(10, 15)...)))
+
+	events := waitEvents(t, up, 15)
+	assertOrdered(t, events, 0)
+}
+
+func TestSpoolFailedWriteBackoff(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(testConfig(dir), &fakeOutput{}, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	writer := &failingWriter{File: s.queue.writer.(*os.File), fail: true}
+	s.queue.mu.Lock()
+	s.queue.writer = writer
+	s.queue.mu.Unlock()
+
+	// 書けない間は再送を頼むたびに待つ時間を延ばす
+	for _, wait := range []time.Duration{2 * time.Millisecond, 4 * time.Millisecond} {
+		batch := outest.NewBatch(makeEvents(0, 2)...)
+		start := time.Now()
+		assert.NoError(t, s.Publish(batch))
+		assert.True(t, time.Since(start) >= wait/2)
+		assert.Equal(t, outest.BatchRetryEvents, batch.Signals[0].Tag)
+		assert.Equal(t, wait, s.writeWait)
+	}
+
+	// 書けたら元に戻す
+	s.queue.mu.Lock()
+	writer.fail = false
+	s.queue.mu.Unlock()
+	assert.NoError(t, s.Publish(outest.NewBatch(makeEvents(0, 2)...)))
+	assert.Equal(t, time.Millisecond, s.writeWait)
+}
+
+func TestSpoolFullPolicies(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	payload, _ := encodeEvent(&makeEvents(0, 1)[0])
+	record := int64(headerSize + len(payload))
+
+	config := testConfig(dir)
+	config.MaxBytes = 5 * record
+	config.SegmentBytes = record
+	config.FullPolicy = FullPolicyDropOldest
+
+	out := &fakeOutput{}
+	s, err := newSpool(config, out, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := metricDropped.Get()
+	assert.NoError(t, s.Publish(outest.NewBatch(makeEvents(0, 8)...)))
+	assert.Equal(t, uint64(3), metricDropped.Get()-dropped)
+	assert.Equal(t, 1., metricFillRatio.Get())
+	s.Close()
+
+	// block では空きが出るまで待つ
+	config.FullPolicy = FullPolicyBlock
+	out = &fakeOutput{}
+	s, err = newSpool(config, out, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.Publish(outest.NewBatch(makeEvents(8, 10)...))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("publish must block while the spool is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	out.setUp(true)
+	<-done
+	events := waitEvents(t, out, 7)
+	assertOrdered(t, events, 3)
+}
+
+func TestLoadSpool(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out := &fakeOutput{up: true}
+	loadedOutput = out
+
+	group, err := outputs.Load(beat.Info{Beat: "sorabeat"}, nil, "spool", common.MustNewConfigFrom(map[string]interface{}{
+		"path":             dir,
+		"output.spooltest": map[string]interface{}{},
+	}))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, -1, group.Retry)
+	if assert.Len(t, group.Clients, 1) {
+		client := group.Clients[0]
+		defer client.Close()
+		assert.NoError(t, client.Publish(outest.NewBatch(makeEvents(0, 3)...)))
+		assertOrdered(t, waitEvents(t, out, 3), 0)
+	}
+
+	for _, c := range []map[string]interface{}{
+		{"path": dir},
+		{"path": dir, "full_policy": "drop_newest", "output.spooltest": map[string]interface{}{}},
+		{"path": dir, "max_bytes": 1024, "segment_bytes": 2048, "output.spooltest": map[string]interface{}{}},
+	} {
+		_, err := outputs.Load(beat.Info{}, nil, "spool", common.MustNewConfigFrom(c))
+		assert.Error(t, err, "%v", c)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package top
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Cbreak puts the terminal of stdin in cbreak mode, so that the keys are read
+// without Enter and not echoed, and returns the function restoring it. It
+// fails when stdin is not a terminal, and the keys are then read by line.
+func Cbreak() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() {
+		stty(strings.TrimSpace(saved))
+	}, nil
+}
+
+// stty は stdin の端末の設定を変える。Beats 6.0 の依存には端末を扱うパッケージがない
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
@@ -0,0 +1,274 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package top implements the sorabeat top live view. It polls the Sora hosts
+// of the sora module configurations through the stats and connections
+// metricsets and renders a refreshing table of the hosts, the channels and
+// the connections.
+package top
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+
+	// top が使うメトリックセット
+	_ "github.com/shiguredo/sorabeat/module/sora/connections"
+	_ "github.com/shiguredo/sorabeat/module/sora/stats"
+)
+
+// Options are the command line options of sorabeat top.
+type Options struct {
+	Interval time.Duration
+	// Sort orders the channels by SortBitrate or SortConnections.
+	Sort string
+	// SortConnections orders the connections by SortNACK or SortPLI.
+	SortConnections string
+	// Filter keeps the channels whose channel_id contains it.
+	Filter string
+	// Rows limits the rows of the channel and connection tables, 0 for all.
+	Rows int
+}
+
+// DefaultOptions are the options of sorabeat top without flags.
+var DefaultOptions = Options{
+	Interval:        2 * time.Second,
+	Sort:            SortBitrate,
+	SortConnections: SortNACK,
+	Rows:            10,
+}
+
+// disabled are the module options with side effects on the running
+// Sorabeat, e.g. notifications or saved state, that top ignores.
+var disabled = []string{"metricsets", "adaptive", "alerts", "anomaly", "accounting", "rollup"}
+
+type host struct {
+	name        string
+	stats       mb.EventsFetcher
+	connections mb.EventsFetcher
+	rater       *rater
+}
+
+// Top polls the hosts and renders the view.
+type Top struct {
+	hosts []*host
+	state state
+	view  *view
+}
+
+// New creates the stats and connections metricsets of each host of the sora
+// module configurations. A host configured in several modules is polled
+// once.
+func New(configs []*common.Config, options Options) (*Top, error) {
+	if options.Sort != SortBitrate && options.Sort != SortConnections {
+		return nil, fmt.Errorf("invalid sort %q, bitrate or connections", options.Sort)
+	}
+	if options.SortConnections != SortNACK && options.SortConnections != SortPLI {
+		return nil, fmt.Errorf("invalid connection sort %q, nack or pli", options.SortConnections)
+	}
+	if options.Interval <= 0 {
+		return nil, fmt.Errorf("invalid interval %s", options.Interval)
+	}
+
+	t := &Top{
+		state: state{
+			channelSort:    options.Sort,
+			connectionSort: options.SortConnections,
+			filter:         options.Filter,
+			rows:           options.Rows,
+			interval:       options.Interval,
+		},
+		view: &view{},
+	}
+	seen := map[string]bool{}
+	for _, config := range configs {
+		module := struct {
+			Module string   `config:"module"`
+			Hosts  []string `config:"hosts"`
+		}{}
+		if err := config.Unpack(&module); err != nil {
+			return nil, err
+		}
+		// client_stats だけのモジュールなどホストのないものは除く
+		if module.Module != "sora" || len(module.Hosts) == 0 || !config.Enabled() {
+			continue
+		}
+
+		fields := map[string]interface{}{}
+		if err := config.Unpack(&fields); err != nil {
+			return nil, err
+		}
+		for _, key := range disabled {
+			delete(fields, key)
+		}
+		fields["metricsets"] = []string{"stats", "connections"}
+		// 動いている Sorabeat が保存している状態を上書きしない
+		fields["persist"] = false
+		for _, name := range module.Hosts {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			fields["hosts"] = []string{name}
+			h, err := newHost(fields)
+			if err != nil {
+				return nil, err
+			}
+			t.hosts = append(t.hosts, h)
+		}
+	}
+	if len(t.hosts) == 0 {
+		return nil, fmt.Errorf("no host in the sora modules")
+	}
+	return t, nil
+}
+
+func newHost(fields map[string]interface{}) (*host, error) {
+	config, err := common.NewConfigFrom(fields)
+	if err != nil {
+		return nil, err
+	}
+	_, metricsets, err := mb.NewModule(config, mb.Registry)
+	if err != nil {
+		return nil, err
+	}
+	h := &host{rater: &rater{}}
+	for _, m := range metricsets {
+		fetcher, ok := m.(mb.EventsFetcher)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an EventsFetcher", m.Name())
+		}
+		h.name = m.Host()
+		switch m.Name() {
+		case "stats":
+			h.stats = fetcher
+		case "connections":
+			h.connections = fetcher
+		}
+	}
+	return h, nil
+}
+
+// poll fetches the hosts in parallel and returns the new view.
+func (t *Top) poll() *view {
+	snapshots := make([]snapshot, len(t.hosts))
+	var wg sync.WaitGroup
+	for i, h := range t.hosts {
+		wg.Add(1)
+		go func(i int, h *host) {
+			defer wg.Done()
+			snapshots[i] = h.fetch()
+		}(i, h)
+	}
+	wg.Wait()
+
+	v := &view{time: time.Now()}
+	for i, h := range t.hosts {
+		hostRow, channels, connections := h.rater.observe(snapshots[i])
+		v.hosts = append(v.hosts, hostRow)
+		v.channels = append(v.channels, channels...)
+		v.connections = append(v.connections, connections...)
+	}
+	return v
+}
+
+func (h *host) fetch() snapshot {
+	s := snapshot{host: h.name}
+	// stats に失敗しても connections の行は出す
+	stats, err := h.stats.Fetch()
+	if err != nil {
+		s.statsErr = err
+	} else if len(stats) > 0 {
+		// 最初のイベントが統計のレポート
+		s.stats = stats[0]
+	}
+	connections, err := h.connections.Fetch()
+	s.time = time.Now()
+	if err != nil {
+		s.connErr = err
+		return s
+	}
+	for _, event := range connections {
+		if _, ok := event["channel_id"]; ok {
+			s.connections = append(s.connections, event)
+		}
+	}
+	return s
+}
+
+// Run polls the hosts every interval and renders the view to out, reading
+// the keys from in, until q is pressed or done is closed. The polls do not
+// block the keys on a slow Sora.
+func (t *Top) Run(in io.Reader, out io.Writer, done <-chan struct{}) error {
+	keys := make(chan byte)
+	go func() {
+		defer close(keys)
+		buf := make([]byte, 1)
+		for {
+			n, err := in.Read(buf)
+			if err != nil {
+				return
+			}
+			if n == 1 {
+				keys <- buf[0]
+			}
+		}
+	}()
+
+	polled := make(chan *view, 1)
+	poll := func() {
+		go func() { polled <- t.poll() }()
+	}
+	poll()
+	polling := true
+	t.render(out)
+
+	ticker := time.NewTicker(t.state.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+			// 前の取得が終わっていなければ待つ
+			if !polling {
+				poll()
+				polling = true
+			}
+		case v := <-polled:
+			t.view = v
+			polling = false
+		case k, ok := <-keys:
+			if !ok {
+				// 入力がなくても表示は続ける
+				keys = nil
+				continue
+			}
+			if !t.state.key(k) {
+				return nil
+			}
+		}
+		t.render(out)
+	}
+}
+
+// render は画面を消してから書く
+func (t *Top) render(out io.Writer) {
+	fmt.Fprint(out, "\x1b[H\x1b[2J")
+	t.view.render(out, &t.state)
+}
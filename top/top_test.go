@@ -0,0 +1,111 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package top
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/sorabeat/module/sora/soratest"
+)
+
+func TestTop(t *testing.T) {
+	server := soratest.NewServer(t, "19.04")
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "sorabeat-top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alerts := filepath.Join(dir, "alerts.ndjson")
+	configs := []*common.Config{
+		common.MustNewConfigFrom(map[string]interface{}{
+			"module":     "sora",
+			"metricsets": []string{"connections"},
+			"hosts":      []string{server.URL},
+			// 動いている Sorabeat と同じ通知はしない
+			"alerts.file": alerts,
+			"alerts.rules": []map[string]interface{}{
+				{"name": "any", "metricsets": []string{"connections"}, "condition": "rtp.total_sent > 0"},
+			},
+		}),
+		common.MustNewConfigFrom(map[string]interface{}{
+			"module":     "sora",
+			"metricsets": []string{"stats"},
+			"hosts":      []string{server.URL},
+			// 動いている Sorabeat が保存した状態は上書きしない
+			"server.path":     filepath.Join(dir, "server"),
+			"anomaly.enabled": true,
+			"anomaly.path":    filepath.Join(dir, "anomaly"),
+		}),
+		common.MustNewConfigFrom(map[string]interface{}{
+			"module":              "sora",
+			"metricsets":          []string{"client_stats"},
+			"client_stats.listen": "127.0.0.1:0",
+		}),
+	}
+
+	top, err := New(configs, DefaultOptions)
+	if !assert.NoError(t, err) || !assert.Len(t, top.hosts, 1) {
+		t.FailNow()
+	}
+	top.poll()
+	v := top.poll()
+	if assert.Len(t, v.hosts, 1) {
+		assert.NoError(t, v.hosts[0].statsErr)
+		assert.NoError(t, v.hosts[0].connErr)
+		assert.Equal(t, 3, v.hosts[0].connections)
+		assert.Equal(t, []int64{0, 0, 0}, v.hosts[0].runQueues)
+		assert.Equal(t, 1., v.hosts[0].activeTasksImbalance)
+	}
+	if assert.Len(t, v.channels, 1) {
+		assert.Equal(t, "sorabeat", v.channels[0].channel)
+		assert.Equal(t, 3, v.channels[0].connections)
+	}
+	if assert.Len(t, v.connections, 3) {
+		assert.True(t, v.connections[0].rated)
+		assert.Equal(t, "6ZF3DT1Q2D5NHAB1QMFGWP4VAW", v.connections[0].identity)
+	}
+	_, err = os.Stat(alerts)
+	assert.True(t, os.IsNotExist(err))
+	var written []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && path != dir {
+			written = append(written, path)
+		}
+		return nil
+	})
+	assert.Empty(t, written)
+
+	// q で終わる
+	var out bytes.Buffer
+	assert.NoError(t, top.Run(strings.NewReader("cq"), &out, nil))
+	assert.Contains(t, out.String(), "channels by connections")
+
+	options := DefaultOptions
+	options.Sort = "nack"
+	_, err = New(configs, options)
+	assert.Error(t, err)
+}
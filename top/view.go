@@ -0,0 +1,400 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package top
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+
+	"github.com/shiguredo/sorabeat/module/sora"
+)
+
+// Orders of the channels and of the connections.
+const (
+	SortBitrate     = "bitrate"
+	SortConnections = "connections"
+	SortNACK        = "nack"
+	SortPLI         = "pli"
+)
+
+// byteCounters are the byte counters of a connection, the names of Sora
+// 18.10.04 and later first.
+var byteCounters = map[string][]string{
+	"sent":     {"rtp.total_sent_byte_size", "rtp.total_sent_bytes"},
+	"received": {"rtp.total_received_byte_size", "rtp.total_received_bytes"},
+}
+
+// feedbackCounters are summed over both directions of a connection.
+var feedbackCounters = map[string][]string{
+	"nack": {"rtp.total_received_rtcp_rtpfb_generic_nack", "rtp.total_sent_rtcp_rtpfb_generic_nack"},
+	"pli":  {"rtp.total_received_rtcp_psfb_pli", "rtp.total_sent_rtcp_psfb_pli"},
+}
+
+// snapshot is what a poll of a host returned.
+type snapshot struct {
+	host        string
+	time        time.Time
+	statsErr    error
+	connErr     error
+	stats       common.MapStr
+	connections []common.MapStr
+}
+
+type counters struct {
+	sent, received, nack, pli float64
+}
+
+// rater turns the counters of the connections of a host into rates between
+// two polls. The counters are kept by sora.ConnectionKey, the identity is
+// only displayed.
+type rater struct {
+	time     time.Time
+	previous map[string]counters
+}
+
+type hostRow struct {
+	host        string
+	statsErr    error
+	connErr     error
+	connections int
+	// Erlang VM のスケジューラごとの値と stats メトリックセットが求めた不均衡さ。
+	// 古い Sora では空
+	runQueues            []int64
+	activeTasks          []int64
+	runQueueImbalance    float64
+	activeTasksImbalance float64
+}
+
+type channelRow struct {
+	host, channel string
+	connections   int
+	sent          float64
+	received      float64
+}
+
+// bitrate is the bits per second Sora sent and received.
+func (c channelRow) bitrate() float64 {
+	return (c.sent + c.received) * 8
+}
+
+type connectionRow struct {
+	host, channel, identity string
+	sent, received          float64
+	nack, pli               float64
+	// 最初に見たときは毎秒の値がない
+	rated bool
+}
+
+type view struct {
+	time        time.Time
+	hosts       []hostRow
+	channels    []channelRow
+	connections []connectionRow
+}
+
+// state is what the keys change.
+type state struct {
+	channelSort    string
+	connectionSort string
+	filter         string
+	rows           int
+	interval       time.Duration
+	// フィルタの入力中
+	editing bool
+	input   []byte
+}
+
+// key applies a key press to the state and returns false on quit.
+func (s *state) key(k byte) bool {
+	if s.editing {
+		switch k {
+		case '\r', '\n':
+			s.filter = string(s.input)
+			s.editing = false
+		case 0x1b:
+			s.editing = false
+		case 0x7f, 0x08:
+			if len(s.input) > 0 {
+				s.input = s.input[:len(s.input)-1]
+			}
+		default:
+			if k >= 0x20 {
+				s.input = append(s.input, k)
+			}
+		}
+		return true
+	}
+	switch k {
+	case 'q', 'Q':
+		return false
+	case 'b':
+		s.channelSort = SortBitrate
+	case 'c':
+		s.channelSort = SortConnections
+	case 'n':
+		s.connectionSort = SortNACK
+	case 'p':
+		s.connectionSort = SortPLI
+	case '/':
+		s.editing = true
+		s.input = []byte(s.filter)
+	case 0x1b:
+		s.filter = ""
+	}
+	return true
+}
+
+// observe computes the rows of the snapshot of a host.
+func (r *rater) observe(s snapshot) (hostRow, []channelRow, []connectionRow) {
+	host := hostRow{host: s.host, statsErr: s.statsErr, connErr: s.connErr, connections: len(s.connections)}
+	if s.stats != nil {
+		host.runQueues = integers(s.stats, "erlang_vm.statistics.run_queue_lengths")
+		host.activeTasks = integers(s.stats, "erlang_vm.statistics.active_tasks")
+		host.runQueueImbalance, _ = number(s.stats, "erlang_vm.statistics.run_queue_lengths_imbalance")
+		host.activeTasksImbalance, _ = number(s.stats, "erlang_vm.statistics.active_tasks_imbalance")
+	}
+	if s.connErr != nil {
+		return host, nil, nil
+	}
+
+	interval := s.time.Sub(r.time).Seconds()
+	current := map[string]counters{}
+	channels := map[string]*channelRow{}
+	var order []string
+	var connections []connectionRow
+	for _, event := range s.connections {
+		channelID, _ := event["channel_id"].(string)
+		identity, _ := event["identity"].(string)
+		c := counters{
+			sent:     first(event, byteCounters["sent"]),
+			received: first(event, byteCounters["received"]),
+			nack:     total(event, feedbackCounters["nack"]),
+			pli:      total(event, feedbackCounters["pli"]),
+		}
+		// identity.key によっては別の接続と identity が同じになるので、
+		// 接続ごとに決まるキーで前回の値と突き合わせる
+		key := sora.ConnectionKey(event)
+		current[key] = c
+
+		row := connectionRow{host: s.host, channel: channelID, identity: identity}
+		if last, ok := r.previous[key]; ok && interval > 0 {
+			row.sent = rate(last.sent, c.sent, interval)
+			row.received = rate(last.received, c.received, interval)
+			row.nack = rate(last.nack, c.nack, interval)
+			row.pli = rate(last.pli, c.pli, interval)
+			row.rated = true
+		}
+		connections = append(connections, row)
+
+		channel, ok := channels[channelID]
+		if !ok {
+			channel = &channelRow{host: s.host, channel: channelID}
+			channels[channelID] = channel
+			order = append(order, channelID)
+		}
+		channel.connections++
+		channel.sent += row.sent
+		channel.received += row.received
+	}
+	r.time = s.time
+	r.previous = current
+
+	rows := make([]channelRow, 0, len(order))
+	for _, channelID := range order {
+		rows = append(rows, *channels[channelID])
+	}
+	return host, rows, connections
+}
+
+// rate はカウンタが戻ったときは接続し直したものとして 0 にする
+func rate(last, value, seconds float64) float64 {
+	if value < last {
+		return 0
+	}
+	return (value - last) / seconds
+}
+
+func number(event common.MapStr, field string) (float64, bool) {
+	value, err := event.GetValue(field)
+	if err != nil {
+		return 0, false
+	}
+	v, ok := value.(float64)
+	return v, ok
+}
+
+func first(event common.MapStr, fields []string) float64 {
+	for _, field := range fields {
+		if v, ok := number(event, field); ok {
+			return v
+		}
+	}
+	return 0
+}
+
+func total(event common.MapStr, fields []string) float64 {
+	var sum float64
+	for _, field := range fields {
+		if v, ok := number(event, field); ok {
+			sum += v
+		}
+	}
+	return sum
+}
+
+func integers(event common.MapStr, field string) []int64 {
+	value, err := event.GetValue(field)
+	if err != nil {
+		return nil
+	}
+	list, _ := value.([]interface{})
+	var values []int64
+	for _, v := range list {
+		if v, ok := v.(float64); ok {
+			values = append(values, int64(v))
+		}
+	}
+	return values
+}
+
+// rows filters and sorts the rows of the view by the state.
+func (v *view) rows(s *state) ([]channelRow, []connectionRow) {
+	var channels []channelRow
+	for _, c := range v.channels {
+		if strings.Contains(c.channel, s.filter) {
+			channels = append(channels, c)
+		}
+	}
+	sort.SliceStable(channels, func(i, j int) bool {
+		if s.channelSort == SortConnections && channels[i].connections != channels[j].connections {
+			return channels[i].connections > channels[j].connections
+		}
+		return channels[i].bitrate() > channels[j].bitrate()
+	})
+
+	var connections []connectionRow
+	for _, c := range v.connections {
+		if strings.Contains(c.channel, s.filter) {
+			connections = append(connections, c)
+		}
+	}
+	sort.SliceStable(connections, func(i, j int) bool {
+		if s.connectionSort == SortPLI && connections[i].pli != connections[j].pli {
+			return connections[i].pli > connections[j].pli
+		}
+		if connections[i].nack != connections[j].nack {
+			return connections[i].nack > connections[j].nack
+		}
+		return connections[i].pli > connections[j].pli
+	})
+
+	if s.rows > 0 && len(channels) > s.rows {
+		channels = channels[:s.rows]
+	}
+	if s.rows > 0 && len(connections) > s.rows {
+		connections = connections[:s.rows]
+	}
+	return channels, connections
+}
+
+// render writes a frame of the view.
+func (v *view) render(out io.Writer, s *state) {
+	polled := "waiting for Sora"
+	if !v.time.IsZero() {
+		polled = v.time.Format("2006-01-02 15:04:05")
+	}
+	fmt.Fprintf(out, "sorabeat top - %s  interval %s  channels by %s  connections by %s",
+		polled, s.interval, s.channelSort, s.connectionSort)
+	if s.filter != "" {
+		fmt.Fprintf(out, "  filter %q", s.filter)
+	}
+	fmt.Fprint(out, "\n\n")
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tCONNS\tRUN QUEUES\tIMBALANCE\tACTIVE TASKS\tIMBALANCE\tERROR")
+	for _, h := range v.hosts {
+		var messages []string
+		if h.statsErr != nil {
+			messages = append(messages, "stats: "+h.statsErr.Error())
+		}
+		if h.connErr != nil {
+			messages = append(messages, "connections: "+h.connErr.Error())
+		}
+		message := strings.Join(messages, "; ")
+		fmt.Fprintf(w, "%s\t%d\t%s\t%.2f\t%s\t%.2f\t%s\n",
+			h.host, h.connections, join(h.runQueues), h.runQueueImbalance,
+			join(h.activeTasks), h.activeTasksImbalance, message)
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+
+	channels, connections := v.rows(s)
+	w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANNEL\tHOST\tCONNS\tSENT\tRECEIVED\tBITRATE")
+	for _, c := range channels {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			c.channel, c.host, c.connections, bps(c.sent*8), bps(c.received*8), bps(c.bitrate()))
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+
+	w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONNECTION\tCHANNEL\tHOST\tBITRATE\tNACK/s\tPLI/s")
+	for _, c := range connections {
+		if !c.rated {
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\n", c.identity, c.channel, c.host)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.1f\t%.1f\n",
+			c.identity, c.channel, c.host, bps((c.sent+c.received)*8), c.nack, c.pli)
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+
+	if s.editing {
+		fmt.Fprintf(out, "filter channels: %s", s.input)
+		return
+	}
+	fmt.Fprint(out, "b: bitrate  c: connections  n: NACK  p: PLI  /: filter  Esc: clear filter  q: quit")
+}
+
+func join(values []int64) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprint(v)
+	}
+	return strings.Join(s, " ")
+}
+
+func bps(v float64) string {
+	switch {
+	case v >= 1e9:
+		return fmt.Sprintf("%.1f Gbps", v/1e9)
+	case v >= 1e6:
+		return fmt.Sprintf("%.1f Mbps", v/1e6)
+	case v >= 1e3:
+		return fmt.Sprintf("%.1f kbps", v/1e3)
+	}
+	return fmt.Sprintf("%.0f bps", v)
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 Shiguredo Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !integration
+
+package top
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func conn(channelID, identity string, sent, nack, pli float64) common.MapStr {
+	return common.MapStr{
+		"channel_id":    channelID,
+		"connection_id": identity,
+		"identity":      identity,
+		"rtp": map[string]interface{}{
+			"total_sent_byte_size":                   sent,
+			"total_received_byte_size":               0.,
+			"total_received_rtcp_rtpfb_generic_nack": nack,
+			"total_received_rtcp_psfb_pli":           pli,
+		},
+	}
+}
+
+func testView(t *testing.T) *view {
+	r := &rater{}
+	now := time.Date(2019, 4, 17, 2, 41, 0, 0, time.UTC)
+	stats := common.MapStr{"erlang_vm": map[string]interface{}{
+		"statistics": map[string]interface{}{
+			"run_queue_lengths":           []interface{}{0., 5., 1.},
+			"run_queue_lengths_imbalance": 5.,
+			"active_tasks":                []interface{}{1., 0., 0.},
+			"active_tasks_imbalance":      1.,
+		},
+	}}
+
+	r.observe(snapshot{host: "sora1", time: now, stats: stats, connections: []common.MapStr{
+		conn("a", "1", 0, 0, 0),
+		conn("a", "2", 0, 0, 0),
+		conn("b", "3", 0, 0, 0),
+	}})
+	host, channels, connections := r.observe(snapshot{host: "sora1", time: now.Add(2 * time.Second), stats: stats, connections: []common.MapStr{
+		conn("a", "1", 1000, 10, 0),
+		conn("a", "2", 1000, 2, 4),
+		conn("b", "3", 250000, 0, 1),
+		conn("a", "4", 100, 100, 100),
+	}})
+	assert.Equal(t, 5., host.runQueueImbalance)
+	return &view{
+		time:        now,
+		hosts:       []hostRow{host, {host: "sora2", connErr: errors.New("connection refused")}},
+		channels:    channels,
+		connections: connections,
+	}
+}
+
+func TestViewRates(t *testing.T) {
+	v := testView(t)
+	if !assert.Len(t, v.channels, 2) || !assert.Len(t, v.connections, 4) {
+		t.FailNow()
+	}
+	assert.Equal(t, channelRow{host: "sora1", channel: "a", connections: 3, sent: 1000}, v.channels[0])
+	assert.Equal(t, 125000.*8, v.channels[1].bitrate())
+	assert.Equal(t, 5., v.connections[0].nack)
+	assert.Equal(t, 2., v.connections[1].pli)
+	// 初めて見た接続は毎秒の値を出さない
+	assert.False(t, v.connections[3].rated)
+}
+
+func TestViewRows(t *testing.T) {
+	v := testView(t)
+	s := &state{channelSort: SortBitrate, connectionSort: SortNACK}
+
+	channels, connections := v.rows(s)
+	assert.Equal(t, "b", channels[0].channel)
+	assert.Equal(t, "1", connections[0].identity)
+
+	assert.True(t, s.key('c'))
+	assert.True(t, s.key('p'))
+	channels, connections = v.rows(s)
+	assert.Equal(t, "a", channels[0].channel)
+	assert.Equal(t, "2", connections[0].identity)
+
+	for _, k := range []byte("/x\x7fb\r") {
+		assert.True(t, s.key(k))
+	}
+	assert.Equal(t, "b", s.filter)
+	channels, connections = v.rows(s)
+	assert.Len(t, channels, 1)
+	assert.Len(t, connections, 1)
+
+	assert.True(t, s.key(0x1b))
+	s.rows = 1
+	channels, connections = v.rows(s)
+	assert.Len(t, channels, 1)
+	assert.Len(t, connections, 1)
+
+	assert.False(t, s.key('q'))
+}
+
+func TestViewRender(t *testing.T) {
+	v := testView(t)
+	s := &state{channelSort: SortBitrate, connectionSort: SortNACK, interval: 2 * time.Second}
+
+	var out bytes.Buffer
+	v.render(&out, s)
+	frame := out.String()
+	assert.Contains(t, frame, "sorabeat top - 2019-04-17 02:41:00  interval 2s")
+	assert.Contains(t, frame, "sora1  4      0 5 1       5.00       1 0 0         1.00")
+	assert.Contains(t, frame, "connections: connection refused")
+	assert.Contains(t, frame, "b        sora1  1      1.0 Mbps  0 bps     1.0 Mbps")
+	assert.Contains(t, frame, "4           a        sora1  -         -       -")
+	assert.Contains(t, frame, "q: quit")
+}
+
+func TestViewSharedClientID(t *testing.T) {
+	r := &rater{}
+	now := time.Date(2019, 4, 17, 2, 41, 0, 0, time.UTC)
+	// identity.key: client_id のときは同じ client_id の接続の identity が同じになる
+	shared := func(connectionID string, sent, nack float64) common.MapStr {
+		event := conn("a", "c1", sent, nack, 0)
+		event["client_id"] = "c1"
+		event["connection_id"] = connectionID
+		return event
+	}
+
+	r.observe(snapshot{host: "sora1", time: now, connections: []common.MapStr{
+		shared("1", 1000, 10),
+		shared("2", 50000, 0),
+	}})
+	_, channels, connections := r.observe(snapshot{host: "sora1", time: now.Add(2 * time.Second), connections: []common.MapStr{
+		shared("1", 3000, 20),
+		shared("2", 60000, 4),
+	}})
+	if assert.Len(t, connections, 2) {
+		assert.Equal(t, "c1", connections[0].identity)
+		assert.Equal(t, 1000., connections[0].sent)
+		assert.Equal(t, 5., connections[0].nack)
+		assert.Equal(t, 5000., connections[1].sent)
+		assert.Equal(t, 2., connections[1].nack)
+	}
+	if assert.Len(t, channels, 1) {
+		assert.Equal(t, 6000., channels[0].sent)
+	}
+}
+
+func TestViewStatsError(t *testing.T) {
+	r := &rater{}
+	now := time.Date(2019, 4, 17, 2, 41, 0, 0, time.UTC)
+	host, channels, connections := r.observe(snapshot{
+		host:        "sora1",
+		time:        now,
+		statsErr:    errors.New("timeout"),
+		connections: []common.MapStr{conn("a", "1", 0, 0, 0)},
+	})
+	// stats に失敗しても connections の行は出す
+	assert.Len(t, channels, 1)
+	assert.Len(t, connections, 1)
+
+	var out bytes.Buffer
+	v := &view{time: now, hosts: []hostRow{host}, channels: channels, connections: connections}
+	v.render(&out, &state{channelSort: SortBitrate, connectionSort: SortNACK})
+	assert.Contains(t, out.String(), "stats: timeout")
+}